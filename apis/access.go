@@ -0,0 +1,22 @@
+package apis
+
+// Permission is a set of operations allowed on a queue.
+type Permission uint8
+
+const (
+	// PermPush allows to push messages into the queue.
+	PermPush Permission = 1 << iota
+	// PermPop allows to receive messages and release them by receipt.
+	PermPop
+	// PermAdmin allows all queue operations including config and message changes.
+	PermAdmin
+)
+
+// PermAny is required by commands that only read the queue state.
+const PermAny = PermPush | PermPop | PermAdmin
+
+// AccessChecker is implemented by response writers of the sessions with access control.
+type AccessChecker interface {
+	// CanAccess returns true if any of the permissions is granted on the queue.
+	CanAccess(queue string, perm Permission) bool
+}
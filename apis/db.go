@@ -14,6 +14,10 @@ type ItemIterator interface {
 // currently the main purpose is to to prepend prefixes to the data key.
 type DataStorage interface {
 	WaitFlush()
+	// ForceFlush flushes the cache without waiting for the flush interval.
+	// If syncData is true, it also waits until data is synced on disk.
+	// Returns an error if data could not be written or synced.
+	ForceFlush(syncData bool) error
 	CachedStore2(key1 string, data1 []byte, key2 string, data2 []byte)
 	CachedStore(key string, data []byte)
 	DeleteDataWithPrefix(prefix string) int
@@ -27,3 +31,20 @@ type DataStorage interface {
 	Close()
 	IsClosed() bool
 }
+
+// SnapshotStorage is implemented by storages that can iterate over
+// a consistent point in time view of the data.
+type SnapshotStorage interface {
+	// SnapshotIterator returns an iterator over all data with prefix
+	// as it was at the moment of the call. Iterator must be closed.
+	SnapshotIterator(prefix string) (ItemIterator, error)
+}
+
+// CompactStorage is implemented by storages that can estimate disk space
+// used by a key range and compact it. Empty limit means the end of the data.
+type CompactStorage interface {
+	// SizeOf returns approximate disk space used by keys in [start, limit).
+	SizeOf(start, limit string) (int64, error)
+	// CompactRange flushes the cache and compacts keys in [start, limit).
+	CompactRange(start, limit string) error
+}
@@ -0,0 +1,63 @@
+package apis
+
+// MutationType is a type of the data change recorded into the mutation log.
+type MutationType byte
+
+const (
+	// MutationPush is a new message with its metadata and payload.
+	MutationPush MutationType = 1
+	// MutationLock is a message locked by receive or lock timeout update.
+	MutationLock MutationType = 2
+	// MutationUnlock is a message returned back into the queue.
+	MutationUnlock MutationType = 3
+	// MutationUpdate is a message metadata or payload change.
+	MutationUpdate MutationType = 4
+	// MutationDelete is a removed message.
+	MutationDelete MutationType = 5
+	// MutationConfig is a new service config.
+	MutationConfig MutationType = 6
+	// MutationService is a created or updated service description.
+	MutationService MutationType = 7
+	// MutationDrop is a removed service with all its data.
+	MutationDrop MutationType = 8
+	// MutationDedup is a remembered deduplication key with its expiration time
+	// or a forgotten one if there is no expiration time.
+	MutationDedup MutationType = 9
+)
+
+var mutationNames = map[MutationType]string{
+	MutationPush:    "PUSH",
+	MutationLock:    "LOCK",
+	MutationUnlock:  "UNLOCK",
+	MutationUpdate:  "UPDATE",
+	MutationDelete:  "DELETE",
+	MutationConfig:  "CONFIG",
+	MutationService: "SERVICE",
+	MutationDrop:    "DROP",
+	MutationDedup:   "DEDUP",
+}
+
+func (mt MutationType) String() string {
+	if name, ok := mutationNames[mt]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// Valid returns true if mutation type is known.
+func (mt MutationType) Valid() bool {
+	_, ok := mutationNames[mt]
+	return ok
+}
+
+// MutationLog records every change of the service data.
+// Data slices must not be modified after they are passed to the log.
+type MutationLog interface {
+	LogMutation(mt MutationType, serviceId, itemId string, meta, payload []byte)
+}
+
+// SeqMutationLog is a mutation log assigning sequence ids to the mutations.
+type SeqMutationLog interface {
+	MutationLog
+	LastSeqId() uint64
+}
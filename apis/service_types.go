@@ -2,3 +2,7 @@ package apis
 
 // ServiceTypePriorityQueue defines a priority queue service type identifier.
 const ServiceTypePriorityQueue = "pqueue"
+
+// ServiceTypeFifoQueue defines a FIFO queue service type identifier.
+// FIFO queue delivers messages in order within message groups.
+const ServiceTypeFifoQueue = "fifo"
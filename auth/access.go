@@ -0,0 +1,206 @@
+// Package auth implements users and queue permissions of the native protocol sessions.
+// Users file keeps users by their names:
+//
+//	{
+//	  "root":   {"password": "$2a$10$...", "roles": ["admin"]},
+//	  "worker": {"password": "$2a$10$...", "queues": {"orders": ["pop"], "jobs_*": ["push", "pop"]}}
+//	}
+//
+// Password is a bcrypt hash of the password, see HashPassword. Queue name ending with '*'
+// is a prefix of queue names, "*" matches all queues.
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/vburenin/firempq/apis"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RoleAdmin allows server administration: creating and dropping queues, PANIC,
+// LOGLEVEL, backups and replication. Admin has all permissions on all queues.
+const RoleAdmin = "admin"
+
+// Queue permission names used by the users file.
+const (
+	PermNamePush  = "push"
+	PermNamePop   = "pop"
+	PermNameAdmin = "admin"
+)
+
+// PasswordCost is the bcrypt cost of password hashes made by HashPassword.
+const PasswordCost = bcrypt.DefaultCost
+
+type userRecord struct {
+	Password string              `json:"password"`
+	Roles    []string            `json:"roles"`
+	Queues   map[string][]string `json:"queues"`
+}
+
+type queueGrant struct {
+	pattern string
+	perm    apis.Permission
+}
+
+// User is an authenticated user.
+type User struct {
+	Name     string
+	password []byte
+	admin    bool
+	grants   []queueGrant
+}
+
+// IsAdmin returns true if user has the admin role.
+func (u *User) IsAdmin() bool {
+	return u.admin
+}
+
+// CanAccess returns true if any of the permissions is granted to the user on the queue.
+// Queue admin permission grants all of them.
+func (u *User) CanAccess(queue string, perm apis.Permission) bool {
+	if u.admin {
+		return true
+	}
+	for _, g := range u.grants {
+		if g.perm&(perm|apis.PermAdmin) != 0 && matchQueue(g.pattern, queue) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchQueue(pattern, queue string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(queue, pattern[:len(pattern)-1])
+	}
+	return pattern == queue
+}
+
+// Access controls access to the native protocol sessions.
+type Access struct {
+	users    map[string]*User
+	anonCmds map[string]bool
+	// Used to spend the same time on unknown users.
+	noUser *User
+}
+
+// LoadAccess loads users from the users file. anonCmds is a comma separated list
+// of commands allowed before authentication.
+func LoadAccess(usersFile, anonCmds string) (*Access, error) {
+	data, err := ioutil.ReadFile(usersFile)
+	if err != nil {
+		return nil, err
+	}
+	users, err := ParseUsers(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", usersFile, err)
+	}
+	var cmds []string
+	for _, cmd := range strings.Split(anonCmds, ",") {
+		if cmd = strings.TrimSpace(cmd); cmd != "" {
+			cmds = append(cmds, strings.ToUpper(cmd))
+		}
+	}
+	return NewAccess(users, cmds), nil
+}
+
+// NewAccess creates access control of the users allowing anonCmds before authentication.
+func NewAccess(users []*User, anonCmds []string) *Access {
+	a := &Access{
+		users:    make(map[string]*User, len(users)),
+		anonCmds: make(map[string]bool, len(anonCmds)),
+		noUser:   &User{},
+	}
+	a.noUser.password, _ = bcrypt.GenerateFromPassword([]byte("nopassword"), PasswordCost)
+	for _, u := range users {
+		a.users[u.Name] = u
+	}
+	for _, cmd := range anonCmds {
+		a.anonCmds[cmd] = true
+	}
+	return a
+}
+
+// Authenticate returns the user if the password matches.
+func (a *Access) Authenticate(name, password string) (*User, bool) {
+	u, ok := a.users[name]
+	if !ok {
+		u = a.noUser
+	}
+	if bcrypt.CompareHashAndPassword(u.password, []byte(password)) != nil || !ok {
+		return nil, false
+	}
+	return u, true
+}
+
+// HashPassword makes a password hash for the users file.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), PasswordCost)
+	return string(hash), err
+}
+
+// AnonAllowed returns true if the command is allowed before authentication.
+func (a *Access) AnonAllowed(cmd string) bool {
+	return a.anonCmds[cmd]
+}
+
+// ParseUsers parses the users file content.
+func ParseUsers(data []byte) ([]*User, error) {
+	records := make(map[string]*userRecord)
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	users := make([]*User, 0, len(records))
+	for name, r := range records {
+		u, err := newUser(name, r)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %s", name, err)
+		}
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func newUser(name string, r *userRecord) (*User, error) {
+	if name == "" {
+		return nil, errors.New("empty user name")
+	}
+	if r == nil {
+		return nil, errors.New("no password")
+	}
+	password := []byte(r.Password)
+	if _, err := bcrypt.Cost(password); err != nil {
+		return nil, fmt.Errorf("password must be a bcrypt hash: %s", err)
+	}
+	u := &User{Name: name, password: password}
+	for _, role := range r.Roles {
+		if role != RoleAdmin {
+			return nil, fmt.Errorf("unknown role: %s", role)
+		}
+		u.admin = true
+	}
+	for pattern, names := range r.Queues {
+		if pattern == "" {
+			return nil, errors.New("empty queue name")
+		}
+		g := queueGrant{pattern: pattern}
+		for _, n := range names {
+			switch n {
+			case PermNamePush:
+				g.perm |= apis.PermPush
+			case PermNamePop:
+				g.perm |= apis.PermPop
+			case PermNameAdmin:
+				g.perm |= apis.PermAdmin
+			default:
+				return nil, fmt.Errorf("unknown permission of %s: %s", pattern, n)
+			}
+		}
+		u.grants = append(u.grants, g)
+	}
+	return u, nil
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/vburenin/firempq/apis"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func passwordHash(password string) string {
+	hash, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	return string(hash)
+}
+
+func TestAccess(t *testing.T) {
+	Convey("Users should be loaded with their permissions", t, func() {
+		users, err := ParseUsers([]byte(`{
+			"root": {"password": "` + passwordHash("rootpw") + `", "roles": ["admin"]},
+			"worker": {"password": "` + passwordHash("workerpw") + `",
+				"queues": {"orders": ["pop"], "jobs_*": ["push", "pop"], "cfg": ["admin"]}}
+		}`))
+		So(err, ShouldBeNil)
+		a := NewAccess(users, []string{"PING"})
+
+		_, ok := a.Authenticate("root", "wrong")
+		So(ok, ShouldBeFalse)
+		_, ok = a.Authenticate("nobody", "rootpw")
+		So(ok, ShouldBeFalse)
+		root, ok := a.Authenticate("root", "rootpw")
+		So(ok, ShouldBeTrue)
+		So(root.IsAdmin(), ShouldBeTrue)
+		So(root.CanAccess("any", apis.PermAdmin), ShouldBeTrue)
+
+		worker, ok := a.Authenticate("worker", "workerpw")
+		So(ok, ShouldBeTrue)
+		So(worker.IsAdmin(), ShouldBeFalse)
+		So(worker.CanAccess("orders", apis.PermPop), ShouldBeTrue)
+		So(worker.CanAccess("orders", apis.PermAny), ShouldBeTrue)
+		So(worker.CanAccess("orders", apis.PermPush), ShouldBeFalse)
+		So(worker.CanAccess("orders2", apis.PermPop), ShouldBeFalse)
+		So(worker.CanAccess("jobs_1", apis.PermPush), ShouldBeTrue)
+		So(worker.CanAccess("jobs_1", apis.PermAdmin), ShouldBeFalse)
+		So(worker.CanAccess("cfg", apis.PermPush), ShouldBeTrue)
+		So(worker.CanAccess("other", apis.PermAny), ShouldBeFalse)
+
+		So(a.AnonAllowed("PING"), ShouldBeTrue)
+		So(a.AnonAllowed("LIST"), ShouldBeFalse)
+	})
+
+	Convey("Password hash should be salted", t, func() {
+		h1, err := HashPassword("secret")
+		So(err, ShouldBeNil)
+		h2, _ := HashPassword("secret")
+		So(h1, ShouldNotEqual, h2)
+		users, err := ParseUsers([]byte(`{"u": {"password": "` + h1 + `"}}`))
+		So(err, ShouldBeNil)
+		_, ok := NewAccess(users, nil).Authenticate("u", "secret")
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("Broken users should be rejected", t, func() {
+		for _, data := range []string{
+			`[]`,
+			`{"u": {"password": "plain"}}`,
+			`{"u": null}`,
+			`{"u": {"password": "sha256:` + hex.EncodeToString(sha256.New().Sum(nil)) + `"}}`,
+			`{"u": {"password": "` + passwordHash("p") + `", "roles": ["root"]}}`,
+			`{"u": {"password": "` + passwordHash("p") + `", "queues": {"q": ["read"]}}}`,
+		} {
+			_, err := ParseUsers([]byte(data))
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
@@ -39,12 +39,25 @@ type Config struct {
 	SNSServerInterface  string // `long:"sns-address" description:"NOT IMPLEMENTED: SNS protocol interface for FireMPQ" default:""`
 	DbFlushInterval     int64  `long:"flush-interval" description:"Disk synchronization interval in milliseconds" default:"100"`
 	DatabasePath        string `long:"data-dir" description:"FireMPQ database location" default:"./fmpq-data"`
+	StorageType         string `long:"storage" description:"Storage backend" default:"leveldb" choice:"leveldb" choice:"bolt" choice:"memory"`
 	UpdateInterval      int64  `long:"update-interval" description:"Timeout and expiration check period in milliseconds" default:"100"`
+	MaxInFlight         int    `long:"max-inflight" description:"Max number of tagged requests executed concurrently per connection" default:"64"`
+	ReclaimBatchSize    int    `long:"reclaim-batch" description:"Number of keys of dropped queues deleted at once" default:"1000"`
+	ReclaimInterval     int64  `long:"reclaim-interval" description:"Pause between deletions of dropped queue data in milliseconds" default:"10"`
 
-	//BinaryLogPath       string
-	//BinaryLogBufferSize int
-	//BinaryLogPageSize   uint64
-	//BinaryLogFrameSize  uint64
+	BinaryLogPath       string `long:"binlog-dir" description:"Binary mutation log location. Log is disabled if not set" default:""`
+	BinaryLogBufferSize int    `long:"binlog-buffer" description:"Number of mutations buffered in memory before they are written into the binary log" default:"4096"`
+	BinaryLogPageSize   uint64 `long:"binlog-page-size" description:"Binary log page size in bytes, log switches to a new page once it is exceeded" default:"67108864"`
+	BinaryLogKeepPages  int    `long:"binlog-keep-pages" description:"Number of the latest binary log pages kept on disk, older pages not read by replicas are deleted. All pages are kept if it is 0" default:"16"`
+	ReplicaOf           string `long:"replica-of" description:"Run as a read only replica of the primary server host:port"`
+	ReplicaUser         string `long:"replica-user" description:"User name to authenticate on the primary server" default:""`
+	ReplicaPassword     string `long:"replica-password" description:"Password to authenticate on the primary server" default:""`
+
+	BackupDir string `long:"backup-dir" description:"Directory BACKUP writes archives into. BACKUP is disabled if not set" default:""`
+	ExportDir string `long:"export-dir" description:"Directory EXPORT and IMPORT files are located in. EXPORT and IMPORT are disabled if not set" default:""`
+
+	UsersFile    string `long:"users-file" description:"JSON file with users and their queue permissions. Authentication is disabled if not set" default:""`
+	AnonCommands string `long:"anon-commands" description:"Comma separated commands allowed before authentication" default:"PING,TS"`
 
 	PQueueConfig PQueueConfigData
 
@@ -89,3 +102,79 @@ func ParseConfigParameters() *Config {
 	CFG_PQ = &(cfg.PQueueConfig)
 	return &cfg
 }
+
+// RestoreConfig is a config of the restore mode that rebuilds a data directory from the backup archive.
+type RestoreConfig struct {
+	Archive      string `long:"archive" description:"Backup archive created by BACKUP command" required:"true"`
+	DatabasePath string `long:"data-dir" description:"FireMPQ database location to rebuild" default:"./fmpq-data"`
+	StorageType  string `long:"storage" description:"Storage backend" default:"leveldb" choice:"leveldb" choice:"bolt"`
+}
+
+// ParseRestoreParameters parses restore mode parameters and initializes
+// the global config used by the storage.
+func ParseRestoreParameters(args []string) *RestoreConfig {
+	rcfg := RestoreConfig{}
+	parser := flags.NewParser(&rcfg, flags.Default)
+	parser.Usage = "restore [OPTIONS]"
+	if _, err := parser.ParseArgs(args); err != nil {
+		os.Exit(255)
+	}
+
+	initOfflineConfig(rcfg.DatabasePath, rcfg.StorageType)
+	return &rcfg
+}
+
+// QueueFileConfig is a config of the export and import modes that work with queue messages
+// in the data directory while the server is not running.
+type QueueFileConfig struct {
+	DatabasePath string `long:"data-dir" description:"FireMPQ database location" default:"./fmpq-data"`
+	StorageType  string `long:"storage" description:"Storage backend" default:"leveldb" choice:"leveldb" choice:"bolt"`
+	Queue        string `long:"queue" description:"Queue name" required:"true"`
+	File         string `long:"file" description:"JSON Lines file with queue messages" required:"true"`
+}
+
+// ParseQueueFileParameters parses export or import mode parameters and initializes
+// the global config used by the storage and queues.
+func ParseQueueFileParameters(mode string, args []string) *QueueFileConfig {
+	qcfg := QueueFileConfig{}
+	parser := flags.NewParser(&qcfg, flags.Default)
+	parser.Usage = mode + " [OPTIONS]"
+	if _, err := parser.ParseArgs(args); err != nil {
+		os.Exit(255)
+	}
+	initOfflineConfig(qcfg.DatabasePath, qcfg.StorageType)
+	return &qcfg
+}
+
+// FsckConfig is a config of the fsck mode that checks consistency of the data directory.
+type FsckConfig struct {
+	DatabasePath string `long:"data-dir" description:"FireMPQ database location" default:"./fmpq-data"`
+	StorageType  string `long:"storage" description:"Storage backend" default:"leveldb" choice:"leveldb" choice:"bolt"`
+	Repair       bool   `long:"repair" description:"Delete broken data and replace broken service configs with defaults"`
+}
+
+// ParseFsckParameters parses fsck mode parameters and initializes
+// the global config used by the storage.
+func ParseFsckParameters(args []string) *FsckConfig {
+	fcfg := FsckConfig{}
+	parser := flags.NewParser(&fcfg, flags.Default)
+	parser.Usage = "fsck [OPTIONS]"
+	if _, err := parser.ParseArgs(args); err != nil {
+		os.Exit(255)
+	}
+	initOfflineConfig(fcfg.DatabasePath, fcfg.StorageType)
+	return &fcfg
+}
+
+// initOfflineConfig initializes the global config with default values
+// to access the data directory without running the server.
+func initOfflineConfig(dataDir, storageType string) {
+	cfg := Config{}
+	flags.ParseArgs(&cfg, []string{})
+	cfg.DatabasePath = dataDir
+	cfg.StorageType = storageType
+	cfg.LogLevel = 4
+
+	CFG = &cfg
+	CFG_PQ = &(cfg.PQueueConfig)
+}
@@ -57,6 +57,16 @@ type PQConfig struct {
 	PopLimitQueueName string `protobuf:"bytes,10,opt,name=pop_limit_queue_name,json=popLimitQueueName,proto3" json:"pop_limit_queue_name,omitempty"`
 	// Time stamp config was modified last time.
 	LastUpdateTs int64 `protobuf:"varint,11,opt,name=last_update_ts,json=lastUpdateTs,proto3" json:"last_update_ts,omitempty"`
+	// Time window in milliseconds during which pushed message IDs are remembered to reject duplicates.
+	DedupWindow int64 `protobuf:"varint,12,opt,name=dedup_window,json=dedupWindow,proto3" json:"dedup_window,omitempty"`
+	// Deduplicate messages by payload hash instead of message ID.
+	DedupByPayload bool `protobuf:"varint,13,opt,name=dedup_by_payload,json=dedupByPayload,proto3" json:"dedup_by_payload,omitempty"`
+	// Payload compression codec name. Empty means no compression.
+	Compression string `protobuf:"bytes,14,opt,name=compression,proto3" json:"compression,omitempty"`
+	// Payloads smaller than this size in bytes are stored uncompressed.
+	CompressMinSize int64 `protobuf:"varint,15,opt,name=compress_min_size,json=compressMinSize,proto3" json:"compress_min_size,omitempty"`
+	// Durability level of pushed messages. Empty means buffered writes.
+	Durability string `protobuf:"bytes,16,opt,name=durability,proto3" json:"durability,omitempty"`
 }
 
 func (m *PQConfig) Reset()                    { *m = PQConfig{} }
@@ -124,13 +134,28 @@ func (this *PQConfig) Equal(that interface{}) bool {
 	if this.LastUpdateTs != that1.LastUpdateTs {
 		return false
 	}
+	if this.DedupWindow != that1.DedupWindow {
+		return false
+	}
+	if this.DedupByPayload != that1.DedupByPayload {
+		return false
+	}
+	if this.Compression != that1.Compression {
+		return false
+	}
+	if this.CompressMinSize != that1.CompressMinSize {
+		return false
+	}
+	if this.Durability != that1.Durability {
+		return false
+	}
 	return true
 }
 func (this *PQConfig) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 15)
+	s := make([]string, 0, 20)
 	s = append(s, "&conf.PQConfig{")
 	s = append(s, "MsgTtl: "+fmt.Sprintf("%#v", this.MsgTtl)+",\n")
 	s = append(s, "DeliveryDelay: "+fmt.Sprintf("%#v", this.DeliveryDelay)+",\n")
@@ -143,6 +168,11 @@ func (this *PQConfig) GoString() string {
 	s = append(s, "PopWaitTimeout: "+fmt.Sprintf("%#v", this.PopWaitTimeout)+",\n")
 	s = append(s, "PopLimitQueueName: "+fmt.Sprintf("%#v", this.PopLimitQueueName)+",\n")
 	s = append(s, "LastUpdateTs: "+fmt.Sprintf("%#v", this.LastUpdateTs)+",\n")
+	s = append(s, "DedupWindow: "+fmt.Sprintf("%#v", this.DedupWindow)+",\n")
+	s = append(s, "DedupByPayload: "+fmt.Sprintf("%#v", this.DedupByPayload)+",\n")
+	s = append(s, "Compression: "+fmt.Sprintf("%#v", this.Compression)+",\n")
+	s = append(s, "CompressMinSize: "+fmt.Sprintf("%#v", this.CompressMinSize)+",\n")
+	s = append(s, "Durability: "+fmt.Sprintf("%#v", this.Durability)+",\n")
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -242,6 +272,40 @@ func (m *PQConfig) MarshalTo(data []byte) (int, error) {
 		i++
 		i = encodeVarintPqconfig(data, i, uint64(m.LastUpdateTs))
 	}
+	if m.DedupWindow != 0 {
+		data[i] = 0x60
+		i++
+		i = encodeVarintPqconfig(data, i, uint64(m.DedupWindow))
+	}
+	if m.DedupByPayload {
+		data[i] = 0x68
+		i++
+		if m.DedupByPayload {
+			data[i] = 1
+		} else {
+			data[i] = 0
+		}
+		i++
+	}
+	if len(m.Compression) > 0 {
+		data[i] = 0x72
+		i++
+		i = encodeVarintPqconfig(data, i, uint64(len(m.Compression)))
+		i += copy(data[i:], m.Compression)
+	}
+	if m.CompressMinSize != 0 {
+		data[i] = 0x78
+		i++
+		i = encodeVarintPqconfig(data, i, uint64(m.CompressMinSize))
+	}
+	if len(m.Durability) > 0 {
+		data[i] = 0x82
+		i++
+		data[i] = 0x1
+		i++
+		i = encodeVarintPqconfig(data, i, uint64(len(m.Durability)))
+		i += copy(data[i:], m.Durability)
+	}
 	return i, nil
 }
 
@@ -309,6 +373,23 @@ func (m *PQConfig) Size() (n int) {
 	if m.LastUpdateTs != 0 {
 		n += 1 + sovPqconfig(uint64(m.LastUpdateTs))
 	}
+	if m.DedupWindow != 0 {
+		n += 1 + sovPqconfig(uint64(m.DedupWindow))
+	}
+	if m.DedupByPayload {
+		n += 2
+	}
+	l = len(m.Compression)
+	if l > 0 {
+		n += 1 + l + sovPqconfig(uint64(l))
+	}
+	if m.CompressMinSize != 0 {
+		n += 1 + sovPqconfig(uint64(m.CompressMinSize))
+	}
+	l = len(m.Durability)
+	if l > 0 {
+		n += 2 + l + sovPqconfig(uint64(l))
+	}
 	return n
 }
 
@@ -341,6 +422,11 @@ func (this *PQConfig) String() string {
 		`PopWaitTimeout:` + fmt.Sprintf("%v", this.PopWaitTimeout) + `,`,
 		`PopLimitQueueName:` + fmt.Sprintf("%v", this.PopLimitQueueName) + `,`,
 		`LastUpdateTs:` + fmt.Sprintf("%v", this.LastUpdateTs) + `,`,
+		`DedupWindow:` + fmt.Sprintf("%v", this.DedupWindow) + `,`,
+		`DedupByPayload:` + fmt.Sprintf("%v", this.DedupByPayload) + `,`,
+		`Compression:` + fmt.Sprintf("%v", this.Compression) + `,`,
+		`CompressMinSize:` + fmt.Sprintf("%v", this.CompressMinSize) + `,`,
+		`Durability:` + fmt.Sprintf("%v", this.Durability) + `,`,
 		`}`,
 	}, "")
 	return s
@@ -601,6 +687,122 @@ func (m *PQConfig) Unmarshal(data []byte) error {
 					break
 				}
 			}
+		case 12:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field DedupWindow", wireType)
+			}
+			m.DedupWindow = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqconfig
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.DedupWindow |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 13:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field DedupByPayload", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqconfig
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.DedupByPayload = bool(v != 0)
+		case 14:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Compression", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqconfig
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthPqconfig
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Compression = string(data[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 15:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CompressMinSize", wireType)
+			}
+			m.CompressMinSize = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqconfig
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.CompressMinSize |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 16:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Durability", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqconfig
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthPqconfig
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Durability = string(data[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipPqconfig(data[iNdEx:])
@@ -728,28 +930,35 @@ var (
 )
 
 var fileDescriptorPqconfig = []byte{
-	// 366 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x3c, 0x91, 0x4f, 0x4e, 0x02, 0x31,
-	0x14, 0x87, 0x19, 0x41, 0xfe, 0x14, 0x45, 0xa9, 0x26, 0x76, 0x35, 0x21, 0x46, 0x0d, 0x26, 0x46,
-	0x16, 0xde, 0x40, 0xdc, 0x98, 0xa0, 0x01, 0x1c, 0xe3, 0xb2, 0x19, 0xa1, 0x62, 0xe3, 0xcc, 0xb4,
-	0xd0, 0x8e, 0x8a, 0x2b, 0x8f, 0xe0, 0x31, 0x5c, 0x78, 0x10, 0x97, 0x2c, 0x5d, 0x0a, 0x6e, 0x5c,
-	0x7a, 0x04, 0x5f, 0x5b, 0x60, 0xf1, 0xd2, 0xe9, 0xf7, 0xfb, 0xd2, 0xbe, 0xd7, 0x41, 0x5b, 0x3d,
-	0x91, 0xdc, 0x35, 0xe4, 0xd0, 0x2c, 0x7c, 0x70, 0x2c, 0x47, 0x42, 0x0b, 0x9c, 0x33, 0xbb, 0xdd,
-	0x8f, 0x2c, 0x2a, 0xb6, 0x3b, 0x4d, 0x1b, 0xe0, 0x1d, 0x54, 0x88, 0xd5, 0x80, 0x6a, 0x1d, 0x11,
-	0xaf, 0xe6, 0xd5, 0xb3, 0xdd, 0x3c, 0x6c, 0x03, 0x1d, 0xe1, 0x7d, 0x54, 0xe9, 0xb3, 0x88, 0x3f,
-	0xb2, 0xd1, 0x98, 0xc2, 0x47, 0x38, 0x26, 0x2b, 0x36, 0x5f, 0x5f, 0xd0, 0x33, 0x03, 0x71, 0x1d,
-	0x6d, 0x4a, 0x21, 0x69, 0x24, 0x7a, 0x0f, 0x54, 0xf3, 0x98, 0x89, 0x54, 0x93, 0xac, 0x15, 0x2b,
-	0xc0, 0x5b, 0x80, 0x03, 0x47, 0xf1, 0x01, 0xda, 0x30, 0x66, 0x4f, 0xa4, 0x89, 0xa6, 0x11, 0x8f,
-	0xb9, 0x26, 0x39, 0x77, 0x22, 0xe0, 0xa6, 0xa1, 0x2d, 0x03, 0xf1, 0x21, 0xaa, 0xc6, 0xe1, 0x33,
-	0x85, 0x36, 0x14, 0xe5, 0x09, 0x1d, 0xa6, 0x2c, 0x65, 0x64, 0xd5, 0x1d, 0x09, 0xc1, 0x05, 0xf0,
-	0xf3, 0xa4, 0x63, 0x28, 0xae, 0xa1, 0xb5, 0xb9, 0x4a, 0x15, 0x7f, 0x61, 0x24, 0x6f, 0x2d, 0xe4,
-	0xac, 0x2b, 0x20, 0xc6, 0x88, 0x42, 0xa5, 0xa9, 0x4c, 0xd5, 0x3d, 0xd5, 0x8a, 0x14, 0x9c, 0x61,
-	0x58, 0x1b, 0x50, 0xa0, 0xb0, 0x8f, 0xca, 0xce, 0x80, 0xde, 0x40, 0x28, 0x5a, 0xa1, 0x64, 0x05,
-	0x21, 0x21, 0x9f, 0x0f, 0xf8, 0x14, 0x72, 0xbd, 0x1c, 0xb0, 0xb4, 0x1c, 0xf0, 0x06, 0xf0, 0x62,
-	0xc0, 0x06, 0xda, 0xb6, 0x4f, 0x61, 0xa6, 0x70, 0x6d, 0xd3, 0x24, 0x8c, 0x19, 0x41, 0x60, 0x97,
-	0xba, 0x55, 0xf3, 0x1c, 0x26, 0xb2, 0xad, 0x5f, 0x42, 0x80, 0xf7, 0x50, 0xc5, 0x5e, 0x9d, 0xca,
-	0x7e, 0xa8, 0x99, 0xb9, 0xbd, 0x6c, 0x0f, 0xb6, 0x2d, 0x5f, 0x5b, 0x18, 0xa8, 0xd3, 0xa3, 0xc9,
-	0xd4, 0xcf, 0x7c, 0x41, 0xfd, 0x4d, 0x7d, 0xef, 0x75, 0xe6, 0x7b, 0xef, 0x50, 0x9f, 0x50, 0x13,
-	0xa8, 0x6f, 0xa8, 0xdf, 0x19, 0x64, 0xb0, 0xbe, 0xfd, 0xf8, 0x99, 0xdb, 0xbc, 0xfd, 0xd3, 0x27,
-	0xff, 0x01, 0x00, 0x00, 0xff, 0xff, 0x97, 0x11, 0x02, 0x23, 0x00, 0x02, 0x00, 0x00,
+	// 474 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x4c, 0x92, 0xc1, 0x6e, 0x13, 0x3d,
+	0x10, 0xc7, 0xe3, 0xaf, 0xf9, 0xd2, 0xc4, 0x49, 0x93, 0xc6, 0x20, 0xe1, 0x93, 0x15, 0x10, 0xa0,
+	0x80, 0x10, 0x3d, 0xf0, 0x06, 0x2d, 0x17, 0xa4, 0x16, 0xa5, 0x61, 0x51, 0x8f, 0x96, 0xb3, 0x6b,
+	0xb6, 0x56, 0xd7, 0x6b, 0x37, 0xf6, 0x92, 0x6e, 0x4f, 0x3c, 0x02, 0x8f, 0xc1, 0xa3, 0x70, 0xec,
+	0x91, 0x23, 0x59, 0x0e, 0x70, 0xec, 0x23, 0x20, 0x8f, 0xd9, 0xaa, 0xa7, 0x95, 0x7f, 0xf3, 0xd3,
+	0xcc, 0xfc, 0x47, 0x8b, 0x1f, 0xa4, 0xa6, 0xfc, 0x74, 0x60, 0x2f, 0xc3, 0x47, 0xe5, 0xaf, 0xed,
+	0xda, 0x78, 0x43, 0xba, 0xe1, 0xf5, 0xe4, 0x77, 0x17, 0xf7, 0x17, 0xa7, 0x47, 0x50, 0x20, 0x8f,
+	0xf0, 0xae, 0x76, 0x39, 0xf7, 0xbe, 0xa0, 0x68, 0x86, 0xe6, 0x3b, 0xcb, 0x9e, 0x76, 0x79, 0xe2,
+	0x0b, 0xf2, 0x0c, 0x8f, 0x33, 0x59, 0xa8, 0xcf, 0x72, 0x5d, 0xf3, 0x4c, 0x16, 0xa2, 0xa6, 0xff,
+	0x41, 0x7d, 0xaf, 0xa5, 0x6f, 0x03, 0x24, 0x73, 0xbc, 0x6f, 0x8d, 0xe5, 0x85, 0x49, 0x2f, 0xb8,
+	0x57, 0x5a, 0x9a, 0xca, 0xd3, 0x1d, 0x10, 0xc7, 0xd6, 0xd8, 0x63, 0x93, 0x5e, 0x24, 0x91, 0x92,
+	0xe7, 0x78, 0x12, 0xcc, 0xd4, 0x54, 0xa5, 0xe7, 0x85, 0xd2, 0xca, 0xd3, 0x6e, 0xec, 0x68, 0x8d,
+	0x3d, 0x0a, 0xf4, 0x38, 0x40, 0xf2, 0x02, 0x4f, 0xb5, 0xb8, 0xe2, 0xda, 0xe5, 0x8e, 0xab, 0x92,
+	0x5f, 0x56, 0xb2, 0x92, 0xf4, 0xff, 0xd8, 0x52, 0x8b, 0xab, 0x13, 0x97, 0xbb, 0x77, 0xe5, 0x69,
+	0xa0, 0x64, 0x86, 0x47, 0xff, 0x54, 0xee, 0xd4, 0xb5, 0xa4, 0x3d, 0xb0, 0x70, 0xb4, 0x3e, 0xa8,
+	0x6b, 0x30, 0x0a, 0xe1, 0x3c, 0xb7, 0x95, 0x3b, 0xe7, 0xde, 0xd1, 0xdd, 0x68, 0x04, 0xb6, 0xa8,
+	0xdc, 0x79, 0xe2, 0x08, 0xc3, 0xc3, 0x68, 0x18, 0x1b, 0x84, 0x3e, 0x08, 0x03, 0x10, 0x8c, 0x4d,
+	0x5c, 0x1b, 0x70, 0x23, 0x94, 0xbf, 0x0b, 0x38, 0xb8, 0x0b, 0x78, 0x26, 0x94, 0x6f, 0x03, 0x1e,
+	0xe0, 0x87, 0x70, 0x8a, 0x90, 0x22, 0xae, 0xcd, 0x4b, 0xa1, 0x25, 0xc5, 0x33, 0x34, 0x1f, 0x2c,
+	0xa7, 0xe1, 0x1c, 0xa1, 0x04, 0xab, 0xbf, 0x17, 0x5a, 0x92, 0xa7, 0x78, 0x0c, 0xa3, 0x2b, 0x9b,
+	0x09, 0x2f, 0xc3, 0xf4, 0x21, 0x34, 0x86, 0x95, 0x3f, 0x02, 0x4c, 0x1c, 0x79, 0x8c, 0x47, 0x99,
+	0xcc, 0x2a, 0xcb, 0x37, 0xaa, 0xcc, 0xcc, 0x86, 0x8e, 0xc0, 0x19, 0x02, 0x3b, 0x03, 0x14, 0x76,
+	0x8c, 0xca, 0xaa, 0xe6, 0x56, 0xd4, 0x85, 0x11, 0x19, 0xdd, 0x9b, 0xa1, 0x79, 0x7f, 0x39, 0x06,
+	0x7e, 0x58, 0x2f, 0x22, 0x25, 0x33, 0x3c, 0x4c, 0x8d, 0xb6, 0x6b, 0xe9, 0x9c, 0x32, 0x25, 0x1d,
+	0xc3, 0x6a, 0xf7, 0x11, 0x79, 0x89, 0xa7, 0xed, 0x93, 0x6b, 0x55, 0xc6, 0xc3, 0x4e, 0x60, 0xe6,
+	0xa4, 0x2d, 0x9c, 0xa8, 0x12, 0xae, 0xcb, 0x30, 0xce, 0xaa, 0xb5, 0x58, 0xa9, 0x42, 0xf9, 0x9a,
+	0xee, 0x43, 0xb3, 0x7b, 0xe4, 0xf0, 0xd5, 0xcd, 0x96, 0x75, 0x7e, 0x6c, 0x59, 0xe7, 0x76, 0xcb,
+	0xd0, 0x97, 0x86, 0xa1, 0x6f, 0x0d, 0x43, 0xdf, 0x1b, 0x86, 0x6e, 0x1a, 0x86, 0x7e, 0x36, 0x0c,
+	0xfd, 0x69, 0x58, 0xe7, 0xb6, 0x61, 0xe8, 0xeb, 0x2f, 0xd6, 0x59, 0xf5, 0xe0, 0x27, 0x7d, 0xf3,
+	0x77, 0x00, 0x61, 0x00, 0xf2, 0x26, 0xbb, 0x02, 0x00, 0x00,
 }
@@ -0,0 +1,339 @@
+package backup
+
+// Backup archive is a gzip stream with the following layout:
+//
+//   "FMPQ-BACKUP\n"                        Magic line.
+//   <uvarint len><JSON Header>             Archive description.
+//   <type><uvarint len><key><uvarint len><value>  Repeated data records.
+//   <RecEnd><uvarint len><JSON Summary>    Number of records of each type.
+//
+// Record type describes what the key/value pair holds, so archive can be
+// inspected without knowing storage key layout.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/db"
+	"github.com/vburenin/firempq/queue_info"
+	"github.com/vburenin/firempq/utils"
+)
+
+const (
+	Magic         = "FMPQ-BACKUP\n"
+	FormatVersion = 1
+)
+
+// Record types.
+const (
+	RecEnd           byte = 0
+	RecServiceDesc   byte = 1
+	RecServiceConfig byte = 2
+	RecItemMeta      byte = 3
+	RecPayload       byte = 4
+	RecDedupKey      byte = 5
+	RecOther         byte = 6
+)
+
+// maxRecordSize limits the size of a single key or value read from the archive.
+const maxRecordSize = 1 << 30
+
+// restoreFlushBatch is a number of restored records cached before they are flushed on disk.
+const restoreFlushBatch = 10000
+
+var ErrBadArchive = errors.New("not a FireMPQ backup archive")
+var ErrStorageNotEmpty = errors.New("target storage is not empty")
+
+// Header describes the archive.
+type Header struct {
+	Version  int
+	CreateTs int64
+	// LastSeqId is the binary log sequence id of the last mutation included into the archive.
+	// A replica restored from the archive continues replication from the next one.
+	LastSeqId uint64 `json:",omitempty"`
+}
+
+// Summary is a number of records of each type in the archive.
+type Summary struct {
+	Services int64
+	Configs  int64
+	Messages int64
+	Payloads int64
+	Dedup    int64
+	Other    int64
+	// LastSeqId is taken from the archive header.
+	LastSeqId uint64 `json:"-"`
+}
+
+// Records is a total number of records.
+func (s *Summary) Records() int64 {
+	return s.Services + s.Configs + s.Messages + s.Payloads + s.Dedup + s.Other
+}
+
+func (s *Summary) add(recType byte) error {
+	switch recType {
+	case RecServiceDesc:
+		s.Services++
+	case RecServiceConfig:
+		s.Configs++
+	case RecItemMeta:
+		s.Messages++
+	case RecPayload:
+		s.Payloads++
+	case RecDedupKey:
+		s.Dedup++
+	case RecOther:
+		s.Other++
+	default:
+		return fmt.Errorf("unknown record type: %d", recType)
+	}
+	return nil
+}
+
+// Dict returns summary as a dictionary suitable for a response.
+func (s *Summary) Dict() map[string]interface{} {
+	return map[string]interface{}{
+		"Records":   s.Records(),
+		"Services":  s.Services,
+		"Configs":   s.Configs,
+		"Messages":  s.Messages,
+		"Payloads":  s.Payloads,
+		"Dedup":     s.Dedup,
+		"LastSeqId": int64(s.LastSeqId),
+	}
+}
+
+// RecordType detects record type by its storage key.
+func RecordType(key []byte) byte {
+	k := string(key)
+	if strings.HasPrefix(k, queue_info.ServiceDescPrefix) {
+		return RecServiceDesc
+	}
+	if strings.HasPrefix(k, queue_info.ServiceConfigPrefix) {
+		return RecServiceConfig
+	}
+	i := strings.IndexAny(k, db.ItemSeparator+db.PayloadSeparator+db.DedupSeparator)
+	if i <= 0 {
+		return RecOther
+	}
+	switch k[i : i+1] {
+	case db.ItemSeparator:
+		return RecItemMeta
+	case db.PayloadSeparator:
+		return RecPayload
+	case db.DedupSeparator:
+		return RecDedupKey
+	}
+	return RecOther
+}
+
+// Write flushes storage cache and writes all its data into the archive file.
+// Archive is written into a temporary file first and renamed once completed.
+func Write(ds apis.DataStorage, path string) (*Summary, error) {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	summary, err := WriteTo(ds, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	return summary, nil
+}
+
+// WriteTo flushes storage cache and writes all its data into the writer.
+// If storage supports snapshots, archive is a consistent point in time copy.
+func WriteTo(ds apis.DataStorage, w io.Writer) (*Summary, error) {
+	// Data is cached before its mutation is logged, so all mutations up to
+	// the last sequence id are flushed and included into the snapshot.
+	lastSeqId := db.LastMutationSeq()
+	ds.FlushCache()
+
+	var iter apis.ItemIterator
+	if ss, ok := ds.(apis.SnapshotStorage); ok {
+		var err error
+		if iter, err = ss.SnapshotIterator(""); err != nil {
+			return nil, err
+		}
+	} else {
+		iter = ds.IterData("")
+	}
+	defer iter.Close()
+
+	gz := gzip.NewWriter(w)
+	bw := bufio.NewWriter(gz)
+	if _, err := bw.WriteString(Magic); err != nil {
+		return nil, err
+	}
+	header, _ := json.Marshal(&Header{Version: FormatVersion, CreateTs: utils.Uts(), LastSeqId: lastSeqId})
+	if err := writeBytes(bw, header); err != nil {
+		return nil, err
+	}
+
+	summary := &Summary{LastSeqId: lastSeqId}
+	for ; iter.Valid(); iter.Next() {
+		key := iter.GetKey()
+		recType := RecordType(key)
+		summary.add(recType)
+		if err := bw.WriteByte(recType); err != nil {
+			return nil, err
+		}
+		if err := writeBytes(bw, key); err != nil {
+			return nil, err
+		}
+		if err := writeBytes(bw, iter.GetValue()); err != nil {
+			return nil, err
+		}
+	}
+
+	data, _ := json.Marshal(summary)
+	if err := bw.WriteByte(RecEnd); err != nil {
+		return nil, err
+	}
+	if err := writeBytes(bw, data); err != nil {
+		return nil, err
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// Restore loads all records from the archive file into the empty storage.
+// Summary keeps the binary log sequence id of the archive to seed a replica.
+func Restore(ds apis.DataStorage, path string) (*Summary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return RestoreFrom(ds, f)
+}
+
+// RestoreFrom loads all records from the archive into the empty storage.
+func RestoreFrom(ds apis.DataStorage, r io.Reader) (*Summary, error) {
+	iter := ds.IterData("")
+	notEmpty := iter.Valid()
+	iter.Close()
+	if notEmpty {
+		return nil, ErrStorageNotEmpty
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, ErrBadArchive
+	}
+	br := bufio.NewReader(gz)
+
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != Magic {
+		return nil, ErrBadArchive
+	}
+	data, err := readBytes(br)
+	if err != nil {
+		return nil, err
+	}
+	header := &Header{}
+	if err := json.Unmarshal(data, header); err != nil {
+		return nil, ErrBadArchive
+	}
+	if header.Version > FormatVersion {
+		return nil, fmt.Errorf("unsupported backup format version: %d", header.Version)
+	}
+
+	summary := &Summary{LastSeqId: header.LastSeqId}
+	for {
+		recType, err := br.ReadByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if recType == RecEnd {
+			break
+		}
+		if err := summary.add(recType); err != nil {
+			return nil, err
+		}
+		key, err := readBytes(br)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readBytes(br)
+		if err != nil {
+			return nil, err
+		}
+		ds.CachedStore(string(key), value)
+		if summary.Records()%restoreFlushBatch == 0 {
+			ds.FlushCache()
+		}
+	}
+	ds.FlushCache()
+
+	if data, err = readBytes(br); err != nil {
+		return nil, err
+	}
+	expected := &Summary{LastSeqId: header.LastSeqId}
+	if err := json.Unmarshal(data, expected); err != nil {
+		return nil, ErrBadArchive
+	}
+	if *expected != *summary {
+		return nil, fmt.Errorf("backup archive is incomplete: %d of %d records restored",
+			summary.Records(), expected.Records())
+	}
+	// Read the rest of the stream to verify gzip checksum.
+	if _, err := io.Copy(ioutil.Discard, br); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+func writeBytes(w *bufio.Writer, data []byte) error {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(data)))
+	if _, err := w.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if l > maxRecordSize {
+		return nil, ErrBadArchive
+	}
+	data := make([]byte, l)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return data, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
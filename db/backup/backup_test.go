@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/db"
+	"github.com/vburenin/firempq/db/memdb"
+	"github.com/vburenin/firempq/queue_info"
+)
+
+func fillStorage() *memdb.MemStorage {
+	ds := memdb.NewMemStorage()
+	ds.StoreData(queue_info.ServiceDescPrefix+"1", []byte("desc"))
+	ds.StoreData(queue_info.ServiceConfigPrefix+"1", []byte("cfg"))
+	ds.CachedStore2(db.MakeItemPrefix("1")+"a", []byte("meta a"), db.MakePayloadPrefix("1")+"a", []byte("payload a"))
+	ds.CachedStore2(db.MakeItemPrefix("1")+"b", []byte("meta b"), db.MakePayloadPrefix("1")+"b", []byte{})
+	ds.CachedStore(db.MakeDedupPrefix("1")+"k", []byte("ts"))
+	return ds
+}
+
+func allData(ds *memdb.MemStorage) map[string]string {
+	data := make(map[string]string)
+	iter := ds.IterData("")
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		data[string(iter.GetKey())] = string(iter.GetValue())
+	}
+	return data
+}
+
+func TestBackupRestore(t *testing.T) {
+	Convey("Backup should restore exactly the same data", t, func() {
+		dir, _ := ioutil.TempDir("", "fmpq-backup")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "backup.fmpq")
+
+		src := fillStorage()
+		summary, err := Write(src, path)
+		So(err, ShouldBeNil)
+		So(*summary, ShouldResemble, Summary{Services: 1, Configs: 1, Messages: 2, Payloads: 2, Dedup: 1})
+		_, err = os.Stat(path + ".tmp")
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		dst := memdb.NewMemStorage()
+		restored, err := Restore(dst, path)
+		So(err, ShouldBeNil)
+		So(*restored, ShouldResemble, *summary)
+		So(allData(dst), ShouldResemble, allData(src))
+
+		Convey("Restore into non empty storage should fail", func() {
+			_, err := Restore(dst, path)
+			So(err, ShouldEqual, ErrStorageNotEmpty)
+		})
+	})
+
+	Convey("Damaged archives should be rejected", t, func() {
+		buf := &bytes.Buffer{}
+		_, err := WriteTo(fillStorage(), buf)
+		So(err, ShouldBeNil)
+		archive := buf.Bytes()
+
+		_, err = RestoreFrom(memdb.NewMemStorage(), bytes.NewReader([]byte("garbage")))
+		So(err, ShouldEqual, ErrBadArchive)
+
+		_, err = RestoreFrom(memdb.NewMemStorage(), bytes.NewReader(archive[:len(archive)/2]))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+type seqLog struct {
+	seqId uint64
+}
+
+func (l *seqLog) LogMutation(mt apis.MutationType, serviceId, itemId string, meta, payload []byte) {
+	l.seqId++
+}
+
+func (l *seqLog) LastSeqId() uint64 { return l.seqId }
+
+func TestBackupSeqId(t *testing.T) {
+	Convey("Archive should keep the binary log sequence id", t, func() {
+		db.SetMutationLog(&seqLog{seqId: 42})
+		defer db.SetMutationLog(nil)
+
+		buf := &bytes.Buffer{}
+		summary, err := WriteTo(fillStorage(), buf)
+		So(err, ShouldBeNil)
+		So(summary.LastSeqId, ShouldEqual, 42)
+		So(summary.Dict()["LastSeqId"], ShouldEqual, int64(42))
+
+		db.SetMutationLog(nil)
+		restored, err := RestoreFrom(memdb.NewMemStorage(), buf)
+		So(err, ShouldBeNil)
+		So(*restored, ShouldResemble, *summary)
+	})
+}
+
+func TestRecordType(t *testing.T) {
+	Convey("Record type should be detected by the key", t, func() {
+		So(RecordType([]byte(queue_info.ServiceDescPrefix+"1")), ShouldEqual, RecServiceDesc)
+		So(RecordType([]byte(queue_info.ServiceConfigPrefix+"1")), ShouldEqual, RecServiceConfig)
+		So(RecordType([]byte(db.MakeItemPrefix("1")+"\x02")), ShouldEqual, RecItemMeta)
+		So(RecordType([]byte(db.MakePayloadPrefix("1")+"\x01")), ShouldEqual, RecPayload)
+		So(RecordType([]byte(db.MakeDedupPrefix("1")+"x")), ShouldEqual, RecDedupKey)
+		So(RecordType([]byte("other")), ShouldEqual, RecOther)
+	})
+}
@@ -0,0 +1,303 @@
+package boltdb
+
+// Bolt DB cached wrapper. Bolt is a pure Go B+tree storage kept in a single file.
+// Like LevelDB wrapper it caches items and writes them as large batches later.
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/conf"
+	"github.com/vburenin/firempq/enc"
+	"github.com/vburenin/firempq/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DBFileName is a name of the database file inside of the data directory.
+const DBFileName = "firempq.bolt"
+
+var dataBucket = []byte("data")
+
+type ItemCache map[string][]byte
+
+// flushResult is shared by all callers waiting for the same flush.
+type flushResult struct {
+	sync.WaitGroup
+	err error
+}
+
+// BoltStorage A high level cached structure on top of Bolt DB.
+type BoltStorage struct {
+	cfg            *conf.Config
+	db             *bolt.DB   // Pointer the the instance of bolt db.
+	dbName         string     // Bolt database file name.
+	itemCache      ItemCache  // Active cache for item metadata.
+	tmpItemCache   ItemCache  // Active cache during flush operation.
+	cacheLock      sync.Mutex // Used for caches access.
+	flushLock      sync.Mutex // Used to prevent double flush.
+	saveLock       sync.Mutex
+	closed         bool
+	flushSync      *flushResult // Use to wait until flush happens.
+	forceFlushChan chan bool
+}
+
+// NewBoltStorage is a constructor of DataStorage.
+func NewBoltStorage(cfg *conf.Config) (*BoltStorage, error) {
+	if err := os.MkdirAll(cfg.DatabasePath, 0755); err != nil {
+		return nil, err
+	}
+	ds := BoltStorage{
+		cfg:            cfg,
+		dbName:         filepath.Join(cfg.DatabasePath, DBFileName),
+		itemCache:      make(ItemCache),
+		tmpItemCache:   make(ItemCache),
+		closed:         false,
+		forceFlushChan: make(chan bool, 1),
+		flushSync:      &flushResult{},
+	}
+
+	db, err := bolt.Open(ds.dbName, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(dataBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	ds.db = db
+	go ds.periodicCacheFlush()
+	return &ds, nil
+}
+
+func (ds *BoltStorage) GetStats() map[string]interface{} {
+	closed := ds.IsClosed()
+	ds.cacheLock.Lock()
+	defer ds.cacheLock.Unlock()
+	return map[string]interface{}{
+		"DBName":       ds.dbName,
+		"CacheSize":    len(ds.itemCache),
+		"TmpCacheSize": len(ds.tmpItemCache),
+		"Close":        closed,
+	}
+}
+
+func (ds *BoltStorage) periodicCacheFlush() {
+	ds.flushSync.Add(1)
+	for !ds.IsClosed() {
+		select {
+		case <-ds.forceFlushChan:
+			break
+		case <-time.After(time.Duration(ds.cfg.DbFlushInterval) * time.Millisecond):
+			break
+		}
+		ds.flushLock.Lock()
+		oldFlushSync := ds.flushSync
+		ds.flushSync = &flushResult{}
+		ds.flushSync.Add(1)
+		if !ds.closed {
+			oldFlushSync.err = ds.flushCache()
+		}
+		oldFlushSync.Done()
+		ds.flushLock.Unlock()
+	}
+	ds.flushSync.Done()
+}
+
+// WaitFlush waits until all data is flushed on disk.
+func (ds *BoltStorage) WaitFlush() {
+	ds.flushLock.Lock()
+	s := ds.flushSync
+	ds.flushLock.Unlock()
+	s.Wait()
+}
+
+// ForceFlush flushes the cache without waiting for the flush interval.
+// Concurrent callers share the same flush. Bolt syncs every write transaction,
+// so data is always synced on disk once flush is completed.
+func (ds *BoltStorage) ForceFlush(syncData bool) error {
+	ds.flushLock.Lock()
+	s := ds.flushSync
+	ds.flushLock.Unlock()
+	select {
+	case ds.forceFlushChan <- true:
+	default:
+	}
+	s.Wait()
+	return s.err
+}
+
+// CachedStore stores data into the cache.
+func (ds *BoltStorage) CachedStore(key string, data []byte) {
+	ds.cacheLock.Lock()
+	ds.itemCache[key] = data
+	ds.cacheLock.Unlock()
+}
+
+// CachedStore2 stores two items into the item cache.
+func (ds *BoltStorage) CachedStore2(key1 string, data1 []byte, key2 string, data2 []byte) {
+	ds.cacheLock.Lock()
+	ds.itemCache[key1] = data1
+	ds.itemCache[key2] = data2
+	ds.cacheLock.Unlock()
+}
+
+// DeleteDataWithPrefix deletes all service data such as service metadata, items and payloads.
+func (ds *BoltStorage) DeleteDataWithPrefix(prefix string) int {
+	ds.FlushCache()
+	ds.saveLock.Lock()
+	defer ds.saveLock.Unlock()
+
+	total := 0
+	bPrefix := []byte(prefix)
+	err := ds.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(dataBucket).Cursor()
+		for k, _ := c.Seek(bPrefix); k != nil && hasPrefix(k, bPrefix); k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			total++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("Failed to delete data with prefix %s: %s", prefix, err)
+	}
+	return total
+}
+
+// FlushCache flushes all cache into database.
+func (ds *BoltStorage) FlushCache() {
+	ds.flushCache()
+}
+
+// flushCache flushes all cache into database. Returns an error if data is not written.
+func (ds *BoltStorage) flushCache() error {
+	ds.saveLock.Lock()
+	defer ds.saveLock.Unlock()
+	ds.cacheLock.Lock()
+	ds.tmpItemCache = ds.itemCache
+	ds.itemCache = make(ItemCache)
+	ds.cacheLock.Unlock()
+
+	if len(ds.tmpItemCache) > 0 {
+		err := ds.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(dataBucket)
+			for k, v := range ds.tmpItemCache {
+				var err error
+				if v == nil {
+					err = b.Delete([]byte(k))
+				} else {
+					err = b.Put([]byte(k), v)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Error("Failed to flush data on disk: %s", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// IterData returns an iterator over all data with prefix.
+func (ds *BoltStorage) IterData(prefix string) apis.ItemIterator {
+	return makeItemIterator(ds.db, enc.UnsafeStringToBytes(prefix))
+}
+
+// SnapshotIterator returns an iterator over a consistent snapshot of data with prefix.
+// The snapshot is a read transaction which stays open until iterator is closed.
+// Cache is not included, flush it first to get the most recent data.
+func (ds *BoltStorage) SnapshotIterator(prefix string) (apis.ItemIterator, error) {
+	tx, err := ds.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return makeSnapshotIterator(tx, []byte(prefix)), nil
+}
+
+// StoreData data directly into the database stores service metadata into database.
+func (ds *BoltStorage) StoreData(key string, data []byte) error {
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dataBucket).Put([]byte(key), data)
+	})
+}
+
+func (ds *BoltStorage) DeleteData(id ...string) error {
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(dataBucket)
+		for _, i := range id {
+			if err := b.Delete([]byte(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetData looks data looks for and item going through each layer of cache finally looking into database.
+func (ds *BoltStorage) GetData(id string) []byte {
+	ds.cacheLock.Lock()
+	data, ok := ds.itemCache[id]
+	if ok {
+		ds.cacheLock.Unlock()
+		return data
+	}
+	data, ok = ds.tmpItemCache[id]
+	if ok {
+		ds.cacheLock.Unlock()
+		return data
+	}
+	ds.cacheLock.Unlock()
+
+	var value []byte
+	ds.db.View(func(tx *bolt.Tx) error {
+		// Bolt values are valid only during transaction.
+		if v := tx.Bucket(dataBucket).Get([]byte(id)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value
+}
+
+// DeleteCacheData deletes item metadata and payload, affects cache only until flushed.
+func (ds *BoltStorage) DeleteCacheData(id ...string) {
+	ds.cacheLock.Lock()
+	for _, i := range id {
+		ds.itemCache[i] = nil
+	}
+	ds.cacheLock.Unlock()
+}
+
+func (ds *BoltStorage) IsClosed() bool {
+	ds.flushLock.Lock()
+	defer ds.flushLock.Unlock()
+	return ds.closed
+}
+
+// Close flushes data on disk and closes database.
+func (ds *BoltStorage) Close() {
+	ds.flushLock.Lock()
+	defer ds.flushLock.Unlock()
+	if !ds.closed {
+		log.Info("Flushing database cache")
+		ds.FlushCache()
+		ds.closed = true
+		log.Info("Closing the database")
+		ds.db.Close()
+		log.Info("The database has been closed.")
+	} else {
+		log.Error("Attempt to close database more than once!")
+	}
+}
@@ -0,0 +1,142 @@
+package boltdb
+
+import (
+	"bytes"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// iterBatchSize is a number of items read from the database in one transaction.
+const iterBatchSize = 1000
+
+// BoltItemIterator iterates over items with the same prefix.
+// Items are read by batches in short read transactions, so a long iteration
+// doesn't prevent the database from growing.
+type BoltItemIterator struct {
+	db      *bolt.DB
+	prefix  []byte   // Prefix for look ups.
+	keys    [][]byte // Current batch of keys.
+	values  [][]byte // Current batch of values.
+	pos     int
+	lastKey []byte // Last key read from the database.
+	done    bool   // No more data in the database.
+}
+
+func makeItemIterator(db *bolt.DB, prefix []byte) *BoltItemIterator {
+	iter := &BoltItemIterator{db: db, prefix: append([]byte{}, prefix...)}
+	iter.readBatch()
+	return iter
+}
+
+func (mi *BoltItemIterator) readBatch() {
+	mi.keys = mi.keys[:0]
+	mi.values = mi.values[:0]
+	mi.pos = 0
+	mi.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(dataBucket).Cursor()
+		var k, v []byte
+		if mi.lastKey == nil {
+			k, v = c.Seek(mi.prefix)
+		} else {
+			k, v = c.Seek(mi.lastKey)
+			if k != nil && bytes.Equal(k, mi.lastKey) {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil && len(mi.keys) < iterBatchSize; k, v = c.Next() {
+			if !hasPrefix(k, mi.prefix) {
+				mi.done = true
+				return nil
+			}
+			// Bolt keys and values are valid only during transaction.
+			mi.keys = append(mi.keys, append([]byte{}, k...))
+			mi.values = append(mi.values, append([]byte{}, v...))
+		}
+		if k == nil {
+			mi.done = true
+		}
+		return nil
+	})
+	if len(mi.keys) > 0 {
+		mi.lastKey = mi.keys[len(mi.keys)-1]
+	}
+}
+
+// Next switches to the next element.
+func (mi *BoltItemIterator) Next() {
+	mi.pos++
+	if mi.pos >= len(mi.keys) && !mi.done {
+		mi.readBatch()
+	}
+}
+
+// Valid returns true if the current value is OK, otherwise false.
+func (mi *BoltItemIterator) Valid() bool {
+	return mi.pos < len(mi.keys)
+}
+
+// Close closes iterator.
+func (mi *BoltItemIterator) Close() {
+	mi.keys = nil
+	mi.values = nil
+	mi.done = true
+}
+
+func (mi *BoltItemIterator) GetKey() []byte {
+	return mi.keys[mi.pos]
+}
+
+func (mi *BoltItemIterator) GetValue() []byte {
+	return mi.values[mi.pos]
+}
+
+func (mi *BoltItemIterator) GetTrimKey() []byte {
+	return mi.keys[mi.pos][len(mi.prefix):]
+}
+
+// BoltSnapshotIterator iterates over items within a single read transaction.
+type BoltSnapshotIterator struct {
+	tx     *bolt.Tx
+	cursor *bolt.Cursor
+	prefix []byte
+	key    []byte
+	value  []byte
+}
+
+func makeSnapshotIterator(tx *bolt.Tx, prefix []byte) *BoltSnapshotIterator {
+	cursor := tx.Bucket(dataBucket).Cursor()
+	key, value := cursor.Seek(prefix)
+	return &BoltSnapshotIterator{tx: tx, cursor: cursor, prefix: prefix, key: key, value: value}
+}
+
+// Next switches to the next element.
+func (si *BoltSnapshotIterator) Next() {
+	si.key, si.value = si.cursor.Next()
+}
+
+// Valid returns true if the current value is OK, otherwise false.
+func (si *BoltSnapshotIterator) Valid() bool {
+	return si.key != nil && hasPrefix(si.key, si.prefix)
+}
+
+// Close closes iterator and its read transaction.
+func (si *BoltSnapshotIterator) Close() {
+	si.tx.Rollback()
+	si.key = nil
+}
+
+func (si *BoltSnapshotIterator) GetKey() []byte {
+	return si.key
+}
+
+func (si *BoltSnapshotIterator) GetValue() []byte {
+	return si.value
+}
+
+func (si *BoltSnapshotIterator) GetTrimKey() []byte {
+	return si.key[len(si.prefix):]
+}
+
+func hasPrefix(k, prefix []byte) bool {
+	return bytes.HasPrefix(k, prefix)
+}
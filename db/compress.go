@@ -0,0 +1,105 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+)
+
+// Payload codecs. Codec is stored in message metadata, so payloads
+// stored before compression has been enabled are read as raw data.
+const (
+	CodecNone   int64 = 0
+	CodecSnappy int64 = 1
+)
+
+const (
+	CompressionNone   = ""
+	CompressionSnappy = "snappy"
+)
+
+var ErrUnknownCodec = errors.New("unknown payload codec")
+
+// CodecByName returns codec id of the compression name.
+func CodecByName(name string) (int64, bool) {
+	switch name {
+	case CompressionNone:
+		return CodecNone, true
+	case CompressionSnappy:
+		return CodecSnappy, true
+	}
+	return CodecNone, false
+}
+
+// CompressPayload compresses payload with the codec if payload is not smaller than minSize.
+// Returns payload as is with CodecNone if compression doesn't make it smaller.
+func CompressPayload(codec int64, minSize int64, payload []byte) ([]byte, int64) {
+	if codec == CodecNone || int64(len(payload)) < minSize {
+		return payload, CodecNone
+	}
+	var data []byte
+	switch codec {
+	case CodecSnappy:
+		data = snappy.Encode(nil, payload)
+	default:
+		return payload, CodecNone
+	}
+	if len(data) >= len(payload) {
+		return payload, CodecNone
+	}
+	return data, codec
+}
+
+// DecompressPayload restores payload stored with the codec.
+func DecompressPayload(codec int64, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return data, nil
+	case CodecSnappy:
+		return snappy.Decode(nil, data)
+	}
+	return nil, ErrUnknownCodec
+}
+
+// DecodedLen returns size of the payload stored with the codec without decoding it.
+func DecodedLen(codec int64, data []byte) (int, error) {
+	switch codec {
+	case CodecNone:
+		return len(data), nil
+	case CodecSnappy:
+		return snappy.DecodedLen(data)
+	}
+	return 0, ErrUnknownCodec
+}
+
+// CompressionStats is an amount of data compressed by the service since the server start.
+type CompressionStats struct {
+	payloads  int64
+	rawBytes  int64
+	dataBytes int64
+}
+
+// Add counts compressed payload.
+func (cs *CompressionStats) Add(rawSize, dataSize int) {
+	atomic.AddInt64(&cs.payloads, 1)
+	atomic.AddInt64(&cs.rawBytes, int64(rawSize))
+	atomic.AddInt64(&cs.dataBytes, int64(dataSize))
+}
+
+// Dict returns stats as a dictionary suitable for a response.
+func (cs *CompressionStats) Dict() map[string]interface{} {
+	rawBytes := atomic.LoadInt64(&cs.rawBytes)
+	dataBytes := atomic.LoadInt64(&cs.dataBytes)
+	ratio := 1.0
+	if dataBytes > 0 {
+		ratio = float64(rawBytes) / float64(dataBytes)
+	}
+	return map[string]interface{}{
+		"CompressedPayloads":     atomic.LoadInt64(&cs.payloads),
+		"CompressionRawBytes":    rawBytes,
+		"CompressionStoredBytes": dataBytes,
+		"CompressionRatio":       strconv.FormatFloat(ratio, 'f', 2, 64),
+	}
+}
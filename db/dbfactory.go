@@ -5,7 +5,6 @@ import (
 
 	"github.com/vburenin/firempq/apis"
 	"github.com/vburenin/firempq/conf"
-	"github.com/vburenin/firempq/db/ldb"
 	"github.com/vburenin/firempq/log"
 )
 
@@ -23,7 +22,7 @@ func SetDatabase(ds apis.DataStorage) {
 func getDatabase() apis.DataStorage {
 	if database == nil {
 		var err error
-		database, err = ldb.NewLevelDBStorage(conf.CFG)
+		database, err = NewStorage(conf.CFG)
 		if err != nil {
 			log.Error("Cannot initialize FireMPQ database: %s", err)
 			os.Exit(255)
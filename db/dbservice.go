@@ -1,32 +1,53 @@
 package db
 
-import "github.com/vburenin/firempq/apis"
+import (
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/enc"
+)
+
+// Separators between service id and item key.
+const (
+	ItemSeparator    = "\x01"
+	PayloadSeparator = "\x02"
+	DedupSeparator   = "\x03"
+)
 
 type DBService struct {
 	database      apis.DataStorage
+	serviceId     string
 	itemPrefix    string
 	payloadPrefix string
+	dedupPrefix   string
 }
 
 func (d *DBService) InitServiceDB(serviceId string) {
+	d.serviceId = serviceId
 	d.itemPrefix = MakeItemPrefix(serviceId)
 	d.payloadPrefix = MakePayloadPrefix(serviceId)
+	d.dedupPrefix = MakeDedupPrefix(serviceId)
 	d.database = DatabaseInstance()
 }
 
 // MakeItemPrefix makes a prefix which will be used to identify to which service item belongs to.
 func MakeItemPrefix(serviceId string) string {
-	return serviceId + "\x01"
+	return serviceId + ItemSeparator
 }
 
 // MakePayloadPrefix makes a prefix which will be used to identify to which service payload belongs to.
 func MakePayloadPrefix(serviceId string) string {
-	return serviceId + "\x02"
+	return serviceId + PayloadSeparator
+}
+
+// MakeDedupPrefix makes a prefix which will be used to identify deduplication keys of the service.
+func MakeDedupPrefix(serviceId string) string {
+	return serviceId + DedupSeparator
 }
 
 // CacheItemData stores only message metadata in the database.
-func (d *DBService) CacheItemData(itemId string, itemData []byte) {
+// Mutation type describes the change for the mutation log.
+func (d *DBService) CacheItemData(mt apis.MutationType, itemId string, itemData []byte) {
 	d.database.CachedStore(d.itemPrefix+itemId, itemData)
+	LogMutation(mt, d.serviceId, itemId, itemData, nil)
 }
 
 // Payload returns message payload.
@@ -34,16 +55,25 @@ func (d *DBService) Payload(itemId string) []byte {
 	return d.database.GetData(d.payloadPrefix + itemId)
 }
 
+// CachePayload stores only message payload in the database.
+func (d *DBService) CachePayload(itemId string, payload []byte) {
+	d.database.CachedStore(d.payloadPrefix+itemId, payload)
+	LogMutation(apis.MutationUpdate, d.serviceId, itemId, nil, payload)
+}
+
 // CacheAllItemData stores messages data and payload data into database.
-func (d *DBService) CacheAllItemData(itemId string, metaData, payload []byte) {
+// Mutation type describes the change for the mutation log.
+func (d *DBService) CacheAllItemData(mt apis.MutationType, itemId string, metaData, payload []byte) {
 	itemKey := d.itemPrefix + itemId
 	payloadKey := d.payloadPrefix + itemId
 	d.database.CachedStore2(itemKey, metaData, payloadKey, payload)
+	LogMutation(mt, d.serviceId, itemId, metaData, payload)
 }
 
 // DeleteAllItemData removes item from database including its payload.
 func (d *DBService) DeleteAllItemData(itemId string) {
 	d.database.DeleteCacheData(d.itemPrefix+itemId, d.payloadPrefix+itemId)
+	LogMutation(apis.MutationDelete, d.serviceId, itemId, nil, nil)
 }
 
 // ItemIterator returns an iterator over items which are matching provided prefix.
@@ -54,3 +84,27 @@ func (d *DBService) ItemIterator() apis.ItemIterator {
 func (d *DBService) WaitFlush() {
 	d.database.WaitFlush()
 }
+
+// ForceFlush flushes all data without waiting for the flush interval.
+// If syncData is true, it waits until data is synced on disk.
+func (d *DBService) ForceFlush(syncData bool) error {
+	return d.database.ForceFlush(syncData)
+}
+
+// CacheDedupKey stores deduplication key with its expiration time.
+func (d *DBService) CacheDedupKey(key string, expireTs int64) {
+	data := enc.UnsafeStringToBytes(enc.Sn2Bin(uint64(expireTs)))
+	d.database.CachedStore(d.dedupPrefix+key, data)
+	LogMutation(apis.MutationDedup, d.serviceId, key, data, nil)
+}
+
+// DeleteDedupKey removes deduplication key from database.
+func (d *DBService) DeleteDedupKey(key string) {
+	d.database.DeleteCacheData(d.dedupPrefix + key)
+	LogMutation(apis.MutationDedup, d.serviceId, key, nil, nil)
+}
+
+// DedupKeyIterator returns an iterator over deduplication keys.
+func (d *DBService) DedupKeyIterator() apis.ItemIterator {
+	return d.database.IterData(d.dedupPrefix)
+}
@@ -3,6 +3,7 @@ package ldb
 import (
 	"bytes"
 
+	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 )
 
@@ -67,3 +68,15 @@ func (mi *LevelDbItemIterator) GetValue() []byte {
 func (mi *LevelDbItemIterator) GetTrimKey() []byte {
 	return mi.TrimKey
 }
+
+// LevelDbSnapshotIterator iterates over LevelDB snapshot releasing it once closed.
+type LevelDbSnapshotIterator struct {
+	*LevelDbItemIterator
+	snapshot *leveldb.Snapshot
+}
+
+// Close closes iterator and releases snapshot.
+func (si *LevelDbSnapshotIterator) Close() {
+	si.LevelDbItemIterator.Close()
+	si.snapshot.Release()
+}
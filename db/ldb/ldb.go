@@ -4,10 +4,12 @@ package ldb
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
 	"github.com/syndtr/goleveldb/leveldb/util"
 	"github.com/vburenin/firempq/apis"
 	"github.com/vburenin/firempq/conf"
@@ -17,23 +19,39 @@ import (
 
 type ItemCache map[string][]byte
 
+// flushResult is shared by all callers waiting for the same flush.
+type flushResult struct {
+	sync.WaitGroup
+	err error
+}
+
 // LevelDBStorage A high level cached structure on top of LevelDB.
 // It caches item storing them into database
 // as multiple large batches later.
 type LevelDBStorage struct {
 	cfg            *conf.Config
-	db             *leveldb.DB // Pointer the the instance of level db.
-	dbName         string      // LevelDB database name.
-	itemCache      ItemCache   // Active cache for item metadata.
-	tmpItemCache   ItemCache   // Active cache during flush operation.
-	cacheLock      sync.Mutex  // Used for caches access.
-	flushLock      sync.Mutex  // Used to prevent double flush.
+	db             *leveldb.DB  // Pointer the the instance of level db.
+	stor           *statStorage // LevelDB files storage counting write stalls.
+	dbName         string       // LevelDB database name.
+	itemCache      ItemCache    // Active cache for item metadata.
+	tmpItemCache   ItemCache    // Active cache during flush operation.
+	cacheLock      sync.Mutex   // Used for caches access.
+	flushLock      sync.Mutex   // Used to prevent double flush.
 	saveLock       sync.Mutex
 	closed         bool
-	flushSync      *sync.WaitGroup // Use to wait until flush happens.
+	flushSync      *flushResult // Use to wait until flush happens.
 	forceFlushChan chan bool
+	syncRequested  bool  // Next flush should sync data on disk.
+	syncCount      int64 // Number of flushes synced on disk.
 }
 
+// syncMarkerKey is deleted to make sure sync write is not empty,
+// empty batches are not written into the journal.
+var syncMarkerKey = []byte("\x00sync")
+
+// syncWriteOptions makes LevelDB to fsync the journal after the write.
+var syncWriteOptions = &opt.WriteOptions{Sync: true}
+
 // NewLevelDBStorage is a constructor of DataStorage.
 func NewLevelDBStorage(cfg *conf.Config) (*LevelDBStorage, error) {
 	ds := LevelDBStorage{
@@ -43,7 +61,7 @@ func NewLevelDBStorage(cfg *conf.Config) (*LevelDBStorage, error) {
 		tmpItemCache:   make(ItemCache),
 		closed:         false,
 		forceFlushChan: make(chan bool, 1),
-		flushSync:      &sync.WaitGroup{},
+		flushSync:      &flushResult{},
 	}
 
 	// LevelDB write options.
@@ -52,39 +70,50 @@ func NewLevelDBStorage(cfg *conf.Config) (*LevelDBStorage, error) {
 	opts.BlockCacheCapacity = 8 * 1024 * 1024
 	opts.WriteBuffer = 8 * 1024 * 1024
 
-	db, err := leveldb.OpenFile(cfg.DatabasePath, opts)
+	stor, err := storage.OpenFile(cfg.DatabasePath, false)
 	if err != nil {
 		return nil, err
 	}
+	ds.stor = &statStorage{Storage: stor}
+	db, err := leveldb.Open(ds.stor, opts)
+	if err != nil {
+		stor.Close()
+		return nil, err
+	}
 	ds.db = db
 	go ds.periodicCacheFlush()
 	return &ds, nil
 }
 
 func (ds *LevelDBStorage) GetStats() map[string]interface{} {
-	return map[string]interface{}{
-		"DBName":       ds.dbName,
-		"CacheSize":    len(ds.itemCache),
-		"TmpCacheSize": len(ds.tmpItemCache),
-		"Close":        ds.closed,
-	}
+	stats := ds.dbProperties()
+	stats["DBName"] = ds.dbName
+	stats["Close"] = ds.IsClosed()
+	ds.cacheLock.Lock()
+	stats["CacheSize"] = len(ds.itemCache)
+	stats["TmpCacheSize"] = len(ds.tmpItemCache)
+	ds.cacheLock.Unlock()
+	stats["SyncCount"] = atomic.LoadInt64(&ds.syncCount)
+	return stats
 }
 
 func (ds *LevelDBStorage) periodicCacheFlush() {
 	ds.flushSync.Add(1)
-	for !ds.closed {
+	for !ds.IsClosed() {
 		select {
 		case <-ds.forceFlushChan:
 			break
-		case <-time.After(time.Duration(conf.CFG.DbFlushInterval) * time.Millisecond):
+		case <-time.After(time.Duration(ds.cfg.DbFlushInterval) * time.Millisecond):
 			break
 		}
 		ds.flushLock.Lock()
 		oldFlushSync := ds.flushSync
-		ds.flushSync = &sync.WaitGroup{}
+		ds.flushSync = &flushResult{}
 		ds.flushSync.Add(1)
+		syncData := ds.syncRequested
+		ds.syncRequested = false
 		if !ds.closed {
-			ds.FlushCache()
+			oldFlushSync.err = ds.flushCache(syncData)
 		}
 		oldFlushSync.Done()
 		ds.flushLock.Unlock()
@@ -100,6 +129,24 @@ func (ds *LevelDBStorage) WaitFlush() {
 	s.Wait()
 }
 
+// ForceFlush flushes the cache without waiting for the flush interval.
+// If syncData is true, it also syncs data on disk. Concurrent callers
+// share the same flush and sync.
+func (ds *LevelDBStorage) ForceFlush(syncData bool) error {
+	ds.flushLock.Lock()
+	s := ds.flushSync
+	if syncData {
+		ds.syncRequested = true
+	}
+	ds.flushLock.Unlock()
+	select {
+	case ds.forceFlushChan <- true:
+	default:
+	}
+	s.Wait()
+	return s.err
+}
+
 // CachedStoreItem stores data into the cache.
 func (ds *LevelDBStorage) CachedStore(key string, data []byte) {
 	ds.cacheLock.Lock()
@@ -128,10 +175,10 @@ func (ds *LevelDBStorage) DeleteDataWithPrefix(prefix string) int {
 
 	for iter.Valid() {
 		total++
-		if limitCounter < 1000 {
-			wb.Delete(iter.GetKey())
-			limitCounter++
-		} else {
+		// Key is added to the batch before it is written, so no key is skipped at the batch boundary.
+		wb.Delete(iter.GetKey())
+		limitCounter++
+		if limitCounter >= 1000 {
 			limitCounter = 0
 			ds.db.Write(wb, nil)
 			wb.Reset()
@@ -145,17 +192,28 @@ func (ds *LevelDBStorage) DeleteDataWithPrefix(prefix string) int {
 
 // FlushCache flushes all cache into database.
 func (ds *LevelDBStorage) FlushCache() {
+	ds.flushCache(false)
+}
+
+// flushCache flushes all cache into database. If syncData is true, the last write
+// syncs the journal on disk making all previously written data durable.
+// Returns the first write error, data is not durable if it is not nil.
+func (ds *LevelDBStorage) flushCache(syncData bool) error {
 	ds.saveLock.Lock()
+	defer ds.saveLock.Unlock()
 	ds.cacheLock.Lock()
 	ds.tmpItemCache = ds.itemCache
 	ds.itemCache = make(ItemCache)
 	ds.cacheLock.Unlock()
 
+	var flushErr error
 	wb := &leveldb.Batch{}
 	count := 0
 	for k, v := range ds.tmpItemCache {
 		if count >= 100 {
-			ds.db.Write(wb, nil)
+			if err := ds.db.Write(wb, nil); err != nil && flushErr == nil {
+				flushErr = err
+			}
 			wb.Reset()
 			count = 0
 		}
@@ -168,8 +226,22 @@ func (ds *LevelDBStorage) FlushCache() {
 		count++
 
 	}
-	ds.db.Write(wb, nil)
-	ds.saveLock.Unlock()
+	if syncData {
+		wb.Delete(syncMarkerKey)
+		if err := ds.db.Write(wb, syncWriteOptions); err != nil {
+			log.Error("Failed to sync data on disk: %s", err)
+			return err
+		}
+		if flushErr == nil {
+			atomic.AddInt64(&ds.syncCount, 1)
+		}
+	} else if err := ds.db.Write(wb, nil); err != nil && flushErr == nil {
+		flushErr = err
+	}
+	if flushErr != nil {
+		log.Error("Failed to flush data on disk: %s", flushErr)
+	}
+	return flushErr
 }
 
 // IterData returns an iterator over all data with prefix.
@@ -178,6 +250,20 @@ func (ds *LevelDBStorage) IterData(prefix string) apis.ItemIterator {
 	return makeItemIterator(iter, enc.UnsafeStringToBytes(prefix))
 }
 
+// SnapshotIterator returns an iterator over a consistent snapshot of data with prefix.
+// Cache is not included, flush it first to get the most recent data.
+func (ds *LevelDBStorage) SnapshotIterator(prefix string) (apis.ItemIterator, error) {
+	snapshot, err := ds.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	iter := snapshot.NewIterator(new(util.Range), nil)
+	return &LevelDbSnapshotIterator{
+		LevelDbItemIterator: makeItemIterator(iter, enc.UnsafeStringToBytes(prefix)),
+		snapshot:            snapshot,
+	}, nil
+}
+
 // StoreData data directly into the database stores service metadata into database.
 func (ds *LevelDBStorage) StoreData(key string, data []byte) error {
 	return ds.db.Put(enc.UnsafeStringToBytes(key), data, nil)
@@ -233,10 +319,11 @@ func (ds *LevelDBStorage) Close() {
 	defer ds.flushLock.Unlock()
 	if !ds.closed {
 		log.Info("Flushing database cache")
-		ds.FlushCache()
+		ds.flushCache(true)
 		ds.closed = true
 		log.Info("Closing the database")
 		ds.db.Close()
+		ds.stor.Close()
 		log.Info("The database has been closed.")
 	} else {
 		log.Error("Attempt to close database more than once!")
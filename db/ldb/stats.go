@@ -0,0 +1,116 @@
+package ldb
+
+// LevelDB internal statistics reported by DBSTATS.
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// statStorage counts write stalls. LevelDB doesn't expose them as a property,
+// it only logs the number and duration of delayed writes once they are over.
+type statStorage struct {
+	storage.Storage
+	writeStalls   int64
+	writeStallDur int64
+}
+
+func (s *statStorage) Log(str string) {
+	var n int64
+	var dur string
+	if _, err := fmt.Sscanf(str, "db@write was delayed N·%d T·%s", &n, &dur); err == nil {
+		if d, err := time.ParseDuration(dur); err == nil {
+			atomic.AddInt64(&s.writeStalls, n)
+			atomic.AddInt64(&s.writeStallDur, int64(d))
+		}
+	}
+	s.Storage.Log(str)
+}
+
+// keyRange makes LevelDB range, empty limit means the end of the data.
+func keyRange(start, limit string) util.Range {
+	r := util.Range{Start: []byte(start)}
+	if limit != "" {
+		r.Limit = []byte(limit)
+	}
+	return r
+}
+
+// SizeOf returns approximate disk space used by keys in [start, limit).
+// Data in the cache and in the memory table is not counted.
+func (ds *LevelDBStorage) SizeOf(start, limit string) (int64, error) {
+	sizes, err := ds.db.SizeOf([]util.Range{keyRange(start, limit)})
+	if err != nil {
+		return 0, err
+	}
+	return sizes.Sum(), nil
+}
+
+// CompactRange flushes the cache and compacts keys in [start, limit)
+// reclaiming disk space used by deleted data.
+func (ds *LevelDBStorage) CompactRange(start, limit string) error {
+	ds.FlushCache()
+	return ds.db.CompactRange(keyRange(start, limit))
+}
+
+// dbProperties returns table counts, sizes and compaction statistics of
+// each non empty level, along with other LevelDB internal properties.
+func (ds *LevelDBStorage) dbProperties() map[string]interface{} {
+	props := map[string]interface{}{
+		"WriteStalls":  atomic.LoadInt64(&ds.stor.writeStalls),
+		"WriteStallMs": atomic.LoadInt64(&ds.stor.writeStallDur) / int64(time.Millisecond),
+	}
+	intProps := map[string]string{
+		"leveldb.openedtables": "OpenedTables",
+		"leveldb.cachedblock":  "CachedBlocks",
+		"leveldb.alivesnaps":   "AliveSnaps",
+		"leveldb.aliveiters":   "AliveIterators",
+	}
+	for prop, name := range intProps {
+		if v, err := ds.db.GetProperty(prop); err == nil {
+			props[name], _ = strconv.ParseInt(v, 10, 64)
+		}
+	}
+
+	stats, err := ds.db.GetProperty("leveldb.stats")
+	if err != nil {
+		return props
+	}
+	var totalTables, totalBytes, totalMs int64
+	levels := 0
+	s := bufio.NewScanner(strings.NewReader(stats))
+	for s.Scan() {
+		// Level | Tables | Size(MB) | Time(sec) | Read(MB) | Write(MB)
+		var level, tables int64
+		var sizeMb, timeSec, readMb, writeMb float64
+		_, err := fmt.Sscanf(strings.Replace(s.Text(), "|", " ", -1), "%d %d %f %f %f %f",
+			&level, &tables, &sizeMb, &timeSec, &readMb, &writeMb)
+		if err != nil {
+			continue
+		}
+		prefix := "Level" + strconv.FormatInt(level, 10)
+		props[prefix+"Tables"] = tables
+		props[prefix+"Bytes"] = int64(sizeMb * 1048576)
+		props[prefix+"CompactionMs"] = int64(timeSec * 1000)
+		props[prefix+"CompactionReadBytes"] = int64(readMb * 1048576)
+		props[prefix+"CompactionWriteBytes"] = int64(writeMb * 1048576)
+		totalTables += tables
+		totalBytes += int64(sizeMb * 1048576)
+		totalMs += int64(timeSec * 1000)
+		if int(level)+1 > levels {
+			levels = int(level) + 1
+		}
+	}
+	props["Levels"] = levels
+	props["SSTableFiles"] = totalTables
+	props["SSTableBytes"] = totalBytes
+	props["CompactionMs"] = totalMs
+	return props
+}
@@ -0,0 +1,153 @@
+package memdb
+
+// Pure in-memory storage. Nothing is written on disk, so all data is lost
+// once the process exits. Useful for ephemeral instances and tests.
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/vburenin/firempq/apis"
+)
+
+type MemStorage struct {
+	lock   sync.RWMutex
+	data   map[string][]byte
+	closed bool
+}
+
+// NewMemStorage is a constructor of DataStorage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{
+		data: make(map[string][]byte),
+	}
+}
+
+func (ms *MemStorage) GetStats() map[string]interface{} {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return map[string]interface{}{
+		"Size":  len(ms.data),
+		"Close": ms.closed,
+	}
+}
+
+// WaitFlush does nothing since there is nothing to flush.
+func (ms *MemStorage) WaitFlush() {}
+
+// ForceFlush does nothing since data is never stored on disk.
+func (ms *MemStorage) ForceFlush(syncData bool) error { return nil }
+
+// FlushCache does nothing since there is no cache.
+func (ms *MemStorage) FlushCache() {}
+
+// CachedStore stores data.
+func (ms *MemStorage) CachedStore(key string, data []byte) {
+	ms.lock.Lock()
+	ms.data[key] = data
+	ms.lock.Unlock()
+}
+
+// CachedStore2 stores two items at once.
+func (ms *MemStorage) CachedStore2(key1 string, data1 []byte, key2 string, data2 []byte) {
+	ms.lock.Lock()
+	ms.data[key1] = data1
+	ms.data[key2] = data2
+	ms.lock.Unlock()
+}
+
+// DeleteDataWithPrefix deletes all service data such as service metadata, items and payloads.
+func (ms *MemStorage) DeleteDataWithPrefix(prefix string) int {
+	ms.lock.Lock()
+	total := 0
+	for k := range ms.data {
+		if strings.HasPrefix(k, prefix) {
+			delete(ms.data, k)
+			total++
+		}
+	}
+	ms.lock.Unlock()
+	return total
+}
+
+// StoreData stores data.
+func (ms *MemStorage) StoreData(key string, data []byte) error {
+	ms.CachedStore(key, data)
+	return nil
+}
+
+func (ms *MemStorage) DeleteData(id ...string) error {
+	ms.lock.Lock()
+	for _, i := range id {
+		delete(ms.data, i)
+	}
+	ms.lock.Unlock()
+	return nil
+}
+
+func (ms *MemStorage) DeleteCacheData(id ...string) {
+	ms.DeleteData(id...)
+}
+
+// IterData returns an iterator over a snapshot of all data with prefix.
+func (ms *MemStorage) IterData(prefix string) apis.ItemIterator {
+	ms.lock.RLock()
+	iter := &MemItemIterator{prefixLen: len(prefix)}
+	for k := range ms.data {
+		if strings.HasPrefix(k, prefix) {
+			iter.keys = append(iter.keys, k)
+		}
+	}
+	sort.Strings(iter.keys)
+	iter.values = make([][]byte, len(iter.keys))
+	for i, k := range iter.keys {
+		iter.values[i] = ms.data[k]
+	}
+	ms.lock.RUnlock()
+	return iter
+}
+
+// SnapshotIterator returns an iterator over a snapshot of data with prefix.
+func (ms *MemStorage) SnapshotIterator(prefix string) (apis.ItemIterator, error) {
+	return ms.IterData(prefix), nil
+}
+
+func (ms *MemStorage) GetData(id string) []byte {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.data[id]
+}
+
+func (ms *MemStorage) IsClosed() bool {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.closed
+}
+
+// Close marks storage closed. A new storage created after that is empty.
+func (ms *MemStorage) Close() {
+	ms.lock.Lock()
+	ms.closed = true
+	ms.lock.Unlock()
+}
+
+// MemItemIterator iterates over sorted keys selected at the moment iterator is created.
+type MemItemIterator struct {
+	keys      []string
+	values    [][]byte
+	pos       int
+	prefixLen int
+}
+
+func (mi *MemItemIterator) Next() { mi.pos++ }
+
+func (mi *MemItemIterator) Valid() bool { return mi.pos < len(mi.keys) }
+
+func (mi *MemItemIterator) Close() {}
+
+func (mi *MemItemIterator) GetKey() []byte { return []byte(mi.keys[mi.pos]) }
+
+func (mi *MemItemIterator) GetValue() []byte { return mi.values[mi.pos] }
+
+func (mi *MemItemIterator) GetTrimKey() []byte { return []byte(mi.keys[mi.pos][mi.prefixLen:]) }
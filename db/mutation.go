@@ -0,0 +1,27 @@
+package db
+
+import "github.com/vburenin/firempq/apis"
+
+var mutationLog apis.MutationLog = nil
+
+// SetMutationLog sets a log receiving all data changes.
+// It must be set before services are loaded. Nil disables logging.
+func SetMutationLog(ml apis.MutationLog) {
+	mutationLog = ml
+}
+
+// LastMutationSeq returns the sequence id of the last logged mutation,
+// 0 if mutation log is not set or doesn't assign sequence ids.
+func LastMutationSeq() uint64 {
+	if sl, ok := mutationLog.(apis.SeqMutationLog); ok {
+		return sl.LastSeqId()
+	}
+	return 0
+}
+
+// LogMutation records a data change if mutation log is set.
+func LogMutation(mt apis.MutationType, serviceId, itemId string, meta, payload []byte) {
+	if mutationLog != nil {
+		mutationLog.LogMutation(mt, serviceId, itemId, meta, payload)
+	}
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/conf"
+	"github.com/vburenin/firempq/db/boltdb"
+	"github.com/vburenin/firempq/db/ldb"
+	"github.com/vburenin/firempq/db/memdb"
+)
+
+const (
+	StorageLevelDB = "leveldb"
+	StorageBolt    = "bolt"
+	StorageMemory  = "memory"
+)
+
+// DefaultStorage is used if storage type is not configured.
+const DefaultStorage = StorageLevelDB
+
+// StorageFactory creates a new data storage using provided config.
+type StorageFactory func(cfg *conf.Config) (apis.DataStorage, error)
+
+var storagesLock sync.Mutex
+var storages = map[string]StorageFactory{}
+
+func init() {
+	RegisterStorage(StorageLevelDB, func(cfg *conf.Config) (apis.DataStorage, error) {
+		return ldb.NewLevelDBStorage(cfg)
+	})
+	RegisterStorage(StorageBolt, func(cfg *conf.Config) (apis.DataStorage, error) {
+		return boltdb.NewBoltStorage(cfg)
+	})
+	RegisterStorage(StorageMemory, func(cfg *conf.Config) (apis.DataStorage, error) {
+		return memdb.NewMemStorage(), nil
+	})
+}
+
+// RegisterStorage makes storage backend available under the provided name.
+// Registering the same name twice replaces previous factory.
+func RegisterStorage(name string, factory StorageFactory) {
+	storagesLock.Lock()
+	storages[name] = factory
+	storagesLock.Unlock()
+}
+
+// StorageNames returns sorted list of registered storage backends.
+func StorageNames() []string {
+	storagesLock.Lock()
+	names := make([]string, 0, len(storages))
+	for name := range storages {
+		names = append(names, name)
+	}
+	storagesLock.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+// NewStorage creates a storage backend selected by the config.
+func NewStorage(cfg *conf.Config) (apis.DataStorage, error) {
+	name := cfg.StorageType
+	if name == "" {
+		name = DefaultStorage
+	}
+	storagesLock.Lock()
+	factory, ok := storages[name]
+	storagesLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage type %q, available: %v", name, StorageNames())
+	}
+	return factory(cfg)
+}
@@ -0,0 +1,142 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/conf"
+)
+
+func testConfig(storage, dataDir string) *conf.Config {
+	return &conf.Config{
+		StorageType:     storage,
+		DatabasePath:    dataDir,
+		DbFlushInterval: 10,
+	}
+}
+
+func iterKeys(ds apis.DataStorage, prefix string) []string {
+	var keys []string
+	iter := ds.IterData(prefix)
+	defer iter.Close()
+	for iter.Valid() {
+		keys = append(keys, string(iter.GetTrimKey()))
+		iter.Next()
+	}
+	return keys
+}
+
+func TestStorageRegistry(t *testing.T) {
+	Convey("All storage backends should be registered", t, func() {
+		So(StorageNames(), ShouldResemble, []string{StorageBolt, StorageLevelDB, StorageMemory})
+	})
+	Convey("Unknown storage should fail", t, func() {
+		_, err := NewStorage(testConfig("unknown", ""))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestStorageBackends(t *testing.T) {
+	for _, name := range StorageNames() {
+		Convey("Storage "+name+" should store, iterate and delete data", t, func() {
+			dataDir, err := ioutil.TempDir("", "fmpq-"+name)
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dataDir)
+			cfg := testConfig(name, dataDir)
+
+			ds, err := NewStorage(cfg)
+			So(err, ShouldBeNil)
+
+			ds.CachedStore2("a\x01id1", []byte("data1"), "a\x01id2", []byte("data2"))
+			ds.CachedStore("b\x01id1", []byte("other"))
+			So(ds.StoreData("a\x01id0", []byte("data0")), ShouldBeNil)
+			So(string(ds.GetData("a\x01id1")), ShouldEqual, "data1")
+
+			ds.FlushCache()
+			So(iterKeys(ds, "a\x01"), ShouldResemble, []string{"id0", "id1", "id2"})
+
+			ds.DeleteCacheData("a\x01id1")
+			ds.FlushCache()
+			So(ds.GetData("a\x01id1"), ShouldBeNil)
+			So(ds.DeleteData("a\x01id0"), ShouldBeNil)
+			So(iterKeys(ds, "a\x01"), ShouldResemble, []string{"id2"})
+
+			for i := 0; i < 1500; i++ {
+				ds.CachedStore(fmt.Sprintf("c\x01%05d", i), []byte("v"))
+			}
+			ds.FlushCache()
+			keys := iterKeys(ds, "c\x01")
+			So(len(keys), ShouldEqual, 1500)
+			So(keys[1499], ShouldEqual, "01499")
+
+			So(ds.DeleteDataWithPrefix("c\x01"), ShouldEqual, 1500)
+			So(iterKeys(ds, "c\x01"), ShouldBeEmpty)
+
+			snap, err := ds.(apis.SnapshotStorage).SnapshotIterator("a\x01")
+			So(err, ShouldBeNil)
+			ds.CachedStore("a\x01id3", []byte("data3"))
+			ds.FlushCache()
+			var snapKeys []string
+			for ; snap.Valid(); snap.Next() {
+				snapKeys = append(snapKeys, string(snap.GetTrimKey()))
+			}
+			snap.Close()
+			So(snapKeys, ShouldResemble, []string{"id2"})
+			So(ds.DeleteData("a\x01id3"), ShouldBeNil)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					ds.CachedStore(fmt.Sprintf("s\x01%d", i), []byte("v"))
+					ds.ForceFlush(true)
+					wg.Done()
+				}(i)
+			}
+			wg.Wait()
+			// Iterators read flushed data only.
+			So(len(iterKeys(ds, "s\x01")), ShouldEqual, 10)
+			So(ds.DeleteDataWithPrefix("s\x01"), ShouldEqual, 10)
+
+			ds.Close()
+			So(ds.IsClosed(), ShouldBeTrue)
+
+			if name != StorageMemory {
+				ds, err = NewStorage(cfg)
+				So(err, ShouldBeNil)
+				So(string(ds.GetData("b\x01id1")), ShouldEqual, "other")
+				So(iterKeys(ds, "a\x01"), ShouldResemble, []string{"id2"})
+				ds.Close()
+			}
+		})
+	}
+}
+
+func TestDeleteDataWithPrefixBatches(t *testing.T) {
+	for _, name := range StorageNames() {
+		Convey("Storage "+name+" should delete all keys around batch boundaries", t, func() {
+			dataDir, err := ioutil.TempDir("", "fmpq-"+name)
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dataDir)
+			ds, err := NewStorage(testConfig(name, dataDir))
+			So(err, ShouldBeNil)
+			defer ds.Close()
+
+			ds.CachedStore("e\x02keep", []byte("v"))
+			for _, count := range []int{999, 1000, 1001, 2001} {
+				for i := 0; i < count; i++ {
+					ds.CachedStore(fmt.Sprintf("e\x01%05d", i), []byte("v"))
+				}
+				ds.FlushCache()
+				So(ds.DeleteDataWithPrefix("e\x01"), ShouldEqual, count)
+				So(iterKeys(ds, "e\x01"), ShouldBeEmpty)
+			}
+			So(iterKeys(ds, "e\x02"), ShouldResemble, []string{"keep"})
+		})
+	}
+}
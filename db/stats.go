@@ -0,0 +1,114 @@
+package db
+
+import (
+	"strconv"
+
+	"github.com/vburenin/firempq/apis"
+)
+
+// ServiceStats is a number of keys of each kind stored by the service
+// and approximate disk space used by them.
+type ServiceStats struct {
+	MetaKeys    int64
+	PayloadKeys int64
+	DedupKeys   int64
+	// PayloadBytes is a size of stored payloads, RawPayloadBytes is their size before compression.
+	PayloadBytes    int64
+	RawPayloadBytes int64
+	// DiskBytes is reported by storages implementing apis.CompactStorage only.
+	DiskBytes int64
+}
+
+// PayloadCodecFunc returns the codec of the payload by the message metadata.
+type PayloadCodecFunc func(meta []byte) int64
+
+// ServiceKeyRange returns the range of all item, payload and deduplication keys of the service.
+// Separators are adjacent, so their keys are stored next to each other.
+func ServiceKeyRange(serviceId string) (string, string) {
+	return MakeItemPrefix(serviceId), serviceId + "\x04"
+}
+
+func countKeys(ds apis.DataStorage, prefix string) int64 {
+	iter := ds.IterData(prefix)
+	defer iter.Close()
+	var n int64
+	for ; iter.Valid(); iter.Next() {
+		n++
+	}
+	return n
+}
+
+// countPayloads walks message metadata and payloads in step to get the codec of each payload.
+// Payloads are counted as raw data if codecOf is nil, payload doesn't have metadata or can't be decoded.
+func countPayloads(ds apis.DataStorage, serviceId string, codecOf PayloadCodecFunc, stats *ServiceStats) {
+	metaIter := ds.IterData(MakeItemPrefix(serviceId))
+	defer metaIter.Close()
+	payloadIter := ds.IterData(MakePayloadPrefix(serviceId))
+	defer payloadIter.Close()
+
+	for ; payloadIter.Valid(); payloadIter.Next() {
+		itemId := string(payloadIter.GetTrimKey())
+		for metaIter.Valid() && string(metaIter.GetTrimKey()) < itemId {
+			stats.MetaKeys++
+			metaIter.Next()
+		}
+		data := payloadIter.GetValue()
+		codec := CodecNone
+		if metaIter.Valid() && string(metaIter.GetTrimKey()) == itemId {
+			if codecOf != nil {
+				codec = codecOf(metaIter.GetValue())
+			}
+			stats.MetaKeys++
+			metaIter.Next()
+		}
+		size, err := DecodedLen(codec, data)
+		if err != nil {
+			size = len(data)
+		}
+		stats.PayloadKeys++
+		stats.PayloadBytes += int64(len(data))
+		stats.RawPayloadBytes += int64(size)
+	}
+	for ; metaIter.Valid(); metaIter.Next() {
+		stats.MetaKeys++
+	}
+}
+
+// GetServiceStats counts keys of the service iterating over all its data,
+// cache should be flushed to get the recent numbers.
+func GetServiceStats(ds apis.DataStorage, serviceId string, codecOf PayloadCodecFunc) (*ServiceStats, error) {
+	stats := &ServiceStats{
+		DedupKeys: countKeys(ds, MakeDedupPrefix(serviceId)),
+	}
+	countPayloads(ds, serviceId, codecOf, stats)
+	if cs, ok := ds.(apis.CompactStorage); ok {
+		size, err := cs.SizeOf(ServiceKeyRange(serviceId))
+		if err != nil {
+			return nil, err
+		}
+		stats.DiskBytes = size
+	}
+	return stats, nil
+}
+
+// CompressionRatio returns the ratio of raw payload size to the stored one.
+func (s *ServiceStats) CompressionRatio() float64 {
+	if s.PayloadBytes == 0 {
+		return 1.0
+	}
+	return float64(s.RawPayloadBytes) / float64(s.PayloadBytes)
+}
+
+// Dict returns stats as a dictionary with keys prefixed by the service name.
+func (s *ServiceStats) Dict(name string) map[string]interface{} {
+	prefix := "Queue." + name + "."
+	return map[string]interface{}{
+		prefix + "MetaKeys":         s.MetaKeys,
+		prefix + "PayloadKeys":      s.PayloadKeys,
+		prefix + "DedupKeys":        s.DedupKeys,
+		prefix + "PayloadBytes":     s.PayloadBytes,
+		prefix + "RawPayloadBytes":  s.RawPayloadBytes,
+		prefix + "CompressionRatio": strconv.FormatFloat(s.CompressionRatio(), 'f', 2, 64),
+		prefix + "DiskBytes":        s.DiskBytes,
+	}
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/vburenin/firempq/apis"
+)
+
+func storeServiceData(ds apis.DataStorage, serviceId string, count int) {
+	payload := []byte(strings.Repeat("p", 1000))
+	for i := 0; i < count; i++ {
+		id := fmt.Sprintf("%05d", i)
+		ds.CachedStore2(MakeItemPrefix(serviceId)+id, []byte("meta"), MakePayloadPrefix(serviceId)+id, payload)
+	}
+	ds.CachedStore(MakeDedupPrefix(serviceId)+"key", []byte("ts"))
+	ds.FlushCache()
+}
+
+func TestServiceStats(t *testing.T) {
+	Convey("Service stats should count keys of the service only", t, func() {
+		dataDir, err := ioutil.TempDir("", "fmpq-stats")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dataDir)
+		ds, err := NewStorage(testConfig(StorageLevelDB, dataDir))
+		So(err, ShouldBeNil)
+		defer ds.Close()
+
+		storeServiceData(ds, "1", 2000)
+		storeServiceData(ds, "10", 10)
+		cs := ds.(apis.CompactStorage)
+		So(cs.CompactRange("", ""), ShouldBeNil)
+
+		stats, err := GetServiceStats(ds, "1", nil)
+		So(err, ShouldBeNil)
+		So(stats.MetaKeys, ShouldEqual, 2000)
+		So(stats.PayloadKeys, ShouldEqual, 2000)
+		So(stats.DedupKeys, ShouldEqual, 1)
+		So(stats.DiskBytes, ShouldBeGreaterThan, 1000000)
+		So(stats.PayloadBytes, ShouldEqual, 2000000)
+		So(stats.Dict("q")["Queue.q.MetaKeys"], ShouldEqual, 2000)
+		So(stats.Dict("q")["Queue.q.CompressionRatio"], ShouldEqual, "1.00")
+
+		stats, err = GetServiceStats(ds, "10", nil)
+		So(err, ShouldBeNil)
+		So(stats.MetaKeys, ShouldEqual, 10)
+
+		dbStats := ds.GetStats()
+		So(dbStats["SSTableFiles"], ShouldBeGreaterThan, 0)
+		So(dbStats["WriteStalls"], ShouldEqual, 0)
+
+		Convey("Compaction should reclaim space of deleted data", func() {
+			So(ds.DeleteDataWithPrefix(MakePayloadPrefix("1")), ShouldEqual, 2000)
+			start, limit := ServiceKeyRange("1")
+			So(cs.CompactRange(start, limit), ShouldBeNil)
+			stats, err := GetServiceStats(ds, "1", nil)
+			So(err, ShouldBeNil)
+			So(stats.PayloadKeys, ShouldEqual, 0)
+			So(stats.DiskBytes, ShouldBeLessThan, 1000000)
+		})
+	})
+
+	Convey("Disk space is not reported by the memory storage", t, func() {
+		ds, err := NewStorage(testConfig(StorageMemory, ""))
+		So(err, ShouldBeNil)
+		storeServiceData(ds, "1", 10)
+		stats, err := GetServiceStats(ds, "1", nil)
+		So(err, ShouldBeNil)
+		So(stats.MetaKeys, ShouldEqual, 10)
+		So(stats.DiskBytes, ShouldEqual, 0)
+	})
+}
+
+func TestServiceCompressionStats(t *testing.T) {
+	Convey("Compression ratio should be computed by the stored payloads", t, func() {
+		ds, err := NewStorage(testConfig(StorageMemory, ""))
+		So(err, ShouldBeNil)
+		payload := []byte(strings.Repeat("p", 1000))
+		data, codec := CompressPayload(CodecSnappy, 0, payload)
+		So(codec, ShouldEqual, CodecSnappy)
+		ds.CachedStore2(MakeItemPrefix("1")+"a", []byte("snappy"), MakePayloadPrefix("1")+"a", data)
+		ds.CachedStore2(MakeItemPrefix("1")+"b", []byte("raw"), MakePayloadPrefix("1")+"b", payload)
+		ds.CachedStore(MakePayloadPrefix("1")+"c", payload)
+		ds.CachedStore(MakeItemPrefix("1")+"d", []byte("snappy"))
+		ds.FlushCache()
+
+		codecOf := func(meta []byte) int64 {
+			if string(meta) == "snappy" {
+				return CodecSnappy
+			}
+			return CodecNone
+		}
+		stats, err := GetServiceStats(ds, "1", codecOf)
+		So(err, ShouldBeNil)
+		So(stats.MetaKeys, ShouldEqual, 3)
+		So(stats.PayloadKeys, ShouldEqual, 3)
+		So(stats.PayloadBytes, ShouldEqual, 2000+len(data))
+		So(stats.RawPayloadBytes, ShouldEqual, 3000)
+		So(stats.CompressionRatio(), ShouldBeGreaterThan, 1.0)
+
+		stats, err = GetServiceStats(ds, "1", nil)
+		So(err, ShouldBeNil)
+		So(stats.RawPayloadBytes, ShouldEqual, stats.PayloadBytes)
+	})
+}
@@ -97,6 +97,18 @@ func WriteDict(b *bufio.Writer, dict map[string]interface{}) error {
 	return err
 }
 
+// WriteStrDict writes a dictionary with string values.
+func WriteStrDict(b *bufio.Writer, dict map[string]string) error {
+	err := WriteDictSize(b, len(dict))
+	for k, v := range dict {
+		err = b.WriteByte(' ')
+		err = WriteString(b, k)
+		err = b.WriteByte(' ')
+		err = WriteString(b, v)
+	}
+	return err
+}
+
 func WriteDictSize(b *bufio.Writer, l int) error {
 	err := b.WriteByte('%')
 	_, err = b.WriteString(strconv.Itoa(l))
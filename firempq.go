@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 	_ "net/http/pprof"
+	"os"
 
 	"github.com/vburenin/firempq/conf"
 	"github.com/vburenin/firempq/log"
@@ -10,6 +11,19 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case RestoreMode:
+			os.Exit(restore(os.Args[2:]))
+		case ExportMode, ImportMode:
+			os.Exit(queueFile(os.Args[1], os.Args[2:]))
+		case FsckMode:
+			os.Exit(checkDataDir(os.Args[2:]))
+		case PasswdMode:
+			os.Exit(passwd())
+		}
+	}
+
 	// Initialize logging to a default INFO level to be able to log config error.
 
 	conf.ParseConfigParameters()
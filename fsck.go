@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+
+	"github.com/vburenin/firempq/conf"
+	"github.com/vburenin/firempq/db"
+	"github.com/vburenin/firempq/log"
+	"github.com/vburenin/firempq/pqueue/fsck"
+)
+
+// FsckMode is a command line mode to check and repair consistency of the data directory.
+const FsckMode = "fsck"
+
+// checkDataDir checks the data directory and returns process exit code.
+// Exit code is 1 if there are problems left not repaired.
+func checkDataDir(args []string) int {
+	fcfg := conf.ParseFsckParameters(args)
+	log.InitLogging()
+
+	if _, err := os.Stat(fcfg.DatabasePath); err != nil {
+		log.Critical("Cannot open data directory: %s", err)
+		return 255
+	}
+	ds, err := db.NewStorage(conf.CFG)
+	if err != nil {
+		log.Critical("Cannot initialize FireMPQ database: %s", err)
+		return 255
+	}
+	defer ds.Close()
+
+	log.Info("Checking %s", fcfg.DatabasePath)
+	report, err := fsck.Check(ds, fcfg.Repair)
+	if err != nil {
+		log.Critical("Check failed: %s", err)
+		return 1
+	}
+	log.Info("Checked %d services, %d messages, %d payloads",
+		report.Services, report.Messages, report.Payloads)
+	log.Info("Found %d corrupt messages, %d orphaned payloads, %d orphaned service keys, %d service problems",
+		report.CorruptMeta, report.OrphanedPayloads, report.OrphanedKeys, report.ServiceProblems)
+	if report.Problems() == 0 {
+		return 0
+	}
+	if fcfg.Repair {
+		log.Info("Repaired %d records", report.Repaired)
+		return 0
+	}
+	log.Warning("Run with --repair to fix found problems")
+	return 1
+}
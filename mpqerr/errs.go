@@ -9,6 +9,8 @@ import (
 )
 
 var CODE_INVALID_REQ int64 = 400
+var CODE_UNAUTHORIZED int64 = 401
+var CODE_FORBIDDEN int64 = 403
 var CODE_NOT_FOUND int64 = 404
 var CODE_CONFLICT_REQ int64 = 409
 var CODE_SERVER_ERR int64 = 500
@@ -77,16 +79,45 @@ var ERR_ITEM_ALREADY_EXISTS = ConflictRequest("Message exists already")
 var ERR_MSG_NOT_LOCKED = InvalidRequest("Message is not locked")
 var ERR_MSG_NOT_FOUND = NotFoundRequest("Message not found")
 var ERR_MSG_IS_LOCKED = ConflictRequest("Message is locked")
+var ERR_MSG_DUPLICATE = ConflictRequest("Message is a duplicate of a recently pushed one")
+var ERR_GROUP_NOT_SUPPORTED = InvalidRequest("Message groups are supported by FIFO queues only")
 
 var ERR_INVALID_RECEIPT = InvalidRequest("Receipt is invalid")
 var ERR_NO_RECEIPT = InvalidRequest("No receipt provided")
 var ERR_RECEIPT_EXPIRED = InvalidRequest("Receipt has expired")
-var ERR_ONE_RECEIPT_ONLY = InvalidRequest("Only one receipt at the time is currently supported")
+var ERR_PRIORITY_RANGE = InvalidRequest("Min priority is greater than max priority")
+var ERR_TOO_MANY_ATTRS = InvalidRequest("Too many message attributes")
+var ERR_REDRIVE_SAME_QUEUE = InvalidRequest("Messages can not be redriven into the same queue")
+var ERR_BATCH_TOO_LARGE = InvalidRequest("Too many items in one batch")
+var ERR_UNKNOWN_COMPRESSION = InvalidRequest("Unknown compression codec")
+var ERR_UNKNOWN_DURABILITY = InvalidRequest("Unknown durability level")
+
+var ERR_BINLOG_DISABLED = InvalidRequest("Binary log is disabled")
+var ERR_REPL_SEQ_NOT_AVAILABLE = NotFoundRequest("Sequence number is not available in the binary log")
+var ERR_REPL_NO_FULL_HISTORY = ConflictRequest("Binary log doesn't have data created before it was enabled")
+var ERR_NOT_REPLICA = InvalidRequest("Server is not a replica")
+var ERR_WRONG_TAG = InvalidRequest("Request tag is wrong")
+var ERR_COMPACT_NOT_SUPPORTED = InvalidRequest("Storage doesn't support compaction")
+var ERR_BACKUP_DISABLED = InvalidRequest("Backup directory is not configured")
+var ERR_EXPORT_DISABLED = InvalidRequest("Export directory is not configured")
+var ERR_BAD_FILE_PATH = InvalidRequest("File path must be relative and stay within the configured directory")
+var ERR_ALREADY_SUBSCRIBED = InvalidRequest("Session is already subscribed to the queue")
+var ERR_NOT_SUBSCRIBED = InvalidRequest("Session is not subscribed to the queue")
+
+var ERR_AUTH_REQUIRED = NewError("Authentication required", CODE_UNAUTHORIZED)
+var ERR_AUTH_FAILED = NewError("Invalid user name or password", CODE_UNAUTHORIZED)
+var ERR_AUTH_DISABLED = InvalidRequest("Authentication is disabled")
+var ERR_PERMISSION_DENIED = NewError("Permission denied", CODE_FORBIDDEN)
 
 var ERR_CONN_CLOSING = NewError("Connection will be closed soon", CODE_SERVER_UNAVAILABLE)
+var ERR_READ_ONLY = NewError("Server is a read only replica", CODE_SERVER_UNAVAILABLE)
 
 // Parameter errors.
 var ERR_MSG_ID_NOT_DEFINED = InvalidRequest("Message ID is not defined")
+var ERR_MSG_PAYLOAD_NOT_DEFINED = InvalidRequest("Message payload is not defined")
+var ERR_MSG_PRIORITY_NOT_DEFINED = InvalidRequest("Message priority is not defined")
+var ERR_ID_OR_PREFIX_ONLY = InvalidRequest("Either ID or PREFIX can be used, not both")
+var ERR_TARGET_NOT_DEFINED = InvalidRequest("Target queue is not defined")
 var ERR_MSG_TIMEOUT_NOT_DEFINED = InvalidRequest("Message timeout is not defined")
 var ERR_ASYNC_WAIT = InvalidRequest("ASYNC param can be used only if WAIT timeout greater than 0")
 var ERR_ASYNC_PUSH = InvalidRequest("ASYNC must be used with SYNCWAIT")
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 
+	"github.com/vburenin/firempq/apis"
 	"github.com/vburenin/firempq/mpqerr"
 )
 
@@ -43,6 +44,22 @@ func ParseStringParam(params []string, minLen, maxLen int64) ([]string, string,
 	return nil, "", mpqerr.InvalidRequest(makeStrDesc(valName, minLen, maxLen))
 }
 
+// ParseKeyValueParam parses parameter followed by key and value strings.
+func ParseKeyValueParam(params []string, maxKeyLen, maxValLen int64) ([]string, string, string, *mpqerr.ErrorResponse) {
+	valName := params[0]
+	if len(params) < 3 {
+		return nil, "", "", mpqerr.InvalidRequest(valName + " must be followed by key and value")
+	}
+	keyLen, valLen := int64(len(params[1])), int64(len(params[2]))
+	if keyLen < 1 || keyLen > maxKeyLen {
+		return nil, "", "", mpqerr.InvalidRequest(makeStrDesc(valName+" key", 1, maxKeyLen))
+	}
+	if valLen < 1 || valLen > maxValLen {
+		return nil, "", "", mpqerr.InvalidRequest(makeStrDesc(valName+" value", 1, maxValLen))
+	}
+	return params[3:], params[1], params[2], nil
+}
+
 // ParseUserItemId parses user provided item id that can not start with '_'.
 func ParseUserItemId(params []string) ([]string, string, *mpqerr.ErrorResponse) {
 	if len(params) >= 2 {
@@ -67,14 +84,17 @@ func ParseItemId(params []string) ([]string, string, *mpqerr.ErrorResponse) {
 	return nil, "", mpqerr.ERR_ID_IS_WRONG
 }
 
+// ParseServiceType parses service type returning its canonical name.
 func ParseServiceType(params []string) ([]string, string, *mpqerr.ErrorResponse) {
 	valName := params[0]
 	if len(params) >= 2 {
-		svcType := params[1]
-		if svcType != "pqueue" && svcType != "pq" {
-			return nil, "", mpqerr.InvalidRequest("Unknown service type: " + svcType)
+		switch params[1] {
+		case "pqueue", "pq":
+			return params[2:], apis.ServiceTypePriorityQueue, nil
+		case "fifo":
+			return params[2:], apis.ServiceTypeFifoQueue, nil
 		}
-		return params[2:], svcType, nil
+		return nil, "", mpqerr.InvalidRequest("Unknown service type: " + params[1])
 	}
 	return nil, "", mpqerr.InvalidRequest(valName + " must be followed by service type")
 }
@@ -0,0 +1,47 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/enc"
+)
+
+// BatchResponse is a response containing results of the batch operation,
+// one result per item in the same order items were provided.
+type BatchResponse struct {
+	results []apis.IResponse
+}
+
+func NewBatchResponse(results []apis.IResponse) *BatchResponse {
+	return &BatchResponse{
+		results: results,
+	}
+}
+
+func (r *BatchResponse) GetResults() []apis.IResponse {
+	return r.results
+}
+
+func (r *BatchResponse) StringResponse() string {
+	var buf bytes.Buffer
+	wb := bufio.NewWriter(&buf)
+	r.WriteResponse(wb)
+	wb.Flush()
+	return buf.String()
+}
+
+func (r *BatchResponse) WriteResponse(buf *bufio.Writer) error {
+	_, err := buf.WriteString("+BATCH ")
+	err = enc.WriteArraySize(buf, len(r.results))
+	for _, res := range r.results {
+		err = buf.WriteByte(' ')
+		err = res.WriteResponse(buf)
+	}
+	return err
+}
+
+func (r *BatchResponse) IsError() bool {
+	return false
+}
@@ -39,5 +39,71 @@ func (r *AsyncResponse) WriteResponse(buf *bufio.Writer) error {
 	return err
 }
 
+// TaggedResponse is a response to the request sent with a tag.
+type TaggedResponse struct {
+	tag  string
+	resp apis.IResponse
+}
+
+func NewTaggedResponse(tag string, resp apis.IResponse) apis.IResponse {
+	return &TaggedResponse{
+		tag:  tag,
+		resp: resp,
+	}
+}
+
+func (r *TaggedResponse) StringResponse() string {
+	var buf bytes.Buffer
+	wb := bufio.NewWriter(&buf)
+	r.WriteResponse(wb)
+	wb.Flush()
+	return buf.String()
+}
+
+func (r *TaggedResponse) IsError() bool {
+	return r.resp.IsError()
+}
+
+func (r *TaggedResponse) WriteResponse(buf *bufio.Writer) error {
+	_, err := buf.WriteString("+TAG ")
+	_, err = buf.WriteString(r.tag)
+	err = buf.WriteByte(' ')
+	err = r.resp.WriteResponse(buf)
+	return err
+}
+
+// SubscriptionResponse is a message batch pushed to the subscribed consumer.
+type SubscriptionResponse struct {
+	queue string
+	resp  apis.IResponse
+}
+
+func NewSubscriptionResponse(queue string, resp apis.IResponse) apis.IResponse {
+	return &SubscriptionResponse{
+		queue: queue,
+		resp:  resp,
+	}
+}
+
+func (r *SubscriptionResponse) StringResponse() string {
+	var buf bytes.Buffer
+	wb := bufio.NewWriter(&buf)
+	r.WriteResponse(wb)
+	wb.Flush()
+	return buf.String()
+}
+
+func (r *SubscriptionResponse) IsError() bool {
+	return r.resp.IsError()
+}
+
+func (r *SubscriptionResponse) WriteResponse(buf *bufio.Writer) error {
+	_, err := buf.WriteString("+SUB ")
+	_, err = buf.WriteString(r.queue)
+	err = buf.WriteByte(' ')
+	err = r.resp.WriteResponse(buf)
+	return err
+}
+
 var PONG = NewStrResponse("PONG")
 var OK = NewStrResponse("OK")
@@ -20,9 +20,10 @@ func NewInMemDBService() *InMemDBService {
 	}
 }
 
-func (d *InMemDBService) WaitFlush()     {}
-func (d *InMemDBService) Close()         { d.closed = true }
-func (d *InMemDBService) IsClosed() bool { return d.closed }
+func (d *InMemDBService) WaitFlush()            {}
+func (d *InMemDBService) ForceFlush(bool) error { return nil }
+func (d *InMemDBService) Close()                { d.closed = true }
+func (d *InMemDBService) IsClosed() bool        { return d.closed }
 
 // CachedStoreItem stores data into the cache.
 func (d *InMemDBService) CachedStore(key string, data []byte) {
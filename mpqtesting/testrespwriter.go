@@ -19,7 +19,9 @@ func (rw *TestResponseWriter) WriteResponse(resp apis.IResponse) error {
 }
 
 func (rw *TestResponseWriter) GetResponses() []apis.IResponse {
-	return rw.responses
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	return rw.responses[:len(rw.responses):len(rw.responses)]
 }
 
 func NewTestResponseWriter() *TestResponseWriter {
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/vburenin/firempq/auth"
+)
+
+// PasswdMode is a command line mode to make a password hash for the users file.
+// Password is read from the first line of the standard input.
+const PasswdMode = "passwd"
+
+// passwd prints the password hash and returns process exit code.
+func passwd() int {
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "Password is expected on the standard input")
+		return 255
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cannot make password hash:", err)
+		return 1
+	}
+	fmt.Println(hash)
+	return 0
+}
@@ -0,0 +1,82 @@
+package pqueue
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+)
+
+type dedupEntry struct {
+	key      string
+	expireTs int64
+}
+
+type dedupEntries []dedupEntry
+
+func (p dedupEntries) Len() int           { return len(p) }
+func (p dedupEntries) Less(i, j int) bool { return p[i].expireTs < p[j].expireTs }
+func (p dedupEntries) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// DedupCache remembers recently pushed message keys for the deduplication window.
+type DedupCache struct {
+	keys  map[string]int64
+	order []dedupEntry
+}
+
+func NewDedupCache() *DedupCache {
+	return &DedupCache{
+		keys:  make(map[string]int64),
+		order: make([]dedupEntry, 0, 128),
+	}
+}
+
+// Seen returns true if key is remembered and has not expired yet.
+func (dc *DedupCache) Seen(key string, nowTs int64) bool {
+	expireTs, ok := dc.keys[key]
+	return ok && expireTs > nowTs
+}
+
+// Add remembers key until expireTs.
+func (dc *DedupCache) Add(key string, expireTs int64) {
+	dc.keys[key] = expireTs
+	dc.order = append(dc.order, dedupEntry{key: key, expireTs: expireTs})
+}
+
+// Remove forgets key.
+func (dc *DedupCache) Remove(key string) {
+	delete(dc.keys, key)
+}
+
+// Prune forgets keys expired before ts. Returns the list of forgotten keys.
+// Keys are checked in the order they were added, so keys with a longer
+// window may stay in memory a little longer if the window was reduced.
+func (dc *DedupCache) Prune(ts int64, limit int64) []string {
+	var pruned []string
+	i := 0
+	for ; i < len(dc.order) && int64(len(pruned)) < limit; i++ {
+		e := dc.order[i]
+		if e.expireTs >= ts {
+			break
+		}
+		// Key could be remembered again later with a new expiration time.
+		if dc.keys[e.key] == e.expireTs {
+			delete(dc.keys, e.key)
+			pruned = append(pruned, e.key)
+		}
+	}
+	if i > 0 {
+		dc.order = append(dc.order[:0], dc.order[i:]...)
+	}
+	return pruned
+}
+
+// Len returns the number of remembered keys.
+func (dc *DedupCache) Len() int {
+	return len(dc.keys)
+}
+
+// payloadDedupKey makes a deduplication key out of the message payload.
+// Hash keys start with '#' which is not allowed in message IDs.
+func payloadDedupKey(payload string) string {
+	h := sha1.Sum([]byte(payload))
+	return "#" + hex.EncodeToString(h[:])
+}
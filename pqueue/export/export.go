@@ -0,0 +1,313 @@
+package export
+
+// Queue export is a JSON Lines stream, one message per line:
+//
+//   {"Id":"m1","Payload":"data","Priority":0,"Ttl":345599000,"PopCount":0}
+//
+// Binary payloads are base64 encoded and marked with "Base64":true.
+// Messages pushed through SQS protocol have their body in "Payload" and
+// SQS specific data in the "Sqs" section, so they can be imported into
+// a queue served by either protocol.
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+
+	"github.com/vburenin/firempq/log"
+	"github.com/vburenin/firempq/mpqerr"
+	"github.com/vburenin/firempq/pqueue"
+	"github.com/vburenin/firempq/server/sqsproto/sqsmsg"
+	"github.com/vburenin/firempq/utils"
+)
+
+// maxLineSize limits the size of a single imported record.
+const maxLineSize = 64 * 1024 * 1024
+
+// Record is an exported message.
+type Record struct {
+	Id      string
+	Payload string
+	// Base64 is true if payload is base64 encoded binary data.
+	Base64   bool `json:",omitempty"`
+	Priority int64
+	// Ttl is a remaining message time to live in milliseconds.
+	Ttl int64
+	// Delay is a remaining delivery delay in milliseconds.
+	Delay       int64             `json:",omitempty"`
+	PopCount    int64             `json:",omitempty"`
+	PopLimit    int64             `json:",omitempty"`
+	LockTimeout int64             `json:",omitempty"`
+	GroupId     string            `json:",omitempty"`
+	Attrs       map[string]string `json:",omitempty"`
+	Sqs         *SQSData          `json:",omitempty"`
+}
+
+// SQSData holds SQS message data stored along with the message body.
+type SQSData struct {
+	SenderId               string
+	SentTimestamp          string
+	MD5OfMessageAttributes string                   `json:",omitempty"`
+	Attributes             map[string]*SQSAttribute `json:",omitempty"`
+}
+
+// SQSAttribute is a user defined SQS message attribute.
+type SQSAttribute struct {
+	Type  string
+	Value string
+}
+
+// Summary is a result of the queue import.
+type Summary struct {
+	Imported int64
+	Failed   int64
+}
+
+// Dict returns summary as a dictionary suitable for a response.
+func (s *Summary) Dict() map[string]interface{} {
+	return map[string]interface{}{
+		"Imported": s.Imported,
+		"Failed":   s.Failed,
+	}
+}
+
+// NewRecord makes an export record out of the message.
+// Returns nil if message has already expired.
+func NewRecord(msg *pqueue.PQMsgMetaData, payload []byte, nowTs int64) *Record {
+	if msg.ExpireTs <= nowTs {
+		return nil
+	}
+	r := &Record{
+		Id:          msg.StrId,
+		Priority:    msg.OriginalPriority(),
+		Ttl:         msg.ExpireTs - nowTs,
+		PopCount:    msg.PopCount,
+		PopLimit:    msg.PopLimit,
+		LockTimeout: msg.LockTimeout,
+		GroupId:     msg.GroupId,
+		Attrs:       msg.Attrs,
+	}
+	if msg.UnlockTs > nowTs && msg.PopCount == 0 {
+		r.Delay = msg.UnlockTs - nowTs
+		r.Ttl -= r.Delay
+	}
+
+	if sqsPayload := parseSQSPayload(payload); sqsPayload != nil {
+		payload = []byte(sqsPayload.Payload)
+		r.Sqs = &SQSData{
+			SenderId:               sqsPayload.SenderId,
+			SentTimestamp:          sqsPayload.SentTimestamp,
+			MD5OfMessageAttributes: sqsPayload.MD5OfMessageAttributes,
+		}
+		if len(sqsPayload.UserAttributes) > 0 {
+			r.Sqs.Attributes = make(map[string]*SQSAttribute, len(sqsPayload.UserAttributes))
+			for k, v := range sqsPayload.UserAttributes {
+				r.Sqs.Attributes[k] = &SQSAttribute{Type: v.Type, Value: v.Value}
+			}
+		}
+	}
+
+	if utf8.Valid(payload) {
+		r.Payload = string(payload)
+	} else {
+		r.Payload = base64.StdEncoding.EncodeToString(payload)
+		r.Base64 = true
+	}
+	return r
+}
+
+// parseSQSPayload returns SQS message if payload has been stored by SQS protocol.
+func parseSQSPayload(payload []byte) *sqsmsg.SQSMessagePayload {
+	m := &sqsmsg.SQSMessagePayload{}
+	if err := m.Unmarshal(payload); err != nil || m.MD5OfMessageBody == "" {
+		return nil
+	}
+	if m.MD5OfMessageBody != md5Hex(m.Payload) {
+		return nil
+	}
+	return m
+}
+
+func md5Hex(data string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(data)))
+}
+
+// MessagePayload returns the payload to be pushed into the queue.
+func (r *Record) MessagePayload() (string, error) {
+	payload := r.Payload
+	if r.Base64 {
+		data, err := base64.StdEncoding.DecodeString(r.Payload)
+		if err != nil {
+			return "", err
+		}
+		payload = string(data)
+	}
+	if r.Sqs == nil {
+		return payload, nil
+	}
+	m := &sqsmsg.SQSMessagePayload{
+		Payload:                payload,
+		MD5OfMessageBody:       md5Hex(payload),
+		MD5OfMessageAttributes: r.Sqs.MD5OfMessageAttributes,
+		SenderId:               r.Sqs.SenderId,
+		SentTimestamp:          r.Sqs.SentTimestamp,
+	}
+	if len(r.Sqs.Attributes) > 0 {
+		m.UserAttributes = make(map[string]*sqsmsg.UserAttribute, len(r.Sqs.Attributes))
+		for k, v := range r.Sqs.Attributes {
+			m.UserAttributes[k] = &sqsmsg.UserAttribute{Type: v.Type, Value: v.Value}
+		}
+	}
+	data, err := m.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// PushParams returns message push parameters.
+func (r *Record) PushParams() *pqueue.PushParams {
+	return &pqueue.PushParams{
+		MsgTtl:      r.Ttl,
+		Delay:       r.Delay,
+		Priority:    r.Priority,
+		GroupId:     r.GroupId,
+		Attrs:       r.Attrs,
+		PopLimit:    r.PopLimit,
+		LockTimeout: r.LockTimeout,
+		PopCount:    r.PopCount,
+		SkipDedup:   true,
+	}
+}
+
+// Write exports all queue messages into the file.
+// File is written into a temporary file first and renamed once completed.
+func Write(pq *pqueue.PQueue, path string) (int64, error) {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	count, err := WriteTo(pq, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return count, nil
+}
+
+// WriteTo exports all queue messages into the writer.
+// Returns the number of exported messages.
+func WriteTo(pq *pqueue.PQueue, w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	var count int64
+	nowTs := utils.Uts()
+	err := pq.ExportMessages(func(msg *pqueue.PQMsgMetaData, payload []byte) error {
+		r := NewRecord(msg, payload, nowTs)
+		if r == nil {
+			return nil
+		}
+		count++
+		return enc.Encode(r)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Read imports messages from the file into the queue.
+func Read(pq *pqueue.PQueue, path string) (*Summary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadFrom(pq, f)
+}
+
+// ReadFrom imports messages into the queue preserving their IDs.
+// Records that can not be parsed or pushed are logged and counted as failed.
+func ReadFrom(pq *pqueue.PQueue, r io.Reader) (*Summary, error) {
+	name := pq.Description().Name
+	summary := &Summary{}
+	br := bufio.NewReader(r)
+	for lineNum := 1; ; lineNum++ {
+		line, err := readLine(br)
+		if err == io.EOF {
+			if summary.Imported > 0 {
+				if err := pq.WaitDurable(false); err != nil {
+					return summary, err
+				}
+			}
+			return summary, nil
+		}
+		if err != nil {
+			return summary, err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if err := importRecord(pq, line); err != nil {
+			log.Warning("%s: import line %d failed: %s", name, lineNum, err)
+			summary.Failed++
+		} else {
+			summary.Imported++
+		}
+	}
+}
+
+func readLine(br *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		data, isPrefix, err := br.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, data...)
+		if len(line) > maxLineSize {
+			return nil, fmt.Errorf("record is longer than %d bytes", maxLineSize)
+		}
+		if !isPrefix {
+			return line, nil
+		}
+	}
+}
+
+func importRecord(pq *pqueue.PQueue, line []byte) error {
+	r := &Record{}
+	if err := json.Unmarshal(line, r); err != nil {
+		return err
+	}
+	if r.Id == "" {
+		return fmt.Errorf("message id is missing")
+	}
+	payload, err := r.MessagePayload()
+	if err != nil {
+		return err
+	}
+	params := r.PushParams()
+	if params.MsgTtl <= 0 {
+		params.MsgTtl = pq.Config().MsgTtl
+	}
+	if err, ok := pq.PushMsg(r.Id, payload, params).(*mpqerr.ErrorResponse); ok {
+		return err
+	}
+	return nil
+}
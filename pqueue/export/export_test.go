@@ -0,0 +1,117 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/db"
+	"github.com/vburenin/firempq/log"
+	. "github.com/vburenin/firempq/mpqtesting"
+	"github.com/vburenin/firempq/pqueue"
+	"github.com/vburenin/firempq/queue_info"
+	"github.com/vburenin/firempq/server/sqsproto/sqsmsg"
+)
+
+type noServices struct{}
+
+func (noServices) GetService(name string) (apis.ISvc, bool) { return nil, false }
+
+func createQueue(name string) *pqueue.PQueue {
+	cfg := pqueue.DefaultPQConfig()
+	cfg.DeliveryDelay = 0
+	log.InitLogging()
+	log.SetLevel(1)
+	desc := &queue_info.ServiceDescription{
+		SType:     apis.ServiceTypePriorityQueue,
+		Name:      name,
+		ServiceId: name,
+	}
+	return pqueue.InitPQueue(noServices{}, desc, cfg)
+}
+
+func sqsPayload(body string) string {
+	m := &sqsmsg.SQSMessagePayload{
+		Payload:          body,
+		MD5OfMessageBody: md5Hex(body),
+		SenderId:         "sender",
+		SentTimestamp:    "12345",
+		UserAttributes: map[string]*sqsmsg.UserAttribute{
+			"attr": {Type: "String", Value: "value"},
+		},
+	}
+	data, _ := m.Marshal()
+	return string(data)
+}
+
+func exportRecords(pq *pqueue.PQueue) (string, []*Record) {
+	buf := &bytes.Buffer{}
+	count, err := WriteTo(pq, buf)
+	So(err, ShouldBeNil)
+	var records []*Record
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		r := &Record{}
+		So(json.Unmarshal([]byte(line), r), ShouldBeNil)
+		records = append(records, r)
+	}
+	So(count, ShouldEqual, len(records))
+	return buf.String(), records
+}
+
+func TestExportImport(t *testing.T) {
+	Convey("Exported messages should be imported with the same IDs", t, func() {
+		db.SetDatabase(NewInMemDBService())
+		src := createQueue("src")
+		dst := createQueue("dst")
+		defer src.Close()
+		defer dst.Close()
+
+		VerifyOkResponse(src.PushMsg("m1", "locked", &pqueue.PushParams{MsgTtl: 10000, Priority: 7}))
+		VerifySingleItem(src.Pop(10000, 0, 1, true), "m1", "locked")
+		VerifyOkResponse(src.PushMsg("m2", "text", &pqueue.PushParams{MsgTtl: 10000, Priority: 5,
+			Attrs: map[string]string{"kind": "a"}, PopLimit: 3}))
+		VerifyOkResponse(src.PushMsg("m3", "\xff\x00bin", &pqueue.PushParams{MsgTtl: 10000}))
+		VerifyOkResponse(src.PushMsg("m4", sqsPayload("sqs body"), &pqueue.PushParams{MsgTtl: 10000}))
+		VerifyOkResponse(src.PushMsg("m5", "delayed", &pqueue.PushParams{MsgTtl: 10000, Delay: 5000}))
+
+		data, records := exportRecords(src)
+		So(len(records), ShouldEqual, 5)
+		So(records[0].Id, ShouldEqual, "m1")
+		So(records[0].PopCount, ShouldEqual, 1)
+		So(records[0].Priority, ShouldEqual, 7)
+		So(records[1].Payload, ShouldEqual, "text")
+		So(records[1].Priority, ShouldEqual, 5)
+		So(records[1].Attrs, ShouldResemble, map[string]string{"kind": "a"})
+		So(records[1].PopLimit, ShouldEqual, 3)
+		So(records[1].Ttl, ShouldBeBetweenOrEqual, 9000, 10000)
+		So(records[2].Base64, ShouldBeTrue)
+		So(records[3].Payload, ShouldEqual, "sqs body")
+		So(records[3].Sqs.SenderId, ShouldEqual, "sender")
+		So(records[3].Sqs.Attributes["attr"].Value, ShouldEqual, "value")
+		So(records[4].Delay, ShouldBeBetweenOrEqual, 4000, 5000)
+		So(records[4].Ttl, ShouldBeBetweenOrEqual, 9000, 10000)
+
+		summary, err := ReadFrom(dst, strings.NewReader(data))
+		So(err, ShouldBeNil)
+		So(*summary, ShouldResemble, Summary{Imported: 5})
+		VerifyServiceSize(dst, 5)
+
+		items, _ := VerifyItemsRespSize(dst.Pop(10000, 0, 10, true), 4)
+		So(items[0].ID(), ShouldEqual, "m3")
+		So(string(items[0].Payload()), ShouldEqual, "\xff\x00bin")
+		So(items[1].ID(), ShouldEqual, "m4")
+		So(string(items[1].Payload()), ShouldEqual, sqsPayload("sqs body"))
+		So(items[2].ID(), ShouldEqual, "m2")
+		So(items[3].ID(), ShouldEqual, "m1")
+		So(items[3].(*pqueue.MsgResponseItem).GetMeta().PopCount, ShouldEqual, 2)
+
+		Convey("Existing and broken records should fail", func() {
+			summary, err := ReadFrom(dst, strings.NewReader(data+"{broken\n\n{\"Payload\":\"no id\"}\n"))
+			So(err, ShouldBeNil)
+			So(*summary, ShouldResemble, Summary{Failed: 7})
+		})
+	})
+}
@@ -0,0 +1,343 @@
+package fsck
+
+// Consistency checker of the queue data. It relies on the storage key layout:
+//
+//   :desc:<service id>             Service description.
+//   :config:<service id>           Service config.
+//   <service id>\x01<sn>           Message metadata.
+//   <service id>\x02<sn>           Message payload.
+//   <service id>\x03<key>          Deduplication key.
+//
+// Separators sort before any service id character, so all data keys of a service
+// are iterated together and message metadata is iterated before payloads.
+
+import (
+	"strings"
+
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/conf"
+	"github.com/vburenin/firempq/db"
+	"github.com/vburenin/firempq/db/backup"
+	"github.com/vburenin/firempq/enc"
+	"github.com/vburenin/firempq/log"
+	"github.com/vburenin/firempq/pqueue"
+	"github.com/vburenin/firempq/queue_info"
+)
+
+// deleteBatch is a number of keys deleted at once during repair.
+const deleteBatch = 10000
+
+// Report is a number of checked records and found problems of each kind.
+type Report struct {
+	Services         int64
+	Messages         int64
+	Payloads         int64
+	CorruptMeta      int64
+	OrphanedPayloads int64
+	OrphanedKeys     int64
+	ServiceProblems  int64
+	Repaired         int64
+}
+
+// Problems is a total number of found problems.
+func (r *Report) Problems() int64 {
+	return r.CorruptMeta + r.OrphanedPayloads + r.OrphanedKeys + r.ServiceProblems
+}
+
+// Dict returns report as a dictionary suitable for a response.
+func (r *Report) Dict() map[string]interface{} {
+	return map[string]interface{}{
+		"Services":         r.Services,
+		"Messages":         r.Messages,
+		"Payloads":         r.Payloads,
+		"CorruptMeta":      r.CorruptMeta,
+		"OrphanedPayloads": r.OrphanedPayloads,
+		"OrphanedKeys":     r.OrphanedKeys,
+		"ServiceProblems":  r.ServiceProblems,
+		"Problems":         r.Problems(),
+		"Repaired":         r.Repaired,
+	}
+}
+
+type checker struct {
+	ds     apis.DataStorage
+	repair bool
+	report *Report
+	// Services which data is valid.
+	services map[string]*queue_info.ServiceDescription
+	// Services which data is left after they have been deleted.
+	deleted map[string]bool
+	// Keys deleted once the batch is full.
+	delKeys []string
+}
+
+// Check verifies all queue data in the storage. Found problems are logged and fixed
+// if repair is true: broken data is deleted, missing or broken configs are replaced
+// with the default config. Storage must not be used by the server.
+func Check(ds apis.DataStorage, repair bool) (*Report, error) {
+	c := &checker{
+		ds:       ds,
+		repair:   repair,
+		report:   &Report{},
+		services: make(map[string]*queue_info.ServiceDescription),
+		deleted:  make(map[string]bool),
+	}
+	ds.FlushCache()
+	if err := c.checkServices(); err != nil {
+		return nil, err
+	}
+	if err := c.checkData(); err != nil {
+		return nil, err
+	}
+	if err := c.deleteKeys(); err != nil {
+		return nil, err
+	}
+	return c.report, nil
+}
+
+func descKey(svcId string) string { return queue_info.ServiceDescPrefix + svcId }
+func cfgKey(svcId string) string  { return queue_info.ServiceConfigPrefix + svcId }
+
+func (c *checker) deleteKey(key string) error {
+	if !c.repair {
+		return nil
+	}
+	c.delKeys = append(c.delKeys, key)
+	if len(c.delKeys) < deleteBatch {
+		return nil
+	}
+	return c.deleteKeys()
+}
+
+func (c *checker) storeData(key string, data []byte) error {
+	if !c.repair {
+		return nil
+	}
+	c.report.Repaired++
+	return c.ds.StoreData(key, data)
+}
+
+func (c *checker) serviceProblem(format string, args ...interface{}) {
+	c.report.ServiceProblems++
+	log.Warning(format, args...)
+}
+
+// checkServices verifies service descriptions and configs.
+func (c *checker) checkServices() error {
+	names := make(map[string]*queue_info.ServiceDescription)
+	iter := c.ds.IterData(queue_info.ServiceDescPrefix)
+	for ; iter.Valid(); iter.Next() {
+		svcId := string(iter.GetTrimKey())
+		desc, err := queue_info.UnmarshalServiceDesc(iter.GetValue())
+		if err != nil {
+			c.serviceProblem("Service %s: corrupt description", svcId)
+			if err := c.deleteKey(descKey(svcId)); err != nil {
+				iter.Close()
+				return err
+			}
+			continue
+		}
+		if desc.ServiceId != svcId {
+			c.serviceProblem("Service %s: description has a wrong service id %s", svcId, desc.ServiceId)
+			desc.ServiceId = svcId
+			data, _ := desc.Marshal()
+			if err := c.storeData(descKey(svcId), data); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		if desc.ToDelete {
+			c.serviceProblem("Service %s (%s): service has been deleted, but its data is left", svcId, desc.Name)
+			if err := c.dropService(svcId); err != nil {
+				iter.Close()
+				return err
+			}
+			continue
+		}
+		// Service loaded last hides the one with the same name.
+		if prev, ok := names[desc.Name]; ok {
+			old := prev
+			if desc.ExportId < prev.ExportId {
+				old = desc
+			} else {
+				names[desc.Name] = desc
+				c.services[svcId] = desc
+			}
+			c.serviceProblem("Service %s (%s): service name is used by another service", old.ServiceId, old.Name)
+			delete(c.services, old.ServiceId)
+			if err := c.dropService(old.ServiceId); err != nil {
+				iter.Close()
+				return err
+			}
+			continue
+		}
+		names[desc.Name] = desc
+		c.services[svcId] = desc
+	}
+	iter.Close()
+	c.report.Services = int64(len(c.services))
+
+	configs := make(map[string]bool)
+	iter = c.ds.IterData(queue_info.ServiceConfigPrefix)
+	for ; iter.Valid(); iter.Next() {
+		svcId := string(iter.GetTrimKey())
+		configs[svcId] = true
+		if _, ok := c.services[svcId]; !ok {
+			if c.deleted[svcId] {
+				continue
+			}
+			c.serviceProblem("Service %s: config without service description", svcId)
+			if err := c.deleteKey(cfgKey(svcId)); err != nil {
+				iter.Close()
+				return err
+			}
+			continue
+		}
+		cfg := &conf.PQConfig{}
+		if err := cfg.Unmarshal(iter.GetValue()); err != nil {
+			configs[svcId] = false
+		}
+	}
+	iter.Close()
+
+	for svcId, desc := range c.services {
+		valid, ok := configs[svcId]
+		if valid {
+			continue
+		}
+		if ok {
+			c.serviceProblem("Service %s (%s): corrupt config", svcId, desc.Name)
+		} else {
+			c.serviceProblem("Service %s (%s): service has no config", svcId, desc.Name)
+		}
+		data, _ := pqueue.DefaultPQConfig().Marshal()
+		if err := c.storeData(cfgKey(svcId), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropService deletes description and config of the service, its data is deleted as orphaned.
+func (c *checker) dropService(svcId string) error {
+	c.deleted[svcId] = true
+	if err := c.deleteKey(descKey(svcId)); err != nil {
+		return err
+	}
+	return c.deleteKey(cfgKey(svcId))
+}
+
+// checkData verifies messages, payloads and deduplication keys of all services.
+func (c *checker) checkData() error {
+	for svcId := range c.services {
+		if err := c.checkMessages(svcId); err != nil {
+			return err
+		}
+	}
+	return c.checkOrphanedData()
+}
+
+// checkMessages walks message metadata and payloads of the service in step,
+// both of them are ordered by the message serial number.
+func (c *checker) checkMessages(svcId string) error {
+	metaIter := c.ds.IterData(db.MakeItemPrefix(svcId))
+	defer metaIter.Close()
+	payloadIter := c.ds.IterData(db.MakePayloadPrefix(svcId))
+	defer payloadIter.Close()
+
+	for ; payloadIter.Valid(); payloadIter.Next() {
+		itemId := string(payloadIter.GetTrimKey())
+		for metaIter.Valid() && string(metaIter.GetTrimKey()) < itemId {
+			if _, err := c.checkMeta(svcId, metaIter); err != nil {
+				return err
+			}
+			metaIter.Next()
+		}
+		valid := false
+		if metaIter.Valid() && string(metaIter.GetTrimKey()) == itemId {
+			var err error
+			if valid, err = c.checkMeta(svcId, metaIter); err != nil {
+				return err
+			}
+			metaIter.Next()
+		}
+		if !valid {
+			log.Warning("Service %s: payload without message %x", svcId, itemId)
+			c.report.OrphanedPayloads++
+			if err := c.deleteKey(db.MakePayloadPrefix(svcId) + itemId); err != nil {
+				return err
+			}
+			continue
+		}
+		c.report.Payloads++
+	}
+	for ; metaIter.Valid(); metaIter.Next() {
+		if _, err := c.checkMeta(svcId, metaIter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkMeta verifies message metadata the iterator points to. Returns true if it is valid.
+func (c *checker) checkMeta(svcId string, iter apis.ItemIterator) (bool, error) {
+	itemId := string(iter.GetTrimKey())
+	if validMeta(itemId, iter.GetValue()) {
+		c.report.Messages++
+		return true, nil
+	}
+	log.Warning("Service %s: corrupt message metadata %x", svcId, itemId)
+	c.report.CorruptMeta++
+	return false, c.deleteKey(db.MakeItemPrefix(svcId) + itemId)
+}
+
+// checkOrphanedData finds data of services which don't exist or have been deleted.
+func (c *checker) checkOrphanedData() error {
+	iter := c.ds.IterData("")
+	defer iter.Close()
+
+	var orphanedSvc string
+	for ; iter.Valid(); iter.Next() {
+		recType := backup.RecordType(iter.GetKey())
+		if recType != backup.RecItemMeta && recType != backup.RecPayload && recType != backup.RecDedupKey {
+			continue
+		}
+		key := string(iter.GetKey())
+		svcId := key[:strings.IndexAny(key, db.ItemSeparator+db.PayloadSeparator+db.DedupSeparator)]
+		if _, ok := c.services[svcId]; ok {
+			continue
+		}
+		if svcId != orphanedSvc {
+			log.Warning("Service %s: data of not existing or deleted service", svcId)
+			orphanedSvc = svcId
+		}
+		c.report.OrphanedKeys++
+		if err := c.deleteKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validMeta(itemId string, data []byte) bool {
+	if len(itemId) != 8 {
+		return false
+	}
+	msg := &pqueue.PQMsgMetaData{SerialNumber: enc.DecodeBytesToUnit64([]byte(itemId))}
+	return msg.Unmarshal(data) == nil && msg.StrId != ""
+}
+
+func (c *checker) deleteKeys() error {
+	for len(c.delKeys) > 0 {
+		n := deleteBatch
+		if n > len(c.delKeys) {
+			n = len(c.delKeys)
+		}
+		if err := c.ds.DeleteData(c.delKeys[:n]...); err != nil {
+			return err
+		}
+		c.report.Repaired += int64(n)
+		c.delKeys = c.delKeys[n:]
+	}
+	return nil
+}
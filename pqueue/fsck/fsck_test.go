@@ -0,0 +1,131 @@
+package fsck
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/db"
+	"github.com/vburenin/firempq/enc"
+	"github.com/vburenin/firempq/log"
+	. "github.com/vburenin/firempq/mpqtesting"
+	"github.com/vburenin/firempq/pqueue"
+	"github.com/vburenin/firempq/queue_info"
+)
+
+type noServices struct{}
+
+func (noServices) GetService(name string) (apis.ISvc, bool) { return nil, false }
+
+// deleteCountingDB counts batches of deleted keys.
+type deleteCountingDB struct {
+	*InMemDBService
+	batches []int
+}
+
+func (d *deleteCountingDB) DeleteData(keys ...string) error {
+	d.batches = append(d.batches, len(keys))
+	return d.InMemDBService.DeleteData(keys...)
+}
+
+func createQueue(name string, exportId uint64) *pqueue.PQueue {
+	desc := queue_info.NewServiceDescription(name, apis.ServiceTypePriorityQueue, exportId)
+	queue_info.SaveServiceDescription(desc)
+	return pqueue.InitPQueue(noServices{}, desc, pqueue.DefaultPQConfig())
+}
+
+func TestCheck(t *testing.T) {
+	Convey("Checker should find and repair broken data", t, func() {
+		pqueue.DefaultPQConfig()
+		log.InitLogging()
+		log.SetLevel(1)
+		ds := NewInMemDBService()
+		db.SetDatabase(ds)
+
+		q := createQueue("q1", 1)
+		q.Push("m1", "p1", 100000, 0, 0)
+		q.Push("m2", "p2", 100000, 0, 0)
+		q.Close()
+
+		report, err := Check(ds, false)
+		So(err, ShouldBeNil)
+		So(report.Problems(), ShouldEqual, 0)
+		So(report.Services, ShouldEqual, 1)
+		So(report.Messages, ShouldEqual, 2)
+		So(report.Payloads, ShouldEqual, 2)
+
+		// Payload without message and broken message metadata.
+		ds.StoreData("1"+db.PayloadSeparator+enc.Sn2Bin(100), []byte("orphan"))
+		ds.StoreData("1"+db.ItemSeparator+enc.Sn2Bin(101), []byte("\xff\xff\xff"))
+		ds.StoreData("1"+db.ItemSeparator+"short", []byte{})
+		// Data of a service without description.
+		ds.StoreData("zz"+db.ItemSeparator+enc.Sn2Bin(1), []byte("meta"))
+		ds.StoreData("zz"+db.PayloadSeparator+enc.Sn2Bin(1), []byte("payload"))
+		// Deleted service with data left.
+		deleted := createQueue("q2", 2)
+		deleted.Push("m1", "p1", 100000, 0, 0)
+		deleted.Close()
+		desc := queue_info.GetServiceDescription("2")
+		desc.ToDelete = true
+		queue_info.SaveServiceDescription(desc)
+		// Config without description and service without config.
+		ds.StoreData(queue_info.ServiceConfigPrefix+"yy", []byte("cfg"))
+		createQueue("q3", 3).Close()
+		ds.DeleteData(queue_info.ServiceConfigPrefix + "3")
+
+		report, err = Check(ds, false)
+		So(err, ShouldBeNil)
+		So(report.Services, ShouldEqual, 2)
+		So(report.OrphanedPayloads, ShouldEqual, 1)
+		So(report.CorruptMeta, ShouldEqual, 2)
+		So(report.OrphanedKeys, ShouldEqual, 4)
+		So(report.ServiceProblems, ShouldEqual, 3)
+		So(report.Repaired, ShouldEqual, 0)
+
+		report, err = Check(ds, true)
+		So(err, ShouldBeNil)
+		So(report.Problems(), ShouldEqual, 10)
+		So(report.Repaired, ShouldEqual, 11)
+
+		report, err = Check(ds, false)
+		So(err, ShouldBeNil)
+		So(report.Problems(), ShouldEqual, 0)
+		So(report.Services, ShouldEqual, 2)
+		So(report.Messages, ShouldEqual, 2)
+		So(ds.GetData(queue_info.ServiceConfigPrefix+"3"), ShouldNotBeNil)
+		So(queue_info.GetServiceDescription("2"), ShouldBeNil)
+
+		q = pqueue.InitPQueue(noServices{}, queue_info.GetServiceDescription("1"), pqueue.DefaultPQConfig())
+		So(q.TotalMessages(), ShouldEqual, 2)
+		q.Close()
+	})
+}
+
+func TestCheckDeletesInBatches(t *testing.T) {
+	Convey("Broken data should be deleted while it is checked", t, func() {
+		pqueue.DefaultPQConfig()
+		log.InitLogging()
+		log.SetLevel(1)
+		ds := &deleteCountingDB{InMemDBService: NewInMemDBService()}
+		db.SetDatabase(ds)
+
+		q := createQueue("q1", 1)
+		q.Push("m1", "p1", 100000, 0, 0)
+		q.Close()
+		for i := 0; i < deleteBatch*2+10; i++ {
+			ds.CachedStore("1"+db.PayloadSeparator+enc.Sn2Bin(uint64(1000+i)), []byte("orphan"))
+		}
+
+		report, err := Check(ds, true)
+		So(err, ShouldBeNil)
+		So(report.Messages, ShouldEqual, 1)
+		So(report.Payloads, ShouldEqual, 1)
+		So(report.OrphanedPayloads, ShouldEqual, deleteBatch*2+10)
+		So(ds.batches, ShouldResemble, []int{deleteBatch, deleteBatch, 10})
+
+		report, err = Check(ds, false)
+		So(err, ShouldBeNil)
+		So(report.Problems(), ShouldEqual, 0)
+		So(report.Payloads, ShouldEqual, 1)
+	})
+}
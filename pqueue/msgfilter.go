@@ -0,0 +1,46 @@
+package pqueue
+
+import (
+	"math"
+	"strings"
+)
+
+// MsgFilter selects messages a consumer is able to process.
+type MsgFilter struct {
+	MinPriority int64
+	MaxPriority int64
+	IdPrefix    string
+	// Attrs must all be present in the message with the same values.
+	Attrs map[string]string
+}
+
+func NewMsgFilter() *MsgFilter {
+	return &MsgFilter{
+		MinPriority: math.MinInt64,
+		MaxPriority: math.MaxInt64,
+	}
+}
+
+// Empty returns true if filter matches any message.
+func (f *MsgFilter) Empty() bool {
+	return f.MinPriority == math.MinInt64 && f.MaxPriority == math.MaxInt64 &&
+		f.IdPrefix == "" && len(f.Attrs) == 0
+}
+
+// Match returns true if message satisfies all filter conditions.
+// Returned messages are matched by the priority they have been pushed with.
+func (f *MsgFilter) Match(msg *PQMsgMetaData) bool {
+	priority := msg.OriginalPriority()
+	if priority < f.MinPriority || priority > f.MaxPriority {
+		return false
+	}
+	if !strings.HasPrefix(msg.StrId, f.IdPrefix) {
+		return false
+	}
+	for k, v := range f.Attrs {
+		if mv, ok := msg.Attrs[k]; !ok || mv != v {
+			return false
+		}
+	}
+	return true
+}
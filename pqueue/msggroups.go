@@ -0,0 +1,82 @@
+package pqueue
+
+// MsgGroups keeps messages of FIFO queue ordered by their serial numbers within
+// each message group. Only the head message of a group can be delivered, so
+// the group stays blocked while its head is locked or delayed.
+type MsgGroups struct {
+	groups map[string]*MsgHeap
+}
+
+func NewMsgGroups() *MsgGroups {
+	return &MsgGroups{
+		groups: make(map[string]*MsgHeap),
+	}
+}
+
+func newGroupHeap() *MsgHeap {
+	h := NewMsgHeap()
+	h.geq = func(l *PQMsgMetaData, r *PQMsgMetaData) bool {
+		return l.SerialNumber >= r.SerialNumber
+	}
+	return h
+}
+
+// Add appends message to its group and returns true if message is the group head.
+func (mg *MsgGroups) Add(msg *PQMsgMetaData) bool {
+	h, ok := mg.groups[msg.GroupId]
+	if !ok {
+		h = newGroupHeap()
+		mg.groups[msg.GroupId] = h
+	}
+	h.Push(msg)
+	return h.MinMsg().SerialNumber == msg.SerialNumber
+}
+
+// IsHead returns true if message is the first one in its group.
+func (mg *MsgGroups) IsHead(msg *PQMsgMetaData) bool {
+	h, ok := mg.groups[msg.GroupId]
+	return ok && h.MinMsg().SerialNumber == msg.SerialNumber
+}
+
+// Head returns the first message of the group or nil if group is empty.
+func (mg *MsgGroups) Head(groupId string) *PQMsgMetaData {
+	if h, ok := mg.groups[groupId]; ok {
+		return h.MinMsg()
+	}
+	return nil
+}
+
+// Remove removes message from its group. If the removed message was the group
+// head, the next message of the group is returned.
+func (mg *MsgGroups) Remove(msg *PQMsgMetaData) *PQMsgMetaData {
+	h, ok := mg.groups[msg.GroupId]
+	if !ok {
+		return nil
+	}
+	wasHead := h.MinMsg().SerialNumber == msg.SerialNumber
+	if h.Remove(msg.SerialNumber) == nil {
+		return nil
+	}
+	if h.Empty() {
+		delete(mg.groups, msg.GroupId)
+		return nil
+	}
+	if wasHead {
+		return h.MinMsg()
+	}
+	return nil
+}
+
+// Heads returns the first message of every group.
+func (mg *MsgGroups) Heads() []*PQMsgMetaData {
+	heads := make([]*PQMsgMetaData, 0, len(mg.groups))
+	for _, h := range mg.groups {
+		heads = append(heads, h.MinMsg())
+	}
+	return heads
+}
+
+// Len returns a number of active message groups.
+func (mg *MsgGroups) Len() int {
+	return len(mg.groups)
+}
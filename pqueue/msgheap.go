@@ -1,5 +1,7 @@
 package pqueue
 
+import "container/heap"
+
 func NewSnHeap() *MsgHeap {
 	h := NewMsgHeap()
 	h.geq = func(l *PQMsgMetaData, r *PQMsgMetaData) bool {
@@ -117,6 +119,68 @@ func (s *MsgHeap) ContainsSn(sn uint64) bool {
 	return ok
 }
 
+// PopMatching removes and returns the first message in the delivery order that satisfies match.
+// Messages that don't match keep their positions. Returns nil if there are no matching messages.
+func (s *MsgHeap) PopMatching(match func(*PQMsgMetaData) bool) *PQMsgMetaData {
+	if len(s.data) > 0 && match(s.data[0]) {
+		return s.Pop()
+	}
+	var found *PQMsgMetaData
+	s.Walk(func(msg *PQMsgMetaData) bool {
+		if match(msg) {
+			found = msg
+			return false
+		}
+		return true
+	})
+	if found == nil {
+		return nil
+	}
+	return s.Remove(found.SerialNumber)
+}
+
+// Walk calls fn for messages in the delivery order until fn returns false.
+// Heap is not modified, only the visited messages and their children are checked,
+// so visiting of the first k messages takes O(k*log(k)).
+func (s *MsgHeap) Walk(fn func(*PQMsgMetaData) bool) {
+	// Heap nodes are visited in order using a heap of positions to check next.
+	w := &heapWalker{heap: s, pos: make([]int, 0, 16)}
+	w.add(0)
+	for w.Len() > 0 {
+		i := heap.Pop(w).(int)
+		if !fn(s.data[i]) {
+			return
+		}
+		w.add(2*i + 1)
+		w.add(2*i + 2)
+	}
+}
+
+// heapWalker is a heap of positions in MsgHeap ordered by message at the position.
+type heapWalker struct {
+	heap *MsgHeap
+	pos  []int
+}
+
+func (w *heapWalker) add(i int) {
+	if i < len(w.heap.data) {
+		heap.Push(w, i)
+	}
+}
+
+func (w *heapWalker) Len() int { return len(w.pos) }
+func (w *heapWalker) Less(i, j int) bool {
+	return !w.heap.geq(w.heap.data[w.pos[i]], w.heap.data[w.pos[j]])
+}
+func (w *heapWalker) Swap(i, j int)      { w.pos[i], w.pos[j] = w.pos[j], w.pos[i] }
+func (w *heapWalker) Push(x interface{}) { w.pos = append(w.pos, x.(int)) }
+func (w *heapWalker) Pop() interface{} {
+	n := len(w.pos) - 1
+	v := w.pos[n]
+	w.pos = w.pos[:n]
+	return v
+}
+
 // Swap and reindex data in heap.
 func (s *MsgHeap) swap(i, j int) {
 	d := s.data
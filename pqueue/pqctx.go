@@ -3,10 +3,12 @@ package pqueue
 import (
 	"math"
 	"sync"
+	"sync/atomic"
 
 	"github.com/jessevdk/go-flags"
 	"github.com/vburenin/firempq/apis"
 	"github.com/vburenin/firempq/conf"
+	"github.com/vburenin/firempq/db"
 	"github.com/vburenin/firempq/idgen"
 	"github.com/vburenin/firempq/log"
 	"github.com/vburenin/firempq/mpqerr"
@@ -24,20 +26,34 @@ type PQContext struct {
 	asyncLock      sync.Mutex
 	asyncCount     int64
 	finishFlag     bool
+	subLock        sync.Mutex
+	sub            *subscription
+	subLocks       sessionLocks
+	popLocks       sessionLocks
+	// Checks session permissions, nil if session has no access control.
+	access apis.AccessChecker
 }
 
 func NewPQContext(pq *PQueue, r apis.ResponseWriter) *PQContext {
+	access, _ := r.(apis.AccessChecker)
 	return &PQContext{
 		pq:             pq,
 		callsCount:     0,
 		responseWriter: r,
 		asyncCount:     512,
 		idGen:          idgen.NewGen(),
+		access:         access,
 	}
 }
 
 const PAYLOAD_LIMIT = 512 * 1024
 
+const (
+	ATTR_KEY_LIMIT   = 128
+	ATTR_VALUE_LIMIT = 256
+	ATTR_NUM_LIMIT   = 16
+)
+
 const (
 	PQ_CMD_DELETE_LOCKED_BY_ID = "DELLCK"
 	PQ_CMD_DELETE_BY_ID        = "DEL"
@@ -54,6 +70,14 @@ const (
 	PQ_CMD_CHECK_TIMEOUTS      = "CHKTS"
 	PQ_CMD_SET_CFG             = "SETCFG"
 	PQ_CMD_PURGE               = "PURGE"
+	PQ_CMD_UPD_PAYLOAD_BY_ID   = "UPDPL"
+	PQ_CMD_UPD_PAYLOAD_BY_RCPT = "RUPDPL"
+	PQ_CMD_SET_PRIORITY        = "SETPRIO"
+	PQ_CMD_PEEK                = "PEEK"
+	PQ_CMD_PEEK_LOCKED         = "PEEKLOCKED"
+	PQ_CMD_REDRIVE             = "REDRIVE"
+	PQ_CMD_SUBSCRIBE           = "SUBSCRIBE"
+	PQ_CMD_UNSUBSCRIBE         = "UNSUBSCRIBE"
 )
 
 const (
@@ -69,6 +93,16 @@ const (
 	PRM_ASYNC        = "ASYNC"
 	PRM_SYNC_WAIT    = "SYNCWAIT"
 	PRM_MSG_TTL      = "TTL"
+	PRM_GROUP        = "GROUP"
+	PRM_PREFIX       = "PREFIX"
+	PRM_OFFSET       = "OFFSET"
+	PRM_ATTR         = "ATTR"
+	PRM_MIN_PRIORITY = "MINPRIO"
+	PRM_MAX_PRIORITY = "MAXPRIO"
+	PRM_POP_LIMIT    = "POPLIMIT"
+	PRM_TARGET       = "TARGET"
+	PRM_PREFETCH     = "PREFETCH"
+	PRM_SESSION      = "SESSION"
 )
 
 const (
@@ -80,14 +114,22 @@ const (
 	CPRM_LOCK_TIMEOUT      = "TIMEOUT"
 	CPRM_FAIL_QUEUE        = "FAILQ"
 	CPRM_POP_WAIT          = "WAIT"
+	CPRM_DEDUP_WINDOW      = "DEDUPWIN"
+	CPRM_DEDUP_BY_PAYLOAD  = "DEDUPPL"
+	CPRM_COMPRESS          = "COMPRESS"
+	CPRM_COMPRESS_MIN      = "COMPRESSMIN"
+	CPRM_DURABILITY        = "DURABILITY"
 )
 
+// DefaultPQConfig returns a queue config with the server defaults.
+// Server config is initialized with the default values if it is not parsed yet.
 func DefaultPQConfig() *conf.PQConfig {
-	cfg := &conf.Config{}
-	flags.ParseArgs(cfg, []string{"firempq"})
-
-	conf.CFG = cfg
-	conf.CFG_PQ = &cfg.PQueueConfig
+	if conf.CFG == nil {
+		cfg := &conf.Config{}
+		flags.ParseArgs(cfg, []string{"firempq"})
+		conf.CFG = cfg
+		conf.CFG_PQ = &cfg.PQueueConfig
+	}
 
 	return &conf.PQConfig{
 		MaxMsgsInQueue:    conf.CFG_PQ.DefaultMaxQueueSize,
@@ -103,6 +145,36 @@ func DefaultPQConfig() *conf.PQConfig {
 	}
 }
 
+// parseCompressionParam parses payload codec name. "none" disables compression.
+func parseCompressionParam(params []string) ([]string, string, *mpqerr.ErrorResponse) {
+	params, name, err := mpqproto.ParseStringParam(params, 1, 32)
+	if err != nil {
+		return nil, "", err
+	}
+	if name == "none" {
+		name = db.CompressionNone
+	}
+	if _, ok := db.CodecByName(name); !ok {
+		return nil, "", mpqerr.ERR_UNKNOWN_COMPRESSION
+	}
+	return params, name, nil
+}
+
+// parseDurabilityParam parses durability level. "buffered" is the default level.
+func parseDurabilityParam(params []string) ([]string, string, *mpqerr.ErrorResponse) {
+	params, level, err := mpqproto.ParseStringParam(params, 1, 32)
+	if err != nil {
+		return nil, "", err
+	}
+	switch level {
+	case "buffered":
+		return params, DurabilityBuffered, nil
+	case DurabilityFlush, DurabilityFsync:
+		return params, level, nil
+	}
+	return nil, "", mpqerr.ERR_UNKNOWN_DURABILITY
+}
+
 func ParsePQConfig(params []string) (*conf.PQConfig, apis.IResponse) {
 	var err *mpqerr.ErrorResponse
 
@@ -125,6 +197,18 @@ func ParsePQConfig(params []string) (*conf.PQConfig, apis.IResponse) {
 			params, cfg.PopLimitQueueName, err = mpqproto.ParseItemId(params)
 		case CPRM_POP_WAIT:
 			params, cfg.PopWaitTimeout, err = mpqproto.ParseInt64Param(params, 0, conf.CFG_PQ.MaxPopWaitTimeout)
+		case CPRM_DEDUP_WINDOW:
+			params, cfg.DedupWindow, err = mpqproto.ParseInt64Param(params, 0, conf.CFG_PQ.MaxMessageTTL)
+		case CPRM_DEDUP_BY_PAYLOAD:
+			var v int64
+			params, v, err = mpqproto.ParseInt64Param(params, 0, 1)
+			cfg.DedupByPayload = v == 1
+		case CPRM_COMPRESS:
+			params, cfg.Compression, err = parseCompressionParam(params)
+		case CPRM_COMPRESS_MIN:
+			params, cfg.CompressMinSize, err = mpqproto.ParseInt64Param(params, 0, conf.CFG_PQ.MaxMessageSize)
+		case CPRM_DURABILITY:
+			params, cfg.Durability, err = parseDurabilityParam(params)
 		default:
 			return nil, mpqerr.UnknownParam(params[0])
 		}
@@ -140,7 +224,13 @@ func (ctx *PQContext) Call(cmd string, params []string) apis.IResponse {
 	if ctx.finishFlag {
 		return mpqerr.ERR_CONN_CLOSING
 	}
-	ctx.callsCount += 1
+	atomic.AddInt64(&ctx.callsCount, 1)
+	if ctx.pq.IsReadOnly() && !isReadOnlyCmd(cmd) {
+		return mpqerr.ERR_READ_ONLY
+	}
+	if !ctx.canAccess(ctx.pq.desc.Name, cmdPermission(cmd)) {
+		return mpqerr.ERR_PERMISSION_DENIED
+	}
 	switch cmd {
 	case PQ_CMD_POPLOCK:
 		return ctx.PopLock(params)
@@ -149,10 +239,13 @@ func (ctx *PQContext) Call(cmd string, params []string) apis.IResponse {
 	case PQ_CMD_MSG_INFO:
 		return ctx.GetMessageInfo(params)
 	case PQ_CMD_DELETE_BY_RCPT:
+		defer ctx.wakeSubscription()
 		return ctx.DeleteByReceipt(params)
 	case PQ_CMD_UNLOCK_BY_RCPT:
+		defer ctx.wakeSubscription()
 		return ctx.UnlockByReceipt(params)
 	case PQ_CMD_DELETE_LOCKED_BY_ID:
+		defer ctx.wakeSubscription()
 		return ctx.DeleteLockedById(params)
 	case PQ_CMD_DELETE_BY_ID:
 		return ctx.DeleteById(params)
@@ -161,8 +254,10 @@ func (ctx *PQContext) Call(cmd string, params []string) apis.IResponse {
 	case PQ_CMD_UPD_LOCK_BY_ID:
 		return ctx.UpdateLockById(params)
 	case PQ_CMD_UPD_LOCK_BY_RCPT:
+		defer ctx.wakeSubscription()
 		return ctx.UpdateLockByRcpt(params)
 	case PQ_CMD_UNLOCK_BY_ID:
+		defer ctx.wakeSubscription()
 		return ctx.UnlockMessageById(params)
 	case PQ_CMD_STATUS:
 		return ctx.GetCurrentStatus(params)
@@ -173,10 +268,57 @@ func (ctx *PQContext) Call(cmd string, params []string) apis.IResponse {
 	case PQ_CMD_PURGE:
 		ctx.pq.Clear()
 		return resp.OK
+	case PQ_CMD_UPD_PAYLOAD_BY_ID:
+		return ctx.UpdatePayloadById(params)
+	case PQ_CMD_UPD_PAYLOAD_BY_RCPT:
+		return ctx.UpdatePayloadByRcpt(params)
+	case PQ_CMD_SET_PRIORITY:
+		return ctx.SetPriority(params)
+	case PQ_CMD_PEEK:
+		return ctx.Peek(params, false)
+	case PQ_CMD_PEEK_LOCKED:
+		return ctx.Peek(params, true)
+	case PQ_CMD_REDRIVE:
+		return ctx.Redrive(params)
+	case PQ_CMD_SUBSCRIBE:
+		return ctx.Subscribe(params)
+	case PQ_CMD_UNSUBSCRIBE:
+		return ctx.Unsubscribe(params)
 	}
 	return mpqerr.InvalidRequest("Unknown command: " + cmd)
 }
 
+// isReadOnlyCmd returns true if command doesn't change the queue, so it can be served by the replica.
+func isReadOnlyCmd(cmd string) bool {
+	switch cmd {
+	case PQ_CMD_STATUS, PQ_CMD_MSG_INFO, PQ_CMD_PEEK, PQ_CMD_PEEK_LOCKED:
+		return true
+	}
+	return false
+}
+
+// cmdPermission returns queue permissions any of which allows to execute the command.
+// Commands changing the queue config or messages of other consumers need admin permission.
+func cmdPermission(cmd string) apis.Permission {
+	switch cmd {
+	case PQ_CMD_STATUS:
+		return apis.PermAny
+	case PQ_CMD_PUSH:
+		return apis.PermPush
+	// Peeked messages are returned with their payloads, so peeking requires the same permission as popping.
+	case PQ_CMD_MSG_INFO, PQ_CMD_PEEK, PQ_CMD_PEEK_LOCKED,
+		PQ_CMD_POP, PQ_CMD_POPLOCK, PQ_CMD_SUBSCRIBE, PQ_CMD_UNSUBSCRIBE,
+		PQ_CMD_DELETE_BY_RCPT, PQ_CMD_UNLOCK_BY_RCPT, PQ_CMD_UPD_LOCK_BY_RCPT, PQ_CMD_UPD_PAYLOAD_BY_RCPT:
+		return apis.PermPop
+	}
+	return apis.PermAdmin
+}
+
+// canAccess returns true if session has any of the permissions on the queue.
+func (ctx *PQContext) canAccess(queue string, perm apis.Permission) bool {
+	return ctx.access == nil || ctx.access.CanAccess(queue, perm)
+}
+
 // parseMessageIdOnly is looking for message id only.
 func parseMessageIdOnly(params []string) (string, *mpqerr.ErrorResponse) {
 	if len(params) == 1 {
@@ -191,14 +333,47 @@ func parseMessageIdOnly(params []string) (string, *mpqerr.ErrorResponse) {
 	return "", mpqerr.ERR_ONE_ID_ONLY
 }
 
-// parseReceiptOnly is looking for message receipt only.
-func parseReceiptOnly(params []string) (string, *mpqerr.ErrorResponse) {
-	if len(params) == 1 {
-		return params[0], nil
-	} else if len(params) > 1 {
-		return "", mpqerr.ERR_ONE_RECEIPT_ONLY
+// parseAttrParam parses message attribute key and value adding them to attrs.
+func parseAttrParam(params []string, attrs map[string]string) ([]string, map[string]string, *mpqerr.ErrorResponse) {
+	params, k, v, err := mpqproto.ParseKeyValueParam(params, ATTR_KEY_LIMIT, ATTR_VALUE_LIMIT)
+	if err != nil {
+		return nil, nil, err
+	}
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	if _, ok := attrs[k]; !ok && len(attrs) >= ATTR_NUM_LIMIT {
+		return nil, nil, mpqerr.ERR_TOO_MANY_ATTRS
+	}
+	attrs[k] = v
+	return params, attrs, nil
+}
+
+// parseMessageIds is looking for one or more message ids.
+func parseMessageIds(params []string) ([]string, *mpqerr.ErrorResponse) {
+	if len(params) == 0 {
+		return nil, mpqerr.ERR_MSG_ID_NOT_DEFINED
+	}
+	if int64(len(params)) > conf.CFG_PQ.MaxPopBatchSize {
+		return nil, mpqerr.ERR_BATCH_TOO_LARGE
 	}
-	return "", mpqerr.ERR_NO_RECEIPT
+	for _, msgId := range params {
+		if !mpqproto.ValidateItemId(msgId) {
+			return nil, mpqerr.ERR_ID_IS_WRONG
+		}
+	}
+	return params, nil
+}
+
+// parseReceipts is looking for one or more message receipts.
+func parseReceipts(params []string) ([]string, *mpqerr.ErrorResponse) {
+	if len(params) == 0 {
+		return nil, mpqerr.ERR_NO_RECEIPT
+	}
+	if int64(len(params)) > conf.CFG_PQ.MaxPopBatchSize {
+		return nil, mpqerr.ERR_BATCH_TOO_LARGE
+	}
+	return params, nil
 }
 
 // PopLock gets message from the queue setting lock timeout.
@@ -206,20 +381,34 @@ func (ctx *PQContext) PopLock(params []string) apis.IResponse {
 	var err *mpqerr.ErrorResponse
 	var limit int64 = 1
 	var asyncId string
+	var sessionLock bool
 
 	popWaitTimeout := ctx.pq.config.PopWaitTimeout
-	lockTimeout := ctx.pq.config.PopLockTimeout
+	// Message or queue lock timeout is used unless it is requested explicitly.
+	var lockTimeout int64 = -1
+	filter := NewMsgFilter()
 
 	for len(params) > 0 {
 		switch params[0] {
 		case PRM_LOCK_TIMEOUT:
 			params, lockTimeout, err = mpqproto.ParseInt64Param(params, 0, conf.CFG_PQ.MaxLockTimeout)
+		case PRM_MIN_PRIORITY:
+			params, filter.MinPriority, err = mpqproto.ParseInt64Param(params, 0, math.MaxInt64)
+		case PRM_MAX_PRIORITY:
+			params, filter.MaxPriority, err = mpqproto.ParseInt64Param(params, 0, math.MaxInt64)
+		case PRM_PREFIX:
+			params, filter.IdPrefix, err = mpqproto.ParseItemId(params)
+		case PRM_ATTR:
+			params, filter.Attrs, err = parseAttrParam(params, filter.Attrs)
 		case PRM_LIMIT:
 			params, limit, err = mpqproto.ParseInt64Param(params, 1, conf.CFG_PQ.MaxPopBatchSize)
 		case PRM_POP_WAIT:
 			params, popWaitTimeout, err = mpqproto.ParseInt64Param(params, 0, conf.CFG_PQ.MaxPopWaitTimeout)
 		case PRM_ASYNC:
 			params, asyncId, err = mpqproto.ParseItemId(params)
+		case PRM_SESSION:
+			params = params[1:]
+			sessionLock = true
 		default:
 			return mpqerr.UnknownParam(params[0])
 		}
@@ -227,11 +416,29 @@ func (ctx *PQContext) PopLock(params []string) apis.IResponse {
 			return err
 		}
 	}
+	if filter.MinPriority > filter.MaxPriority {
+		return mpqerr.ERR_PRIORITY_RANGE
+	}
+	if filter.Empty() {
+		filter = nil
+	}
 	if len(asyncId) > 0 {
-		return ctx.asyncPop(asyncId, lockTimeout, popWaitTimeout, limit, true)
+		return ctx.asyncPop(asyncId, lockTimeout, popWaitTimeout, limit, true, sessionLock, filter)
 	} else {
-		return ctx.pq.Pop(lockTimeout, popWaitTimeout, limit, true)
+		return ctx.popLock(lockTimeout, popWaitTimeout, limit, sessionLock, filter)
+	}
+}
+
+// popLock pops locked messages. Messages locked with the session lock are
+// returned into the queue once the session is finished.
+func (ctx *PQContext) popLock(lockTimeout, popWaitTimeout, limit int64, sessionLock bool, filter *MsgFilter) apis.IResponse {
+	res := ctx.pq.PopFiltered(lockTimeout, popWaitTimeout, limit, true, filter)
+	if sessionLock {
+		if items, ok := res.(*resp.MessagesResponse); ok {
+			ctx.popLocks.add(ctx.pq, items.GetItems())
+		}
 	}
+	return res
 }
 
 // Pop message from queue completely removing it.
@@ -258,19 +465,155 @@ func (ctx *PQContext) Pop(params []string) apis.IResponse {
 		}
 	}
 	if len(asyncId) > 0 {
-		return ctx.asyncPop(asyncId, 0, popWaitTimeout, limit, false)
+		return ctx.asyncPop(asyncId, 0, popWaitTimeout, limit, false, false, nil)
 	} else {
 		return ctx.pq.Pop(0, popWaitTimeout, limit, false)
 	}
 }
 
-func (ctx *PQContext) asyncPop(asyncId string, lockTimeout, popWaitTimeout, limit int64, lock bool) apis.IResponse {
+// Peek returns messages without popping them. Available messages are
+// returned by default, in-flight messages are returned if locked is true.
+func (ctx *PQContext) Peek(params []string, locked bool) apis.IResponse {
+	var err *mpqerr.ErrorResponse
+	var offset int64
+	var limit int64 = 1
+
+	for len(params) > 0 {
+		switch params[0] {
+		case PRM_OFFSET:
+			params, offset, err = mpqproto.ParseInt64Param(params, 0, math.MaxInt64)
+		case PRM_LIMIT:
+			params, limit, err = mpqproto.ParseInt64Param(params, 1, conf.CFG_PQ.MaxPopBatchSize)
+		default:
+			return mpqerr.UnknownParam(params[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if locked {
+		return ctx.pq.PeekLocked(offset, limit)
+	}
+	return ctx.pq.Peek(offset, limit)
+}
+
+// Redrive moves messages into the target queue. All not locked messages are moved
+// unless LIMIT or a list of IDs is provided.
+func (ctx *PQContext) Redrive(params []string) apis.IResponse {
+	var err *mpqerr.ErrorResponse
+	var target string
+	var limit int64
+	var msgId string
+	var msgIds []string
+
+	for len(params) > 0 {
+		switch params[0] {
+		case PRM_TARGET:
+			params, target, err = mpqproto.ParseItemId(params)
+		case PRM_LIMIT:
+			params, limit, err = mpqproto.ParseInt64Param(params, 1, math.MaxInt64)
+		case PRM_ID:
+			params, msgId, err = mpqproto.ParseItemId(params)
+			msgIds = append(msgIds, msgId)
+		default:
+			return mpqerr.UnknownParam(params[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(target) == 0 {
+		return mpqerr.ERR_TARGET_NOT_DEFINED
+	}
+	if int64(len(msgIds)) > conf.CFG_PQ.MaxPopBatchSize {
+		return mpqerr.ERR_BATCH_TOO_LARGE
+	}
+	if !ctx.canAccess(target, apis.PermPush) {
+		return mpqerr.ERR_PERMISSION_DENIED
+	}
+	return ctx.pq.Redrive(target, limit, msgIds)
+}
+
+// Subscribe registers the session as a consumer of the queue. Locked messages are
+// pushed to the session as they become available, up to PREFETCH messages that are
+// not deleted or unlocked yet. Messages still locked by the subscription are
+// unlocked once the session is finished.
+func (ctx *PQContext) Subscribe(params []string) apis.IResponse {
+	var err *mpqerr.ErrorResponse
+	var prefetch int64 = 1
+	// Message or queue lock timeout is used unless it is requested explicitly.
+	var lockTimeout int64 = -1
+
+	for len(params) > 0 {
+		switch params[0] {
+		case PRM_PREFETCH:
+			params, prefetch, err = mpqproto.ParseInt64Param(params, 1, MAX_PREFETCH)
+		case PRM_LOCK_TIMEOUT:
+			params, lockTimeout, err = mpqproto.ParseInt64Param(params, 0, conf.CFG_PQ.MaxLockTimeout)
+		default:
+			return mpqerr.UnknownParam(params[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx.subLock.Lock()
+	defer ctx.subLock.Unlock()
+	if ctx.sub != nil {
+		return mpqerr.ERR_ALREADY_SUBSCRIBED
+	}
+	ctx.sub = newSubscription(ctx.pq, ctx.responseWriter, &ctx.subLocks, prefetch, lockTimeout)
+	ctx.sub.start()
+	return resp.OK
+}
+
+// Unsubscribe stops pushing messages to the session. Delivered messages stay locked,
+// so they still can be deleted or unlocked by receipt.
+func (ctx *PQContext) Unsubscribe(params []string) apis.IResponse {
+	if len(params) > 0 {
+		return mpqerr.ERR_CMD_WITH_NO_PARAMS
+	}
+	if !ctx.stopSubscription() {
+		return mpqerr.ERR_NOT_SUBSCRIBED
+	}
+	return resp.OK
+}
+
+func (ctx *PQContext) stopSubscription() bool {
+	ctx.subLock.Lock()
+	defer ctx.subLock.Unlock()
+	if ctx.sub == nil {
+		return false
+	}
+	ctx.sub.stop()
+	ctx.sub = nil
+	return true
+}
+
+// wakeSubscription lets subscription deliver more messages once some of them are acknowledged.
+func (ctx *PQContext) wakeSubscription() {
+	ctx.subLock.Lock()
+	if ctx.sub != nil {
+		ctx.sub.wake()
+	}
+	ctx.subLock.Unlock()
+}
+
+func (ctx *PQContext) asyncPop(asyncId string, lockTimeout, popWaitTimeout, limit int64, lock, sessionLock bool,
+	filter *MsgFilter) apis.IResponse {
 	if len(asyncId) != 0 && popWaitTimeout == 0 {
 		return resp.NewAsyncResponse(asyncId, mpqerr.ERR_ASYNC_WAIT)
 	}
+	// Group is incremented before the start, so Finish waits for the session locks to be tracked.
+	ctx.asyncGroup.Add(1)
 	go func() {
-		ctx.asyncGroup.Add(1)
-		res := ctx.pq.Pop(lockTimeout, popWaitTimeout, limit, lock)
+		var res apis.IResponse
+		if lock {
+			res = ctx.popLock(lockTimeout, popWaitTimeout, limit, sessionLock, filter)
+		} else {
+			res = ctx.pq.PopFiltered(lockTimeout, popWaitTimeout, limit, lock, filter)
+		}
 		r := resp.NewAsyncResponse(asyncId, res)
 		if err := ctx.responseWriter.WriteResponse(r); err != nil {
 			log.LogConnError(err)
@@ -288,43 +631,61 @@ func (ctx *PQContext) GetMessageInfo(params []string) apis.IResponse {
 	return ctx.pq.GetMessageInfo(msgId)
 }
 
+// DeleteLockedById deletes one or more locked messages.
+// Multiple messages get a result per message.
 func (ctx *PQContext) DeleteLockedById(params []string) apis.IResponse {
-	msgId, retData := parseMessageIdOnly(params)
+	msgIds, retData := parseMessageIds(params)
 	if retData != nil {
 		return retData
 	}
-	return ctx.pq.DeleteLockedById(msgId)
+	if len(msgIds) == 1 {
+		return ctx.pq.DeleteLockedById(msgIds[0])
+	}
+	return ctx.pq.DeleteLockedByIds(msgIds)
 }
 
+// DeleteById deletes one or more not locked messages.
+// Multiple messages get a result per message.
 func (ctx *PQContext) DeleteById(params []string) apis.IResponse {
-	msgId, retData := parseMessageIdOnly(params)
+	msgIds, retData := parseMessageIds(params)
 	if retData != nil {
 		return retData
 	}
-	return ctx.pq.DeleteById(msgId)
+	if len(msgIds) == 1 {
+		return ctx.pq.DeleteById(msgIds[0])
+	}
+	return ctx.pq.DeleteByIds(msgIds)
 }
 
 // DeleteByReceipt deletes locked message using provided receipt.
 // This is a preferable method to unlock messages. It helps to avoid
 // race condition in case if when message lock has timed out and was
 // picked up by other consumer.
+// Multiple receipts get a result per receipt.
 func (ctx *PQContext) DeleteByReceipt(params []string) apis.IResponse {
-	rcpt, err := parseReceiptOnly(params)
+	rcpts, err := parseReceipts(params)
 	if err != nil {
 		return err
 	}
-	return ctx.pq.DeleteByReceipt(rcpt)
+	if len(rcpts) == 1 {
+		return ctx.pq.DeleteByReceipt(rcpts[0])
+	}
+	return ctx.pq.DeleteByReceipts(rcpts)
 }
 
 // UnlockByReceipt unlocks locked message using provided receipt.
 // Unlocking by receipt is making sure message was not relocked
 // by something else.
+// Multiple receipts get a result per receipt.
 func (ctx *PQContext) UnlockByReceipt(params []string) apis.IResponse {
-	rcpt, err := parseReceiptOnly(params)
+	rcpts, err := parseReceipts(params)
 	if err != nil {
 		return err
 	}
-	return ctx.pq.UnlockByReceipt(rcpt)
+	if len(rcpts) == 1 {
+		return ctx.pq.UnlockByReceipt(rcpts[0])
+	}
+	return ctx.pq.UnlockByReceipts(rcpts)
 }
 
 // Push message to the queue.
@@ -332,27 +693,36 @@ func (ctx *PQContext) UnlockByReceipt(params []string) apis.IResponse {
 func (ctx *PQContext) Push(params []string) apis.IResponse {
 	var err *mpqerr.ErrorResponse
 	var msgId string
-	var priority int64 = 0
 	var syncWait bool
 	var asyncId string
 	var payload string
 
 	cfg := ctx.pq.config
-	delay := cfg.DeliveryDelay
-	msgTtl := cfg.MsgTtl
+	pushParams := &PushParams{
+		MsgTtl: cfg.MsgTtl,
+		Delay:  cfg.DeliveryDelay,
+	}
 
 	for len(params) > 0 {
 		switch params[0] {
 		case PRM_ID:
 			params, msgId, err = mpqproto.ParseUserItemId(params)
 		case PRM_PRIORITY:
-			params, priority, err = mpqproto.ParseInt64Param(params, 0, math.MaxInt64)
+			params, pushParams.Priority, err = mpqproto.ParseInt64Param(params, 0, math.MaxInt64)
 		case PRM_PAYLOAD:
 			params, payload, err = mpqproto.ParseStringParam(params, 1, PAYLOAD_LIMIT)
 		case PRM_DELAY:
-			params, delay, err = mpqproto.ParseInt64Param(params, 0, conf.CFG_PQ.MaxDeliveryDelay)
+			params, pushParams.Delay, err = mpqproto.ParseInt64Param(params, 0, conf.CFG_PQ.MaxDeliveryDelay)
 		case PRM_MSG_TTL:
-			params, msgTtl, err = mpqproto.ParseInt64Param(params, 0, conf.CFG_PQ.MaxMessageTTL)
+			params, pushParams.MsgTtl, err = mpqproto.ParseInt64Param(params, 0, conf.CFG_PQ.MaxMessageTTL)
+		case PRM_GROUP:
+			params, pushParams.GroupId, err = mpqproto.ParseItemId(params)
+		case PRM_ATTR:
+			params, pushParams.Attrs, err = parseAttrParam(params, pushParams.Attrs)
+		case PRM_POP_LIMIT:
+			params, pushParams.PopLimit, err = mpqproto.ParseInt64Param(params, 1, math.MaxInt64)
+		case PRM_LOCK_TIMEOUT:
+			params, pushParams.LockTimeout, err = mpqproto.ParseInt64Param(params, 1, conf.CFG_PQ.MaxLockTimeout)
 		case PRM_SYNC_WAIT:
 			params = params[1:]
 			syncWait = true
@@ -365,24 +735,20 @@ func (ctx *PQContext) Push(params []string) apis.IResponse {
 			return err
 		}
 	}
+	if len(pushParams.GroupId) > 0 && !ctx.pq.IsFifo() {
+		return mpqerr.ERR_GROUP_NOT_SUPPORTED
+	}
 	if len(msgId) == 0 {
 		msgId = ctx.idGen.RandId()
 	}
 
 	if syncWait {
 		if len(asyncId) == 0 {
-			res := ctx.pq.Push(msgId, payload, msgTtl, delay, priority)
-			if !res.IsError() {
-				ctx.pq.WaitFlush()
-			}
-			return res
+			return ctx.pushDurable(msgId, payload, pushParams, true)
 		} else {
 			go func() {
 				ctx.asyncGroup.Add(1)
-				res := ctx.pq.Push(msgId, payload, msgTtl, delay, priority)
-				if !res.IsError() {
-					ctx.pq.WaitFlush()
-				}
+				res := ctx.pushDurable(msgId, payload, pushParams, true)
 				ctx.responseWriter.WriteResponse(resp.NewAsyncResponse(asyncId, res))
 				ctx.asyncGroup.Done()
 			}()
@@ -392,19 +758,35 @@ func (ctx *PQContext) Push(params []string) apis.IResponse {
 	if len(asyncId) > 0 {
 		return resp.NewAsyncResponse(asyncId, mpqerr.ERR_ASYNC_PUSH)
 	}
-	return ctx.pq.Push(msgId, payload, msgTtl, delay, priority)
+	return ctx.pushDurable(msgId, payload, pushParams, false)
+}
+
+// pushDurable pushes a message and waits until it is durable. If data can not be
+// written on disk, client gets an error since the message may be lost.
+func (ctx *PQContext) pushDurable(msgId, payload string, pushParams *PushParams, flush bool) apis.IResponse {
+	res := ctx.pq.PushMsg(msgId, payload, pushParams)
+	if res.IsError() {
+		return res
+	}
+	if err := ctx.pq.WaitDurable(flush); err != nil {
+		return mpqerr.ServerError("Message is not durable: " + err.Error())
+	}
+	return res
 }
 
 // UpdateLockByRcpt updates message lock according to provided receipt.
+// RCPT can be repeated to update many messages, they get a result per receipt.
 func (ctx *PQContext) UpdateLockByRcpt(params []string) apis.IResponse {
 	var err *mpqerr.ErrorResponse
 	var rcpt string
+	var rcpts []string
 	var lockTimeout int64 = -1
 
 	for len(params) > 0 {
 		switch params[0] {
 		case PRM_RECEIPT:
 			params, rcpt, err = mpqproto.ParseReceiptParam(params)
+			rcpts = append(rcpts, rcpt)
 		case PRM_LOCK_TIMEOUT:
 			params, lockTimeout, err = mpqproto.ParseInt64Param(params, 0, conf.CFG_PQ.MaxLockTimeout)
 		default:
@@ -415,14 +797,20 @@ func (ctx *PQContext) UpdateLockByRcpt(params []string) apis.IResponse {
 		}
 	}
 
-	if len(rcpt) == 0 {
+	if len(rcpts) == 0 {
 		return mpqerr.ERR_NO_RECEIPT
 	}
+	if int64(len(rcpts)) > conf.CFG_PQ.MaxPopBatchSize {
+		return mpqerr.ERR_BATCH_TOO_LARGE
+	}
 
 	if lockTimeout < 0 {
 		return mpqerr.ERR_MSG_TIMEOUT_NOT_DEFINED
 	}
-	return ctx.pq.UpdateLockByRcpt(rcpt, lockTimeout)
+	if len(rcpts) == 1 {
+		return ctx.pq.UpdateLockByRcpt(rcpts[0], lockTimeout)
+	}
+	return ctx.pq.UpdateLockByRcpts(rcpts, lockTimeout)
 }
 
 // UpdateLockById sets a user defined message lock timeout.
@@ -456,12 +844,117 @@ func (ctx *PQContext) UpdateLockById(params []string) apis.IResponse {
 	return ctx.pq.UpdateLockById(msgId, lockTimeout)
 }
 
+// UpdatePayloadById replaces payload of the message that is not locked.
+func (ctx *PQContext) UpdatePayloadById(params []string) apis.IResponse {
+	var err *mpqerr.ErrorResponse
+	var msgId string
+	var payload string
+	var hasPayload bool
+
+	for len(params) > 0 {
+		switch params[0] {
+		case PRM_ID:
+			params, msgId, err = mpqproto.ParseItemId(params)
+		case PRM_PAYLOAD:
+			params, payload, err = mpqproto.ParseStringParam(params, 1, PAYLOAD_LIMIT)
+			hasPayload = true
+		default:
+			return mpqerr.UnknownParam(params[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(msgId) == 0 {
+		return mpqerr.ERR_MSG_ID_NOT_DEFINED
+	}
+	if !hasPayload {
+		return mpqerr.ERR_MSG_PAYLOAD_NOT_DEFINED
+	}
+	return ctx.pq.UpdatePayloadById(msgId, payload)
+}
+
+// UpdatePayloadByRcpt replaces payload of the locked message using provided receipt.
+func (ctx *PQContext) UpdatePayloadByRcpt(params []string) apis.IResponse {
+	var err *mpqerr.ErrorResponse
+	var rcpt string
+	var payload string
+	var hasPayload bool
+
+	for len(params) > 0 {
+		switch params[0] {
+		case PRM_RECEIPT:
+			params, rcpt, err = mpqproto.ParseReceiptParam(params)
+		case PRM_PAYLOAD:
+			params, payload, err = mpqproto.ParseStringParam(params, 1, PAYLOAD_LIMIT)
+			hasPayload = true
+		default:
+			return mpqerr.UnknownParam(params[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(rcpt) == 0 {
+		return mpqerr.ERR_NO_RECEIPT
+	}
+	if !hasPayload {
+		return mpqerr.ERR_MSG_PAYLOAD_NOT_DEFINED
+	}
+	return ctx.pq.UpdatePayloadByRcpt(rcpt, payload)
+}
+
+// SetPriority changes priority of a single message or of all messages matching ID prefix.
+func (ctx *PQContext) SetPriority(params []string) apis.IResponse {
+	var err *mpqerr.ErrorResponse
+	var msgId string
+	var prefix string
+	var priority int64 = -1
+
+	for len(params) > 0 {
+		switch params[0] {
+		case PRM_ID:
+			params, msgId, err = mpqproto.ParseItemId(params)
+		case PRM_PREFIX:
+			params, prefix, err = mpqproto.ParseItemId(params)
+		case PRM_PRIORITY:
+			params, priority, err = mpqproto.ParseInt64Param(params, 0, math.MaxInt64)
+		default:
+			return mpqerr.UnknownParam(params[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if priority < 0 {
+		return mpqerr.ERR_MSG_PRIORITY_NOT_DEFINED
+	}
+	if len(msgId) > 0 && len(prefix) > 0 {
+		return mpqerr.ERR_ID_OR_PREFIX_ONLY
+	}
+	if len(prefix) > 0 {
+		return ctx.pq.SetPriorityByPrefix(prefix, priority)
+	}
+	if len(msgId) == 0 {
+		return mpqerr.ERR_MSG_ID_NOT_DEFINED
+	}
+	return ctx.pq.SetPriorityById(msgId, priority)
+}
+
+// UnlockMessageById unlocks one or more messages.
+// Multiple messages get a result per message.
 func (ctx *PQContext) UnlockMessageById(params []string) apis.IResponse {
-	msgId, retData := parseMessageIdOnly(params)
+	msgIds, retData := parseMessageIds(params)
 	if retData != nil {
 		return retData
 	}
-	return ctx.pq.UnlockMessageById(msgId)
+	if len(msgIds) == 1 {
+		return ctx.pq.UnlockMessageById(msgIds[0])
+	}
+	return ctx.pq.UnlockMessagesByIds(msgIds)
 }
 
 func (ctx *PQContext) GetCurrentStatus(params []string) apis.IResponse {
@@ -500,6 +993,11 @@ func (ctx *PQContext) SetParamValue(params []string) apis.IResponse {
 	popLimit := cfg.PopCountLimit
 	deliveryDelay := cfg.DeliveryDelay
 	lockTimeout := cfg.PopLockTimeout
+	dedupWindow := cfg.DedupWindow
+	dedupByPayload := cfg.DedupByPayload
+	compression := cfg.Compression
+	compressMinSize := cfg.CompressMinSize
+	durability := cfg.Durability
 	failQueue := ""
 
 	if len(params) == 0 {
@@ -531,6 +1029,23 @@ func (ctx *PQContext) SetParamValue(params []string) apis.IResponse {
 		case CPRM_FAIL_QUEUE:
 			params, pqParams.FailQueue, err = mpqproto.ParseItemId(params)
 			pqParams.FailQueue = failQueue
+		case CPRM_DEDUP_WINDOW:
+			params, dedupWindow, err = mpqproto.ParseInt64Param(params, 0, conf.CFG_PQ.MaxMessageTTL)
+			pqParams.DedupWindow = &dedupWindow
+		case CPRM_DEDUP_BY_PAYLOAD:
+			var v int64
+			params, v, err = mpqproto.ParseInt64Param(params, 0, 1)
+			dedupByPayload = v == 1
+			pqParams.DedupByPayload = &dedupByPayload
+		case CPRM_COMPRESS:
+			params, compression, err = parseCompressionParam(params)
+			pqParams.Compression = &compression
+		case CPRM_COMPRESS_MIN:
+			params, compressMinSize, err = mpqproto.ParseInt64Param(params, 0, conf.CFG_PQ.MaxMessageSize)
+			pqParams.CompressMinSize = &compressMinSize
+		case CPRM_DURABILITY:
+			params, durability, err = parseDurabilityParam(params)
+			pqParams.Durability = &durability
 		default:
 			return mpqerr.UnknownParam(params[0])
 		}
@@ -544,6 +1059,10 @@ func (ctx *PQContext) SetParamValue(params []string) apis.IResponse {
 func (ctx *PQContext) Finish() {
 	if !ctx.finishFlag {
 		ctx.finishFlag = true
+		ctx.stopSubscription()
 		ctx.asyncGroup.Wait()
+		if n := ctx.subLocks.release(ctx.pq) + ctx.popLocks.release(ctx.pq); n > 0 {
+			log.Debug("%d message(s) locked by the session returned to the queue", n)
+		}
 	}
 }
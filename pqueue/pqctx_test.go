@@ -3,6 +3,7 @@ package pqueue
 import (
 	"math"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -10,11 +11,13 @@ import (
 	"github.com/vburenin/firempq/apis"
 	"github.com/vburenin/firempq/conf"
 	"github.com/vburenin/firempq/db"
+	"github.com/vburenin/firempq/enc"
 	"github.com/vburenin/firempq/log"
 	"github.com/vburenin/firempq/mpqerr"
 	"github.com/vburenin/firempq/mpqproto/resp"
 	. "github.com/vburenin/firempq/mpqtesting"
 	"github.com/vburenin/firempq/queue_info"
+	"github.com/vburenin/firempq/utils"
 )
 
 func getCtxConfig() *conf.PQConfig {
@@ -69,9 +72,19 @@ func TestCtxParsePQConfig(t *testing.T) {
 				CPRM_DELIVERY_DELAY, "300",
 				CPRM_POP_LIMIT, "400",
 				CPRM_LOCK_TIMEOUT, "500",
+				CPRM_DEDUP_WINDOW, "600",
+				CPRM_DEDUP_BY_PAYLOAD, "1",
+				CPRM_COMPRESS, "snappy",
+				CPRM_COMPRESS_MIN, "512",
+				CPRM_DURABILITY, "fsync",
 			}
 			cfg, resp := ParsePQConfig(params)
 			VerifyOkResponse(resp)
+			So(cfg.Durability, ShouldEqual, DurabilityFsync)
+			So(cfg.Compression, ShouldEqual, "snappy")
+			So(cfg.CompressMinSize, ShouldEqual, 512)
+			So(cfg.DedupWindow, ShouldEqual, 600)
+			So(cfg.DedupByPayload, ShouldBeTrue)
 			So(cfg.MsgTtl, ShouldEqual, 100)
 			So(cfg.MaxMsgsInQueue, ShouldEqual, 200)
 			So(cfg.DeliveryDelay, ShouldEqual, 300)
@@ -98,6 +111,14 @@ func TestCtxParsePQConfig(t *testing.T) {
 			_, err := ParsePQConfig([]string{CPRM_LOCK_TIMEOUT, "-1"})
 			So(err.StringResponse(), ShouldContainSubstring, i2a(conf.CFG_PQ.MaxLockTimeout))
 		})
+		Convey("Unknown compression error", func() {
+			_, err := ParsePQConfig([]string{CPRM_COMPRESS, "gzip"})
+			So(err, ShouldEqual, mpqerr.ERR_UNKNOWN_COMPRESSION)
+		})
+		Convey("Unknown durability error", func() {
+			_, err := ParsePQConfig([]string{CPRM_DURABILITY, "always"})
+			So(err, ShouldEqual, mpqerr.ERR_UNKNOWN_DURABILITY)
+		})
 	})
 }
 
@@ -298,6 +319,29 @@ func TestCtxPush(t *testing.T) {
 			resp := q.Call(PQ_CMD_PUSH, []string{PRM_ID, "ab", PRM_PAYLOAD, "p", "TEST_PARAM"})
 			So(resp.StringResponse(), ShouldContainSubstring, "TEST_PARAM")
 		})
+		Convey("Push with message group should fail for priority queue.", func() {
+			resp := q.Call(PQ_CMD_PUSH, []string{PRM_ID, "ab", PRM_PAYLOAD, "p", PRM_GROUP, "g1"})
+			So(resp, ShouldEqual, mpqerr.ERR_GROUP_NOT_SUPPORTED)
+			VerifyServiceSize(q.pq, 0)
+		})
+	})
+}
+
+func TestCtxPushGroup(t *testing.T) {
+	Convey("Push command should accept message groups for FIFO queue", t, func() {
+		log.InitLogging()
+		log.SetLevel(1)
+		db.SetDatabase(NewInMemDBService())
+		desc := getCtxDesc()
+		desc.SType = apis.ServiceTypeFifoQueue
+		q := InitPQueue(&FakeCtxSvcLoader{}, desc, getCtxConfig()).NewContext(NewTestResponseWriter()).(*PQContext)
+
+		VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "a1", PRM_PAYLOAD, "p", PRM_GROUP, "g1", PRM_DELAY, "0"}))
+		VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "a2", PRM_PAYLOAD, "p", PRM_GROUP, "g1", PRM_DELAY, "0"}))
+		VerifyItems(q.Call(PQ_CMD_POPLOCK, []string{PRM_LIMIT, "10"}), 1, "a1", "p")
+
+		resp := q.Call(PQ_CMD_PUSH, []string{PRM_ID, "a3", PRM_PAYLOAD, "p", PRM_GROUP, "$g"})
+		So(resp, ShouldEqual, mpqerr.ERR_ID_IS_WRONG)
 	})
 }
 
@@ -431,6 +475,21 @@ func TestCtxSetParamValue(t *testing.T) {
 			}
 			VerifyOkResponse(q.Call(PQ_CMD_SET_CFG, params))
 		})
+		Convey("Compression should be enabled and disabled", func() {
+			VerifyOkResponse(q.Call(PQ_CMD_SET_CFG, []string{CPRM_COMPRESS, "snappy", CPRM_COMPRESS_MIN, "100"}))
+			So(q.pq.config.Compression, ShouldEqual, "snappy")
+			So(q.pq.config.CompressMinSize, ShouldEqual, 100)
+			VerifyOkResponse(q.Call(PQ_CMD_SET_CFG, []string{CPRM_COMPRESS, "none"}))
+			So(q.pq.config.Compression, ShouldEqual, "")
+			So(q.Call(PQ_CMD_SET_CFG, []string{CPRM_COMPRESS, "zip"}), ShouldEqual, mpqerr.ERR_UNKNOWN_COMPRESSION)
+		})
+		Convey("Durability level should be changed", func() {
+			VerifyOkResponse(q.Call(PQ_CMD_SET_CFG, []string{CPRM_DURABILITY, "flush"}))
+			So(q.pq.config.Durability, ShouldEqual, DurabilityFlush)
+			VerifyOkResponse(q.Call(PQ_CMD_SET_CFG, []string{CPRM_DURABILITY, "buffered"}))
+			So(q.pq.config.Durability, ShouldEqual, DurabilityBuffered)
+			So(q.Call(PQ_CMD_SET_CFG, []string{CPRM_DURABILITY, "sync"}), ShouldEqual, mpqerr.ERR_UNKNOWN_DURABILITY)
+		})
 	})
 }
 
@@ -488,6 +547,215 @@ func TestCtxUpdateLockByReceipt(t *testing.T) {
 	})
 }
 
+func TestCtxUpdatePayload(t *testing.T) {
+	Convey("Update payload should validate parameters", t, func() {
+		q, _ := CreateNewQueueTestContext()
+		Convey("Should return no message id error", func() {
+			resp := q.Call(PQ_CMD_UPD_PAYLOAD_BY_ID, []string{PRM_PAYLOAD, "p"})
+			So(resp, ShouldEqual, mpqerr.ERR_MSG_ID_NOT_DEFINED)
+		})
+		Convey("Should return no payload error", func() {
+			resp := q.Call(PQ_CMD_UPD_PAYLOAD_BY_ID, []string{PRM_ID, "ab"})
+			So(resp, ShouldEqual, mpqerr.ERR_MSG_PAYLOAD_NOT_DEFINED)
+		})
+		Convey("Should return no receipt error", func() {
+			resp := q.Call(PQ_CMD_UPD_PAYLOAD_BY_RCPT, []string{PRM_PAYLOAD, "p"})
+			So(resp, ShouldEqual, mpqerr.ERR_NO_RECEIPT)
+		})
+		Convey("Should return unknown parameter error", func() {
+			resp := q.Call(PQ_CMD_UPD_PAYLOAD_BY_RCPT, []string{"UNKNOWN"})
+			So(resp.StringResponse(), ShouldContainSubstring, "UNKNOWN")
+		})
+		Convey("Should update payload", func() {
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "ab", PRM_PAYLOAD, "p", PRM_DELAY, "0"}))
+			VerifyOkResponse(q.Call(PQ_CMD_UPD_PAYLOAD_BY_ID, []string{PRM_ID, "ab", PRM_PAYLOAD, "p2"}))
+			VerifySingleItem(q.Call(PQ_CMD_POP, nil), "ab", "p2")
+		})
+	})
+}
+
+func TestCtxSetPriority(t *testing.T) {
+	Convey("Set priority should validate parameters", t, func() {
+		q, _ := CreateNewQueueTestContext()
+		Convey("Should return no priority error", func() {
+			resp := q.Call(PQ_CMD_SET_PRIORITY, []string{PRM_ID, "ab"})
+			So(resp, ShouldEqual, mpqerr.ERR_MSG_PRIORITY_NOT_DEFINED)
+		})
+		Convey("Should return no message id error", func() {
+			resp := q.Call(PQ_CMD_SET_PRIORITY, []string{PRM_PRIORITY, "1"})
+			So(resp, ShouldEqual, mpqerr.ERR_MSG_ID_NOT_DEFINED)
+		})
+		Convey("Should return id or prefix error", func() {
+			resp := q.Call(PQ_CMD_SET_PRIORITY, []string{PRM_ID, "ab", PRM_PREFIX, "a", PRM_PRIORITY, "1"})
+			So(resp, ShouldEqual, mpqerr.ERR_ID_OR_PREFIX_ONLY)
+		})
+		Convey("Should return wrong priority error", func() {
+			resp := q.Call(PQ_CMD_SET_PRIORITY, []string{PRM_ID, "ab", PRM_PRIORITY, "-1"})
+			So(resp.IsError(), ShouldBeTrue)
+		})
+		Convey("Should change priority", func() {
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "ab", PRM_PAYLOAD, "p1", PRM_PRIORITY, "5", PRM_DELAY, "0"}))
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "cd", PRM_PAYLOAD, "p2", PRM_PRIORITY, "6", PRM_DELAY, "0"}))
+			VerifyOkResponse(q.Call(PQ_CMD_SET_PRIORITY, []string{PRM_ID, "cd", PRM_PRIORITY, "1"}))
+			resp := q.Call(PQ_CMD_SET_PRIORITY, []string{PRM_PREFIX, "a", PRM_PRIORITY, "2"})
+			So(resp.StringResponse(), ShouldEqual, "+DATA :1")
+			VerifySingleItem(q.Call(PQ_CMD_POP, nil), "cd", "p2")
+		})
+	})
+}
+
+func TestCtxPeek(t *testing.T) {
+	Convey("Peek should validate parameters", t, func() {
+		q, _ := CreateNewQueueTestContext()
+		Convey("Should return unknown parameter error", func() {
+			resp := q.Call(PQ_CMD_PEEK, []string{"UNKNOWN"})
+			So(resp.StringResponse(), ShouldContainSubstring, "UNKNOWN")
+		})
+		Convey("Should return wrong offset error", func() {
+			resp := q.Call(PQ_CMD_PEEK_LOCKED, []string{PRM_OFFSET, "-1"})
+			So(resp.IsError(), ShouldBeTrue)
+		})
+		Convey("Should return wrong limit error", func() {
+			resp := q.Call(PQ_CMD_PEEK, []string{PRM_LIMIT, "0"})
+			So(resp.IsError(), ShouldBeTrue)
+		})
+		Convey("Should peek messages", func() {
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "ab", PRM_PAYLOAD, "p1", PRM_DELAY, "0"}))
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "cd", PRM_PAYLOAD, "p2", PRM_DELAY, "0"}))
+			VerifySingleItem(q.Call(PQ_CMD_PEEK, nil), "ab", "p1")
+			VerifySingleItem(q.Call(PQ_CMD_PEEK, []string{PRM_OFFSET, "1", PRM_LIMIT, "10"}), "cd", "p2")
+			VerifySingleItem(q.Call(PQ_CMD_POPLOCK, nil), "ab", "p1")
+			VerifySingleItem(q.Call(PQ_CMD_PEEK_LOCKED, []string{PRM_LIMIT, "10"}), "ab", "p1")
+		})
+	})
+}
+
+func TestCtxBatchCommands(t *testing.T) {
+	Convey("Batch commands should return a result per item", t, func() {
+		q, _ := CreateNewQueueTestContext()
+		Convey("Should return wrong id error", func() {
+			resp := q.Call(PQ_CMD_DELETE_LOCKED_BY_ID, []string{"id1", "$"})
+			So(resp, ShouldEqual, mpqerr.ERR_ID_IS_WRONG)
+		})
+		Convey("Should return too many items error", func() {
+			resp := q.Call(PQ_CMD_UNLOCK_BY_RCPT, make([]string, conf.CFG_PQ.MaxPopBatchSize+1))
+			So(resp, ShouldEqual, mpqerr.ERR_BATCH_TOO_LARGE)
+		})
+		Convey("Should process all ids and receipts", func() {
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "ab", PRM_PAYLOAD, "p1", PRM_DELAY, "0"}))
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "cd", PRM_PAYLOAD, "p2", PRM_DELAY, "0"}))
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "ef", PRM_PAYLOAD, "p3", PRM_DELAY, "0"}))
+			items, _ := VerifyItemsRespSize(q.Call(PQ_CMD_POPLOCK, []string{PRM_LIMIT, "2"}), 2)
+			rcpt1 := items[0].(*MsgResponseItem).Receipt()
+			rcpt2 := items[1].(*MsgResponseItem).Receipt()
+
+			resp := q.Call(PQ_CMD_UPD_LOCK_BY_RCPT, []string{PRM_RECEIPT, rcpt1, PRM_RECEIPT, rcpt2, PRM_LOCK_TIMEOUT, "1000"})
+			So(resp.StringResponse(), ShouldEqual, "+BATCH *2 +OK +OK")
+
+			resp = q.Call(PQ_CMD_UNLOCK_BY_ID, []string{"ab", "ef"})
+			So(resp.StringResponse(), ShouldStartWith, "+BATCH *2 +OK -ERR")
+
+			resp = q.Call(PQ_CMD_DELETE_BY_RCPT, []string{rcpt2, "1-2-3"})
+			So(resp.StringResponse(), ShouldStartWith, "+BATCH *2 +OK -ERR")
+
+			resp = q.Call(PQ_CMD_DELETE_BY_ID, []string{"ab", "ef"})
+			So(resp.StringResponse(), ShouldEqual, "+BATCH *2 +OK +OK")
+			VerifyServiceSize(q.pq, 0)
+		})
+	})
+}
+
+func TestCtxPopLockFilter(t *testing.T) {
+	Convey("Pop lock filters should be validated", t, func() {
+		q, _ := CreateNewQueueTestContext()
+		Convey("Should return priority range error", func() {
+			resp := q.Call(PQ_CMD_POPLOCK, []string{PRM_MIN_PRIORITY, "10", PRM_MAX_PRIORITY, "5"})
+			So(resp, ShouldEqual, mpqerr.ERR_PRIORITY_RANGE)
+		})
+		Convey("Should return attribute error", func() {
+			resp := q.Call(PQ_CMD_POPLOCK, []string{PRM_ATTR, "kind"})
+			So(resp.IsError(), ShouldBeTrue)
+		})
+		Convey("Should return too many attributes error", func() {
+			params := []string{PRM_ID, "ab"}
+			for i := 0; i <= ATTR_NUM_LIMIT; i++ {
+				params = append(params, PRM_ATTR, strconv.Itoa(i), "v")
+			}
+			So(q.Call(PQ_CMD_PUSH, params), ShouldEqual, mpqerr.ERR_TOO_MANY_ATTRS)
+		})
+		Convey("Should pop matching messages only", func() {
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "ab", PRM_PAYLOAD, "p1", PRM_DELAY, "0",
+				PRM_ATTR, "kind", "img"}))
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "cd", PRM_PAYLOAD, "p2", PRM_DELAY, "0",
+				PRM_ATTR, "kind", "txt", PRM_PRIORITY, "5"}))
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "ce", PRM_PAYLOAD, "p3", PRM_DELAY, "0",
+				PRM_PRIORITY, "7"}))
+			resp := q.Call(PQ_CMD_POPLOCK, []string{PRM_ATTR, "kind", "txt"})
+			VerifySingleItem(resp, "cd", "p2")
+			So(resp.StringResponse(), ShouldContainSubstring, "ATTR %1 $4 kind $3 txt")
+			VerifySingleItem(q.Call(PQ_CMD_POPLOCK, []string{PRM_PREFIX, "c", PRM_MIN_PRIORITY, "6"}), "ce", "p3")
+			VerifySingleItem(q.Call(PQ_CMD_POPLOCK, []string{PRM_MAX_PRIORITY, "6"}), "ab", "p1")
+		})
+		Convey("Should pop unlocked messages by their original priority", func() {
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "ab", PRM_PAYLOAD, "p1", PRM_DELAY, "0",
+				PRM_PRIORITY, "5"}))
+			VerifySingleItem(q.Call(PQ_CMD_POPLOCK, []string{PRM_MIN_PRIORITY, "5"}), "ab", "p1")
+			VerifyOkResponse(q.Call(PQ_CMD_UNLOCK_BY_ID, []string{"ab"}))
+			VerifySingleItem(q.Call(PQ_CMD_POPLOCK, []string{PRM_MIN_PRIORITY, "5", PRM_MAX_PRIORITY, "5"}), "ab", "p1")
+		})
+	})
+}
+
+func TestCtxPushPopLimitAndTimeout(t *testing.T) {
+	Convey("Push should accept message pop limit and lock timeout", t, func() {
+		q, _ := CreateNewQueueTestContext()
+		Convey("Should return wrong pop limit error", func() {
+			resp := q.Call(PQ_CMD_PUSH, []string{PRM_ID, "ab", PRM_POP_LIMIT, "0"})
+			So(resp.IsError(), ShouldBeTrue)
+		})
+		Convey("Should return wrong lock timeout error", func() {
+			resp := q.Call(PQ_CMD_PUSH, []string{PRM_ID, "ab", PRM_LOCK_TIMEOUT, "-1"})
+			So(resp.IsError(), ShouldBeTrue)
+		})
+		Convey("Should store message settings", func() {
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "ab", PRM_PAYLOAD, "p",
+				PRM_POP_LIMIT, "3", PRM_LOCK_TIMEOUT, "5000"}))
+			resp := q.Call(PQ_CMD_MSG_INFO, []string{"ab"}).StringResponse()
+			So(resp, ShouldContainSubstring, "PopLimit :3")
+			So(resp, ShouldContainSubstring, "LockTimeout :5000")
+		})
+		Convey("POPLCK timeout should override message lock timeout", func() {
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "a1", PRM_PAYLOAD, "p", PRM_DELAY, "0",
+				PRM_LOCK_TIMEOUT, "50000"}))
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "a2", PRM_PAYLOAD, "p", PRM_DELAY, "0",
+				PRM_LOCK_TIMEOUT, "50000"}))
+			nowTs := utils.Uts()
+			items, _ := VerifyItemsRespSize(q.Call(PQ_CMD_POPLOCK, nil), 1)
+			So(items[0].(*MsgResponseItem).GetMeta().UnlockTs, ShouldBeGreaterThanOrEqualTo, nowTs+50000)
+			items, _ = VerifyItemsRespSize(q.Call(PQ_CMD_POPLOCK, []string{PRM_LOCK_TIMEOUT, "1000"}), 1)
+			So(items[0].(*MsgResponseItem).GetMeta().UnlockTs, ShouldBeLessThan, nowTs+50000)
+		})
+	})
+}
+
+func TestCtxRedrive(t *testing.T) {
+	Convey("Redrive should validate parameters", t, func() {
+		q, _ := CreateNewQueueTestContext()
+		Convey("Should return no target error", func() {
+			resp := q.Call(PQ_CMD_REDRIVE, []string{PRM_LIMIT, "1"})
+			So(resp, ShouldEqual, mpqerr.ERR_TARGET_NOT_DEFINED)
+		})
+		Convey("Should return wrong limit error", func() {
+			resp := q.Call(PQ_CMD_REDRIVE, []string{PRM_TARGET, "q", PRM_LIMIT, "0"})
+			So(resp.IsError(), ShouldBeTrue)
+		})
+		Convey("Should return no service error", func() {
+			resp := q.Call(PQ_CMD_REDRIVE, []string{PRM_TARGET, "q", PRM_ID, "a", PRM_ID, "b"})
+			So(resp, ShouldEqual, mpqerr.ERR_NO_SVC)
+		})
+	})
+}
+
 func TestCtxFinish(t *testing.T) {
 	Convey("Finish should block context work", t, func() {
 		q, _ := CreateNewQueueTestContext()
@@ -496,3 +764,101 @@ func TestCtxFinish(t *testing.T) {
 		So(q.Call("CMD", []string{}), ShouldEqual, mpqerr.ERR_CONN_CLOSING)
 	})
 }
+
+// waitSubscription waits until the subscription delivers cnt messages in total.
+func waitSubscription(rw *TestResponseWriter, cnt int) []apis.IResponse {
+	for i := 0; i < 200; i++ {
+		delivered := 0
+		for _, r := range rw.GetResponses() {
+			delivered += strings.Count(r.StringResponse(), " RCPT ")
+		}
+		if delivered >= cnt {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return rw.GetResponses()
+}
+
+func subscriptionReceipts(q *PQContext) []string {
+	q.subLocks.lock.Lock()
+	defer q.subLocks.lock.Unlock()
+	var rcpts []string
+	for sn, popCount := range q.subLocks.locks {
+		rcpts = append(rcpts, enc.To36Base(sn)+"-"+enc.To36Base(uint64(popCount)))
+	}
+	return rcpts
+}
+
+func TestCtxSubscribe(t *testing.T) {
+	Convey("Subscription should push messages within prefetch window", t, func() {
+		DefaultPQConfig()
+		q, rw := CreateNewQueueTestContext()
+		for _, id := range []string{"a", "b", "c"} {
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, id, PRM_PAYLOAD, "p", PRM_DELAY, "0"}))
+		}
+
+		Convey("Should validate parameters", func() {
+			So(q.Call(PQ_CMD_SUBSCRIBE, []string{PRM_PREFETCH, "0"}).IsError(), ShouldBeTrue)
+			So(q.Call(PQ_CMD_UNSUBSCRIBE, nil), ShouldEqual, mpqerr.ERR_NOT_SUBSCRIBED)
+			VerifyOkResponse(q.Call(PQ_CMD_SUBSCRIBE, nil))
+			So(q.Call(PQ_CMD_SUBSCRIBE, nil), ShouldEqual, mpqerr.ERR_ALREADY_SUBSCRIBED)
+			VerifyOkResponse(q.Call(PQ_CMD_UNSUBSCRIBE, nil))
+			q.Finish()
+		})
+
+		Convey("Acknowledged messages should replenish the window", func() {
+			VerifyOkResponse(q.Call(PQ_CMD_SUBSCRIBE, []string{PRM_PREFETCH, "2", PRM_LOCK_TIMEOUT, "10000"}))
+			responses := waitSubscription(rw, 2)
+			So(responses[0].StringResponse(), ShouldStartWith, "+SUB name +MSGS")
+			time.Sleep(20 * time.Millisecond)
+			So(q.pq.LockedCount(), ShouldEqual, 2)
+
+			rcpts := subscriptionReceipts(q)
+			So(len(rcpts), ShouldEqual, 2)
+			VerifyOkResponse(q.Call(PQ_CMD_DELETE_BY_RCPT, []string{rcpts[0]}))
+			waitSubscription(rw, 3)
+			So(q.pq.LockedCount(), ShouldEqual, 2)
+			VerifyServiceSize(q.pq, 2)
+
+			Convey("Unacknowledged messages should be unlocked on finish", func() {
+				q.Finish()
+				So(q.pq.LockedCount(), ShouldEqual, 0)
+				So(q.pq.AvailableMessages(), ShouldEqual, 2)
+			})
+		})
+
+		Convey("Push should be delivered to the waiting subscriber", func() {
+			VerifyOkResponse(q.Call(PQ_CMD_SUBSCRIBE, []string{PRM_PREFETCH, "5"}))
+			waitSubscription(rw, 3)
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "d", PRM_PAYLOAD, "p", PRM_DELAY, "0"}))
+			waitSubscription(rw, 4)
+			So(q.pq.LockedCount(), ShouldEqual, 4)
+			q.Finish()
+			So(q.pq.LockedCount(), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestCtxPopLockSession(t *testing.T) {
+	Convey("Session locks should be released once the session is finished", t, func() {
+		DefaultPQConfig()
+		q, rw := CreateNewQueueTestContext()
+		for _, id := range []string{"a", "b", "c", "d"} {
+			VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, id, PRM_PAYLOAD, "p", PRM_DELAY, "0"}))
+		}
+
+		items, _ := VerifyItemsRespSize(q.Call(PQ_CMD_POPLOCK, []string{PRM_SESSION, PRM_LIMIT, "2"}), 2)
+		VerifyItemsRespSize(q.Call(PQ_CMD_POPLOCK, nil), 1)
+		VerifyOkResponse(q.Call(PQ_CMD_DELETE_BY_RCPT, []string{items[0].(*MsgResponseItem).Receipt()}))
+		So(q.Call(PQ_CMD_POPLOCK, []string{PRM_SESSION, PRM_ASYNC, "a1", PRM_POP_WAIT, "1000"}).StringResponse(),
+			ShouldEqual, "+A a1")
+
+		// Finish waits for the async pop, so its message is unlocked too.
+		q.Finish()
+		So(rw.GetResponses()[0].StringResponse(), ShouldContainSubstring, "+ASYNC a1 +MSGS *1")
+		So(q.pq.LockedCount(), ShouldEqual, 1)
+		So(q.pq.AvailableMessages(), ShouldEqual, 2)
+		VerifyServiceSize(q.pq, 3)
+	})
+}
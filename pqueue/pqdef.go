@@ -16,4 +16,20 @@ const (
 	PQ_STATUS_DELAYED          = "DelayedMessages"
 	PQ_STATUS_FAIL_QUEUE       = "FailQueue"
 	PQ_STATUS_MAX_MSG_SIZE     = "MaxMsgSize"
+	PQ_STATUS_DEDUP_WINDOW     = "DedupWindow"
+	PQ_STATUS_DEDUP_BY_PAYLOAD = "DedupByPayload"
+	PQ_STATUS_DEDUP_KEYS       = "DedupKeys"
+	PQ_STATUS_COMPRESSION      = "Compression"
+	PQ_STATUS_COMPRESS_MIN     = "CompressMinSize"
+	PQ_STATUS_DURABILITY       = "Durability"
+)
+
+// Durability levels of pushed messages.
+const (
+	// DurabilityBuffered confirms push once message is cached, cache is flushed periodically.
+	DurabilityBuffered = ""
+	// DurabilityFlush confirms push once message is written into the database.
+	DurabilityFlush = "flush"
+	// DurabilityFsync confirms push once message is synced on disk.
+	DurabilityFsync = "fsync"
 )
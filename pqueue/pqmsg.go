@@ -1,6 +1,7 @@
 package pqueue
 
 import (
+	"github.com/vburenin/firempq/db"
 	"github.com/vburenin/firempq/enc"
 	"github.com/vburenin/firempq/log"
 )
@@ -27,6 +28,21 @@ func (pqm *PQMsgMetaData) Sn2Bin() string {
 	return enc.Sn2Bin(pqm.SerialNumber)
 }
 
+// IsLocked returns true if message has been popped and its lock has not expired yet.
+// Delayed messages also have UnlockTs set, but they have never been popped.
+func (pqm *PQMsgMetaData) IsLocked() bool {
+	return pqm.UnlockTs > 0 && pqm.PopCount > 0
+}
+
+// OriginalPriority returns the priority message has been pushed with.
+// Priority of the locked or unlocked message is -1 to keep it at the top of the queue.
+func (pqm *PQMsgMetaData) OriginalPriority() int64 {
+	if pqm.Priority < 0 {
+		return pqm.OrigPriority
+	}
+	return pqm.Priority
+}
+
 func UnmarshalPQMsgMetaData(sn uint64, buf []byte) *PQMsgMetaData {
 	p := PQMsgMetaData{SerialNumber: sn}
 	if err := p.Unmarshal(buf); err != nil {
@@ -36,6 +52,15 @@ func UnmarshalPQMsgMetaData(sn uint64, buf []byte) *PQMsgMetaData {
 	return &p
 }
 
+// PayloadCodec returns the codec of the message payload by its stored metadata.
+func PayloadCodec(meta []byte) int64 {
+	var p PQMsgMetaData
+	if err := p.Unmarshal(meta); err != nil {
+		return db.CodecNone
+	}
+	return p.Codec
+}
+
 func (self *PQMsgMetaData) ByteMarshal() []byte {
 	data, _ := self.Marshal()
 	return data
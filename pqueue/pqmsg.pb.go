@@ -35,17 +35,38 @@ var _ = math.Inf
 const _ = proto.GoGoProtoPackageIsVersion1
 
 type PQueueMsgData struct {
-	Priority int64  `protobuf:"varint,1,opt,name=priority,proto3" json:"priority,omitempty"`
-	ExpireTs int64  `protobuf:"varint,2,opt,name=expire_ts,json=expireTs,proto3" json:"expire_ts,omitempty"`
-	PopCount int64  `protobuf:"varint,3,opt,name=pop_count,json=popCount,proto3" json:"pop_count,omitempty"`
-	UnlockTs int64  `protobuf:"varint,4,opt,name=unlock_ts,json=unlockTs,proto3" json:"unlock_ts,omitempty"`
-	StrId    string `protobuf:"bytes,5,opt,name=str_id,json=strId,proto3" json:"str_id,omitempty"`
+	Priority    int64             `protobuf:"varint,1,opt,name=priority,proto3" json:"priority,omitempty"`
+	ExpireTs    int64             `protobuf:"varint,2,opt,name=expire_ts,json=expireTs,proto3" json:"expire_ts,omitempty"`
+	PopCount    int64             `protobuf:"varint,3,opt,name=pop_count,json=popCount,proto3" json:"pop_count,omitempty"`
+	UnlockTs    int64             `protobuf:"varint,4,opt,name=unlock_ts,json=unlockTs,proto3" json:"unlock_ts,omitempty"`
+	StrId       string            `protobuf:"bytes,5,opt,name=str_id,json=strId,proto3" json:"str_id,omitempty"`
+	GroupId     string            `protobuf:"bytes,6,opt,name=group_id,json=groupId,proto3" json:"group_id,omitempty"`
+	Attrs       map[string]string `protobuf:"bytes,7,rep,name=attrs" json:"attrs,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	PopLimit    int64             `protobuf:"varint,8,opt,name=pop_limit,json=popLimit,proto3" json:"pop_limit,omitempty"`
+	LockTimeout int64             `protobuf:"varint,9,opt,name=lock_timeout,json=lockTimeout,proto3" json:"lock_timeout,omitempty"`
+	PushTs      int64             `protobuf:"varint,10,opt,name=push_ts,json=pushTs,proto3" json:"push_ts,omitempty"`
+	// Dead letter provenance, set when message is moved into the fail queue.
+	SrcQueue    string `protobuf:"bytes,11,opt,name=src_queue,json=srcQueue,proto3" json:"src_queue,omitempty"`
+	SrcPopCount int64  `protobuf:"varint,12,opt,name=src_pop_count,json=srcPopCount,proto3" json:"src_pop_count,omitempty"`
+	SrcPushTs   int64  `protobuf:"varint,13,opt,name=src_push_ts,json=srcPushTs,proto3" json:"src_push_ts,omitempty"`
+	FailReason  string `protobuf:"bytes,14,opt,name=fail_reason,json=failReason,proto3" json:"fail_reason,omitempty"`
+	// Codec the payload is stored with. 0 means raw payload.
+	Codec int64 `protobuf:"varint,15,opt,name=codec,proto3" json:"codec,omitempty"`
+	// Priority of the message before it has been locked. Locked message priority is -1.
+	OrigPriority int64 `protobuf:"varint,16,opt,name=orig_priority,json=origPriority,proto3" json:"orig_priority,omitempty"`
 }
 
 func (m *PQueueMsgData) Reset()                    { *m = PQueueMsgData{} }
 func (*PQueueMsgData) ProtoMessage()               {}
 func (*PQueueMsgData) Descriptor() ([]byte, []int) { return fileDescriptorPqmsg, []int{0} }
 
+func (m *PQueueMsgData) GetAttrs() map[string]string {
+	if m != nil {
+		return m.Attrs
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*PQueueMsgData)(nil), "pqueue.PQueueMsgData")
 }
@@ -89,19 +110,80 @@ func (this *PQueueMsgData) Equal(that interface{}) bool {
 	if this.StrId != that1.StrId {
 		return false
 	}
+	if this.GroupId != that1.GroupId {
+		return false
+	}
+	if len(this.Attrs) != len(that1.Attrs) {
+		return false
+	}
+	for i := range this.Attrs {
+		if this.Attrs[i] != that1.Attrs[i] {
+			return false
+		}
+	}
+	if this.PopLimit != that1.PopLimit {
+		return false
+	}
+	if this.LockTimeout != that1.LockTimeout {
+		return false
+	}
+	if this.PushTs != that1.PushTs {
+		return false
+	}
+	if this.SrcQueue != that1.SrcQueue {
+		return false
+	}
+	if this.SrcPopCount != that1.SrcPopCount {
+		return false
+	}
+	if this.SrcPushTs != that1.SrcPushTs {
+		return false
+	}
+	if this.FailReason != that1.FailReason {
+		return false
+	}
+	if this.Codec != that1.Codec {
+		return false
+	}
+	if this.OrigPriority != that1.OrigPriority {
+		return false
+	}
 	return true
 }
 func (this *PQueueMsgData) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 9)
+	s := make([]string, 0, 20)
 	s = append(s, "&pqueue.PQueueMsgData{")
 	s = append(s, "Priority: "+fmt.Sprintf("%#v", this.Priority)+",\n")
 	s = append(s, "ExpireTs: "+fmt.Sprintf("%#v", this.ExpireTs)+",\n")
 	s = append(s, "PopCount: "+fmt.Sprintf("%#v", this.PopCount)+",\n")
 	s = append(s, "UnlockTs: "+fmt.Sprintf("%#v", this.UnlockTs)+",\n")
 	s = append(s, "StrId: "+fmt.Sprintf("%#v", this.StrId)+",\n")
+	s = append(s, "GroupId: "+fmt.Sprintf("%#v", this.GroupId)+",\n")
+	keysForAttrs := make([]string, 0, len(this.Attrs))
+	for k, _ := range this.Attrs {
+		keysForAttrs = append(keysForAttrs, k)
+	}
+	sort.Strings(keysForAttrs)
+	mapStringForAttrs := "map[string]string{"
+	for _, k := range keysForAttrs {
+		mapStringForAttrs += fmt.Sprintf("%#v: %#v,", k, this.Attrs[k])
+	}
+	mapStringForAttrs += "}"
+	if this.Attrs != nil {
+		s = append(s, "Attrs: "+mapStringForAttrs+",\n")
+	}
+	s = append(s, "PopLimit: "+fmt.Sprintf("%#v", this.PopLimit)+",\n")
+	s = append(s, "LockTimeout: "+fmt.Sprintf("%#v", this.LockTimeout)+",\n")
+	s = append(s, "PushTs: "+fmt.Sprintf("%#v", this.PushTs)+",\n")
+	s = append(s, "SrcQueue: "+fmt.Sprintf("%#v", this.SrcQueue)+",\n")
+	s = append(s, "SrcPopCount: "+fmt.Sprintf("%#v", this.SrcPopCount)+",\n")
+	s = append(s, "SrcPushTs: "+fmt.Sprintf("%#v", this.SrcPushTs)+",\n")
+	s = append(s, "FailReason: "+fmt.Sprintf("%#v", this.FailReason)+",\n")
+	s = append(s, "Codec: "+fmt.Sprintf("%#v", this.Codec)+",\n")
+	s = append(s, "OrigPriority: "+fmt.Sprintf("%#v", this.OrigPriority)+",\n")
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -171,6 +253,78 @@ func (m *PQueueMsgData) MarshalTo(data []byte) (int, error) {
 		i = encodeVarintPqmsg(data, i, uint64(len(m.StrId)))
 		i += copy(data[i:], m.StrId)
 	}
+	if len(m.GroupId) > 0 {
+		data[i] = 0x32
+		i++
+		i = encodeVarintPqmsg(data, i, uint64(len(m.GroupId)))
+		i += copy(data[i:], m.GroupId)
+	}
+	if len(m.Attrs) > 0 {
+		for k, _ := range m.Attrs {
+			data[i] = 0x3a
+			i++
+			v := m.Attrs[k]
+			mapSize := 1 + len(k) + sovPqmsg(uint64(len(k))) + 1 + len(v) + sovPqmsg(uint64(len(v)))
+			i = encodeVarintPqmsg(data, i, uint64(mapSize))
+			data[i] = 0xa
+			i++
+			i = encodeVarintPqmsg(data, i, uint64(len(k)))
+			i += copy(data[i:], k)
+			data[i] = 0x12
+			i++
+			i = encodeVarintPqmsg(data, i, uint64(len(v)))
+			i += copy(data[i:], v)
+		}
+	}
+	if m.PopLimit != 0 {
+		data[i] = 0x40
+		i++
+		i = encodeVarintPqmsg(data, i, uint64(m.PopLimit))
+	}
+	if m.LockTimeout != 0 {
+		data[i] = 0x48
+		i++
+		i = encodeVarintPqmsg(data, i, uint64(m.LockTimeout))
+	}
+	if m.PushTs != 0 {
+		data[i] = 0x50
+		i++
+		i = encodeVarintPqmsg(data, i, uint64(m.PushTs))
+	}
+	if len(m.SrcQueue) > 0 {
+		data[i] = 0x5a
+		i++
+		i = encodeVarintPqmsg(data, i, uint64(len(m.SrcQueue)))
+		i += copy(data[i:], m.SrcQueue)
+	}
+	if m.SrcPopCount != 0 {
+		data[i] = 0x60
+		i++
+		i = encodeVarintPqmsg(data, i, uint64(m.SrcPopCount))
+	}
+	if m.SrcPushTs != 0 {
+		data[i] = 0x68
+		i++
+		i = encodeVarintPqmsg(data, i, uint64(m.SrcPushTs))
+	}
+	if len(m.FailReason) > 0 {
+		data[i] = 0x72
+		i++
+		i = encodeVarintPqmsg(data, i, uint64(len(m.FailReason)))
+		i += copy(data[i:], m.FailReason)
+	}
+	if m.Codec != 0 {
+		data[i] = 0x78
+		i++
+		i = encodeVarintPqmsg(data, i, uint64(m.Codec))
+	}
+	if m.OrigPriority != 0 {
+		data[i] = 0x80
+		i++
+		data[i] = 0x1
+		i++
+		i = encodeVarintPqmsg(data, i, uint64(m.OrigPriority))
+	}
 	return i, nil
 }
 
@@ -220,6 +374,47 @@ func (m *PQueueMsgData) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovPqmsg(uint64(l))
 	}
+	l = len(m.GroupId)
+	if l > 0 {
+		n += 1 + l + sovPqmsg(uint64(l))
+	}
+	if len(m.Attrs) > 0 {
+		for k, v := range m.Attrs {
+			_ = k
+			_ = v
+			mapEntrySize := 1 + len(k) + sovPqmsg(uint64(len(k))) + 1 + len(v) + sovPqmsg(uint64(len(v)))
+			n += mapEntrySize + 1 + sovPqmsg(uint64(mapEntrySize))
+		}
+	}
+	if m.PopLimit != 0 {
+		n += 1 + sovPqmsg(uint64(m.PopLimit))
+	}
+	if m.LockTimeout != 0 {
+		n += 1 + sovPqmsg(uint64(m.LockTimeout))
+	}
+	if m.PushTs != 0 {
+		n += 1 + sovPqmsg(uint64(m.PushTs))
+	}
+	l = len(m.SrcQueue)
+	if l > 0 {
+		n += 1 + l + sovPqmsg(uint64(l))
+	}
+	if m.SrcPopCount != 0 {
+		n += 1 + sovPqmsg(uint64(m.SrcPopCount))
+	}
+	if m.SrcPushTs != 0 {
+		n += 1 + sovPqmsg(uint64(m.SrcPushTs))
+	}
+	l = len(m.FailReason)
+	if l > 0 {
+		n += 1 + l + sovPqmsg(uint64(l))
+	}
+	if m.Codec != 0 {
+		n += 1 + sovPqmsg(uint64(m.Codec))
+	}
+	if m.OrigPriority != 0 {
+		n += 2 + sovPqmsg(uint64(m.OrigPriority))
+	}
 	return n
 }
 
@@ -240,12 +435,33 @@ func (this *PQueueMsgData) String() string {
 	if this == nil {
 		return "nil"
 	}
+	keysForAttrs := make([]string, 0, len(this.Attrs))
+	for k, _ := range this.Attrs {
+		keysForAttrs = append(keysForAttrs, k)
+	}
+	sort.Strings(keysForAttrs)
+	mapStringForAttrs := "map[string]string{"
+	for _, k := range keysForAttrs {
+		mapStringForAttrs += fmt.Sprintf("%v: %v,", k, this.Attrs[k])
+	}
+	mapStringForAttrs += "}"
 	s := strings.Join([]string{`&PQueueMsgData{`,
 		`Priority:` + fmt.Sprintf("%v", this.Priority) + `,`,
 		`ExpireTs:` + fmt.Sprintf("%v", this.ExpireTs) + `,`,
 		`PopCount:` + fmt.Sprintf("%v", this.PopCount) + `,`,
 		`UnlockTs:` + fmt.Sprintf("%v", this.UnlockTs) + `,`,
 		`StrId:` + fmt.Sprintf("%v", this.StrId) + `,`,
+		`GroupId:` + fmt.Sprintf("%v", this.GroupId) + `,`,
+		`Attrs:` + mapStringForAttrs + `,`,
+		`PopLimit:` + fmt.Sprintf("%v", this.PopLimit) + `,`,
+		`LockTimeout:` + fmt.Sprintf("%v", this.LockTimeout) + `,`,
+		`PushTs:` + fmt.Sprintf("%v", this.PushTs) + `,`,
+		`SrcQueue:` + fmt.Sprintf("%v", this.SrcQueue) + `,`,
+		`SrcPopCount:` + fmt.Sprintf("%v", this.SrcPopCount) + `,`,
+		`SrcPushTs:` + fmt.Sprintf("%v", this.SrcPushTs) + `,`,
+		`FailReason:` + fmt.Sprintf("%v", this.FailReason) + `,`,
+		`Codec:` + fmt.Sprintf("%v", this.Codec) + `,`,
+		`OrigPriority:` + fmt.Sprintf("%v", this.OrigPriority) + `,`,
 		`}`,
 	}, "")
 	return s
@@ -392,6 +608,337 @@ func (m *PQueueMsgData) Unmarshal(data []byte) error {
 			}
 			m.StrId = string(data[iNdEx:postIndex])
 			iNdEx = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field GroupId", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqmsg
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthPqmsg
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.GroupId = string(data[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Attrs", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqmsg
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthPqmsg
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			var keykey uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqmsg
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				keykey |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			var stringLenmapkey uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqmsg
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				stringLenmapkey |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLenmapkey := int(stringLenmapkey)
+			if intStringLenmapkey < 0 {
+				return ErrInvalidLengthPqmsg
+			}
+			postStringIndexmapkey := iNdEx + intStringLenmapkey
+			if postStringIndexmapkey > l {
+				return io.ErrUnexpectedEOF
+			}
+			mapkey := string(data[iNdEx:postStringIndexmapkey])
+			iNdEx = postStringIndexmapkey
+			var valuekey uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqmsg
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				valuekey |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			var stringLenmapvalue uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqmsg
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				stringLenmapvalue |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLenmapvalue := int(stringLenmapvalue)
+			if intStringLenmapvalue < 0 {
+				return ErrInvalidLengthPqmsg
+			}
+			postStringIndexmapvalue := iNdEx + intStringLenmapvalue
+			if postStringIndexmapvalue > l {
+				return io.ErrUnexpectedEOF
+			}
+			mapvalue := string(data[iNdEx:postStringIndexmapvalue])
+			iNdEx = postStringIndexmapvalue
+			if m.Attrs == nil {
+				m.Attrs = make(map[string]string)
+			}
+			m.Attrs[mapkey] = mapvalue
+			iNdEx = postIndex
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PopLimit", wireType)
+			}
+			m.PopLimit = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqmsg
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.PopLimit |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field LockTimeout", wireType)
+			}
+			m.LockTimeout = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqmsg
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.LockTimeout |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 10:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PushTs", wireType)
+			}
+			m.PushTs = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqmsg
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.PushTs |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 11:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SrcQueue", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqmsg
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthPqmsg
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.SrcQueue = string(data[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 12:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SrcPopCount", wireType)
+			}
+			m.SrcPopCount = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqmsg
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.SrcPopCount |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 13:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SrcPushTs", wireType)
+			}
+			m.SrcPushTs = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqmsg
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.SrcPushTs |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 14:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field FailReason", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqmsg
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthPqmsg
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.FailReason = string(data[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 15:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Codec", wireType)
+			}
+			m.Codec = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqmsg
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.Codec |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 16:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field OrigPriority", wireType)
+			}
+			m.OrigPriority = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPqmsg
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := data[iNdEx]
+				iNdEx++
+				m.OrigPriority |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipPqmsg(data[iNdEx:])
@@ -519,18 +1066,32 @@ var (
 )
 
 var fileDescriptorPqmsg = []byte{
-	// 204 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xe2, 0x12, 0x2a, 0x28, 0x2c, 0x4d,
-	0x2d, 0x4d, 0xd5, 0x2f, 0x28, 0xcc, 0x2d, 0x4e, 0xd7, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62,
-	0x83, 0x88, 0x29, 0xcd, 0x64, 0xe4, 0xe2, 0x0d, 0x08, 0x04, 0x31, 0x7d, 0x8b, 0xd3, 0x5d, 0x12,
-	0x4b, 0x12, 0x85, 0xa4, 0xb8, 0x38, 0x0a, 0x8a, 0x32, 0xf3, 0x8b, 0x32, 0x4b, 0x2a, 0x25, 0x18,
-	0x15, 0x18, 0x35, 0x98, 0x83, 0xe0, 0x7c, 0x21, 0x69, 0x2e, 0xce, 0xd4, 0x8a, 0x82, 0xcc, 0xa2,
-	0xd4, 0xf8, 0x92, 0x62, 0x09, 0x26, 0x88, 0x24, 0x44, 0x20, 0xa4, 0x18, 0x24, 0x59, 0x90, 0x5f,
-	0x10, 0x9f, 0x9c, 0x5f, 0x9a, 0x57, 0x22, 0xc1, 0x0c, 0xd5, 0x99, 0x5f, 0xe0, 0x0c, 0xe2, 0x83,
-	0x24, 0x4b, 0xf3, 0x72, 0xf2, 0x93, 0xb3, 0x41, 0x3a, 0x59, 0x20, 0x92, 0x10, 0x01, 0xa0, 0x4e,
-	0x51, 0x2e, 0xb6, 0xe2, 0x92, 0xa2, 0xf8, 0xcc, 0x14, 0x09, 0x56, 0xa0, 0x0c, 0x67, 0x10, 0x2b,
-	0x90, 0xe7, 0x99, 0xe2, 0xa4, 0x73, 0xe1, 0xa1, 0x1c, 0xc3, 0x0d, 0x20, 0xfe, 0xf0, 0x50, 0x8e,
-	0xb1, 0xe1, 0x91, 0x1c, 0xe3, 0x0a, 0x20, 0x3e, 0x01, 0xc4, 0x17, 0x80, 0xf8, 0x01, 0x10, 0xbf,
-	0x78, 0x04, 0x94, 0x03, 0xd2, 0x13, 0x1e, 0xcb, 0x31, 0x24, 0xb1, 0x81, 0x3d, 0x66, 0x0c, 0x08,
-	0x00, 0x00, 0xff, 0xff, 0x81, 0x3b, 0x71, 0x4f, 0xee, 0x00, 0x00, 0x00,
+	// 425 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x55, 0x52, 0xcb, 0x4e, 0xc2, 0x40,
+	0x14, 0xa5, 0x3c, 0x0a, 0xdc, 0x82, 0x92, 0x89, 0xc6, 0x11, 0x93, 0x8a, 0xb8, 0x61, 0x61, 0x30,
+	0xd1, 0xc4, 0x10, 0x77, 0xbe, 0x16, 0x26, 0x9a, 0x60, 0xe3, 0xbe, 0xa9, 0xa5, 0x62, 0xc3, 0x63,
+	0x86, 0x99, 0xa9, 0x91, 0x9d, 0x9f, 0xe0, 0x67, 0xf8, 0x11, 0x7e, 0x80, 0x4b, 0x96, 0x2e, 0x05,
+	0x37, 0x2e, 0xfd, 0x04, 0xe7, 0x01, 0x18, 0x17, 0x37, 0x9d, 0x73, 0xce, 0xbd, 0x77, 0xce, 0x9d,
+	0x5b, 0x40, 0x74, 0x94, 0x44, 0x49, 0xb4, 0x4f, 0x47, 0x03, 0xde, 0x6d, 0x52, 0x46, 0x04, 0x41,
+	0xb6, 0xe1, 0xea, 0x6f, 0x59, 0x28, 0xb7, 0x6f, 0xd4, 0xf1, 0x9a, 0x77, 0xcf, 0x03, 0x11, 0xa0,
+	0x2a, 0x14, 0x28, 0x8b, 0x09, 0x8b, 0xc5, 0x18, 0x5b, 0x35, 0xab, 0x91, 0xf1, 0x96, 0x18, 0x6d,
+	0x41, 0x31, 0x7a, 0xa2, 0x31, 0x8b, 0x7c, 0xc1, 0x71, 0xda, 0x88, 0x86, 0xb8, 0xe5, 0x4a, 0xa4,
+	0x84, 0xfa, 0x21, 0x49, 0x86, 0x02, 0x67, 0xe6, 0x95, 0x84, 0x9e, 0x29, 0xac, 0xc4, 0x64, 0xd8,
+	0x27, 0x61, 0x4f, 0x55, 0x66, 0x8d, 0x68, 0x08, 0x59, 0xb9, 0x0e, 0x36, 0x17, 0xcc, 0x8f, 0x3b,
+	0x38, 0x27, 0x95, 0xa2, 0x97, 0x93, 0xe8, 0xb2, 0x83, 0x36, 0xa1, 0xd0, 0x65, 0x24, 0xa1, 0x4a,
+	0xb0, 0xb5, 0x90, 0xd7, 0x58, 0x4a, 0x47, 0x90, 0x0b, 0x84, 0x60, 0x1c, 0xe7, 0x6b, 0x99, 0x86,
+	0x73, 0x50, 0x6b, 0x9a, 0x71, 0x9a, 0xff, 0x46, 0x69, 0x9e, 0xa8, 0x94, 0x8b, 0xa1, 0x60, 0x63,
+	0xcf, 0xa4, 0x2f, 0x3c, 0xf6, 0xe3, 0x41, 0x2c, 0x70, 0x61, 0xe9, 0xf1, 0x4a, 0x61, 0xb4, 0x03,
+	0x25, 0xe3, 0x30, 0x1e, 0x44, 0x24, 0x11, 0xb8, 0xa8, 0x75, 0x47, 0x9b, 0x34, 0x14, 0xda, 0x80,
+	0x3c, 0x4d, 0xf8, 0x83, 0x1a, 0x02, 0xb4, 0x6a, 0x2b, 0x68, 0x86, 0xe7, 0x2c, 0xf4, 0xb5, 0x0b,
+	0xec, 0x68, 0xb3, 0x05, 0x49, 0x68, 0x3b, 0xa8, 0x0e, 0x65, 0x25, 0xfe, 0xbd, 0x4e, 0xc9, 0x74,
+	0x96, 0x64, 0x7b, 0xf1, 0x40, 0x2e, 0x38, 0x3a, 0x67, 0xde, 0xbd, 0xac, 0x33, 0x54, 0xcf, 0xb6,
+	0xb9, 0x60, 0x1b, 0x9c, 0xfb, 0x20, 0xee, 0xfb, 0x2c, 0x0a, 0x38, 0x19, 0xe2, 0x15, 0x7d, 0x05,
+	0x28, 0xca, 0xd3, 0x0c, 0x5a, 0x83, 0x5c, 0x48, 0x3a, 0x51, 0x88, 0x57, 0x75, 0xa9, 0x01, 0x68,
+	0x17, 0xca, 0x72, 0x75, 0x5d, 0x7f, 0xb9, 0xd2, 0x8a, 0x56, 0x4b, 0x8a, 0x6c, 0xcf, 0xb9, 0x6a,
+	0x0b, 0xe0, 0xef, 0xa9, 0x50, 0x05, 0x32, 0xbd, 0xc8, 0xec, 0xbe, 0xe8, 0xa9, 0xa3, 0x6a, 0xfd,
+	0x18, 0xf4, 0xe5, 0x60, 0x69, 0xb3, 0x1e, 0x0d, 0x8e, 0xd3, 0x2d, 0xeb, 0x74, 0x6f, 0x32, 0x75,
+	0x53, 0x1f, 0x32, 0x7e, 0xa6, 0xae, 0xf5, 0x3c, 0x73, 0xad, 0x57, 0x19, 0xef, 0x32, 0x26, 0x32,
+	0x3e, 0x65, 0x7c, 0xcf, 0xa4, 0x26, 0xbf, 0x2f, 0x5f, 0x6e, 0xea, 0xce, 0xd6, 0xff, 0xde, 0xe1,
+	0x2f, 0x1e, 0xc4, 0xa1, 0xb6, 0x91, 0x02, 0x00, 0x00,
 }
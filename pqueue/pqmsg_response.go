@@ -9,6 +9,7 @@ import (
 type MsgResponseItem struct {
 	msg     *PQMsgMetaData
 	payload []byte
+	noRcpt  bool
 }
 
 func NewMsgResponseItem(msg *PQMsgMetaData, payload []byte) *MsgResponseItem {
@@ -18,6 +19,16 @@ func NewMsgResponseItem(msg *PQMsgMetaData, payload []byte) *MsgResponseItem {
 	}
 }
 
+// NewPeekResponseItem creates a response item that doesn't expose message receipt,
+// so peeked in-flight messages can't be released by the peeking client.
+func NewPeekResponseItem(msg *PQMsgMetaData, payload []byte) *MsgResponseItem {
+	return &MsgResponseItem{
+		msg:     msg,
+		payload: payload,
+		noRcpt:  true,
+	}
+}
+
 func (p *MsgResponseItem) ID() string {
 	return p.msg.StrId
 }
@@ -36,9 +47,13 @@ func (p *MsgResponseItem) GetMeta() *PQMsgMetaData {
 
 func (p *MsgResponseItem) WriteResponse(buf *bufio.Writer) error {
 
+	withRcpt := p.msg.UnlockTs > 0 && !p.noRcpt
 	v := 5
-	if p.msg.UnlockTs > 0 {
-		v = 6
+	if withRcpt {
+		v++
+	}
+	if len(p.msg.Attrs) > 0 {
+		v++
 	}
 
 	err := enc.WriteDictSize(buf, v)
@@ -57,7 +72,12 @@ func (p *MsgResponseItem) WriteResponse(buf *bufio.Writer) error {
 	_, err = buf.WriteString(" UTS ")
 	err = enc.WriteInt64(buf, p.msg.UnlockTs)
 
-	if p.msg.UnlockTs > 0 {
+	if len(p.msg.Attrs) > 0 {
+		_, err = buf.WriteString(" ATTR ")
+		err = enc.WriteStrDict(buf, p.msg.Attrs)
+	}
+
+	if withRcpt {
 		_, err = buf.WriteString(" RCPT ")
 		_, err = buf.WriteString(enc.To36Base(p.msg.SerialNumber))
 		err = buf.WriteByte('-')
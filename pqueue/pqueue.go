@@ -1,6 +1,7 @@
 package pqueue
 
 import (
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -53,6 +54,18 @@ type PQueue struct {
 
 	// Number of message which are locked
 	lockedMsgCnt int64
+
+	// Message groups of FIFO queue. It is nil for priority queues.
+	groups *MsgGroups
+
+	// Recently pushed message keys used to reject duplicates.
+	dedup *DedupCache
+
+	// Payloads compressed by the queue.
+	compressStats db.CompressionStats
+
+	// Set to 1 if queue is served by the replica and doesn't accept changes.
+	readOnly int32
 }
 
 func InitPQueue(svcs apis.IServices, desc *queue_info.ServiceDescription, config *conf.PQConfig) *PQueue {
@@ -67,11 +80,16 @@ func InitPQueue(svcs apis.IServices, desc *queue_info.ServiceDescription, config
 		msgSerialNumber:    0,
 		lockedMsgCnt:       0,
 		popLimitMoveChan:   make(chan *PQMsgMetaData, 16384),
+		dedup:              NewDedupCache(),
+	}
+	if desc.SType == apis.ServiceTypeFifoQueue {
+		pq.groups = NewMsgGroups()
 	}
 	// Init inherited service db.
 	pq.InitServiceDB(desc.ServiceId)
 	queue_info.SaveServiceConfig(desc.ServiceId, config)
 	pq.loadAllMessages()
+	pq.loadDedupKeys()
 	return &pq
 }
 
@@ -175,6 +193,17 @@ func (pq *PQueue) GetStatus() map[string]interface{} {
 	res[PQ_STATUS_IN_FLIGHT_MSG] = lockedCount
 	res[PQ_STATUS_AVAILABLE_MSGS] = totalMsg - lockedCount
 	res[PQ_STATUS_FAIL_QUEUE] = pq.config.PopLimitQueueName
+	res[PQ_STATUS_DEDUP_WINDOW] = pq.config.DedupWindow
+	res[PQ_STATUS_DEDUP_BY_PAYLOAD] = pq.config.DedupByPayload
+	res[PQ_STATUS_COMPRESSION] = pq.config.Compression
+	res[PQ_STATUS_COMPRESS_MIN] = pq.config.CompressMinSize
+	res[PQ_STATUS_DURABILITY] = pq.config.Durability
+	for k, v := range pq.compressStats.Dict() {
+		res[k] = v
+	}
+	pq.lock.Lock()
+	res[PQ_STATUS_DEDUP_KEYS] = pq.dedup.Len()
+	pq.lock.Unlock()
 	return res
 }
 
@@ -186,7 +215,13 @@ type PQueueParams struct {
 	PopCountLimit  *int64
 	PopLockTimeout *int64
 	PopWaitTimeout *int64
-	FailQueue      string
+	DedupWindow    *int64
+	DedupByPayload *bool
+	// Compression is a payload codec name, empty string disables compression.
+	Compression     *string
+	CompressMinSize *int64
+	Durability      *string
+	FailQueue       string
 }
 
 func (pq *PQueue) SetParams(params *PQueueParams) apis.IResponse {
@@ -222,6 +257,21 @@ func (pq *PQueue) SetParams(params *PQueueParams) apis.IResponse {
 	if params.PopWaitTimeout != nil {
 		pq.config.PopWaitTimeout = *params.PopWaitTimeout
 	}
+	if params.DedupWindow != nil {
+		pq.config.DedupWindow = *params.DedupWindow
+	}
+	if params.DedupByPayload != nil {
+		pq.config.DedupByPayload = *params.DedupByPayload
+	}
+	if params.Compression != nil {
+		pq.config.Compression = *params.Compression
+	}
+	if params.CompressMinSize != nil {
+		pq.config.CompressMinSize = *params.CompressMinSize
+	}
+	if params.Durability != nil {
+		pq.config.Durability = *params.Durability
+	}
 	pq.lock.Unlock()
 	queue_info.SaveServiceConfig(pq.desc.ServiceId, pq.config)
 	return resp.OK
@@ -236,13 +286,23 @@ func (pq *PQueue) Info() apis.ServiceInfo {
 	s := len(pq.id2sn)
 	pq.lock.Unlock()
 
+	svcType := apis.ServiceTypePriorityQueue
+	if pq.IsFifo() {
+		svcType = apis.ServiceTypeFifoQueue
+	}
+
 	return apis.ServiceInfo{
 		Size: s,
 		ID:   pq.desc.ServiceId,
-		Type: apis.ServiceTypePriorityQueue,
+		Type: svcType,
 	}
 }
 
+// IsFifo returns true if messages are delivered in order within message groups.
+func (pq *PQueue) IsFifo() bool {
+	return pq.groups != nil
+}
+
 // Clear drops all locked and unlocked messages in the queue.
 func (pq *PQueue) Clear() {
 	total := 0
@@ -308,14 +368,25 @@ func (pq *PQueue) ReleaseInFlight(cutOffTs int64) apis.IResponse {
 }
 
 // PopWaitItems pops 'limit' messages within 'timeout'(milliseconds) time interval.
+// Negative lockTimeout locks messages for their own lock timeout or for the queue one.
 func (pq *PQueue) Pop(lockTimeout, popWaitTimeout, limit int64, lock bool) apis.IResponse {
+	return pq.PopFiltered(lockTimeout, popWaitTimeout, limit, lock, nil)
+}
+
+// PopFiltered pops 'limit' messages matching filter within 'timeout'(milliseconds) time interval.
+// Messages that don't match the filter are skipped staying at their positions.
+func (pq *PQueue) PopFiltered(lockTimeout, popWaitTimeout, limit int64, lock bool, filter *MsgFilter) apis.IResponse {
 	// Try to pop items first time and return them if number of popped items is greater than 0.
-	msgItems := pq.popMessages(lockTimeout, limit, lock)
+	msgItems := pq.popMessages(lockTimeout, limit, lock, filter)
 
 	if len(msgItems) > 0 || popWaitTimeout == 0 {
 		return resp.NewItemsResponse(msgItems)
 	}
 
+	// Filtered consumer may receive a notification about the message it can't process.
+	// Such notification is passed once to another waiting consumer, if there is any.
+	passNotification := filter != nil
+
 	endTs := utils.Uts() + popWaitTimeout
 	for {
 		waitLeft := endTs - utils.Uts()
@@ -323,23 +394,34 @@ func (pq *PQueue) Pop(lockTimeout, popWaitTimeout, limit int64, lock bool) apis.
 		case <-signals.QuitChan:
 			return resp.NewItemsResponse(msgItems)
 		case <-pq.newMsgNotification:
-			msgItems := pq.popMessages(lockTimeout, limit, lock)
+			msgItems := pq.popMessages(lockTimeout, limit, lock, filter)
 			if len(msgItems) > 0 {
 				return resp.NewItemsResponse(msgItems)
 			}
+			if passNotification {
+				passNotification = false
+				signals.NewMessageNotify(pq.newMsgNotification)
+			}
 		case <-time.After(time.Duration(waitLeft) * time.Millisecond):
-			return resp.NewItemsResponse(pq.popMessages(lockTimeout, limit, lock))
+			return resp.NewItemsResponse(pq.popMessages(lockTimeout, limit, lock, filter))
 		}
 	}
 }
 
 const (
-	MSG_INFO_ID        = "Id"
-	MSG_INFO_LOCKED    = "Locked"
-	MSG_INFO_UNLOCK_TS = "UnlockTs"
-	MSG_INFO_POP_COUNT = "PopCount"
-	MSG_INFO_PRIORITY  = "Priority"
-	MSG_INFO_EXPIRE_TS = "ExpireTs"
+	MSG_INFO_ID           = "Id"
+	MSG_INFO_LOCKED       = "Locked"
+	MSG_INFO_UNLOCK_TS    = "UnlockTs"
+	MSG_INFO_POP_COUNT    = "PopCount"
+	MSG_INFO_PRIORITY     = "Priority"
+	MSG_INFO_EXPIRE_TS    = "ExpireTs"
+	MSG_INFO_POP_LIMIT    = "PopLimit"
+	MSG_INFO_LOCK_TIMEOUT = "LockTimeout"
+	MSG_INFO_PUSH_TS      = "PushTs"
+	MSG_INFO_SRC_QUEUE    = "SrcQueue"
+	MSG_INFO_SRC_POPCOUNT = "SrcPopCount"
+	MSG_INFO_SRC_PUSH_TS  = "SrcPushTs"
+	MSG_INFO_FAIL_REASON  = "FailReason"
 )
 
 func (pq *PQueue) GetMessageInfo(msgId string) apis.IResponse {
@@ -358,6 +440,21 @@ func (pq *PQueue) GetMessageInfo(msgId string) apis.IResponse {
 		MSG_INFO_PRIORITY:  msg.Priority,
 		MSG_INFO_EXPIRE_TS: msg.ExpireTs,
 	}
+	if msg.PopLimit > 0 {
+		data[MSG_INFO_POP_LIMIT] = msg.PopLimit
+	}
+	if msg.LockTimeout > 0 {
+		data[MSG_INFO_LOCK_TIMEOUT] = msg.LockTimeout
+	}
+	if msg.PushTs > 0 {
+		data[MSG_INFO_PUSH_TS] = msg.PushTs
+	}
+	if msg.SrcQueue != "" {
+		data[MSG_INFO_SRC_QUEUE] = msg.SrcQueue
+		data[MSG_INFO_SRC_POPCOUNT] = msg.SrcPopCount
+		data[MSG_INFO_SRC_PUSH_TS] = msg.SrcPushTs
+		data[MSG_INFO_FAIL_REASON] = msg.FailReason
+	}
 	pq.lock.Unlock()
 	return resp.NewDictResponse("+MSGINFO", data)
 }
@@ -365,6 +462,15 @@ func (pq *PQueue) GetMessageInfo(msgId string) apis.IResponse {
 func (pq *PQueue) DeleteLockedById(msgId string) apis.IResponse {
 	pq.lock.Lock()
 	defer pq.lock.Unlock()
+	return pq.deleteLockedById(msgId)
+}
+
+// DeleteLockedByIds deletes locked messages returning result for each of them.
+func (pq *PQueue) DeleteLockedByIds(msgIds []string) apis.IResponse {
+	return pq.applyBatch(msgIds, pq.deleteLockedById)
+}
+
+func (pq *PQueue) deleteLockedById(msgId string) apis.IResponse {
 	sn := pq.id2sn[msgId]
 
 	if sn == 0 {
@@ -384,6 +490,15 @@ func (pq *PQueue) DeleteLockedById(msgId string) apis.IResponse {
 func (pq *PQueue) DeleteById(msgId string) apis.IResponse {
 	pq.lock.Lock()
 	defer pq.lock.Unlock()
+	return pq.deleteById(msgId)
+}
+
+// DeleteByIds deletes not locked messages returning result for each of them.
+func (pq *PQueue) DeleteByIds(msgIds []string) apis.IResponse {
+	return pq.applyBatch(msgIds, pq.deleteById)
+}
+
+func (pq *PQueue) deleteById(msgId string) apis.IResponse {
 	sn := pq.id2sn[msgId]
 	if sn == 0 {
 		return mpqerr.ERR_MSG_NOT_FOUND
@@ -395,38 +510,126 @@ func (pq *PQueue) DeleteById(msgId string) apis.IResponse {
 	return resp.OK
 }
 
+// PushParams are optional message attributes provided with PUSH.
+type PushParams struct {
+	MsgTtl   int64
+	Delay    int64
+	Priority int64
+	// GroupId is a message group of FIFO queue.
+	GroupId string
+	// Attrs are user defined message attributes that can be used to filter messages.
+	Attrs map[string]string
+	// PopLimit and LockTimeout override queue settings for this message if greater than 0.
+	PopLimit    int64
+	LockTimeout int64
+	// SkipDedup pushes message even if its deduplication key has been seen recently.
+	SkipDedup bool
+	// PopCount is an initial number of receive attempts. It is used to import messages
+	// and ignored for delayed messages.
+	PopCount int64
+	// DeadLetter is set when message is moved from another queue after a failure.
+	DeadLetter *DeadLetterInfo
+}
+
+// FAIL_REASON_POP_LIMIT is a failure reason of the messages moved into the fail queue
+// after their pop count reached the pop limit.
+const FAIL_REASON_POP_LIMIT = "PopLimitExceeded"
+
+// DeadLetterInfo describes where a dead-lettered message came from and why.
+type DeadLetterInfo struct {
+	SrcQueue    string
+	SrcPopCount int64
+	SrcPushTs   int64
+	FailReason  string
+}
+
 func (pq *PQueue) Push(msgId string, payload string, msgTtl, delay, priority int64) apis.IResponse {
+	return pq.PushMsg(msgId, payload, &PushParams{
+		MsgTtl:   msgTtl,
+		Delay:    delay,
+		Priority: priority,
+	})
+}
 
-	if pq.config.MaxMsgsInQueue > 0 && int64(len(pq.id2sn)) >= pq.config.MaxMsgsInQueue {
-		return mpqerr.ERR_SIZE_EXCEEDED
+// PushMsg pushes a message with the provided attributes.
+func (pq *PQueue) PushMsg(msgId string, payload string, params *PushParams) apis.IResponse {
+	if len(params.GroupId) > 0 && !pq.IsFifo() {
+		return mpqerr.ERR_GROUP_NOT_SUPPORTED
 	}
 
 	nowTs := utils.Uts()
-	msg := NewPQMsgMetaData(msgId, priority, nowTs+msgTtl+delay, 0)
+	delay := params.Delay
+	msg := NewPQMsgMetaData(msgId, params.Priority, nowTs+params.MsgTtl+delay, 0)
+	msg.GroupId = params.GroupId
+	if len(params.Attrs) > 0 {
+		msg.Attrs = params.Attrs
+	}
+	msg.PopLimit = params.PopLimit
+	msg.LockTimeout = params.LockTimeout
+	msg.PushTs = nowTs
+	if delay == 0 {
+		msg.PopCount = params.PopCount
+	}
+	data, codec := pq.compressPayload(payload)
+	msg.Codec = codec
+	if dl := params.DeadLetter; dl != nil {
+		msg.SrcQueue = dl.SrcQueue
+		msg.SrcPopCount = dl.SrcPopCount
+		msg.SrcPushTs = dl.SrcPushTs
+		msg.FailReason = dl.FailReason
+	}
+
+	dedupWindow := pq.config.DedupWindow
+	dedupKey := ""
+	if dedupWindow > 0 && !params.SkipDedup {
+		if pq.config.DedupByPayload {
+			dedupKey = payloadDedupKey(payload)
+		} else {
+			dedupKey = msgId
+		}
+	}
 
 	atomic.StoreInt64(&pq.config.LastPushTs, nowTs)
 
 	pq.lock.Lock()
 
+	if pq.config.MaxMsgsInQueue > 0 && int64(len(pq.id2sn)) >= pq.config.MaxMsgsInQueue {
+		pq.lock.Unlock()
+		return mpqerr.ERR_SIZE_EXCEEDED
+	}
+
 	if _, ok := pq.id2sn[msgId]; ok {
 		pq.lock.Unlock()
 		return mpqerr.ERR_ITEM_ALREADY_EXISTS
 	}
 
+	if dedupKey != "" {
+		if pq.dedup.Seen(dedupKey, nowTs) {
+			pq.lock.Unlock()
+			return mpqerr.ERR_MSG_DUPLICATE
+		}
+		pq.dedup.Add(dedupKey, nowTs+dedupWindow)
+		pq.CacheDedupKey(dedupKey, nowTs+dedupWindow)
+	}
+
 	pq.msgSerialNumber++
 	sn := pq.msgSerialNumber
 	msg.SerialNumber = sn
 	pq.id2sn[msgId] = sn
 
+	if pq.groups != nil {
+		pq.groups.Add(msg)
+	}
+
 	if delay == 0 {
-		pq.availMsgs.Push(msg)
+		pq.pushAvailable(msg)
 	} else {
 		msg.UnlockTs = nowTs + delay
 	}
 	pq.trackHeap.Push(msg)
 	// Payload is a race conditional case, since it is not always flushed on disk and may or may not exist in memory.
 	pq.payloadLock.Lock()
-	pq.CacheAllItemData(enc.Sn2Bin(sn), msg.ByteMarshal(), enc.UnsafeStringToBytes(payload))
+	pq.CacheAllItemData(apis.MutationPush, enc.Sn2Bin(sn), msg.ByteMarshal(), data)
 	pq.payloadLock.Unlock()
 	pq.lock.Unlock()
 
@@ -435,7 +638,25 @@ func (pq *PQueue) Push(msgId string, payload string, msgTtl, delay, priority int
 	return resp.OK
 }
 
-func (pq *PQueue) popMessages(lockTimeout int64, limit int64, lock bool) []apis.IResponseItem {
+// WaitDurable waits until pushed messages are durable according to the queue durability level.
+// If flush is true, it waits at least until messages are written into the database.
+// Concurrent callers share the same flush, so it should be called once after a batch of pushes.
+// Returns an error if data could not be written or synced on disk.
+func (pq *PQueue) WaitDurable(flush bool) error {
+	switch pq.config.Durability {
+	case DurabilityFsync:
+		return pq.ForceFlush(true)
+	case DurabilityFlush:
+		return pq.ForceFlush(false)
+	default:
+		if flush {
+			pq.WaitFlush()
+		}
+	}
+	return nil
+}
+
+func (pq *PQueue) popMessages(lockTimeout int64, limit int64, lock bool, filter *MsgFilter) []apis.IResponseItem {
 	nowTs := utils.Uts()
 	var msgs []apis.IResponseItem
 
@@ -444,29 +665,48 @@ func (pq *PQueue) popMessages(lockTimeout int64, limit int64, lock bool) []apis.
 	for int64(len(msgs)) < limit {
 
 		pq.lock.Lock()
-		if pq.availMsgs.Empty() {
+		var msg *PQMsgMetaData
+		if filter == nil {
+			if pq.availMsgs.NotEmpty() {
+				msg = pq.availMsgs.Pop()
+			}
+		} else {
+			msg = pq.availMsgs.PopMatching(filter.Match)
+		}
+		if msg == nil {
 			pq.lock.Unlock()
 			return msgs
 		}
-
-		msg := pq.availMsgs.Pop()
 		snDb := msg.Sn2Bin()
 
 		if lock {
 			pq.lockedMsgCnt++
-			msg.UnlockTs = nowTs + lockTimeout
+			timeout := lockTimeout
+			if timeout < 0 {
+				timeout = pq.config.PopLockTimeout
+				if msg.LockTimeout > 0 {
+					timeout = msg.LockTimeout
+				}
+			}
+			msg.UnlockTs = nowTs + timeout
 			msg.PopCount += 1
+			if msg.Priority >= 0 {
+				msg.OrigPriority = msg.Priority
+			}
 			// Changing priority to -1 guarantees that message will stay at the top of the queue.
 			msg.Priority = -1
 			pq.trackHeap.Push(msg)
-			pq.CacheItemData(snDb, msg.ByteMarshal())
+			pq.CacheItemData(apis.MutationLock, snDb, msg.ByteMarshal())
 		} else {
+			// Message is deleted once it is popped, it must not expire later.
+			pq.trackHeap.Remove(msg.SerialNumber)
 			delete(pq.id2sn, msg.StrId)
+			pq.releaseGroup(msg)
 		}
 
 		pq.payloadLock.Lock()
 		pq.lock.Unlock()
-		payload := pq.Payload(snDb)
+		payload := pq.msgPayload(msg)
 		msgs = append(msgs, NewMsgResponseItem(msg, payload))
 
 		if !lock {
@@ -478,6 +718,77 @@ func (pq *PQueue) popMessages(lockTimeout int64, limit int64, lock bool) []apis.
 	return msgs
 }
 
+// Peek returns available messages in the order they are going to be delivered
+// without changing their state.
+func (pq *PQueue) Peek(offset, limit int64) apis.IResponse {
+	pq.lock.Lock()
+	items := pq.peekItems(pq.availMsgs, offset, limit, nil)
+	pq.lock.Unlock()
+	return resp.NewItemsResponse(items)
+}
+
+// PeekLocked returns in-flight messages ordered by their unlock time
+// without changing their state.
+func (pq *PQueue) PeekLocked(offset, limit int64) apis.IResponse {
+	pq.lock.Lock()
+	items := pq.peekItems(pq.trackHeap, offset, limit, (*PQMsgMetaData).IsLocked)
+	pq.lock.Unlock()
+	return resp.NewItemsResponse(items)
+}
+
+// peekItems makes response items out of the requested page of heap messages that satisfy match.
+// Only offset+limit matching messages are visited in the heap order.
+// Message metadata is copied, so it can be safely accessed after the queue lock is released.
+func (pq *PQueue) peekItems(h *MsgHeap, offset, limit int64, match func(*PQMsgMetaData) bool) []apis.IResponseItem {
+	var items []apis.IResponseItem
+	pq.payloadLock.Lock()
+	h.Walk(func(msg *PQMsgMetaData) bool {
+		if match != nil && !match(msg) {
+			return true
+		}
+		if offset > 0 {
+			offset--
+			return true
+		}
+		m := *msg
+		items = append(items, NewPeekResponseItem(&m, pq.msgPayload(&m)))
+		return int64(len(items)) < limit
+	})
+	pq.payloadLock.Unlock()
+	return items
+}
+
+// ExportMessages calls fn for every message in the order they were pushed including
+// locked and delayed messages. Message metadata passed to fn is a copy.
+// Messages removed while export is in progress are skipped.
+func (pq *PQueue) ExportMessages(fn func(msg *PQMsgMetaData, payload []byte) error) error {
+	pq.lock.Lock()
+	sns := make([]uint64, 0, len(pq.trackHeap.data))
+	for _, msg := range pq.trackHeap.data {
+		sns = append(sns, msg.SerialNumber)
+	}
+	pq.lock.Unlock()
+	sort.Slice(sns, func(i, j int) bool { return sns[i] < sns[j] })
+
+	for _, sn := range sns {
+		pq.lock.Lock()
+		msg := pq.trackHeap.GetMsg(sn)
+		if msg == nil {
+			pq.lock.Unlock()
+			continue
+		}
+		m := *msg
+		pq.payloadLock.Lock()
+		pq.lock.Unlock()
+		payload := pq.msgPayload(&m)
+		pq.payloadLock.Unlock()
+		if err := fn(&m, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // UpdateLockById sets a user defined message lock timeout.
 // It works only for locked messages.
 func (pq *PQueue) UpdateLockById(msgId string, lockTimeout int64) apis.IResponse {
@@ -490,7 +801,7 @@ func (pq *PQueue) UpdateLockById(msgId string, lockTimeout int64) apis.IResponse
 		if msg.UnlockTs > 0 {
 			msg.UnlockTs = utils.Uts() + lockTimeout
 			pq.trackHeap.Push(msg)
-			pq.CacheItemData(msg.Sn2Bin(), msg.ByteMarshal())
+			pq.CacheItemData(apis.MutationLock, msg.Sn2Bin(), msg.ByteMarshal())
 			return resp.OK
 		} else {
 			return mpqerr.ERR_MSG_NOT_LOCKED
@@ -503,7 +814,15 @@ func (pq *PQueue) UpdateLockById(msgId string, lockTimeout int64) apis.IResponse
 func (pq *PQueue) UnlockMessageById(msgId string) apis.IResponse {
 	pq.lock.Lock()
 	defer pq.lock.Unlock()
+	return pq.unlockMessageById(msgId)
+}
+
+// UnlockMessagesByIds unlocks messages returning result for each of them.
+func (pq *PQueue) UnlockMessagesByIds(msgIds []string) apis.IResponse {
+	return pq.applyBatch(msgIds, pq.unlockMessageById)
+}
 
+func (pq *PQueue) unlockMessageById(msgId string) apis.IResponse {
 	// Make sure message exists.
 	sn := pq.id2sn[msgId]
 	if sn == 0 {
@@ -518,33 +837,68 @@ func (pq *PQueue) UnlockMessageById(msgId string) apis.IResponse {
 	return resp.OK
 }
 
-// WARNING: this function acquires lock! It automatically releases lock if message is not found.
-func (pq *PQueue) acquireLockAndGetReceiptMessage(rcpt string) (*PQMsgMetaData, *mpqerr.ErrorResponse) {
+// parseReceipt splits receipt into message serial number and pop count.
+func parseReceipt(rcpt string) (uint64, int64, *mpqerr.ErrorResponse) {
 	parts := strings.SplitN(rcpt, "-", 2)
 
 	if len(parts) != 2 {
-		return nil, mpqerr.ERR_INVALID_RECEIPT
+		return 0, 0, mpqerr.ERR_INVALID_RECEIPT
 	}
 	sn, err := mpqproto.Parse36BaseUIntValue(parts[0])
 	if err != nil {
-		return nil, mpqerr.ERR_INVALID_RECEIPT
+		return 0, 0, mpqerr.ERR_INVALID_RECEIPT
 	}
 
 	popCount, err := mpqproto.Parse36BaseIntValue(parts[1])
 	if err != nil {
-		return nil, mpqerr.ERR_INVALID_RECEIPT
+		return 0, 0, mpqerr.ERR_INVALID_RECEIPT
 	}
+	return sn, popCount, nil
+}
 
-	// To improve performance the lock is acquired here. The caller must unlock it.
-	pq.lock.Lock()
+// receiptMessage returns a message matching serial number and pop count. Lock must be held.
+func (pq *PQueue) receiptMessage(sn uint64, popCount int64) (*PQMsgMetaData, *mpqerr.ErrorResponse) {
 	msg := pq.trackHeap.GetMsg(sn)
-
 	if msg != nil && msg.PopCount == popCount {
 		return msg, nil
 	}
+	return nil, mpqerr.ERR_RECEIPT_EXPIRED
+}
+
+// getReceiptMessage returns a message matching receipt. Lock must be held.
+func (pq *PQueue) getReceiptMessage(rcpt string) (*PQMsgMetaData, *mpqerr.ErrorResponse) {
+	sn, popCount, err := parseReceipt(rcpt)
+	if err != nil {
+		return nil, err
+	}
+	return pq.receiptMessage(sn, popCount)
+}
 
+// WARNING: this function acquires lock! It automatically releases lock if message is not found.
+func (pq *PQueue) acquireLockAndGetReceiptMessage(rcpt string) (*PQMsgMetaData, *mpqerr.ErrorResponse) {
+	sn, popCount, err := parseReceipt(rcpt)
+	if err != nil {
+		return nil, err
+	}
+
+	// To improve performance the lock is acquired here. The caller must unlock it.
+	pq.lock.Lock()
+	msg, err := pq.receiptMessage(sn, popCount)
+	if err != nil {
+		pq.lock.Unlock()
+	}
+	return msg, err
+}
+
+// applyBatch calls fn for every item holding the queue lock once for the whole batch.
+func (pq *PQueue) applyBatch(items []string, fn func(string) apis.IResponse) apis.IResponse {
+	results := make([]apis.IResponse, len(items))
+	pq.lock.Lock()
+	for i, item := range items {
+		results[i] = fn(item)
+	}
 	pq.lock.Unlock()
-	return nil, mpqerr.ERR_RECEIPT_EXPIRED
+	return resp.NewBatchResponse(results)
 }
 
 // UpdateLockByRcpt sets a user defined message lock timeout tp the message that matches receipt.
@@ -554,12 +908,29 @@ func (pq *PQueue) UpdateLockByRcpt(rcpt string, lockTimeout int64) apis.IRespons
 	if err != nil {
 		return err
 	}
+	pq.updateLock(msg, lockTimeout)
+	pq.lock.Unlock()
+	return resp.OK
+}
+
+// UpdateLockByRcpts sets lock timeout to all messages matching receipts returning result for each of them.
+func (pq *PQueue) UpdateLockByRcpts(rcpts []string, lockTimeout int64) apis.IResponse {
+	return pq.applyBatch(rcpts, func(rcpt string) apis.IResponse {
+		msg, err := pq.getReceiptMessage(rcpt)
+		if err != nil {
+			return err
+		}
+		pq.updateLock(msg, lockTimeout)
+		return resp.OK
+	})
+}
 
+func (pq *PQueue) updateLock(msg *PQMsgMetaData, lockTimeout int64) {
 	if msg.UnlockTs == 0 {
 		if lockTimeout > 0 {
 			pq.availMsgs.Remove(msg.SerialNumber)
 		} else {
-			return resp.OK
+			return
 		}
 	}
 
@@ -568,12 +939,8 @@ func (pq *PQueue) UpdateLockByRcpt(rcpt string, lockTimeout int64) apis.IRespons
 	} else {
 		msg.UnlockTs = utils.Uts() + lockTimeout
 		pq.trackHeap.Push(msg)
-		pq.CacheItemData(msg.Sn2Bin(), msg.ByteMarshal())
+		pq.CacheItemData(apis.MutationLock, msg.Sn2Bin(), msg.ByteMarshal())
 	}
-
-	pq.lock.Unlock()
-
-	return resp.OK
 }
 
 func (pq *PQueue) DeleteByReceipt(rcpt string) apis.IResponse {
@@ -582,25 +949,170 @@ func (pq *PQueue) DeleteByReceipt(rcpt string) apis.IResponse {
 	if err != nil {
 		return err
 	}
-	pq.lockedMsgCnt--
-	pq.deleteMessage(msg.SerialNumber)
+	pq.deleteReceiptMessage(msg)
 	pq.lock.Unlock()
 	return resp.OK
 }
 
+// DeleteByReceipts deletes messages matching receipts returning result for each of them.
+func (pq *PQueue) DeleteByReceipts(rcpts []string) apis.IResponse {
+	return pq.applyBatch(rcpts, func(rcpt string) apis.IResponse {
+		msg, err := pq.getReceiptMessage(rcpt)
+		if err != nil {
+			return err
+		}
+		pq.deleteReceiptMessage(msg)
+		return resp.OK
+	})
+}
+
+func (pq *PQueue) deleteReceiptMessage(msg *PQMsgMetaData) {
+	pq.lockedMsgCnt--
+	pq.deleteMessage(msg.SerialNumber)
+}
+
 func (pq *PQueue) UnlockByReceipt(rcpt string) apis.IResponse {
 	// This call may acquire lock.
 	msg, err := pq.acquireLockAndGetReceiptMessage(rcpt)
 	if err != nil {
 		return err
 	}
+	pq.unlockReceiptMessage(msg)
+	pq.lock.Unlock()
+	return resp.OK
+}
+
+// UnlockByReceipts unlocks messages matching receipts returning result for each of them.
+func (pq *PQueue) UnlockByReceipts(rcpts []string) apis.IResponse {
+	return pq.applyBatch(rcpts, func(rcpt string) apis.IResponse {
+		msg, err := pq.getReceiptMessage(rcpt)
+		if err != nil {
+			return err
+		}
+		pq.unlockReceiptMessage(msg)
+		return resp.OK
+	})
+}
+
+func (pq *PQueue) unlockReceiptMessage(msg *PQMsgMetaData) {
 	if msg.UnlockTs > 0 {
 		pq.returnToFront(msg)
 	}
+}
+
+// SetPriorityById changes priority of the message that is not locked.
+func (pq *PQueue) SetPriorityById(msgId string, priority int64) apis.IResponse {
+	pq.lock.Lock()
+	defer pq.lock.Unlock()
+
+	sn := pq.id2sn[msgId]
+	if sn == 0 {
+		return mpqerr.ERR_MSG_NOT_FOUND
+	}
+	if !pq.setPriority(pq.trackHeap.GetMsg(sn), priority) {
+		return mpqerr.ERR_MSG_IS_LOCKED
+	}
+	return resp.OK
+}
+
+// SetPriorityByPrefix changes priority of all not locked messages which IDs start with prefix.
+// Returns a number of updated messages.
+func (pq *PQueue) SetPriorityByPrefix(prefix string, priority int64) apis.IResponse {
+	var total int64
+	pq.lock.Lock()
+	for msgId, sn := range pq.id2sn {
+		if strings.HasPrefix(msgId, prefix) && pq.setPriority(pq.trackHeap.GetMsg(sn), priority) {
+			total++
+		}
+	}
+	pq.lock.Unlock()
+	return resp.NewIntResponse(total)
+}
+
+// setPriority updates message priority moving it to the new position in the queue.
+// Returns false if message is locked.
+func (pq *PQueue) setPriority(msg *PQMsgMetaData, priority int64) bool {
+	if msg.IsLocked() {
+		return false
+	}
+	if msg.Priority == priority {
+		return true
+	}
+	available := pq.availMsgs.Remove(msg.SerialNumber) != nil
+	msg.Priority = priority
+	if available {
+		pq.availMsgs.Push(msg)
+	}
+	pq.CacheItemData(apis.MutationUpdate, msg.Sn2Bin(), msg.ByteMarshal())
+	return true
+}
+
+// UpdatePayloadById replaces payload of the message that is not locked.
+// Serial number, priority and expiration of the message stay the same.
+func (pq *PQueue) UpdatePayloadById(msgId string, payload string) apis.IResponse {
+	pq.lock.Lock()
+	defer pq.lock.Unlock()
+
+	sn := pq.id2sn[msgId]
+	if sn == 0 {
+		return mpqerr.ERR_MSG_NOT_FOUND
+	}
+	msg := pq.trackHeap.GetMsg(sn)
+	// Consumer which holds the lock may be processing the old payload.
+	// It should use receipt to update the payload.
+	if msg.IsLocked() {
+		return mpqerr.ERR_MSG_IS_LOCKED
+	}
+	pq.updatePayload(msg, payload)
+	return resp.OK
+}
+
+// UpdatePayloadByRcpt replaces payload of the message that matches receipt.
+func (pq *PQueue) UpdatePayloadByRcpt(rcpt string, payload string) apis.IResponse {
+	// This call may acquire lock.
+	msg, err := pq.acquireLockAndGetReceiptMessage(rcpt)
+	if err != nil {
+		return err
+	}
+	pq.updatePayload(msg, payload)
 	pq.lock.Unlock()
 	return resp.OK
 }
 
+func (pq *PQueue) updatePayload(msg *PQMsgMetaData, payload string) {
+	data, codec := pq.compressPayload(payload)
+	pq.payloadLock.Lock()
+	if msg.Codec == codec {
+		pq.CachePayload(msg.Sn2Bin(), data)
+	} else {
+		msg.Codec = codec
+		pq.CacheAllItemData(apis.MutationUpdate, msg.Sn2Bin(), msg.ByteMarshal(), data)
+	}
+	pq.payloadLock.Unlock()
+}
+
+// compressPayload compresses payload according to the queue compression settings.
+func (pq *PQueue) compressPayload(payload string) ([]byte, int64) {
+	codec, _ := db.CodecByName(pq.config.Compression)
+	data, codec := db.CompressPayload(codec, pq.config.CompressMinSize, enc.UnsafeStringToBytes(payload))
+	if codec != db.CodecNone {
+		pq.compressStats.Add(len(payload), len(data))
+	}
+	return data, codec
+}
+
+// msgPayload returns message payload decompressing it if necessary.
+// Should be called under payload lock.
+func (pq *PQueue) msgPayload(msg *PQMsgMetaData) []byte {
+	data := pq.Payload(msg.Sn2Bin())
+	payload, err := db.DecompressPayload(msg.Codec, data)
+	if err != nil {
+		log.Error("%s: failed to decompress payload of message %s: %s", pq.desc.Name, msg.StrId, err)
+		return data
+	}
+	return payload
+}
+
 func (pq *PQueue) deleteMessage(sn uint64) bool {
 	if msg := pq.trackHeap.Remove(sn); msg != nil {
 		// message that has UnlockTs > 0 must not be in avail msgs queue.
@@ -608,6 +1120,7 @@ func (pq *PQueue) deleteMessage(sn uint64) bool {
 			pq.availMsgs.Remove(sn)
 		}
 		delete(pq.id2sn, msg.StrId)
+		pq.releaseGroup(msg)
 		pq.payloadLock.Lock()
 		pq.DeleteAllItemData(msg.Sn2Bin())
 		pq.payloadLock.Unlock()
@@ -616,6 +1129,26 @@ func (pq *PQueue) deleteMessage(sn uint64) bool {
 	return false
 }
 
+// pushAvailable makes message available for delivery. Messages of FIFO queue
+// become available only when they reach the head of their group.
+func (pq *PQueue) pushAvailable(msg *PQMsgMetaData) {
+	if pq.groups == nil || pq.groups.IsHead(msg) {
+		pq.availMsgs.Push(msg)
+	}
+}
+
+// releaseGroup removes message from its group making the next group message
+// available for delivery.
+func (pq *PQueue) releaseGroup(msg *PQMsgMetaData) {
+	if pq.groups == nil {
+		return
+	}
+	if next := pq.groups.Remove(msg); next != nil && next.UnlockTs == 0 {
+		pq.availMsgs.Push(next)
+		signals.NewMessageNotify(pq.newMsgNotification)
+	}
+}
+
 func (pq *PQueue) getFailQueue(name string) *PQueue {
 	// Get service and make sure it is still available.
 	popQ, ok := pq.svcs.GetService(name)
@@ -662,17 +1195,173 @@ func (pq *PQueue) moveToPopLimitedQueue() {
 		popLimitPq.closed.Lock()
 
 		binSn := msg.Sn2Bin()
-		popLimitPq.Push(msg.StrId,
-			string(pq.Payload(binSn)),
-			popLimitPq.config.MsgTtl,
-			popLimitPq.config.DeliveryDelay,
-			msg.Priority)
+		params := &PushParams{
+			MsgTtl:   popLimitPq.config.MsgTtl,
+			Delay:    popLimitPq.config.DeliveryDelay,
+			Priority: msg.OriginalPriority(),
+			Attrs:    msg.Attrs,
+			DeadLetter: &DeadLetterInfo{
+				SrcQueue:    pq.desc.Name,
+				SrcPopCount: msg.PopCount,
+				SrcPushTs:   msg.PushTs,
+				FailReason:  FAIL_REASON_POP_LIMIT,
+			},
+		}
+		// Keep the original enqueue time if message has been already dead-lettered before.
+		if msg.SrcPushTs > 0 {
+			params.DeadLetter.SrcPushTs = msg.SrcPushTs
+		}
+		if popLimitPq.IsFifo() {
+			params.GroupId = msg.GroupId
+		}
+		if !popLimitPq.PushMsg(msg.StrId, string(pq.msgPayload(msg)), params).IsError() {
+			if err := popLimitPq.WaitDurable(false); err != nil {
+				log.Error("%s: dead letter queue data is not durable: %s", pq.desc.Name, err)
+			}
+		}
 
 		pq.DeleteAllItemData(binSn)
 		popLimitPq.closed.Unlock()
 	}
 }
 
+// Redrive moves not locked messages into the target queue resetting their pop count.
+// Messages are moved in the order they were pushed unless msgIds are provided.
+// If limit is greater than 0 it restricts the number of moved messages.
+// Returns the number of moved messages.
+func (pq *PQueue) Redrive(targetName string, limit int64, msgIds []string) apis.IResponse {
+	if targetName == pq.desc.Name {
+		return mpqerr.ERR_REDRIVE_SAME_QUEUE
+	}
+	svc, ok := pq.svcs.GetService(targetName)
+	if !ok {
+		return mpqerr.ERR_NO_SVC
+	}
+	target, ok := svc.(*PQueue)
+	if !ok {
+		return mpqerr.ERR_SVC_UNKNOWN_TYPE
+	}
+
+	var moved int64
+	for _, sn := range pq.redriveCandidates(limit, msgIds) {
+		msg, payload := pq.takeMessage(sn)
+		if msg == nil {
+			continue
+		}
+		params := &PushParams{
+			MsgTtl:      target.config.MsgTtl,
+			Priority:    msg.OriginalPriority(),
+			Attrs:       msg.Attrs,
+			PopLimit:    msg.PopLimit,
+			LockTimeout: msg.LockTimeout,
+			SkipDedup:   true,
+		}
+		if target.IsFifo() {
+			params.GroupId = msg.GroupId
+		}
+
+		// Make sure service is not closed while we are pushing messages into it.
+		target.closed.Lock()
+		var res apis.IResponse = mpqerr.ERR_NO_SVC
+		if target.closed.IsUnset() {
+			res = target.PushMsg(msg.StrId, string(payload), params)
+		}
+		target.closed.Unlock()
+
+		if res.IsError() {
+			log.Debug("%s: could not redrive message %s into %s: %s",
+				pq.desc.Name, msg.StrId, targetName, res.StringResponse())
+			pq.restoreMessage(msg)
+			continue
+		}
+		pq.payloadLock.Lock()
+		pq.DeleteAllItemData(msg.Sn2Bin())
+		pq.payloadLock.Unlock()
+		moved++
+	}
+	if moved > 0 {
+		if err := target.WaitDurable(false); err != nil {
+			log.Error("%s: redriven messages are not durable: %s", pq.desc.Name, err)
+		}
+	}
+	return resp.NewIntResponse(moved)
+}
+
+// redriveCandidates returns serial numbers of messages to redrive.
+func (pq *PQueue) redriveCandidates(limit int64, msgIds []string) []uint64 {
+	var sns []uint64
+	pq.lock.Lock()
+	if len(msgIds) > 0 {
+		for _, msgId := range msgIds {
+			if sn := pq.id2sn[msgId]; sn > 0 {
+				sns = append(sns, sn)
+			}
+		}
+	} else {
+		sns = make([]uint64, 0, len(pq.id2sn))
+		for _, msg := range pq.trackHeap.data {
+			if !msg.IsLocked() {
+				sns = append(sns, msg.SerialNumber)
+			}
+		}
+		sort.Slice(sns, func(i, j int) bool { return sns[i] < sns[j] })
+	}
+	pq.lock.Unlock()
+	if limit > 0 && int64(len(sns)) > limit {
+		sns = sns[:limit]
+	}
+	return sns
+}
+
+// takeMessage removes not locked message from the queue keeping its data in the database.
+// The data must be deleted by the caller, or message must be restored.
+func (pq *PQueue) takeMessage(sn uint64) (*PQMsgMetaData, []byte) {
+	pq.lock.Lock()
+	defer pq.lock.Unlock()
+
+	msg := pq.trackHeap.GetMsg(sn)
+	if msg == nil || msg.IsLocked() {
+		return nil, nil
+	}
+	if msg.UnlockTs == 0 {
+		pq.availMsgs.Remove(sn)
+	}
+	pq.trackHeap.Remove(sn)
+	delete(pq.id2sn, msg.StrId)
+	pq.releaseGroup(msg)
+
+	pq.payloadLock.Lock()
+	payload := pq.msgPayload(msg)
+	pq.payloadLock.Unlock()
+	return msg, payload
+}
+
+// restoreMessage returns message taken by takeMessage back into the queue.
+func (pq *PQueue) restoreMessage(msg *PQMsgMetaData) {
+	pq.lock.Lock()
+	defer pq.lock.Unlock()
+
+	if _, ok := pq.id2sn[msg.StrId]; ok {
+		log.Error("%s: message %s has been pushed again, previous message is lost", pq.desc.Name, msg.StrId)
+		pq.payloadLock.Lock()
+		pq.DeleteAllItemData(msg.Sn2Bin())
+		pq.payloadLock.Unlock()
+		return
+	}
+	pq.id2sn[msg.StrId] = msg.SerialNumber
+	if pq.groups != nil {
+		prevHead := pq.groups.Head(msg.GroupId)
+		if pq.groups.Add(msg) && prevHead != nil {
+			pq.availMsgs.Remove(prevHead.SerialNumber)
+		}
+	}
+	if msg.UnlockTs == 0 {
+		pq.pushAvailable(msg)
+	}
+	pq.trackHeap.Push(msg)
+	signals.NewMessageNotify(pq.newMsgNotification)
+}
+
 // Attempts to return a message into the front of the queue.
 // If a number of POP attempts has exceeded, message will be deleted.
 func (pq *PQueue) returnToFront(msg *PQMsgMetaData) {
@@ -680,19 +1369,23 @@ func (pq *PQueue) returnToFront(msg *PQMsgMetaData) {
 		pq.lockedMsgCnt--
 	}
 	popLimit := pq.config.PopCountLimit
+	if msg.PopLimit > 0 {
+		popLimit = msg.PopLimit
+	}
 	if popLimit > 0 && msg.PopCount >= popLimit {
 		if pq.config.PopLimitQueueName == "" {
 			pq.deleteMessage(msg.SerialNumber)
 		} else {
 			pq.trackHeap.Remove(msg.SerialNumber)
 			delete(pq.id2sn, msg.StrId)
+			pq.releaseGroup(msg)
 			pq.popLimitMoveChan <- msg
 		}
 	} else {
 		msg.UnlockTs = 0
-		pq.availMsgs.Push(msg)
+		pq.pushAvailable(msg)
 		pq.trackHeap.Push(msg)
-		pq.CacheItemData(msg.Sn2Bin(), msg.ByteMarshal())
+		pq.CacheItemData(apis.MutationUnlock, msg.Sn2Bin(), msg.ByteMarshal())
 	}
 }
 
@@ -702,6 +1395,7 @@ func (pq *PQueue) CheckTimeouts(ts int64) apis.IResponse {
 
 // Unlocks all items which exceeded their lock time.
 func (pq *PQueue) checkTimeouts(ts int64) int64 {
+	pq.pruneDedupKeys(ts)
 	h := pq.trackHeap
 	var cntDel int64 = 0
 	var cntRet int64 = 0
@@ -731,6 +1425,44 @@ func (pq *PQueue) checkTimeouts(ts int64) int64 {
 	return cntDel + cntRet
 }
 
+// pruneDedupKeys forgets deduplication keys which are out of the deduplication window.
+func (pq *PQueue) pruneDedupKeys(ts int64) {
+	pruned := pq.dedup.Prune(ts, conf.CFG_PQ.TimeoutCheckBatchSize)
+	for _, key := range pruned {
+		pq.DeleteDedupKey(key)
+	}
+	if len(pruned) > 0 {
+		log.Debug("%d deduplication key(s) expired.", len(pruned))
+	}
+}
+
+func (pq *PQueue) loadDedupKeys() {
+	nowTs := utils.Uts()
+	keysIter := pq.DedupKeyIterator()
+	entries := []dedupEntry{}
+	expired := []string{}
+
+	for ; keysIter.Valid(); keysIter.Next() {
+		key := string(keysIter.GetTrimKey())
+		expireTs := int64(enc.DecodeBytesToUnit64(keysIter.GetValue()))
+		if expireTs <= nowTs {
+			expired = append(expired, key)
+		} else {
+			entries = append(entries, dedupEntry{key: key, expireTs: expireTs})
+		}
+	}
+	keysIter.Close()
+
+	sort.Sort(dedupEntries(entries))
+	for _, e := range entries {
+		pq.dedup.Add(e.key, e.expireTs)
+	}
+	for _, key := range expired {
+		pq.DeleteDedupKey(key)
+	}
+	log.Debug("Deduplication keys: %d", pq.dedup.Len())
+}
+
 func (pq *PQueue) loadAllMessages() {
 	nowTs := utils.Uts()
 	log.Debug("Initializing queue: %s", pq.desc.Name)
@@ -756,8 +1488,14 @@ func (pq *PQueue) loadAllMessages() {
 			}
 			pq.id2sn[msg.StrId] = sn
 			pq.trackHeap.Push(msg)
+			if pq.groups != nil {
+				// Group heads are made available once all messages are loaded.
+				pq.groups.Add(msg)
+			}
 			if msg.UnlockTs == 0 {
-				pq.availMsgs.Push(msg)
+				if pq.groups == nil {
+					pq.availMsgs.Push(msg)
+				}
 			} else {
 				if msg.PopCount > 0 {
 					pq.lockedMsgCnt++
@@ -768,6 +1506,14 @@ func (pq *PQueue) loadAllMessages() {
 
 	msgIter.Close()
 
+	if pq.groups != nil {
+		for _, msg := range pq.groups.Heads() {
+			if msg.UnlockTs == 0 {
+				pq.availMsgs.Push(msg)
+			}
+		}
+	}
+
 	if len(delSn) > 0 {
 		log.Debug("Deleting %d expired messages", len(delSn))
 		for _, dsn := range delSn {
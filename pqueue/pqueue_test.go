@@ -1,7 +1,9 @@
 package pqueue
 
 import (
+	"errors"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -9,6 +11,7 @@ import (
 	"github.com/vburenin/firempq/apis"
 	"github.com/vburenin/firempq/conf"
 	"github.com/vburenin/firempq/db"
+	"github.com/vburenin/firempq/enc"
 	"github.com/vburenin/firempq/log"
 	"github.com/vburenin/firempq/mpqerr"
 	"github.com/vburenin/firempq/mpqproto/resp"
@@ -65,6 +68,7 @@ func CreateTestQueueWithName(fsl *FakeSvcLoader, name string) *PQueue {
 	d := getDesc()
 	c := getConfig()
 	d.Name = name
+	d.ServiceId = name
 	q := InitPQueue(fsl, d, c)
 	fsl.data[name] = q
 	return q
@@ -83,6 +87,21 @@ func cmp(t *testing.T, a, b string) {
 	}
 }
 
+func TestPopWithoutLockStopsTracking(t *testing.T) {
+	DefaultPQConfig()
+	q := CreateNewTestQueue()
+	defer q.Close()
+	Convey("Popped messages should not be tracked for expiration", t, func() {
+		q.Push("data1", "p1", 10000, 0, 12)
+		q.Push("data2", "p2", 10000, 0, 12)
+		VerifySingleItem(q.Pop(10000, 0, 1, false), "data1", "p1")
+		VerifyServiceSize(q, 1)
+		So(q.trackHeap.Len(), ShouldEqual, 1)
+		So(q.checkTimeouts(utils.Uts()+20000), ShouldEqual, 1)
+		VerifyServiceSize(q, 0)
+	})
+}
+
 func TestPushPopAndTimeUnlockItems(t *testing.T) {
 	q := CreateNewTestQueue()
 	defer q.Close()
@@ -373,6 +392,8 @@ func TestGetMessageInfo(t *testing.T) {
 		So(msgInfo2[MSG_INFO_POP_COUNT], ShouldEqual, 0)
 		So(msgInfo2[MSG_INFO_PRIORITY], ShouldEqual, 11)
 		So(msgInfo2[MSG_INFO_EXPIRE_TS], ShouldBeGreaterThan, utils.Uts())
+		So(msgInfo2[MSG_INFO_PUSH_TS], ShouldBeLessThanOrEqualTo, utils.Uts())
+		So(msgInfo2, ShouldNotContainKey, MSG_INFO_SRC_QUEUE)
 
 	})
 }
@@ -491,6 +512,134 @@ func TestUnlockByReceipt(t *testing.T) {
 	})
 }
 
+func TestUpdatePayload(t *testing.T) {
+	Convey("Payload should be updated in place", t, func() {
+		q := CreateNewTestQueue()
+		defer q.Close()
+		q.Push("d1", "p1", 10000, 0, 11)
+		q.Push("d2", "p2", 10000, 0, 12)
+
+		So(q.UpdatePayloadById("d3", "p"), ShouldEqual, mpqerr.ERR_MSG_NOT_FOUND)
+		VerifyOkResponse(q.UpdatePayloadById("d2", "new2"))
+
+		r := q.Pop(100000, 0, 1, true)
+		VerifySingleItem(r, "d1", "p1")
+		So(q.UpdatePayloadById("d1", "new1"), ShouldEqual, mpqerr.ERR_MSG_IS_LOCKED)
+
+		rcpt := r.(*resp.MessagesResponse).GetItems()[0].(*MsgResponseItem).Receipt()
+		VerifyOkResponse(q.UpdatePayloadByRcpt(rcpt, "new1"))
+		VerifyOkResponse(q.UnlockByReceipt(rcpt))
+		VerifyItems(q.Pop(0, 0, 10, false), 2, "d1", "new1", "d2", "new2")
+		So(q.UpdatePayloadByRcpt(rcpt, "p"), ShouldEqual, mpqerr.ERR_RECEIPT_EXPIRED)
+	})
+}
+
+func TestPayloadCompression(t *testing.T) {
+	Convey("Payloads should be compressed at rest and read transparently", t, func() {
+		q := CreateNewTestQueue()
+		big := strings.Repeat(`{"key":"value"},`, 100)
+		q.Push("raw", big, 10000, 0, 1)
+
+		compression := db.CompressionSnappy
+		minSize := int64(64)
+		VerifyOkResponse(q.SetParams(&PQueueParams{Compression: &compression, CompressMinSize: &minSize}))
+		q.Push("c1", big, 10000, 0, 1)
+		q.Push("c2", big, 10000, 0, 1)
+		q.Push("small", "p", 10000, 0, 1)
+
+		codec := func(id string) int64 { return q.trackHeap.GetMsg(q.id2sn[id]).Codec }
+		So(codec("raw"), ShouldEqual, db.CodecNone)
+		So(codec("c1"), ShouldEqual, db.CodecSnappy)
+		So(codec("small"), ShouldEqual, db.CodecNone)
+		So(len(q.Payload(enc.Sn2Bin(q.id2sn["c1"]))), ShouldBeLessThan, len(big))
+
+		VerifyOkResponse(q.UpdatePayloadById("c2", "p2"))
+		So(codec("c2"), ShouldEqual, db.CodecNone)
+		status := q.GetStatus()
+		So(status["CompressedPayloads"], ShouldEqual, 2)
+		So(status["CompressionRawBytes"], ShouldEqual, 2*len(big))
+		q.Close()
+
+		q = CreateTestQueue()
+		defer q.Close()
+		So(q.GetStatus()["CompressedPayloads"], ShouldEqual, 0)
+		VerifyItems(q.Pop(0, 0, 10, false), 4, "raw", big, "c1", big, "c2", "p2", "small", "p")
+	})
+}
+
+func TestSetPriority(t *testing.T) {
+	Convey("Priority change should reorder messages", t, func() {
+		q := CreateNewTestQueue()
+		defer q.Close()
+		q.Push("d1", "p1", 10000, 0, 11)
+		q.Push("d2", "p2", 10000, 0, 12)
+		q.Push("x3", "p3", 10000, 0, 13)
+		q.Push("d4", "p4", 10000, 0, 14)
+
+		So(q.SetPriorityById("d5", 1), ShouldEqual, mpqerr.ERR_MSG_NOT_FOUND)
+		VerifyOkResponse(q.SetPriorityById("d4", 1))
+
+		r := q.Pop(100000, 0, 1, true)
+		VerifySingleItem(r, "d4", "p4")
+		So(q.SetPriorityById("d4", 20), ShouldEqual, mpqerr.ERR_MSG_IS_LOCKED)
+
+		n, _ := q.SetPriorityByPrefix("d", 20).(*resp.IntResponse)
+		So(n.Value, ShouldEqual, 2)
+		VerifyItems(q.Pop(0, 0, 10, false), 3, "x3", "p3", "d1", "p1", "d2", "p2")
+	})
+}
+
+func TestPeek(t *testing.T) {
+	Convey("Peek should not change messages state", t, func() {
+		q := CreateNewTestQueue()
+		defer q.Close()
+		q.Push("d1", "p1", 10000, 0, 13)
+		q.Push("d2", "p2", 10000, 0, 11)
+		q.Push("d3", "p3", 10000, 0, 12)
+		q.Push("d4", "p4", 10000, 0, 14)
+
+		VerifyItems(q.Peek(0, 10), 4, "d2", "p2", "d3", "p3", "d1", "p1", "d4", "p4")
+		VerifyItems(q.Peek(1, 2), 2, "d3", "p3", "d1", "p1")
+		VerifyItemsRespSize(q.Peek(4, 2), 0)
+		VerifyItemsRespSize(q.PeekLocked(0, 10), 0)
+
+		VerifySingleItem(q.Pop(20000, 0, 1, true), "d2", "p2")
+		VerifySingleItem(q.Pop(10000, 0, 1, true), "d3", "p3")
+
+		items, _ := VerifyItemsRespSize(q.PeekLocked(0, 10), 2)
+		So(items[0].ID(), ShouldEqual, "d3")
+		So(items[1].ID(), ShouldEqual, "d2")
+		item := items[0].(*MsgResponseItem)
+		So(item.GetMeta().PopCount, ShouldEqual, 1)
+		So(item.GetMeta().UnlockTs, ShouldBeGreaterThan, 0)
+		So(q.PeekLocked(0, 10).StringResponse(), ShouldNotContainSubstring, "RCPT")
+		VerifySingleItem(q.PeekLocked(1, 1), "d2", "p2")
+
+		VerifyItems(q.Peek(0, 10), 2, "d1", "p1", "d4", "p4")
+		VerifyItems(q.Pop(0, 0, 10, false), 2, "d1", "p1", "d4", "p4")
+	})
+
+	Convey("Peek pages should follow the delivery order", t, func() {
+		q := CreateNewTestQueue()
+		defer q.Close()
+		for i := 0; i < 100; i++ {
+			q.Push("d"+strconv.Itoa(i), "p", 10000, 0, int64(i*37%10))
+		}
+		var peeked []string
+		for offset := int64(0); offset < 100; offset += 7 {
+			for _, item := range q.Peek(offset, 7).(*resp.MessagesResponse).GetItems() {
+				peeked = append(peeked, item.ID())
+			}
+		}
+		var popped []string
+		items, _ := VerifyItemsRespSize(q.Pop(0, 0, 100, false), 100)
+		for _, item := range items {
+			popped = append(popped, item.ID())
+		}
+		So(peeked, ShouldResemble, popped)
+	})
+}
+
 func TestDeleteByReceipt(t *testing.T) {
 	Convey("Delete by receipt should have correct behavior", t, func() {
 		q := CreateNewTestQueue()
@@ -509,6 +658,57 @@ func TestDeleteByReceipt(t *testing.T) {
 	})
 }
 
+func TestBatchByReceipts(t *testing.T) {
+	Convey("Batch receipt operations should return result per receipt", t, func() {
+		q := CreateNewTestQueue()
+		defer q.Close()
+		q.Push("d1", "p1", 10000, 0, 11)
+		q.Push("d2", "p2", 10000, 0, 12)
+		q.Push("d3", "p3", 10000, 0, 13)
+		items, _ := VerifyItemsRespSize(q.Pop(100000, 0, 3, true), 3)
+		rcpts := make([]string, 0, 3)
+		for _, item := range items {
+			rcpts = append(rcpts, item.(*MsgResponseItem).Receipt())
+		}
+
+		r := q.UpdateLockByRcpts([]string{rcpts[0], "1-2-3"}, 20000).(*resp.BatchResponse)
+		So(r.GetResults(), ShouldResemble, []apis.IResponse{resp.OK, mpqerr.ERR_INVALID_RECEIPT})
+
+		r = q.UnlockByReceipts([]string{rcpts[1], rcpts[1]}).(*resp.BatchResponse)
+		So(r.GetResults(), ShouldResemble, []apis.IResponse{resp.OK, resp.OK})
+
+		r = q.DeleteByReceipts([]string{rcpts[0], rcpts[2], rcpts[2]}).(*resp.BatchResponse)
+		So(r.GetResults(), ShouldResemble, []apis.IResponse{resp.OK, resp.OK, mpqerr.ERR_RECEIPT_EXPIRED})
+		So(r.StringResponse(), ShouldStartWith, "+BATCH *3 +OK +OK -ERR :400")
+
+		VerifyServiceSize(q, 1)
+		VerifySingleItem(q.Pop(0, 0, 10, false), "d2", "p2")
+	})
+}
+
+func TestBatchByIds(t *testing.T) {
+	Convey("Batch id operations should return result per id", t, func() {
+		q := CreateNewTestQueue()
+		defer q.Close()
+		q.Push("d1", "p1", 10000, 0, 11)
+		q.Push("d2", "p2", 10000, 0, 12)
+		q.Push("d3", "p3", 10000, 0, 13)
+		q.Push("d4", "p4", 10000, 0, 14)
+		VerifyItems(q.Pop(100000, 0, 2, true), 2, "d1", "p1", "d2", "p2")
+
+		r := q.UnlockMessagesByIds([]string{"d1", "d3"}).(*resp.BatchResponse)
+		So(r.GetResults(), ShouldResemble, []apis.IResponse{resp.OK, mpqerr.ERR_MSG_NOT_LOCKED})
+
+		r = q.DeleteLockedByIds([]string{"d2", "d3", "d5"}).(*resp.BatchResponse)
+		So(r.GetResults(), ShouldResemble, []apis.IResponse{resp.OK, mpqerr.ERR_MSG_NOT_LOCKED, mpqerr.ERR_MSG_NOT_FOUND})
+
+		r = q.DeleteByIds([]string{"d1", "d3"}).(*resp.BatchResponse)
+		So(r.GetResults(), ShouldResemble, []apis.IResponse{resp.OK, resp.OK})
+
+		VerifySingleItem(q.Pop(0, 0, 10, false), "d4", "p4")
+	})
+}
+
 func TestUpdateLockByReceipt(t *testing.T) {
 	Convey("Delete by receipt should have correct behavior", t, func() {
 		q := CreateNewTestQueue()
@@ -595,7 +795,476 @@ func TestMessagesMovedToAnotherQueue(t *testing.T) {
 				}
 			}
 			VerifyServiceSize(failQueue, 2)
+
+			m, _ := failQueue.GetMessageInfo("d1").(*resp.DictResponse)
+			So(m, ShouldNotBeNil)
+			info := m.GetDict()
+			So(info[MSG_INFO_SRC_QUEUE], ShouldEqual, "q1")
+			So(info[MSG_INFO_SRC_POPCOUNT], ShouldEqual, 2)
+			So(info[MSG_INFO_SRC_PUSH_TS], ShouldBeGreaterThan, 0)
+			So(info[MSG_INFO_SRC_PUSH_TS], ShouldBeLessThanOrEqualTo, info[MSG_INFO_PUSH_TS])
+			So(info[MSG_INFO_FAIL_REASON], ShouldEqual, FAIL_REASON_POP_LIMIT)
+			So(info[MSG_INFO_PRIORITY], ShouldEqual, 11)
+		})
+
+	})
+}
+
+func CreateNewTestFifoQueue() *PQueue {
+	log.InitLogging()
+	log.SetLevel(1)
+	db.SetDatabase(NewInMemDBService())
+	d := getDesc()
+	d.SType = apis.ServiceTypeFifoQueue
+	return InitPQueue(NewFakeSvcLoader(), d, getConfig())
+}
+
+func pushToGroup(q *PQueue, msgId, group string) apis.IResponse {
+	return q.PushMsg(msgId, "p", &PushParams{MsgTtl: 10000, GroupId: group})
+}
+
+func TestFifoGroupOrder(t *testing.T) {
+	Convey("Messages should be delivered in order within a group", t, func() {
+		q := CreateNewTestFifoQueue()
+		defer q.Close()
+		So(q.Info().Type, ShouldEqual, apis.ServiceTypeFifoQueue)
+
+		VerifyOkResponse(pushToGroup(q, "a1", "a"))
+		VerifyOkResponse(pushToGroup(q, "b1", "b"))
+		VerifyOkResponse(pushToGroup(q, "a2", "a"))
+		VerifyOkResponse(pushToGroup(q, "b2", "b"))
+		VerifyServiceSize(q, 4)
+
+		Convey("Group stays blocked while its head is locked", func() {
+			VerifyItems(q.Pop(10000, 0, 10, true), 2, "a1", "p", "b1", "p")
+			VerifyItems(q.Pop(10000, 0, 10, true), 0)
+
+			VerifyOkResponse(q.DeleteLockedById("a1"))
+			VerifySingleItem(q.Pop(10000, 0, 10, true), "a2", "p")
+
+			VerifyOkResponse(q.UnlockMessageById("b1"))
+			VerifySingleItem(q.Pop(10000, 0, 10, true), "b1", "p")
+		})
+
+		Convey("Timed out head is redelivered before the rest of the group", func() {
+			VerifyItems(q.Pop(1000, 0, 10, true), 2, "a1", "p", "b1", "p")
+			q.checkTimeouts(utils.Uts() + 2000)
+			VerifyItems(q.Pop(1000, 0, 10, true), 2, "a1", "p", "b1", "p")
 		})
 
+		Convey("Deleting a waiting message keeps the group order", func() {
+			VerifyOkResponse(q.DeleteById("a2"))
+			VerifyItems(q.Pop(0, 0, 10, false), 3, "a1", "p", "b1", "p", "b2", "p")
+			VerifyServiceSize(q, 0)
+		})
+	})
+}
+
+func TestFifoPushGroupToPQueue(t *testing.T) {
+	Convey("Priority queue should reject message groups", t, func() {
+		q := CreateNewTestQueue()
+		defer q.Close()
+		So(pushToGroup(q, "a1", "a"), ShouldEqual, mpqerr.ERR_GROUP_NOT_SUPPORTED)
+		VerifyServiceSize(q, 0)
+	})
+}
+
+func TestFifoMessageLoad(t *testing.T) {
+	Convey("Message groups should be restored after reload", t, func() {
+		q := CreateNewTestFifoQueue()
+		VerifyOkResponse(pushToGroup(q, "a1", "a"))
+		VerifyOkResponse(pushToGroup(q, "a2", "a"))
+		VerifyOkResponse(pushToGroup(q, "b1", "b"))
+		VerifyOkResponse(pushToGroup(q, "b2", "b"))
+		VerifyItems(q.Pop(10000, 0, 1, true), 1, "a1", "p")
+		q.Close()
+
+		d := getDesc()
+		d.SType = apis.ServiceTypeFifoQueue
+		q = InitPQueue(NewFakeSvcLoader(), d, getConfig())
+		defer q.Close()
+		VerifyServiceSize(q, 4)
+		VerifySingleItem(q.Pop(10000, 0, 10, true), "b1", "p")
+		VerifyOkResponse(q.DeleteLockedById("a1"))
+		VerifySingleItem(q.Pop(10000, 0, 10, true), "a2", "p")
+	})
+}
+
+func pushWithAttrs(q *PQueue, msgId string, priority int64, attrs map[string]string) apis.IResponse {
+	return q.PushMsg(msgId, "p", &PushParams{MsgTtl: 10000, Priority: priority, Attrs: attrs})
+}
+
+func TestPopFiltered(t *testing.T) {
+	Convey("Filtered pop should skip not matching messages", t, func() {
+		q := CreateNewTestQueue()
+		defer q.Close()
+		VerifyOkResponse(pushWithAttrs(q, "a1", 1, map[string]string{"kind": "img"}))
+		VerifyOkResponse(pushWithAttrs(q, "b2", 2, map[string]string{"kind": "txt"}))
+		VerifyOkResponse(pushWithAttrs(q, "a3", 3, map[string]string{"kind": "txt", "lang": "en"}))
+		VerifyOkResponse(pushWithAttrs(q, "b4", 4, nil))
+		VerifyOkResponse(pushWithAttrs(q, "a5", 5, nil))
+
+		f := NewMsgFilter()
+		f.Attrs = map[string]string{"kind": "txt"}
+		VerifyItems(q.PopFiltered(10000, 0, 10, true, f), 2, "b2", "p", "a3", "p")
+
+		f = NewMsgFilter()
+		f.IdPrefix = "a"
+		f.MinPriority = 2
+		VerifySingleItem(q.PopFiltered(10000, 0, 1, true, f), "a5", "p")
+
+		f = NewMsgFilter()
+		f.MaxPriority = 0
+		VerifyItemsRespSize(q.PopFiltered(10000, 0, 10, true, f), 0)
+
+		VerifyItems(q.Peek(0, 10), 2, "a1", "p", "b4", "p")
+		items, _ := VerifyItemsRespSize(q.Pop(0, 0, 1, false), 1)
+		So(items[0].(*MsgResponseItem).GetMeta().Attrs, ShouldResemble, map[string]string{"kind": "img"})
+	})
+
+	Convey("Filtered pop should wait for matching message", t, func() {
+		q := CreateNewTestQueue()
+		defer q.Close()
+		f := NewMsgFilter()
+		f.Attrs = map[string]string{"kind": "txt"}
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			pushWithAttrs(q, "a1", 1, nil)
+			time.Sleep(10 * time.Millisecond)
+			pushWithAttrs(q, "a2", 1, map[string]string{"kind": "txt"})
+		}()
+		VerifySingleItem(q.PopFiltered(10000, 1000, 10, true, f), "a2", "p")
+		VerifySingleItem(q.Pop(0, 0, 10, false), "a1", "p")
+	})
+}
+
+func TestMsgAttrsLoad(t *testing.T) {
+	Convey("Message attributes should be restored after reload", t, func() {
+		q := CreateNewTestQueue()
+		VerifyOkResponse(pushWithAttrs(q, "a1", 1, map[string]string{"kind": "img", "lang": "en"}))
+		q.Close()
+
+		q = CreateTestQueue()
+		defer q.Close()
+		items, _ := VerifyItemsRespSize(q.Pop(0, 0, 1, false), 1)
+		So(items[0].(*MsgResponseItem).GetMeta().Attrs, ShouldResemble, map[string]string{"kind": "img", "lang": "en"})
+	})
+}
+
+func TestMsgPopLimitAndLockTimeout(t *testing.T) {
+	Convey("Message pop limit and lock timeout should override queue settings", t, func() {
+		q := CreateNewTestQueue()
+		defer q.Close()
+		VerifyOkResponse(q.PushMsg("d1", "p1", &PushParams{MsgTtl: 100000, PopLimit: 1, LockTimeout: 50000}))
+		VerifyOkResponse(q.PushMsg("d2", "p2", &PushParams{MsgTtl: 100000, Priority: 1}))
+
+		nowTs := utils.Uts()
+		items, _ := VerifyItemsRespSize(q.Pop(-1, 0, 2, true), 2)
+		So(items[0].(*MsgResponseItem).GetMeta().UnlockTs, ShouldBeGreaterThanOrEqualTo, nowTs+50000)
+		So(items[1].(*MsgResponseItem).GetMeta().UnlockTs, ShouldBeLessThan, nowTs+50000)
+
+		VerifyOkResponse(q.UnlockMessageById("d1"))
+		VerifyOkResponse(q.UnlockMessageById("d2"))
+		VerifyServiceSize(q, 1)
+		VerifySingleItem(q.Pop(0, 0, 10, false), "d2", "p2")
+	})
+
+	Convey("Requested lock timeout should override message lock timeout", t, func() {
+		q := CreateNewTestQueue()
+		defer q.Close()
+		VerifyOkResponse(q.PushMsg("d1", "p1", &PushParams{MsgTtl: 100000, LockTimeout: 50000}))
+
+		nowTs := utils.Uts()
+		items, _ := VerifyItemsRespSize(q.Pop(1000, 0, 1, true), 1)
+		So(items[0].(*MsgResponseItem).GetMeta().UnlockTs, ShouldBeLessThan, nowTs+50000)
+	})
+}
+
+func TestRedrive(t *testing.T) {
+	Convey("Messages should be redriven into the target queue", t, func() {
+		log.InitLogging()
+		log.SetLevel(1)
+		db.SetDatabase(NewInMemDBService())
+
+		fsl := NewFakeSvcLoader()
+		q1 := CreateTestQueueWithName(fsl, "q1")
+		fq := CreateTestQueueWithName(fsl, "fq")
+		defer q1.Close()
+		defer fq.Close()
+		q1.SetParams(&PQueueParams{DedupWindow: int64Ptr(100000)})
+
+		VerifyOkResponse(q1.PushMsg("d1", "p1", &PushParams{MsgTtl: 10000}))
+		VerifyOkResponse(q1.DeleteById("d1"))
+		VerifyOkResponse(fq.PushMsg("d1", "p1", &PushParams{MsgTtl: 10000, Priority: 3}))
+		VerifyOkResponse(fq.PushMsg("d2", "p2", &PushParams{MsgTtl: 10000, Priority: 2}))
+		VerifyOkResponse(fq.PushMsg("d3", "p3", &PushParams{MsgTtl: 10000, Priority: 1}))
+		VerifyOkResponse(fq.PushMsg("d4", "p4", &PushParams{MsgTtl: 10000, Priority: 0}))
+		VerifySingleItem(fq.Pop(10000, 0, 1, true), "d4", "p4")
+		VerifySingleItem(fq.Pop(10000, 0, 1, true), "d3", "p3")
+		VerifyOkResponse(fq.UnlockMessageById("d3"))
+
+		So(fq.Redrive("fq", 0, nil), ShouldEqual, mpqerr.ERR_REDRIVE_SAME_QUEUE)
+		So(fq.Redrive("q2", 0, nil), ShouldEqual, mpqerr.ERR_NO_SVC)
+
+		So(fq.Redrive("q1", 1, nil).(*resp.IntResponse).Value, ShouldEqual, 1)
+		So(fq.Redrive("q1", 0, []string{"d3", "d4", "d5"}).(*resp.IntResponse).Value, ShouldEqual, 1)
+		So(fq.Redrive("q1", 0, nil).(*resp.IntResponse).Value, ShouldEqual, 1)
+		VerifyServiceSize(fq, 1)
+		VerifyServiceSize(q1, 3)
+
+		// Unlocked message keeps its original priority.
+		VerifyOkResponse(q1.PushMsg("d5", "p5", &PushParams{MsgTtl: 10000, Priority: 0}))
+		items, _ := VerifyItemsRespSize(q1.Pop(10000, 0, 10, true), 4)
+		So(items[0].ID(), ShouldEqual, "d5")
+		So(items[1].ID(), ShouldEqual, "d3")
+		So(items[1].(*MsgResponseItem).GetMeta().PopCount, ShouldEqual, 1)
+		So(items[1].(*MsgResponseItem).GetMeta().OriginalPriority(), ShouldEqual, 1)
+		So(items[2].ID(), ShouldEqual, "d2")
+		So(items[3].ID(), ShouldEqual, "d1")
+		So(string(items[3].Payload()), ShouldEqual, "p1")
+	})
+
+	Convey("Messages should stay in place if they can't be redriven", t, func() {
+		log.InitLogging()
+		log.SetLevel(1)
+		db.SetDatabase(NewInMemDBService())
+
+		fsl := NewFakeSvcLoader()
+		q1 := CreateTestQueueWithName(fsl, "q1")
+		fq := CreateTestQueueWithName(fsl, "fq")
+		defer q1.Close()
+		defer fq.Close()
+
+		VerifyOkResponse(q1.PushMsg("d1", "p", &PushParams{MsgTtl: 10000}))
+		VerifyOkResponse(fq.PushMsg("d1", "p1", &PushParams{MsgTtl: 10000, Priority: 1}))
+		VerifyOkResponse(fq.PushMsg("d2", "p2", &PushParams{MsgTtl: 10000, Priority: 2}))
+		So(fq.Redrive("q1", 0, nil).(*resp.IntResponse).Value, ShouldEqual, 1)
+		VerifySingleItem(fq.Pop(0, 0, 10, false), "d1", "p1")
+	})
+}
+
+func boolPtr(v bool) *bool {
+	return &v
+}
+
+func TestDedupWindow(t *testing.T) {
+	Convey("Message IDs should be deduplicated within the window", t, func() {
+		q := CreateNewTestQueue()
+		defer q.Close()
+		VerifyOkResponse(q.SetParams(&PQueueParams{DedupWindow: int64Ptr(1000)}))
+
+		VerifyOkResponse(q.Push("d1", "p1", 10000, 0, 0))
+		VerifySingleItem(q.Pop(0, 0, 1, false), "d1", "p1")
+		So(q.Push("d1", "p1", 10000, 0, 0), ShouldEqual, mpqerr.ERR_MSG_DUPLICATE)
+		VerifyOkResponse(q.Push("d2", "p1", 10000, 0, 0))
+
+		Convey("ID can be pushed again once window is over", func() {
+			q.checkTimeouts(utils.Uts() + 1100)
+			VerifyOkResponse(q.Push("d1", "p1", 10000, 0, 0))
+		})
+
+		Convey("Payload deduplication should ignore message IDs", func() {
+			VerifyOkResponse(q.SetParams(&PQueueParams{DedupByPayload: boolPtr(true)}))
+			VerifyOkResponse(q.Push("d3", "p3", 10000, 0, 0))
+			So(q.Push("d4", "p3", 10000, 0, 0), ShouldEqual, mpqerr.ERR_MSG_DUPLICATE)
+			VerifyServiceSize(q, 2)
+		})
+	})
+}
+
+func TestDedupKeysLoad(t *testing.T) {
+	Convey("Deduplication keys should be restored after reload", t, func() {
+		q := CreateNewTestQueue()
+		cfg := getConfig()
+		cfg.DedupWindow = 100000
+		VerifyOkResponse(q.SetParams(&PQueueParams{DedupWindow: int64Ptr(cfg.DedupWindow)}))
+		VerifyOkResponse(q.Push("d1", "p1", 10000, 0, 0))
+		VerifyOkResponse(q.DeleteById("d1"))
+		q.Close()
+
+		q = InitPQueue(NewFakeSvcLoader(), getDesc(), cfg)
+		defer q.Close()
+		So(q.Push("d1", "p1", 10000, 0, 0), ShouldEqual, mpqerr.ERR_MSG_DUPLICATE)
+		q.checkTimeouts(utils.Uts() + cfg.DedupWindow + 1)
+		VerifyOkResponse(q.Push("d1", "p1", 10000, 0, 0))
+	})
+}
+
+// flushCountingDB counts forced flushes of the storage.
+type flushCountingDB struct {
+	*InMemDBService
+	flushes int
+	syncs   int
+	err     error
+}
+
+func (d *flushCountingDB) ForceFlush(syncData bool) error {
+	d.flushes++
+	if syncData {
+		d.syncs++
+	}
+	return d.err
+}
+
+func TestPushDurability(t *testing.T) {
+	Convey("Push should wait for the queue durability level", t, func() {
+		DefaultPQConfig()
+		log.InitLogging()
+		log.SetLevel(1)
+		ds := &flushCountingDB{InMemDBService: NewInMemDBService()}
+		db.SetDatabase(ds)
+		q, _ := CreateQueueTestContext()
+		defer q.pq.Close()
+
+		VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "d1", PRM_PAYLOAD, "p1"}))
+		So(ds.flushes, ShouldEqual, 0)
+
+		VerifyOkResponse(q.Call(PQ_CMD_SET_CFG, []string{CPRM_DURABILITY, DurabilityFlush}))
+		VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "d2", PRM_PAYLOAD, "p2"}))
+		So(ds.flushes, ShouldEqual, 1)
+		So(ds.syncs, ShouldEqual, 0)
+
+		VerifyOkResponse(q.Call(PQ_CMD_SET_CFG, []string{CPRM_DURABILITY, DurabilityFsync}))
+		VerifyOkResponse(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "d3", PRM_PAYLOAD, "p3", PRM_SYNC_WAIT}))
+		So(ds.syncs, ShouldEqual, 1)
+
+		So(q.Call(PQ_CMD_PUSH, []string{PRM_ID, "d3", PRM_PAYLOAD, "p3"}), ShouldEqual, mpqerr.ERR_ITEM_ALREADY_EXISTS)
+		So(ds.syncs, ShouldEqual, 1)
+	})
+	Convey("Push should fail if data is not synced on disk", t, func() {
+		DefaultPQConfig()
+		log.InitLogging()
+		log.SetLevel(1)
+		ds := &flushCountingDB{InMemDBService: NewInMemDBService(), err: errors.New("disk failure")}
+		db.SetDatabase(ds)
+		q, _ := CreateQueueTestContext()
+		defer q.pq.Close()
+
+		VerifyOkResponse(q.Call(PQ_CMD_SET_CFG, []string{CPRM_DURABILITY, DurabilityFsync}))
+		res := q.Call(PQ_CMD_PUSH, []string{PRM_ID, "d1", PRM_PAYLOAD, "p1", PRM_SYNC_WAIT})
+		So(res.IsError(), ShouldBeTrue)
+		So(res.(*mpqerr.ErrorResponse).ErrorCode, ShouldEqual, mpqerr.CODE_SERVER_ERR)
+		So(ds.syncs, ShouldEqual, 1)
+
+		VerifyOkResponse(q.Call(PQ_CMD_SET_CFG, []string{CPRM_DURABILITY, DurabilityFlush}))
+		res = q.Call(PQ_CMD_PUSH, []string{PRM_ID, "d2", PRM_PAYLOAD, "p2"})
+		So(res.IsError(), ShouldBeTrue)
+		So(ds.flushes, ShouldEqual, 2)
+	})
+}
+
+type mutation struct {
+	mt        apis.MutationType
+	serviceId string
+	itemId    string
+	meta      []byte
+	payload   []byte
+}
+
+type mutationRecorder struct {
+	mutations []mutation
+}
+
+func (r *mutationRecorder) LogMutation(mt apis.MutationType, serviceId, itemId string, meta, payload []byte) {
+	r.mutations = append(r.mutations, mutation{mt, serviceId, itemId,
+		append([]byte(nil), meta...), append([]byte(nil), payload...)})
+}
+
+func TestApplyMutation(t *testing.T) {
+	Convey("Replica queue should get the same state as the primary queue", t, func() {
+		DefaultPQConfig()
+		log.InitLogging()
+		log.SetLevel(1)
+		db.SetDatabase(NewInMemDBService())
+		recorder := &mutationRecorder{}
+		db.SetMutationLog(recorder)
+		defer db.SetMutationLog(nil)
+
+		fsl := NewFakeSvcLoader()
+		primary := CreateTestQueueWithName(fsl, "primary")
+		defer primary.Close()
+		primary.Push("d1", "p1", 10000, 0, 10)
+		primary.Push("d2", "p2", 10000, 0, 11)
+		primary.Push("d3", "p3", 10000, 0, 12)
+		primary.Push("d4", "p4", 10000, 0, 13)
+		VerifySingleItem(primary.Pop(10000, 0, 1, true), "d1", "p1")
+		VerifySingleItem(primary.Pop(10000, 0, 1, false), "d2", "p2")
+		VerifyOkResponse(primary.UpdatePayloadById("d3", "p3new"))
+		VerifyOkResponse(primary.DeleteById("d4"))
+		db.SetMutationLog(nil)
+
+		replica := CreateTestQueueWithName(fsl, "replica")
+		defer replica.Close()
+		replica.SetReadOnly(true)
+		// Mutations are applied twice to make sure they are idempotent.
+		for i := 0; i < 2; i++ {
+			for _, m := range recorder.mutations {
+				if m.serviceId != "primary" || m.itemId == "" {
+					continue
+				}
+				So(replica.ApplyMutation(m.mt, m.itemId, m.meta, m.payload), ShouldBeNil)
+			}
+		}
+
+		So(replica.TotalMessages(), ShouldEqual, 2)
+		So(replica.LockedCount(), ShouldEqual, 1)
+		So(replica.AvailableMessages(), ShouldEqual, 1)
+		VerifySingleItem(replica.Peek(0, 10), "d3", "p3new")
+		VerifySingleItem(replica.PeekLocked(0, 10), "d1", "p1")
+
+		ctx := replica.NewContext(NewTestResponseWriter())
+		So(ctx.Call(PQ_CMD_PUSH, []string{PRM_ID, "d5", PRM_PAYLOAD, "p5"}), ShouldEqual, mpqerr.ERR_READ_ONLY)
+		So(ctx.Call(PQ_CMD_STATUS, nil).IsError(), ShouldBeFalse)
+
+		replica.SetReadOnly(false)
+		VerifySingleItem(replica.Pop(10000, 0, 1, true), "d3", "p3new")
+		VerifyOkResponse(replica.DeleteLockedById("d1"))
+		So(replica.TotalMessages(), ShouldEqual, 1)
+	})
+}
+
+func TestApplyDedupMutation(t *testing.T) {
+	Convey("Replica should reject duplicates remembered by the primary", t, func() {
+		DefaultPQConfig()
+		log.InitLogging()
+		log.SetLevel(1)
+		db.SetDatabase(NewInMemDBService())
+		recorder := &mutationRecorder{}
+
+		fsl := NewFakeSvcLoader()
+		primary := CreateTestQueueWithName(fsl, "primary")
+		defer primary.Close()
+		replica := CreateTestQueueWithName(fsl, "replica")
+		defer replica.Close()
+		VerifyOkResponse(primary.SetParams(&PQueueParams{DedupWindow: int64Ptr(1000)}))
+		VerifyOkResponse(replica.SetParams(&PQueueParams{DedupWindow: int64Ptr(1000)}))
+
+		db.SetMutationLog(recorder)
+		defer db.SetMutationLog(nil)
+		VerifyOkResponse(primary.Push("d1", "p1", 10000, 0, 0))
+		VerifyOkResponse(primary.DeleteById("d1"))
+		db.SetMutationLog(nil)
+
+		apply := func() {
+			for _, m := range recorder.mutations {
+				if m.serviceId == "primary" && m.itemId != "" {
+					So(replica.ApplyMutation(m.mt, m.itemId, m.meta, m.payload), ShouldBeNil)
+				}
+			}
+			recorder.mutations = nil
+		}
+
+		replica.SetReadOnly(true)
+		apply()
+		replica.SetReadOnly(false)
+		So(replica.Push("d1", "p1", 10000, 0, 0), ShouldEqual, mpqerr.ERR_MSG_DUPLICATE)
+
+		Convey("Expired key should be forgotten by the replica too", func() {
+			db.SetMutationLog(recorder)
+			primary.checkTimeouts(utils.Uts() + 1100)
+			db.SetMutationLog(nil)
+			apply()
+			VerifyOkResponse(replica.Push("d1", "p1", 10000, 0, 0))
+		})
 	})
 }
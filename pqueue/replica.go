@@ -0,0 +1,162 @@
+package pqueue
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/conf"
+	"github.com/vburenin/firempq/enc"
+	"github.com/vburenin/firempq/queue_info"
+	"github.com/vburenin/firempq/signals"
+)
+
+var errBadItemId = errors.New("wrong replicated message id")
+var errBadMetaData = errors.New("wrong replicated message data")
+
+// SetReadOnly switches queue into read only mode. Queue served by the replica
+// doesn't accept changes from clients, it receives them from the primary server.
+func (pq *PQueue) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&pq.readOnly, v)
+}
+
+// IsReadOnly returns true if queue doesn't accept changes from clients.
+func (pq *PQueue) IsReadOnly() bool {
+	return atomic.LoadInt32(&pq.readOnly) == 1
+}
+
+// ApplyConfig replaces queue config with the one replicated from the primary server.
+func (pq *PQueue) ApplyConfig(data []byte) error {
+	config := &conf.PQConfig{}
+	if err := config.Unmarshal(data); err != nil {
+		return err
+	}
+	pq.lock.Lock()
+	*pq.config = *config
+	pq.lock.Unlock()
+	return queue_info.SaveServiceConfig(pq.desc.ServiceId, pq.config)
+}
+
+// ApplyMutation applies message change replicated from the primary server.
+// Mutations are idempotent, so the same mutation can be applied more than once.
+func (pq *PQueue) ApplyMutation(mt apis.MutationType, itemId string, meta, payload []byte) error {
+	if mt == apis.MutationDedup {
+		return pq.applyDedupKey(itemId, meta)
+	}
+	if len(itemId) != 8 {
+		return errBadItemId
+	}
+	sn := enc.DecodeBytesToUnit64(enc.UnsafeStringToBytes(itemId))
+
+	pq.lock.Lock()
+	defer pq.lock.Unlock()
+
+	if mt == apis.MutationDelete {
+		if msg := pq.trackHeap.GetMsg(sn); msg != nil && msg.IsLocked() {
+			pq.lockedMsgCnt--
+		}
+		if !pq.deleteMessage(sn) {
+			pq.payloadLock.Lock()
+			pq.DeleteAllItemData(itemId)
+			pq.payloadLock.Unlock()
+		}
+		return nil
+	}
+
+	if meta == nil {
+		// Payload only update.
+		pq.payloadLock.Lock()
+		pq.CachePayload(itemId, payload)
+		pq.payloadLock.Unlock()
+		return nil
+	}
+
+	msg := UnmarshalPQMsgMetaData(sn, meta)
+	if msg == nil {
+		return errBadMetaData
+	}
+	if prev := pq.trackHeap.GetMsg(sn); prev != nil {
+		pq.replaceMessage(prev, msg)
+	} else {
+		pq.insertMessage(msg)
+	}
+	if sn > pq.msgSerialNumber {
+		pq.msgSerialNumber = sn
+	}
+
+	pq.payloadLock.Lock()
+	if payload != nil {
+		pq.CacheAllItemData(mt, itemId, meta, payload)
+	} else {
+		pq.CacheItemData(mt, itemId, meta)
+	}
+	pq.payloadLock.Unlock()
+	return nil
+}
+
+// applyDedupKey remembers or forgets replicated deduplication key,
+// so the replica rejects duplicates once it is promoted to primary.
+func (pq *PQueue) applyDedupKey(key string, meta []byte) error {
+	if key == "" {
+		return errBadItemId
+	}
+	if meta == nil {
+		pq.lock.Lock()
+		pq.dedup.Remove(key)
+		pq.DeleteDedupKey(key)
+		pq.lock.Unlock()
+		return nil
+	}
+	if len(meta) != 8 {
+		return errBadMetaData
+	}
+	expireTs := int64(enc.DecodeBytesToUnit64(meta))
+	pq.lock.Lock()
+	pq.dedup.Add(key, expireTs)
+	pq.CacheDedupKey(key, expireTs)
+	pq.lock.Unlock()
+	return nil
+}
+
+// replaceMessage updates message state keeping its position in the message group.
+func (pq *PQueue) replaceMessage(prev, msg *PQMsgMetaData) {
+	if prev.UnlockTs == 0 {
+		pq.availMsgs.Remove(prev.SerialNumber)
+	} else if prev.IsLocked() {
+		pq.lockedMsgCnt--
+	}
+	pq.trackHeap.Remove(prev.SerialNumber)
+	// Message groups keep the pointer to the message, so it is updated in place.
+	*prev = *msg
+	pq.trackHeap.Push(prev)
+	pq.makeAvailable(prev)
+}
+
+// insertMessage adds a new replicated message into the queue.
+func (pq *PQueue) insertMessage(msg *PQMsgMetaData) {
+	if sn, ok := pq.id2sn[msg.StrId]; ok {
+		pq.deleteMessage(sn)
+	}
+	pq.id2sn[msg.StrId] = msg.SerialNumber
+	if pq.groups != nil {
+		prevHead := pq.groups.Head(msg.GroupId)
+		if pq.groups.Add(msg) && prevHead != nil {
+			pq.availMsgs.Remove(prevHead.SerialNumber)
+		}
+	}
+	pq.trackHeap.Push(msg)
+	pq.makeAvailable(msg)
+}
+
+func (pq *PQueue) makeAvailable(msg *PQMsgMetaData) {
+	if msg.UnlockTs == 0 {
+		pq.pushAvailable(msg)
+		signals.NewMessageNotify(pq.newMsgNotification)
+	} else if msg.IsLocked() {
+		pq.lockedMsgCnt++
+	}
+}
@@ -0,0 +1,81 @@
+package pqueue
+
+import (
+	"sync"
+
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/signals"
+)
+
+// sessionLocks tracks messages locked on behalf of the session, so they can be
+// returned into the queue once the session is finished. Message is identified
+// by its serial number and pop count, the same way as by receipt.
+type sessionLocks struct {
+	lock      sync.Mutex
+	locks     map[uint64]int64
+	pruneSize int
+}
+
+// Minimal number of tracked messages to prune acknowledged ones while adding new messages.
+const minLocksPruneSize = 128
+
+// add starts tracking of popped messages. Acknowledged messages are pruned
+// once the number of tracked messages is doubled, so long sessions don't leak memory.
+func (sl *sessionLocks) add(pq *PQueue, items []apis.IResponseItem) {
+	sl.lock.Lock()
+	if sl.locks == nil {
+		sl.locks = make(map[uint64]int64, len(items))
+	}
+	for _, item := range items {
+		msg := item.(*MsgResponseItem).GetMeta()
+		sl.locks[msg.SerialNumber] = msg.PopCount
+	}
+	if len(sl.locks) >= sl.pruneSize {
+		sl.pruneLocks(pq)
+		sl.pruneSize = 2*len(sl.locks) + minLocksPruneSize
+	}
+	sl.lock.Unlock()
+}
+
+// prune stops tracking of messages which are not locked anymore: deleted, unlocked
+// or relocked after their lock has expired. Returns the number of messages still locked.
+func (sl *sessionLocks) prune(pq *PQueue) int64 {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	sl.pruneLocks(pq)
+	return int64(len(sl.locks))
+}
+
+func (sl *sessionLocks) pruneLocks(pq *PQueue) {
+	if len(sl.locks) == 0 {
+		return
+	}
+	pq.lock.Lock()
+	for sn, popCount := range sl.locks {
+		if msg, err := pq.receiptMessage(sn, popCount); err != nil || msg.UnlockTs == 0 {
+			delete(sl.locks, sn)
+		}
+	}
+	pq.lock.Unlock()
+}
+
+// release returns all messages that are still locked into the front of the queue.
+// Returns the number of returned messages.
+func (sl *sessionLocks) release(pq *PQueue) int64 {
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	var cnt int64
+	pq.lock.Lock()
+	for sn, popCount := range sl.locks {
+		if msg, err := pq.receiptMessage(sn, popCount); err == nil && msg.UnlockTs > 0 {
+			pq.returnToFront(msg)
+			cnt++
+		}
+	}
+	pq.lock.Unlock()
+	sl.locks = nil
+	if cnt > 0 {
+		signals.NewMessageNotify(pq.newMsgNotification)
+	}
+	return cnt
+}
@@ -0,0 +1,94 @@
+package pqueue
+
+import (
+	"time"
+
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/conf"
+	"github.com/vburenin/firempq/log"
+	"github.com/vburenin/firempq/mpqproto/resp"
+	"github.com/vburenin/firempq/signals"
+)
+
+// MAX_PREFETCH limits the number of unacknowledged messages delivered to the subscriber.
+const MAX_PREFETCH = 10000
+
+// subscription pushes locked messages to the consumer as they become available.
+// No more than prefetch messages are delivered until they are deleted, unlocked
+// or their locks expire.
+type subscription struct {
+	pq          *PQueue
+	writer      apis.ResponseWriter
+	delivered   *sessionLocks
+	prefetch    int64
+	lockTimeout int64
+	wakeChan    chan struct{}
+	stopChan    chan struct{}
+	doneChan    chan struct{}
+}
+
+func newSubscription(pq *PQueue, w apis.ResponseWriter, delivered *sessionLocks,
+	prefetch, lockTimeout int64) *subscription {
+	return &subscription{
+		pq:          pq,
+		writer:      w,
+		delivered:   delivered,
+		prefetch:    prefetch,
+		lockTimeout: lockTimeout,
+		wakeChan:    make(chan struct{}, 1),
+		stopChan:    make(chan struct{}),
+		doneChan:    make(chan struct{}),
+	}
+}
+
+func (s *subscription) start() {
+	go s.run()
+}
+
+// stop stops the delivery waiting for the current batch to be sent.
+func (s *subscription) stop() {
+	close(s.stopChan)
+	<-s.doneChan
+}
+
+// wake makes subscription to recount its credits after messages are acknowledged.
+func (s *subscription) wake() {
+	signals.NewMessageNotify(s.wakeChan)
+}
+
+func (s *subscription) run() {
+	defer close(s.doneChan)
+	// Locks may expire or messages may be deleted by other consumers without
+	// a notification, so credits are recounted periodically.
+	checkInterval := time.Duration(conf.CFG.UpdateInterval) * time.Millisecond
+	queueName := s.pq.Description().Name
+	for {
+		credits := s.prefetch - s.delivered.prune(s.pq)
+		var newMsgs chan struct{}
+		if credits > 0 {
+			if credits > conf.CFG_PQ.MaxPopBatchSize {
+				credits = conf.CFG_PQ.MaxPopBatchSize
+			}
+			msgs := s.pq.popMessages(s.lockTimeout, credits, true, nil)
+			if len(msgs) > 0 {
+				s.delivered.add(s.pq, msgs)
+				r := resp.NewSubscriptionResponse(queueName, resp.NewItemsResponse(msgs))
+				if err := s.writer.WriteResponse(r); err != nil {
+					log.LogConnError(err)
+					return
+				}
+				continue
+			}
+			newMsgs = s.pq.newMsgNotification
+		}
+		select {
+		case <-newMsgs:
+		case <-s.wakeChan:
+		case <-time.After(checkInterval):
+		case <-s.stopChan:
+			return
+		case <-signals.QuitChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package qmgr
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/db"
+	"github.com/vburenin/firempq/log"
+	"github.com/vburenin/firempq/queue_info"
+)
+
+// Default reclaimer settings used if config is not initialized.
+const (
+	defaultReclaimBatchSize = 1000
+	defaultReclaimInterval  = 10 * time.Millisecond
+)
+
+var errReclaimStopped = errors.New("reclaimer is stopped")
+
+// Reclaimer deletes data of dropped services in the background. Keys are deleted
+// in batches with a pause between them, so dropping a large queue doesn't stall
+// other services. Service description is deleted last, so deletion of the services
+// still marked to be deleted continues after restart.
+type Reclaimer struct {
+	lock        sync.Mutex
+	pending     []string
+	current     string
+	deletedKeys int64
+	batchSize   int
+	interval    time.Duration
+	wakeChan    chan struct{}
+	stopChan    chan struct{}
+	doneChan    chan struct{}
+	stopOnce    sync.Once
+}
+
+// NewReclaimer creates a reclaimer deleting batchSize keys at once with the interval between batches.
+func NewReclaimer(batchSize int, interval time.Duration) *Reclaimer {
+	if batchSize <= 0 {
+		batchSize = defaultReclaimBatchSize
+	}
+	return &Reclaimer{
+		batchSize: batchSize,
+		interval:  interval,
+		wakeChan:  make(chan struct{}, 1),
+		stopChan:  make(chan struct{}),
+		doneChan:  make(chan struct{}),
+	}
+}
+
+// Add schedules deletion of the service data.
+func (r *Reclaimer) Add(serviceId string) {
+	r.lock.Lock()
+	r.pending = append(r.pending, serviceId)
+	r.lock.Unlock()
+	select {
+	case r.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts deleting data of scheduled services.
+func (r *Reclaimer) Start() {
+	go r.run()
+}
+
+// Stop stops the reclaimer waiting for the current batch to be deleted.
+func (r *Reclaimer) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stopChan)
+		<-r.doneChan
+	})
+}
+
+// Stats returns the reclaimer progress reported by DBSTATS.
+func (r *Reclaimer) Stats() map[string]interface{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	pending := len(r.pending)
+	if r.current != "" {
+		pending++
+	}
+	return map[string]interface{}{
+		"ReclaimPendingServices": pending,
+		"ReclaimService":         r.current,
+		"ReclaimDeletedKeys":     atomic.LoadInt64(&r.deletedKeys),
+	}
+}
+
+func (r *Reclaimer) next() (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.current = ""
+	if len(r.pending) == 0 {
+		return "", false
+	}
+	r.current = r.pending[0]
+	r.pending = r.pending[1:]
+	return r.current, true
+}
+
+func (r *Reclaimer) run() {
+	defer close(r.doneChan)
+	for {
+		serviceId, ok := r.next()
+		if !ok {
+			select {
+			case <-r.wakeChan:
+				continue
+			case <-r.stopChan:
+				return
+			}
+		}
+		if !r.reclaim(serviceId) {
+			return
+		}
+	}
+}
+
+// reclaim deletes all service data. Returns false if the reclaimer is stopped.
+func (r *Reclaimer) reclaim(serviceId string) bool {
+	log.Info("Deleting data of the dropped service: (id:%s)", serviceId)
+	ds := db.DatabaseInstance()
+	ds.FlushCache()
+	prefixes := []string{
+		db.MakeItemPrefix(serviceId),
+		db.MakePayloadPrefix(serviceId),
+		db.MakeDedupPrefix(serviceId),
+	}
+	var total int64
+	for _, prefix := range prefixes {
+		deleted, err := r.reclaimPrefix(ds, prefix)
+		total += deleted
+		if err == errReclaimStopped {
+			log.Info("Stopped deleting data of the dropped service: (id:%s)", serviceId)
+			return false
+		}
+		if err != nil {
+			log.Error("Failed to delete data of the dropped service %s: %s", serviceId, err)
+			return true
+		}
+	}
+	if err := queue_info.DeleteServiceDescription(serviceId); err != nil {
+		log.Error("Failed to delete dropped service description %s: %s", serviceId, err)
+		return true
+	}
+	log.Info("Data of the dropped service has been deleted: (id:%s) %d keys", serviceId, total)
+	return true
+}
+
+// reclaimPrefix deletes all keys with prefix. The same iterator is used for all
+// batches, so deleted keys are not walked over again to find the next batch.
+func (r *Reclaimer) reclaimPrefix(ds apis.DataStorage, prefix string) (int64, error) {
+	iter := ds.IterData(prefix)
+	defer iter.Close()
+	var total int64
+	for {
+		keys := r.batchKeys(iter)
+		if len(keys) == 0 {
+			return total, nil
+		}
+		if err := ds.DeleteData(keys...); err != nil {
+			return total, err
+		}
+		total += int64(len(keys))
+		atomic.AddInt64(&r.deletedKeys, int64(len(keys)))
+		select {
+		case <-r.stopChan:
+			return total, errReclaimStopped
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+func (r *Reclaimer) batchKeys(iter apis.ItemIterator) []string {
+	keys := make([]string, 0, r.batchSize)
+	for ; iter.Valid() && len(keys) < r.batchSize; iter.Next() {
+		keys = append(keys, string(iter.GetKey()))
+	}
+	return keys
+}
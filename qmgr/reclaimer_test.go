@@ -0,0 +1,125 @@
+package qmgr
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/db"
+	"github.com/vburenin/firempq/log"
+	. "github.com/vburenin/firempq/mpqtesting"
+	"github.com/vburenin/firempq/pqueue"
+	"github.com/vburenin/firempq/queue_info"
+)
+
+func storeService(ds apis.DataStorage, exportId uint64, count int) string {
+	desc := queue_info.NewServiceDescription("q"+strconv.Itoa(int(exportId)), apis.ServiceTypePriorityQueue, exportId)
+	queue_info.SaveServiceDescription(desc)
+	queue_info.SaveServiceConfig(desc.ServiceId, pqueue.DefaultPQConfig())
+	for i := 0; i < count; i++ {
+		id := strconv.Itoa(i)
+		ds.CachedStore2(db.MakeItemPrefix(desc.ServiceId)+id, []byte("meta"),
+			db.MakePayloadPrefix(desc.ServiceId)+id, []byte("payload"))
+	}
+	ds.CachedStore(db.MakeDedupPrefix(desc.ServiceId)+"key", []byte("ts"))
+	return desc.ServiceId
+}
+
+func countKeys(ds apis.DataStorage, svcId string) int {
+	n := 0
+	for _, prefix := range []string{db.MakeItemPrefix(svcId), db.MakePayloadPrefix(svcId), db.MakeDedupPrefix(svcId)} {
+		iter := ds.IterData(prefix)
+		for ; iter.Valid(); iter.Next() {
+			n++
+		}
+		iter.Close()
+	}
+	return n
+}
+
+// iterCountingDB counts iterators opened over the storage.
+type iterCountingDB struct {
+	*InMemDBService
+	iters int64
+}
+
+func (d *iterCountingDB) IterData(prefix string) apis.ItemIterator {
+	atomic.AddInt64(&d.iters, 1)
+	return d.InMemDBService.IterData(prefix)
+}
+
+func waitReclaimed(r *Reclaimer) map[string]interface{} {
+	for i := 0; i < 500 && r.Stats()["ReclaimPendingServices"] != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return r.Stats()
+}
+
+func TestReclaimer(t *testing.T) {
+	Convey("Reclaimer should delete data of dropped services only", t, func() {
+		pqueue.DefaultPQConfig()
+		log.InitLogging()
+		log.SetLevel(1)
+		ds := NewInMemDBService()
+		db.SetDatabase(ds)
+
+		// Service "1" is a prefix of service "10".
+		svcId := storeService(ds, 1, 50)
+		otherId := storeService(ds, 36, 10)
+		So(otherId, ShouldEqual, "10")
+		So(queue_info.MarkServiceDeleted(svcId), ShouldBeTrue)
+		So(queue_info.GetServiceDescription(svcId).ToDelete, ShouldBeTrue)
+
+		Convey("All keys should be deleted in batches", func() {
+			r := NewReclaimer(7, 0)
+			r.Add(svcId)
+			r.Start()
+			stats := waitReclaimed(r)
+			r.Stop()
+			So(stats["ReclaimDeletedKeys"], ShouldEqual, 101)
+			So(stats["ReclaimService"], ShouldEqual, "")
+			So(countKeys(ds, svcId), ShouldEqual, 0)
+			So(queue_info.GetServiceDescription(svcId), ShouldBeNil)
+			So(ds.GetData(queue_info.ServiceConfigPrefix+svcId), ShouldBeNil)
+			So(countKeys(ds, otherId), ShouldEqual, 21)
+			So(queue_info.GetServiceDescription(otherId), ShouldNotBeNil)
+		})
+
+		Convey("Keys should be deleted with one iterator per key prefix", func() {
+			counting := &iterCountingDB{InMemDBService: ds}
+			db.SetDatabase(counting)
+			r := NewReclaimer(3, 0)
+			r.Add(svcId)
+			r.Start()
+			stats := waitReclaimed(r)
+			r.Stop()
+			So(stats["ReclaimDeletedKeys"], ShouldEqual, 101)
+			So(countKeys(ds, svcId), ShouldEqual, 0)
+			So(atomic.LoadInt64(&counting.iters), ShouldEqual, 3)
+		})
+
+		Convey("Stopped reclaimer should continue deletion after restart", func() {
+			r := NewReclaimer(10, time.Hour)
+			r.Add(svcId)
+			r.Start()
+			for i := 0; i < 500 && r.Stats()["ReclaimDeletedKeys"] == int64(0); i++ {
+				time.Sleep(time.Millisecond)
+			}
+			r.Stop()
+			So(countKeys(ds, svcId), ShouldEqual, 91)
+			So(queue_info.GetServiceDescription(svcId), ShouldNotBeNil)
+
+			r = NewReclaimer(10, 0)
+			r.Add(svcId)
+			r.Start()
+			stats := waitReclaimed(r)
+			r.Stop()
+			So(stats["ReclaimDeletedKeys"], ShouldEqual, 91)
+			So(countKeys(ds, svcId), ShouldEqual, 0)
+			So(queue_info.GetServiceDescription(svcId), ShouldBeNil)
+		})
+	})
+}
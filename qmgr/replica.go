@@ -0,0 +1,139 @@
+package qmgr
+
+import (
+	"errors"
+
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/conf"
+	"github.com/vburenin/firempq/log"
+	"github.com/vburenin/firempq/pqueue"
+	"github.com/vburenin/firempq/queue_info"
+)
+
+var errServiceNotLoaded = errors.New("replicated service could not be loaded")
+
+func setReadOnly(svc apis.ISvc, readOnly bool) {
+	if pq, ok := svc.(*pqueue.PQueue); ok {
+		pq.SetReadOnly(readOnly)
+	}
+}
+
+// IsReadOnly returns true if services don't accept changes from clients.
+func (s *ServiceManager) IsReadOnly() bool {
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
+	return s.readOnly
+}
+
+// Promote makes all services writable and starts their background updates.
+func (s *ServiceManager) Promote() {
+	s.rwLock.Lock()
+	defer s.rwLock.Unlock()
+	if !s.readOnly {
+		return
+	}
+	s.readOnly = false
+	for _, svc := range s.allSvcs {
+		setReadOnly(svc, false)
+		svc.StartUpdate()
+	}
+	log.Info("Services are promoted to primary")
+}
+
+func (s *ServiceManager) serviceById(serviceId string) apis.ISvc {
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
+	return s.svcIds[serviceId]
+}
+
+// ApplyMutation applies data mutation replicated from the primary server.
+func (s *ServiceManager) ApplyMutation(mt apis.MutationType, serviceId, itemId string, meta, payload []byte) error {
+	switch mt {
+	case apis.MutationService:
+		return s.applyServiceDesc(meta)
+	case apis.MutationConfig:
+		return s.applyServiceConfig(serviceId, meta)
+	case apis.MutationDrop:
+		s.applyDrop(serviceId)
+		return nil
+	}
+
+	pq, ok := s.serviceById(serviceId).(*pqueue.PQueue)
+	if !ok {
+		log.Debug("Mutation of unknown service is skipped: %s", serviceId)
+		return nil
+	}
+	return pq.ApplyMutation(mt, itemId, meta, payload)
+}
+
+func (s *ServiceManager) applyServiceDesc(data []byte) error {
+	desc, err := queue_info.UnmarshalServiceDesc(data)
+	if err != nil {
+		return err
+	}
+	// Service marked to be deleted is followed by the drop mutation.
+	if desc.ToDelete {
+		return nil
+	}
+
+	s.rwLock.Lock()
+	defer s.rwLock.Unlock()
+	if _, ok := s.svcIds[desc.ServiceId]; ok {
+		return queue_info.SaveServiceDescription(desc)
+	}
+	if prev, ok := s.allSvcs[desc.Name]; ok {
+		// Service has been recreated on the primary.
+		s.dropService(prev)
+	}
+	if err := queue_info.SaveServiceDescription(desc); err != nil {
+		return err
+	}
+	svc, ok := s.loadService(desc)
+	if !ok {
+		return errServiceNotLoaded
+	}
+	setReadOnly(svc, s.readOnly)
+	s.allSvcs[desc.Name] = svc
+	s.svcIds[desc.ServiceId] = svc
+	if desc.ExportId > s.serviceIdCounter {
+		s.serviceIdCounter = desc.ExportId
+	}
+	log.Info("Replicated service has been created: %s", desc.Name)
+	return nil
+}
+
+func (s *ServiceManager) applyServiceConfig(serviceId string, data []byte) error {
+	if pq, ok := s.serviceById(serviceId).(*pqueue.PQueue); ok {
+		return pq.ApplyConfig(data)
+	}
+	// Config of a new service is replicated before its description.
+	config := &conf.PQConfig{}
+	if err := config.Unmarshal(data); err != nil {
+		return err
+	}
+	return queue_info.SaveServiceConfig(serviceId, config)
+}
+
+func (s *ServiceManager) applyDrop(serviceId string) {
+	s.rwLock.Lock()
+	defer s.rwLock.Unlock()
+	if svc, ok := s.svcIds[serviceId]; ok {
+		s.dropService(svc)
+	} else {
+		s.deleteServiceData(serviceId)
+	}
+}
+
+// dropService closes the service and deletes all its data. Must be called under the lock.
+func (s *ServiceManager) dropService(svc apis.ISvc) {
+	svcId := svc.Info().ID
+	svc.Close()
+	for name, v := range s.allSvcs {
+		if v == svc {
+			delete(s.allSvcs, name)
+		}
+	}
+	delete(s.svcIds, svcId)
+	s.deleteServiceData(svcId)
+	log.Info("Replicated service has been removed: (id:%s)", svcId)
+}
@@ -3,6 +3,7 @@ package qmgr
 import (
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/vburenin/firempq/apis"
 	"github.com/vburenin/firempq/conf"
@@ -19,7 +20,7 @@ type ServiceLoader func(apis.IServices, *queue_info.ServiceDescription) (apis.IS
 
 func GetServiceLoader(serviceType string) (ServiceLoader, bool) {
 	switch serviceType {
-	case apis.ServiceTypePriorityQueue:
+	case apis.ServiceTypePriorityQueue, apis.ServiceTypeFifoQueue:
 		return pqueue.LoadPQueue, true
 	default:
 		return nil, false
@@ -36,19 +37,35 @@ func CreateServiceManager() *ServiceManager {
 
 type ServiceManager struct {
 	allSvcs          map[string]apis.ISvc
+	svcIds           map[string]apis.ISvc
 	rwLock           sync.RWMutex
 	serviceIdCounter uint64
+	// Services of the replica don't accept changes from clients.
+	readOnly bool
+	// Deletes data of dropped services.
+	reclaimer *Reclaimer
 }
 
 func NewServiceManager() *ServiceManager {
 	f := ServiceManager{
 		allSvcs:          make(map[string]apis.ISvc),
+		svcIds:           make(map[string]apis.ISvc),
 		serviceIdCounter: 0,
+		readOnly:         conf.CFG != nil && conf.CFG.ReplicaOf != "",
+		reclaimer:        newReclaimer(),
 	}
 	f.loadAllServices()
+	f.reclaimer.Start()
 	return &f
 }
 
+func newReclaimer() *Reclaimer {
+	if conf.CFG == nil {
+		return NewReclaimer(defaultReclaimBatchSize, defaultReclaimInterval)
+	}
+	return NewReclaimer(conf.CFG.ReclaimBatchSize, time.Duration(conf.CFG.ReclaimInterval)*time.Millisecond)
+}
+
 func (s *ServiceManager) loadAllServices() {
 	descList := queue_info.GetServiceDescriptions()
 	if len(descList) > 0 {
@@ -60,10 +77,15 @@ func (s *ServiceManager) loadAllServices() {
 		}
 		if svc, ok := s.loadService(desc); ok {
 			s.allSvcs[desc.Name] = svc
+			s.svcIds[desc.ServiceId] = svc
 		}
 	}
 	for _, svc := range s.allSvcs {
-		svc.StartUpdate()
+		if s.readOnly {
+			setReadOnly(svc, true)
+		} else {
+			svc.StartUpdate()
+		}
 	}
 }
 
@@ -74,7 +96,7 @@ func (s *ServiceManager) loadService(desc *queue_info.ServiceDescription) (apis.
 	}
 	if desc.ToDelete {
 		log.Warning("Service should be deleted: %s", desc.Name)
-		queue_info.DeleteServiceData(desc.Name)
+		s.reclaimer.Add(desc.ServiceId)
 		return nil, false
 	}
 	log.Debug("Loading service data for: %s", desc.Name)
@@ -101,14 +123,32 @@ func (s *ServiceManager) CreateService(svcType string, svcName string, params []
 			return r
 		}
 		return s.CreatePQueue(svcName, pqConf)
+	case apis.ServiceTypeFifoQueue:
+		pqConf, r := pqueue.ParsePQConfig(params)
+		if r.IsError() {
+			return r
+		}
+		return s.CreateFifoQueue(svcName, pqConf)
 	default:
 		return mpqerr.ERR_SVC_UNKNOWN_TYPE
 	}
 }
 
 func (s *ServiceManager) CreatePQueue(svcName string, config *conf.PQConfig) apis.IResponse {
+	return s.createQueue(apis.ServiceTypePriorityQueue, svcName, config)
+}
+
+// CreateFifoQueue creates a queue delivering messages in order within message groups.
+func (s *ServiceManager) CreateFifoQueue(svcName string, config *conf.PQConfig) apis.IResponse {
+	return s.createQueue(apis.ServiceTypeFifoQueue, svcName, config)
+}
+
+func (s *ServiceManager) createQueue(svcType, svcName string, config *conf.PQConfig) apis.IResponse {
 	s.rwLock.Lock()
 	defer s.rwLock.Unlock()
+	if s.readOnly {
+		return mpqerr.ERR_READ_ONLY
+	}
 	if !mpqproto.ValidateServiceName(svcName) {
 		return mpqerr.ERR_WRONG_SVC_NAME
 	}
@@ -116,22 +156,26 @@ func (s *ServiceManager) CreatePQueue(svcName string, config *conf.PQConfig) api
 		return mpqerr.ERR_SVC_ALREADY_EXISTS
 	}
 
-	desc := queue_info.NewServiceDescription(svcName, apis.ServiceTypePriorityQueue, s.serviceIdCounter+1)
+	desc := queue_info.NewServiceDescription(svcName, svcType, s.serviceIdCounter+1)
 	svc := pqueue.InitPQueue(s, desc, config)
 
 	s.serviceIdCounter++
 	queue_info.SaveServiceDescription(desc)
 	s.allSvcs[svcName] = svc
+	s.svcIds[desc.ServiceId] = svc
 
 	svc.StartUpdate()
 
 	return resp.OK
 }
 
-// DropService drops service.
+// DropService drops service. Service data is deleted in the background.
 func (s *ServiceManager) DropService(svcName string) apis.IResponse {
 	s.rwLock.Lock()
 	defer s.rwLock.Unlock()
+	if s.readOnly {
+		return mpqerr.ERR_READ_ONLY
+	}
 	svc, ok := s.allSvcs[svcName]
 	if !ok {
 		return mpqerr.ERR_NO_SVC
@@ -139,11 +183,24 @@ func (s *ServiceManager) DropService(svcName string) apis.IResponse {
 	svc.Close()
 	delete(s.allSvcs, svcName)
 	svcID := svc.Info().ID
-	queue_info.DeleteServiceData(svcID)
+	delete(s.svcIds, svcID)
+	s.deleteServiceData(svcID)
 	log.Debug("Service '%s' has been removed: (id:%s)", svcName, svcID)
 	return resp.OK
 }
 
+// deleteServiceData marks the service to be deleted and schedules deletion of its data.
+func (s *ServiceManager) deleteServiceData(svcId string) {
+	if queue_info.MarkServiceDeleted(svcId) {
+		s.reclaimer.Add(svcId)
+	}
+}
+
+// ReclaimStats returns progress of the dropped services data deletion.
+func (s *ServiceManager) ReclaimStats() map[string]interface{} {
+	return s.reclaimer.Stats()
+}
+
 func (s *ServiceManager) BuildServiceNameList(svcPrefix string) []string {
 	services := make([]string, 0)
 	s.rwLock.RLock()
@@ -176,4 +233,5 @@ func (s *ServiceManager) Close() {
 		svc.Close()
 	}
 	s.rwLock.Unlock()
+	s.reclaimer.Stop()
 }
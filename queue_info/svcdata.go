@@ -36,13 +36,14 @@ func LoadServiceConfig(serviceId string, cfg apis.BinaryMarshaller) error {
 
 // SaveServiceConfig saves service config into database.
 func SaveServiceConfig(serviceId string, conf apis.BinaryMarshaller) error {
-	db := db.DatabaseInstance()
+	ds := db.DatabaseInstance()
 	data, _ := conf.Marshal()
-	err := db.StoreData(cfgKey(serviceId), data)
+	err := ds.StoreData(cfgKey(serviceId), data)
 	if err != nil {
 		log.Error("Failed to save config: %s", err.Error())
 		return mpqerr.ServerError("Can not save service data: " + serviceId)
 	}
+	db.LogMutation(apis.MutationConfig, serviceId, "", data, nil)
 	return nil
 }
 
@@ -74,24 +75,32 @@ func GetServiceDescription(serviceId string) *ServiceDescription {
 
 // SaveServiceDescription saves service config into database.
 func SaveServiceDescription(desc *ServiceDescription) error {
-	db := db.DatabaseInstance()
+	ds := db.DatabaseInstance()
 	data, _ := desc.Marshal()
-	return db.StoreData(descKey(desc.ServiceId), data)
+	if err := ds.StoreData(descKey(desc.ServiceId), data); err != nil {
+		return err
+	}
+	db.LogMutation(apis.MutationService, desc.ServiceId, "", data, nil)
+	return nil
 }
 
-func DeleteServiceData(serviceId string) {
+// MarkServiceDeleted marks the service to be deleted, so it is not loaded anymore.
+// Service data is deleted later by the background reclaimer.
+func MarkServiceDeleted(serviceId string) bool {
 	desc := GetServiceDescription(serviceId)
 	if desc == nil {
 		log.Error("Attempt to delete unknown service id: %s", serviceId)
-		return
+		return false
 	}
 	desc.ToDelete = true
 	SaveServiceDescription(desc)
+	db.LogMutation(apis.MutationDrop, serviceId, "", nil, nil)
+	return true
+}
 
-	db := db.DatabaseInstance()
-	db.DeleteDataWithPrefix(serviceId)
-	db.DeleteData(cfgKey(serviceId))
-	db.DeleteData(descKey(serviceId))
+// DeleteServiceDescription deletes config and description of the service once its data is deleted.
+func DeleteServiceDescription(serviceId string) error {
+	return db.DatabaseInstance().DeleteData(cfgKey(serviceId), descKey(serviceId))
 }
 
 func NewServiceDescription(name, sType string, exportId uint64) *ServiceDescription {
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/conf"
+	"github.com/vburenin/firempq/db"
+	"github.com/vburenin/firempq/log"
+	"github.com/vburenin/firempq/pqueue"
+	"github.com/vburenin/firempq/pqueue/export"
+	"github.com/vburenin/firempq/qmgr"
+)
+
+// Command line modes to export and import queue messages as JSON Lines.
+const (
+	ExportMode = "export"
+	ImportMode = "import"
+)
+
+// queueFile exports or imports queue messages in the data directory and returns process exit code.
+// Import creates a priority queue if it doesn't exist.
+func queueFile(mode string, args []string) int {
+	qcfg := conf.ParseQueueFileParameters(mode, args)
+	log.InitLogging()
+
+	svcs := qmgr.NewServiceManager()
+	defer db.DatabaseInstance().Close()
+	defer svcs.Close()
+
+	svc, ok := svcs.GetService(qcfg.Queue)
+	if !ok && mode == ImportMode {
+		if r := svcs.CreateService(apis.ServiceTypePriorityQueue, qcfg.Queue, nil); r.IsError() {
+			log.Critical("Cannot create queue %s: %s", qcfg.Queue, r.StringResponse())
+			return 1
+		}
+		log.Info("Queue %s has been created", qcfg.Queue)
+		svc, ok = svcs.GetService(qcfg.Queue)
+	}
+	pq, isQueue := svc.(*pqueue.PQueue)
+	if !ok || !isQueue {
+		log.Critical("Queue not found: %s", qcfg.Queue)
+		return 1
+	}
+
+	if mode == ExportMode {
+		count, err := export.Write(pq, qcfg.File)
+		if err != nil {
+			log.Critical("Export failed: %s", err)
+			return 1
+		}
+		log.Info("Exported %d messages from %s into %s", count, qcfg.Queue, qcfg.File)
+		return 0
+	}
+
+	summary, err := export.Read(pq, qcfg.File)
+	if err != nil {
+		log.Critical("Import failed: %s", err)
+		return 1
+	}
+	log.Info("Imported %d messages into %s, %d failed", summary.Imported, qcfg.Queue, summary.Failed)
+	if summary.Failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,16 +1,21 @@
 package replica
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/vburenin/firempq/apis"
 	"github.com/vburenin/firempq/conf"
 	"github.com/vburenin/firempq/log"
+	"github.com/vburenin/firempq/utils"
 )
 
 const (
@@ -18,6 +23,9 @@ const (
 	BinaryLogFileExt      = ".bin"
 	BinaryLogNumSeparator = "_"
 	BinaryLogNamePrefix   = BinaryLogFileName + BinaryLogNumSeparator
+	// BinaryLogFullHistoryFile marks the log started on empty data.
+	// Such log holds all data changes, so a new replica can replay it from the start.
+	BinaryLogFullHistoryFile = BinaryLogFileName + ".full"
 )
 
 type BinLogFile struct {
@@ -35,39 +43,67 @@ func (p BinaryLogs) Len() int           { return len(p) }
 func (p BinaryLogs) Less(i, j int) bool { return p[i].Num < p[j].Num }
 func (p BinaryLogs) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
+// BinaryLog is an append only log of all data mutations.
+// Every mutation gets a sequence id, frames are written by a background
+// goroutine in the order of their sequence ids.
 type BinaryLog struct {
+	lock        sync.Mutex
 	dataChan    chan []byte
-	serviceChan chan []byte
+	doneChan    chan struct{}
+	closed      bool
 	seqId       uint64
+	writtenSeq  uint64
 	maxPageSize uint64
 	pageSize    uint64
-	frameSize   uint64
-	logWriter   io.WriteCloser
+	logFile     *os.File
+	logWriter   *bufio.Writer
 	logLocation string
 	logFiles    BinaryLogs
+	keepPages   int
+	readersLock sync.Mutex
+	readers     map[*LogReader]struct{}
+	isNew       bool
+	fullHistory bool
 }
 
-func NewBinaryLog(cfg conf.Config) *BinaryLog {
+// NewBinaryLog opens the binary log in the configured location.
+// Writing continues after the last complete frame, incomplete frame
+// left after the crash is truncated.
+func NewBinaryLog(cfg *conf.Config) (*BinaryLog, error) {
+	if err := os.MkdirAll(cfg.BinaryLogPath, 0755); err != nil {
+		return nil, err
+	}
+	logFiles, err := findLogFiles(cfg.BinaryLogPath)
+	if err != nil {
+		return nil, err
+	}
 	binlog := &BinaryLog{
 		dataChan:    make(chan []byte, cfg.BinaryLogBufferSize),
-		serviceChan: make(chan []byte, cfg.BinaryLogBufferSize),
-		//frameSize: cfg.FrameSize,
-		seqId:       0,
+		doneChan:    make(chan struct{}),
 		maxPageSize: cfg.BinaryLogPageSize,
-		pageSize:    0,
-		logWriter:   nil,
+		logLocation: cfg.BinaryLogPath,
+		logFiles:    logFiles,
+		keepPages:   cfg.BinaryLogKeepPages,
+		readers:     make(map[*LogReader]struct{}),
+		isNew:       len(logFiles) == 0,
 	}
-	logFiles, err := findLogFiles(cfg.BinaryLogPath)
-	if err != nil {
-		log.Fatal("Coould not init bin log subsystems: %s", err.Error())
+	if _, err := os.Stat(binlog.fullHistoryPath()); err == nil {
+		binlog.fullHistory = true
+	}
+	if err := binlog.openLastPage(); err != nil {
+		return nil, err
 	}
-	binlog.logFiles = logFiles
-	return binlog
+	go binlog.writeLoop()
+	return binlog, nil
+}
+
+func pageFileName(num int) string {
+	return BinaryLogNamePrefix + strconv.Itoa(num) + BinaryLogFileExt
 }
 
 func (self *BinaryLog) initializeLogFile() *BinLogFile {
 	if len(self.logFiles) == 0 {
-		firstName := self.logLocation + BinaryLogNamePrefix + "0" + BinaryLogFileExt
+		firstName := filepath.Join(self.logLocation, pageFileName(0))
 		self.logFiles = append(self.logFiles, &BinLogFile{firstName, 0})
 	}
 	lastLogFile := self.logFiles[len(self.logFiles)-1]
@@ -79,8 +115,273 @@ func (self *BinaryLog) initializeLogFile() *BinLogFile {
 	return lastLogFile
 }
 
-func (self *BinaryLog) LogDataChange(exportId uint64, data []byte) {
+// openLastPage opens the last page for writing and restores the sequence id.
+func (self *BinaryLog) openLastPage() error {
+	page := self.initializeLogFile()
+	f, err := os.OpenFile(page.FilePath, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	firstSeq, err := readPageHeader(f)
+	if err == errIncompleteFrame {
+		// Page has been created, but the header has not been written.
+		lastSeq, err := self.prevPageLastSeq()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		self.seqId = lastSeq
+		return self.startPage(f, lastSeq+1)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %s", page.FilePath, err)
+	}
+
+	lastSeq, size, err := scanPage(f, firstSeq)
+	if err != nil {
+		log.Warning("%s: truncating data after frame %d: %s", page.FilePath, lastSeq, err)
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	self.seqId = lastSeq
+	self.writtenSeq = lastSeq
+	self.pageSize = uint64(size)
+	self.logFile = f
+	self.logWriter = bufio.NewWriter(f)
+	return nil
+}
+
+// prevPageLastSeq returns the last sequence id written into the page before the last one.
+func (self *BinaryLog) prevPageLastSeq() (uint64, error) {
+	if len(self.logFiles) < 2 {
+		return 0, nil
+	}
+	path := self.logFiles[len(self.logFiles)-2].FilePath
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	firstSeq, err := readPageHeader(f)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", path, err)
+	}
+	lastSeq, _, err := scanPage(f, firstSeq)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", path, err)
+	}
+	return lastSeq, nil
+}
 
+// scanPage validates all page frames.
+// Returns the last valid sequence id and the size of valid data.
+func scanPage(f io.ReaderAt, firstSeq uint64) (uint64, int64, error) {
+	offset := int64(pageHeaderSize)
+	lastSeq := firstSeq - 1
+	for {
+		rec, size, err := readFrame(f, offset)
+		if err == errIncompleteFrame {
+			// Incomplete frame at the end of the page is not an error.
+			var b [1]byte
+			if n, _ := f.ReadAt(b[:], offset); n == 0 {
+				return lastSeq, offset, nil
+			}
+			return lastSeq, offset, err
+		}
+		if err != nil {
+			return lastSeq, offset, err
+		}
+		if rec.SeqId != lastSeq+1 {
+			return lastSeq, offset, ErrCorruptedLog
+		}
+		lastSeq = rec.SeqId
+		offset += size
+	}
+}
+
+// startPage writes the page header and makes the page current.
+func (self *BinaryLog) startPage(f *os.File, firstSeq uint64) error {
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt(encodePageHeader(firstSeq), 0); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(pageHeaderSize, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	self.writtenSeq = firstSeq - 1
+	self.pageSize = pageHeaderSize
+	self.logFile = f
+	self.logWriter = bufio.NewWriter(f)
+	return nil
+}
+
+// LogMutation assigns the next sequence id to the mutation and queues it to be written.
+// It blocks if the write buffer is full.
+func (self *BinaryLog) LogMutation(mt apis.MutationType, serviceId, itemId string, meta, payload []byte) {
+	self.lock.Lock()
+	if !self.closed {
+		self.seqId++
+		self.dataChan <- encodeFrame(self.seqId, utils.Uts(), mt, serviceId, itemId, meta, payload)
+	}
+	self.lock.Unlock()
+}
+
+// LastSeqId returns the sequence id of the last logged mutation.
+func (self *BinaryLog) LastSeqId() uint64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.seqId
+}
+
+func (self *BinaryLog) fullHistoryPath() string {
+	return filepath.Join(self.logLocation, BinaryLogFullHistoryFile)
+}
+
+// IsNew returns true if the log didn't exist before it was opened.
+func (self *BinaryLog) IsNew() bool {
+	return self.isNew
+}
+
+// MarkFullHistory records that the log has been started on empty data.
+func (self *BinaryLog) MarkFullHistory() error {
+	f, err := os.Create(self.fullHistoryPath())
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	self.lock.Lock()
+	self.fullHistory = true
+	self.lock.Unlock()
+	return nil
+}
+
+// HasFullHistory returns true if the log has all data changes since the data was empty.
+// Otherwise, data created before the log was enabled can't be replicated from the log.
+func (self *BinaryLog) HasFullHistory() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.fullHistory
+}
+
+// NewReader returns a reader of the log starting from the given sequence id.
+// Pages are not deleted while the reader needs them, so reader must be closed.
+func (self *BinaryLog) NewReader(fromSeq uint64) (*LogReader, error) {
+	self.readersLock.Lock()
+	defer self.readersLock.Unlock()
+	r, err := NewLogReader(self.logLocation, fromSeq)
+	if err != nil {
+		return nil, err
+	}
+	self.readers[r] = struct{}{}
+	r.release = func() {
+		self.readersLock.Lock()
+		delete(self.readers, r)
+		self.readersLock.Unlock()
+	}
+	return r, nil
+}
+
+// Close writes all queued mutations and closes the log.
+func (self *BinaryLog) Close() {
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return
+	}
+	self.closed = true
+	close(self.dataChan)
+	self.lock.Unlock()
+	<-self.doneChan
+}
+
+func (self *BinaryLog) writeLoop() {
+	defer close(self.doneChan)
+	for frame := range self.dataChan {
+		if _, err := self.logWriter.Write(frame); err != nil {
+			log.Fatal("Failed to write binary log: %s", err.Error())
+		}
+		self.pageSize += uint64(len(frame))
+		self.writtenSeq = frameSeqId(frame)
+		if self.maxPageSize > 0 && self.pageSize >= self.maxPageSize {
+			self.switchPage()
+			self.purgePages()
+		} else if len(self.dataChan) == 0 {
+			self.flush()
+		}
+	}
+	self.flush()
+	if err := self.logFile.Sync(); err != nil {
+		log.Error("Failed to sync binary log: %s", err.Error())
+	}
+	self.logFile.Close()
+}
+
+func (self *BinaryLog) flush() {
+	if err := self.logWriter.Flush(); err != nil {
+		log.Fatal("Failed to write binary log: %s", err.Error())
+	}
+}
+
+// switchPage completes the current page and starts the next one.
+func (self *BinaryLog) switchPage() {
+	self.flush()
+	if err := self.logFile.Sync(); err != nil {
+		log.Fatal("Failed to sync binary log: %s", err.Error())
+	}
+	self.logFile.Close()
+
+	num := self.logFiles[len(self.logFiles)-1].Num + 1
+	page := &BinLogFile{filepath.Join(self.logLocation, pageFileName(num)), num}
+	f, err := os.OpenFile(page.FilePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		log.Fatal("Failed to create binary log page: %s", err.Error())
+	}
+	self.logFiles = append(self.logFiles, page)
+	if err := self.startPage(f, self.writtenSeq+1); err != nil {
+		log.Fatal("Failed to create binary log page: %s", err.Error())
+	}
+}
+
+// purgePages deletes the oldest pages exceeding the retention limit.
+// Pages which are still read are kept.
+func (self *BinaryLog) purgePages() {
+	if self.keepPages <= 0 {
+		return
+	}
+	self.readersLock.Lock()
+	defer self.readersLock.Unlock()
+	for len(self.logFiles) > self.keepPages {
+		page := self.logFiles[0]
+		for r := range self.readers {
+			if r.PageNum() <= page.Num {
+				return
+			}
+		}
+		if err := os.Remove(page.FilePath); err != nil && !os.IsNotExist(err) {
+			log.Error("Failed to delete binary log page: %s", err.Error())
+			return
+		}
+		log.Info("Binary log page is deleted: %s", page.FilePath)
+		self.logFiles = self.logFiles[1:]
+	}
 }
 
 // createFileIfNotExists initializes log file.
@@ -132,5 +433,9 @@ func findLogFiles(location string) (BinaryLogs, error) {
 		log.Critical("Can't read binary log directory: %s", err.Error())
 		return nil, err
 	}
-	return extractLogFiles(items), nil
+	logFiles := extractLogFiles(items)
+	for _, f := range logFiles {
+		f.FilePath = filepath.Join(location, f.FilePath)
+	}
+	return logFiles, nil
 }
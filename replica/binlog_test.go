@@ -1,11 +1,17 @@
 package replica
 
 import (
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"strconv"
 	"testing"
 	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/conf"
 )
 
 type fileStat struct {
@@ -58,3 +64,233 @@ func TestSelectLogFile(t *testing.T) {
 		t.Error("Number if log file is not 0")
 	}
 }
+
+func testLogConfig(dir string, pageSize uint64) *conf.Config {
+	return &conf.Config{
+		BinaryLogPath:       dir,
+		BinaryLogBufferSize: 16,
+		BinaryLogPageSize:   pageSize,
+	}
+}
+
+func logMessages(bl *BinaryLog, from, to int) {
+	for i := from; i <= to; i++ {
+		id := strconv.Itoa(i)
+		bl.LogMutation(apis.MutationPush, "svc", id, []byte("meta"+id), []byte("payload"+id))
+	}
+}
+
+func readAll(r *LogReader) ([]*Record, error) {
+	var records []*Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+func lastPage(dir string) string {
+	files, _ := findLogFiles(dir)
+	return files[len(files)-1].FilePath
+}
+
+func TestBinaryLog(t *testing.T) {
+	Convey("Binary log should keep sequence of all mutations", t, func() {
+		dir, _ := ioutil.TempDir("", "fmpq-binlog")
+		defer os.RemoveAll(dir)
+
+		bl, err := NewBinaryLog(testLogConfig(dir, 1024))
+		So(err, ShouldBeNil)
+		logMessages(bl, 1, 50)
+		bl.LogMutation(apis.MutationConfig, "svc", "", []byte("cfg"), nil)
+		bl.LogMutation(apis.MutationDelete, "svc", "1", nil, nil)
+		So(bl.LastSeqId(), ShouldEqual, 52)
+		bl.Close()
+
+		files, _ := findLogFiles(dir)
+		So(len(files), ShouldBeGreaterThan, 2)
+
+		r, err := NewLogReader(dir, 0)
+		So(err, ShouldBeNil)
+		records, err := readAll(r)
+		r.Close()
+		So(err, ShouldBeNil)
+		So(len(records), ShouldEqual, 52)
+		So(records[0].SeqId, ShouldEqual, 1)
+		So(records[9].Type, ShouldEqual, apis.MutationPush)
+		So(records[9].ItemId, ShouldEqual, "10")
+		So(string(records[9].Meta), ShouldEqual, "meta10")
+		So(string(records[9].Payload), ShouldEqual, "payload10")
+		So(records[50].Type, ShouldEqual, apis.MutationConfig)
+		So(records[51].Type, ShouldEqual, apis.MutationDelete)
+		So(records[51].Meta, ShouldBeNil)
+
+		Convey("Reopened log should continue the sequence", func() {
+			bl, err := NewBinaryLog(testLogConfig(dir, 1024))
+			So(err, ShouldBeNil)
+			So(bl.LastSeqId(), ShouldEqual, 52)
+			logMessages(bl, 53, 60)
+			bl.Close()
+
+			r, err := NewLogReader(dir, 40)
+			So(err, ShouldBeNil)
+			records, err := readAll(r)
+			r.Close()
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 21)
+			So(records[0].SeqId, ShouldEqual, 40)
+			So(records[20].SeqId, ShouldEqual, 60)
+		})
+
+		Convey("Incomplete frame should be truncated on open", func() {
+			f, _ := os.OpenFile(lastPage(dir), os.O_WRONLY|os.O_APPEND, 0644)
+			f.Write(encodeFrame(53, 0, apis.MutationPush, "svc", "53", nil, nil)[:10])
+			f.Close()
+
+			bl, err := NewBinaryLog(testLogConfig(dir, 1024))
+			So(err, ShouldBeNil)
+			So(bl.LastSeqId(), ShouldEqual, 52)
+			logMessages(bl, 53, 53)
+			bl.Close()
+
+			r, _ := NewLogReader(dir, 52)
+			records, err := readAll(r)
+			r.Close()
+			So(err, ShouldBeNil)
+			So(len(records), ShouldEqual, 2)
+			So(records[1].ItemId, ShouldEqual, "53")
+		})
+
+		Convey("Damaged frame should be reported by reader", func() {
+			path := lastPage(dir)
+			data, _ := ioutil.ReadFile(path)
+			data[len(data)-3] ^= 0xff
+			ioutil.WriteFile(path, data, 0644)
+
+			r, _ := NewLogReader(dir, 0)
+			records, err := readAll(r)
+			r.Close()
+			So(err, ShouldEqual, ErrCorruptedLog)
+			So(len(records), ShouldEqual, 51)
+		})
+
+		Convey("Removed pages should not be available", func() {
+			files, _ := findLogFiles(dir)
+			os.Remove(files[0].FilePath)
+			_, err := NewLogReader(dir, 1)
+			So(err, ShouldEqual, ErrSeqNotAvailable)
+		})
+	})
+
+	Convey("Reader should follow the log while it is written", t, func() {
+		dir, _ := ioutil.TempDir("", "fmpq-binlog")
+		defer os.RemoveAll(dir)
+
+		bl, err := NewBinaryLog(testLogConfig(dir, 512))
+		So(err, ShouldBeNil)
+		defer bl.Close()
+		r, err := bl.NewReader(0)
+		So(err, ShouldBeNil)
+		defer r.Close()
+
+		_, err = r.Next()
+		So(err, ShouldEqual, io.EOF)
+
+		var seqIds []uint64
+		for i := 1; i <= 100; i += 10 {
+			logMessages(bl, i, i+9)
+			deadline := time.Now().Add(5 * time.Second)
+			for len(seqIds) < i+9 && time.Now().Before(deadline) {
+				rec, err := r.Next()
+				if err == io.EOF {
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				So(err, ShouldBeNil)
+				seqIds = append(seqIds, rec.SeqId)
+			}
+		}
+		So(len(seqIds), ShouldEqual, 100)
+		So(seqIds[99], ShouldEqual, 100)
+		So(r.NextSeqId(), ShouldEqual, 101)
+	})
+}
+
+func TestBinaryLogFullHistory(t *testing.T) {
+	Convey("Full history mark should be kept with the log", t, func() {
+		dir, _ := ioutil.TempDir("", "fmpq-binlog")
+		defer os.RemoveAll(dir)
+
+		bl, err := NewBinaryLog(testLogConfig(dir, 1024))
+		So(err, ShouldBeNil)
+		So(bl.IsNew(), ShouldBeTrue)
+		So(bl.HasFullHistory(), ShouldBeFalse)
+		So(bl.MarkFullHistory(), ShouldBeNil)
+		So(bl.HasFullHistory(), ShouldBeTrue)
+		logMessages(bl, 1, 10)
+		bl.Close()
+
+		bl, err = NewBinaryLog(testLogConfig(dir, 1024))
+		So(err, ShouldBeNil)
+		defer bl.Close()
+		So(bl.IsNew(), ShouldBeFalse)
+		So(bl.HasFullHistory(), ShouldBeTrue)
+		files, _ := findLogFiles(dir)
+		So(len(files), ShouldBeGreaterThan, 0)
+	})
+}
+
+// readRecords reads records until count of them are read or reading times out.
+func readRecords(r *LogReader, count int) []*Record {
+	var records []*Record
+	for i := 0; i < 500 && len(records) < count; i++ {
+		recs, err := readAll(r)
+		So(err, ShouldBeNil)
+		records = append(records, recs...)
+		time.Sleep(time.Millisecond)
+	}
+	return records
+}
+
+func TestBinaryLogRetention(t *testing.T) {
+	Convey("Old pages should be deleted unless they are read", t, func() {
+		dir, _ := ioutil.TempDir("", "fmpq-binlog")
+		defer os.RemoveAll(dir)
+
+		cfg := testLogConfig(dir, 256)
+		cfg.BinaryLogKeepPages = 3
+		bl, err := NewBinaryLog(cfg)
+		So(err, ShouldBeNil)
+		defer bl.Close()
+
+		r, err := bl.NewReader(1)
+		So(err, ShouldBeNil)
+		logMessages(bl, 1, 100)
+		unregistered, err := NewLogReader(dir, 1)
+		So(err, ShouldBeNil)
+		So(len(readRecords(unregistered, 100)), ShouldEqual, 100)
+		unregistered.Close()
+		files, _ := findLogFiles(dir)
+		So(len(files), ShouldBeGreaterThan, 3)
+		So(files[0].Num, ShouldEqual, 0)
+
+		// Closed reader doesn't keep pages anymore.
+		So(len(readRecords(r, 100)), ShouldEqual, 100)
+		r.Close()
+		logMessages(bl, 101, 120)
+		for i := 0; i < 500 && len(files) != 3; i++ {
+			time.Sleep(time.Millisecond)
+			files, _ = findLogFiles(dir)
+		}
+		So(len(files), ShouldEqual, 3)
+		So(files[0].Num, ShouldBeGreaterThan, 0)
+
+		_, err = bl.NewReader(1)
+		So(err, ShouldEqual, ErrSeqNotAvailable)
+	})
+}
@@ -0,0 +1,384 @@
+package replica
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/enc"
+	"github.com/vburenin/firempq/log"
+	"github.com/vburenin/firempq/mpqproto"
+	"github.com/vburenin/firempq/utils"
+)
+
+// Storage keys of the replication state.
+const (
+	// AppliedSeqKey is the last primary sequence id applied to the local data.
+	AppliedSeqKey = ":replica:seq"
+	// PromotedKey is set once the replica has been promoted to primary.
+	PromotedKey = ":replica:promoted"
+)
+
+// Replication status names.
+const (
+	STAT_ROLE        = "ReplicationRole"
+	STAT_PRIMARY     = "ReplicationPrimary"
+	STAT_CONNECTED   = "ReplicationConnected"
+	STAT_APPLIED_SEQ = "ReplicationAppliedSeq"
+	STAT_PRIMARY_SEQ = "ReplicationPrimarySeq"
+	STAT_LAG         = "ReplicationLag"
+	STAT_LAG_MS      = "ReplicationLagMs"
+	STAT_ERROR       = "ReplicationError"
+	STAT_BINLOG_SEQ  = "BinaryLogSeq"
+	STAT_REPLICAS    = "Replicas"
+	ROLE_PRIMARY     = "primary"
+	ROLE_REPLICA     = "replica"
+)
+
+const (
+	followerRetryDelay = time.Second
+	dialTimeout        = 5 * time.Second
+	// readTimeout breaks connection if primary doesn't even send heartbeats.
+	readTimeout = 10 * HeartbeatInterval
+	// appliedSeqSaveInterval is a period to store the applied sequence id.
+	appliedSeqSaveInterval = 100 * time.Millisecond
+)
+
+// Applier applies replicated mutations to the local services.
+type Applier interface {
+	ApplyMutation(mt apis.MutationType, serviceId, itemId string, meta, payload []byte) error
+}
+
+// Follower receives mutations from the primary server and applies them locally.
+// It reconnects to the primary if connection is lost, continuing after the last applied mutation.
+type Follower struct {
+	primary    string
+	user       string
+	password   string
+	applier    Applier
+	ds         apis.DataStorage
+	lock       sync.Mutex
+	conn       net.Conn
+	connected  bool
+	appliedSeq uint64
+	savedSeq   uint64
+	appliedTs  int64
+	primarySeq uint64
+	lastError  string
+	stopChan   chan struct{}
+	doneChan   chan struct{}
+	savedChan  chan struct{}
+}
+
+func NewFollower(primary string, applier Applier, ds apis.DataStorage) *Follower {
+	seq := AppliedSeq(ds)
+	return &Follower{
+		primary:    primary,
+		applier:    applier,
+		ds:         ds,
+		appliedSeq: seq,
+		savedSeq:   seq,
+		stopChan:   make(chan struct{}),
+		doneChan:   make(chan struct{}),
+		savedChan:  make(chan struct{}),
+	}
+}
+
+// SetCredentials sets user name and password to authenticate on the primary.
+// Follower doesn't authenticate if user is empty.
+func (f *Follower) SetCredentials(user, password string) {
+	f.user = user
+	f.password = password
+}
+
+// AppliedSeq returns the last applied primary sequence id stored in the database.
+func AppliedSeq(ds apis.DataStorage) uint64 {
+	data := ds.GetData(AppliedSeqKey)
+	if len(data) == 0 {
+		return 0
+	}
+	return enc.DecodeBytesToUnit64(data)
+}
+
+// StoreAppliedSeq stores the last applied primary sequence id into the database.
+func StoreAppliedSeq(ds apis.DataStorage, seq uint64) error {
+	return ds.StoreData(AppliedSeqKey, enc.UnsafeStringToBytes(enc.Sn2Bin(seq)))
+}
+
+// SeedAppliedSeq prepares data restored from the primary backup to be replicated
+// starting after the sequence id the backup has been made at.
+func SeedAppliedSeq(ds apis.DataStorage, seq uint64) error {
+	if err := ds.DeleteData(PromotedKey); err != nil {
+		return err
+	}
+	return StoreAppliedSeq(ds, seq)
+}
+
+// IsPromoted returns true if the data has been already promoted to primary.
+func IsPromoted(ds apis.DataStorage) bool {
+	return len(ds.GetData(PromotedKey)) > 0
+}
+
+// Start runs the replication loop.
+func (f *Follower) Start() {
+	go f.run()
+	go f.saveLoop()
+}
+
+// Stop breaks the connection with the primary server and waits until the replication loop exits.
+func (f *Follower) Stop() {
+	f.lock.Lock()
+	select {
+	case <-f.stopChan:
+		f.lock.Unlock()
+		return
+	default:
+	}
+	close(f.stopChan)
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.lock.Unlock()
+	<-f.savedChan
+}
+
+// Promote stops replication and marks the data as promoted,
+// so the server can not be started as a replica again.
+func (f *Follower) Promote() error {
+	f.Stop()
+	return f.ds.StoreData(PromotedKey, []byte(strconv.FormatUint(f.AppliedSeq(), 10)))
+}
+
+// AppliedSeq returns the last applied primary sequence id.
+func (f *Follower) AppliedSeq() uint64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.appliedSeq
+}
+
+// Stats returns the replication status.
+func (f *Follower) Stats() map[string]interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var lag, lagMs int64
+	if f.primarySeq > f.appliedSeq {
+		lag = int64(f.primarySeq - f.appliedSeq)
+		if f.appliedTs > 0 {
+			lagMs = utils.Uts() - f.appliedTs
+		}
+	}
+	return map[string]interface{}{
+		STAT_ROLE:        ROLE_REPLICA,
+		STAT_PRIMARY:     f.primary,
+		STAT_CONNECTED:   f.connected,
+		STAT_APPLIED_SEQ: int64(f.appliedSeq),
+		STAT_PRIMARY_SEQ: int64(f.primarySeq),
+		STAT_LAG:         lag,
+		STAT_LAG_MS:      lagMs,
+		STAT_ERROR:       f.lastError,
+	}
+}
+
+func (f *Follower) isStopped() bool {
+	select {
+	case <-f.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// saveLoop periodically stores the applied sequence id. The last one is stored
+// once the replication loop exits.
+func (f *Follower) saveLoop() {
+	defer close(f.savedChan)
+	for {
+		select {
+		case <-f.stopChan:
+			<-f.doneChan
+			if err := f.saveAppliedSeq(); err != nil {
+				log.Error("Failed to store applied sequence id: %s", err)
+			}
+			return
+		case <-time.After(appliedSeqSaveInterval):
+		}
+		if err := f.saveAppliedSeq(); err != nil {
+			log.Error("Failed to store applied sequence id: %s", err)
+		}
+	}
+}
+
+// saveAppliedSeq stores the applied sequence id once data of all applied mutations
+// is flushed, flush doesn't write the cached data in order. Mutations applied after
+// the stored sequence id are applied again after restart, they are idempotent.
+func (f *Follower) saveAppliedSeq() error {
+	seq := f.AppliedSeq()
+	if seq == f.savedSeq {
+		return nil
+	}
+	f.ds.WaitFlush()
+	if err := StoreAppliedSeq(f.ds, seq); err != nil {
+		return err
+	}
+	f.savedSeq = seq
+	return nil
+}
+
+func (f *Follower) run() {
+	defer close(f.doneChan)
+	for {
+		err := f.replicate()
+		f.lock.Lock()
+		f.connected = false
+		f.conn = nil
+		if err != nil && !f.isStopped() {
+			f.lastError = err.Error()
+			log.Warning("Replication from %s is interrupted: %s", f.primary, err)
+		}
+		f.lock.Unlock()
+
+		select {
+		case <-f.stopChan:
+			log.Info("Replication from %s stopped at %d", f.primary, f.AppliedSeq())
+			return
+		case <-time.After(followerRetryDelay):
+		}
+	}
+}
+
+// replicate connects to the primary and applies received mutations until connection fails.
+func (f *Follower) replicate() error {
+	conn, err := net.DialTimeout("tcp", f.primary, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	f.lock.Lock()
+	if f.isStopped() {
+		f.lock.Unlock()
+		return nil
+	}
+	f.conn = conn
+	fromSeq := f.appliedSeq + 1
+	f.lock.Unlock()
+
+	tok := mpqproto.NewTokenizer()
+	// Skip the server greeting.
+	if _, err := f.readTokens(tok, conn); err != nil {
+		return err
+	}
+	if f.user != "" {
+		// Password is sent as a binary token, so it may contain any symbols.
+		cmd := fmt.Sprintf("%s %s $%d %s\n", CmdAuth, f.user, len(f.password), f.password)
+		if _, err := conn.Write([]byte(cmd)); err != nil {
+			return err
+		}
+		tokens, err := f.readTokens(tok, conn)
+		if err != nil {
+			return err
+		}
+		if tokens[0] != "+OK" {
+			return responseError(tokens)
+		}
+	}
+	cmd := fmt.Sprintf("%s %s %d\n", CmdReplicate, PrmFrom, fromSeq)
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		return err
+	}
+	tokens, err := f.readTokens(tok, conn)
+	if err != nil {
+		return err
+	}
+	if tokens[0] != "+OK" {
+		return responseError(tokens)
+	}
+
+	log.Info("Replicating from %s starting at %d", f.primary, fromSeq)
+	f.lock.Lock()
+	f.connected = true
+	f.lastError = ""
+	f.lock.Unlock()
+
+	for {
+		tokens, err := f.readTokens(tok, conn)
+		if err != nil {
+			return err
+		}
+		switch {
+		case tokens[0] == RespRecord && len(tokens) == 3:
+			primarySeq, err := parseSeq(tokens[1])
+			if err != nil {
+				return err
+			}
+			if err := f.apply(enc.UnsafeStringToBytes(tokens[2]), primarySeq); err != nil {
+				return err
+			}
+		case tokens[0] == RespHeartbeat && len(tokens) == 2:
+			primarySeq, err := parseSeq(tokens[1])
+			if err != nil {
+				return err
+			}
+			f.lock.Lock()
+			f.primarySeq = primarySeq
+			f.lock.Unlock()
+		default:
+			return responseError(tokens)
+		}
+	}
+}
+
+func (f *Follower) readTokens(tok *mpqproto.Tokenizer, conn net.Conn) ([]string, error) {
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	tokens, err := tok.ReadTokens(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty response")
+	}
+	return tokens, nil
+}
+
+// apply applies a single mutation and stores its sequence id.
+func (f *Follower) apply(frame []byte, primarySeq uint64) error {
+	rec, err := DecodeFrame(frame)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	appliedSeq := f.appliedSeq
+	f.lock.Unlock()
+	if rec.SeqId <= appliedSeq {
+		return nil
+	}
+	if rec.SeqId != appliedSeq+1 {
+		return fmt.Errorf("expected mutation %d, received %d", appliedSeq+1, rec.SeqId)
+	}
+	err = f.applier.ApplyMutation(rec.Type, rec.ServiceId, rec.ItemId, rec.Meta, rec.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to apply mutation %d: %s", rec.SeqId, err)
+	}
+	f.lock.Lock()
+	f.appliedSeq = rec.SeqId
+	f.appliedTs = rec.Ts
+	f.primarySeq = primarySeq
+	f.lock.Unlock()
+	return nil
+}
+
+func parseSeq(token string) (uint64, error) {
+	if !strings.HasPrefix(token, ":") {
+		return 0, fmt.Errorf("wrong sequence id: %s", token)
+	}
+	return strconv.ParseUint(token[1:], 10, 64)
+}
+
+func responseError(tokens []string) error {
+	return fmt.Errorf("unexpected response: %s", strings.Join(tokens, " "))
+}
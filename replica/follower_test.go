@@ -0,0 +1,213 @@
+package replica
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/log"
+	"github.com/vburenin/firempq/mpqproto"
+	. "github.com/vburenin/firempq/mpqtesting"
+)
+
+type testApplier struct {
+	lock    sync.Mutex
+	itemIds []string
+}
+
+func (a *testApplier) ApplyMutation(mt apis.MutationType, serviceId, itemId string, meta, payload []byte) error {
+	a.lock.Lock()
+	a.itemIds = append(a.itemIds, itemId)
+	a.lock.Unlock()
+	return nil
+}
+
+func (a *testApplier) applied() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return append([]string(nil), a.itemIds...)
+}
+
+// partialFlushDB keeps cached data in memory until it is flushed.
+type partialFlushDB struct {
+	*InMemDBService
+	lock    sync.Mutex
+	pending map[string][]byte
+}
+
+func newPartialFlushDB() *partialFlushDB {
+	return &partialFlushDB{InMemDBService: NewInMemDBService(), pending: make(map[string][]byte)}
+}
+
+func (d *partialFlushDB) CachedStore(key string, data []byte) {
+	d.lock.Lock()
+	d.pending[key] = data
+	d.lock.Unlock()
+}
+
+func (d *partialFlushDB) WaitFlush() {
+	d.lock.Lock()
+	for k, v := range d.pending {
+		d.InMemDBService.StoreData(k, v)
+	}
+	d.pending = make(map[string][]byte)
+	d.lock.Unlock()
+}
+
+// crash writes the applied sequence id only out of all cached data.
+func (d *partialFlushDB) crash() {
+	d.lock.Lock()
+	if v, ok := d.pending[AppliedSeqKey]; ok {
+		d.InMemDBService.StoreData(AppliedSeqKey, v)
+	}
+	d.pending = make(map[string][]byte)
+	d.lock.Unlock()
+}
+
+// storingApplier caches every applied mutation.
+type storingApplier struct {
+	testApplier
+	ds apis.DataStorage
+}
+
+func (a *storingApplier) ApplyMutation(mt apis.MutationType, serviceId, itemId string, meta, payload []byte) error {
+	a.ds.CachedStore("item:"+itemId, meta)
+	return a.testApplier.ApplyMutation(mt, serviceId, itemId, meta, payload)
+}
+
+// servePrimary streams the binary log to every connected replica.
+func servePrimary(l net.Listener, bl *BinaryLog) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			w := bufio.NewWriter(conn)
+			w.WriteString("+HELLO\n")
+			w.Flush()
+			tokens, err := mpqproto.NewTokenizer().ReadTokens(conn)
+			if err != nil || len(tokens) != 3 || tokens[0] != CmdReplicate {
+				return
+			}
+			fromSeq, _ := strconv.ParseUint(tokens[2], 10, 64)
+			r, err := bl.NewReader(fromSeq)
+			if err != nil {
+				return
+			}
+			defer r.Close()
+			w.WriteString("+OK\n")
+			w.Flush()
+			Stream(bl, r, w, &sync.Mutex{}, func() bool { return false })
+		}()
+	}
+}
+
+func waitApplied(a *testApplier, count int) []string {
+	for i := 0; i < 500 && len(a.applied()) < count; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return a.applied()
+}
+
+func TestFollower(t *testing.T) {
+	Convey("Follower should apply all mutations of the primary", t, func() {
+		log.SetLevel(1)
+		dir, _ := ioutil.TempDir("", "fmpq-follower")
+		defer os.RemoveAll(dir)
+		bl, err := NewBinaryLog(testLogConfig(dir, 1024))
+		So(err, ShouldBeNil)
+		defer bl.Close()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		go servePrimary(l, bl)
+
+		ds := NewInMemDBService()
+		applier := &testApplier{}
+		logMessages(bl, 1, 10)
+		f := NewFollower(l.Addr().String(), applier, ds)
+		f.Start()
+		So(len(waitApplied(applier, 10)), ShouldEqual, 10)
+
+		logMessages(bl, 11, 15)
+		applied := waitApplied(applier, 15)
+		So(len(applied), ShouldEqual, 15)
+		So(applied[14], ShouldEqual, "15")
+		stats := f.Stats()
+		So(stats[STAT_ROLE], ShouldEqual, ROLE_REPLICA)
+		So(stats[STAT_CONNECTED], ShouldEqual, true)
+		So(stats[STAT_APPLIED_SEQ], ShouldEqual, 15)
+		So(stats[STAT_LAG], ShouldEqual, 0)
+		f.Stop()
+		So(AppliedSeq(ds), ShouldEqual, 15)
+
+		// Follower continues after the last applied mutation.
+		logMessages(bl, 16, 17)
+		f = NewFollower(l.Addr().String(), applier, ds)
+		f.Start()
+		applied = waitApplied(applier, 17)
+		So(len(applied), ShouldEqual, 17)
+		So(applied[15], ShouldEqual, "16")
+
+		So(IsPromoted(ds), ShouldBeFalse)
+		So(f.Promote(), ShouldBeNil)
+		So(IsPromoted(ds), ShouldBeTrue)
+		So(f.Stats()[STAT_CONNECTED], ShouldEqual, false)
+
+		logMessages(bl, 18, 18)
+		time.Sleep(50 * time.Millisecond)
+		So(len(applier.applied()), ShouldEqual, 17)
+	})
+}
+
+func TestFollowerAppliedSeq(t *testing.T) {
+	Convey("Applied sequence id should never be stored ahead of the data", t, func() {
+		log.SetLevel(1)
+		dir, _ := ioutil.TempDir("", "fmpq-follower")
+		defer os.RemoveAll(dir)
+		bl, err := NewBinaryLog(testLogConfig(dir, 1024))
+		So(err, ShouldBeNil)
+		defer bl.Close()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		go servePrimary(l, bl)
+
+		for i := 1; i <= 10; i++ {
+			logMessages(bl, i*5-4, i*5)
+			ds := newPartialFlushDB()
+			applier := &storingApplier{ds: ds}
+			f := NewFollower(l.Addr().String(), applier, ds)
+			f.Start()
+			So(len(waitApplied(&applier.testApplier, i*5)), ShouldEqual, i*5)
+			time.Sleep(time.Duration(i*20) * time.Millisecond)
+			ds.crash()
+			seq := AppliedSeq(ds)
+			for id := uint64(1); id <= seq; id++ {
+				So(ds.GetData("item:"+strconv.FormatUint(id, 10)), ShouldNotBeNil)
+			}
+			f.Stop()
+		}
+	})
+}
+
+func TestSeedAppliedSeq(t *testing.T) {
+	Convey("Restored data should be replicated after the backup sequence id", t, func() {
+		ds := NewInMemDBService()
+		ds.StoreData(PromotedKey, []byte("10"))
+		So(SeedAppliedSeq(ds, 42), ShouldBeNil)
+		So(AppliedSeq(ds), ShouldEqual, 42)
+		So(IsPromoted(ds), ShouldBeFalse)
+	})
+}
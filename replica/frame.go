@@ -0,0 +1,194 @@
+package replica
+
+// Binary log is a sequence of page files named ServiceBinaryLog_<num>.bin.
+// Every page starts with a header:
+//
+//   "FMPQBLOG"               Magic.
+//   <uint64 first seq id>    Sequence id of the first frame in the page.
+//
+// followed by frames, one frame per data mutation:
+//
+//   <uint32 body len><uint32 crc32c of body><body>
+//
+// Frame body is:
+//
+//   <uint64 seq id><int64 ts><byte mutation type>
+//   <uvarint len><service id><uvarint len><item id>
+//   <uvarint len><meta><uvarint len><payload>
+//
+// All fixed size integers are big endian. Page is never modified after
+// the log has switched to the next one.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/vburenin/firempq/apis"
+)
+
+const (
+	PageMagic = "FMPQBLOG"
+	// pageHeaderSize is the magic and the first sequence id.
+	pageHeaderSize = 8 + 8
+
+	frameHeaderSize = 8
+	frameFixedSize  = 8 + 8 + 1
+	// maxFrameSize limits the size of a single frame read from the log.
+	maxFrameSize = 1 << 30
+)
+
+var ErrCorruptedLog = errors.New("binary log is corrupted")
+var ErrSeqNotAvailable = errors.New("sequence id is not available in the binary log")
+
+// errIncompleteFrame is returned if frame has not been completely written yet.
+var errIncompleteFrame = errors.New("incomplete frame")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Record is a single data mutation read from the binary log.
+type Record struct {
+	SeqId     uint64
+	Ts        int64
+	Type      apis.MutationType
+	ServiceId string
+	ItemId    string
+	Meta      []byte
+	Payload   []byte
+	frame     []byte
+}
+
+// Frame returns the record encoded as it is stored in the log.
+func (r *Record) Frame() []byte {
+	return r.frame
+}
+
+// DecodeFrame decodes a single frame verifying its checksum.
+func DecodeFrame(frame []byte) (*Record, error) {
+	rec, size, err := readFrame(bytes.NewReader(frame), 0)
+	if err == errIncompleteFrame || (err == nil && size != int64(len(frame))) {
+		return nil, ErrCorruptedLog
+	}
+	return rec, err
+}
+
+func encodeFrame(seqId uint64, ts int64, mt apis.MutationType,
+	serviceId, itemId string, meta, payload []byte) []byte {
+
+	size := frameHeaderSize + frameFixedSize +
+		4*binary.MaxVarintLen64 + len(serviceId) + len(itemId) + len(meta) + len(payload)
+	buf := make([]byte, frameHeaderSize+frameFixedSize, size)
+	binary.BigEndian.PutUint64(buf[frameHeaderSize:], seqId)
+	binary.BigEndian.PutUint64(buf[frameHeaderSize+8:], uint64(ts))
+	buf[frameHeaderSize+16] = byte(mt)
+	buf = appendBytes(buf, []byte(serviceId))
+	buf = appendBytes(buf, []byte(itemId))
+	buf = appendBytes(buf, meta)
+	buf = appendBytes(buf, payload)
+
+	body := buf[frameHeaderSize:]
+	binary.BigEndian.PutUint32(buf, uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(body, crcTable))
+	return buf
+}
+
+func appendBytes(buf []byte, data []byte) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(data)))
+	buf = append(buf, lenBuf[:n]...)
+	return append(buf, data...)
+}
+
+// frameSeqId returns a sequence id of the encoded frame.
+func frameSeqId(frame []byte) uint64 {
+	return binary.BigEndian.Uint64(frame[frameHeaderSize:])
+}
+
+// readFrame reads a frame located at the offset.
+// Returns the record and the total frame size.
+func readFrame(f io.ReaderAt, offset int64) (*Record, int64, error) {
+	var header [frameHeaderSize]byte
+	if n, _ := f.ReadAt(header[:], offset); n < frameHeaderSize {
+		return nil, 0, errIncompleteFrame
+	}
+	bodyLen := binary.BigEndian.Uint32(header[:])
+	if bodyLen < frameFixedSize || bodyLen > maxFrameSize {
+		return nil, 0, ErrCorruptedLog
+	}
+	frame := make([]byte, frameHeaderSize+int(bodyLen))
+	copy(frame, header[:])
+	body := frame[frameHeaderSize:]
+	if n, _ := f.ReadAt(body, offset+frameHeaderSize); n < len(body) {
+		return nil, 0, errIncompleteFrame
+	}
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, ErrCorruptedLog
+	}
+	rec, err := decodeBody(body)
+	if err != nil {
+		return nil, 0, err
+	}
+	rec.frame = frame
+	return rec, int64(len(frame)), nil
+}
+
+func decodeBody(body []byte) (*Record, error) {
+	rec := &Record{
+		SeqId: binary.BigEndian.Uint64(body),
+		Ts:    int64(binary.BigEndian.Uint64(body[8:])),
+		Type:  apis.MutationType(body[16]),
+	}
+	if !rec.Type.Valid() {
+		return nil, ErrCorruptedLog
+	}
+	data := body[frameFixedSize:]
+	var fields [4][]byte
+	for i := range fields {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || l > uint64(len(data)-n) {
+			return nil, ErrCorruptedLog
+		}
+		if l > 0 {
+			fields[i] = data[n : n+int(l)]
+		}
+		data = data[n+int(l):]
+	}
+	rec.ServiceId = string(fields[0])
+	rec.ItemId = string(fields[1])
+	rec.Meta = fields[2]
+	rec.Payload = fields[3]
+	return rec, nil
+}
+
+func encodePageHeader(firstSeqId uint64) []byte {
+	buf := make([]byte, pageHeaderSize)
+	copy(buf, PageMagic)
+	binary.BigEndian.PutUint64(buf[len(PageMagic):], firstSeqId)
+	return buf
+}
+
+// readPageHeader returns a sequence id of the first frame in the page.
+// Returns errIncompleteFrame if page header has not been written yet.
+func readPageHeader(f io.ReaderAt) (uint64, error) {
+	buf := make([]byte, pageHeaderSize)
+	if n, _ := f.ReadAt(buf, 0); n < pageHeaderSize {
+		return 0, errIncompleteFrame
+	}
+	if string(buf[:len(PageMagic)]) != PageMagic {
+		return 0, ErrCorruptedLog
+	}
+	return binary.BigEndian.Uint64(buf[len(PageMagic):]), nil
+}
+
+// pageFirstSeqId reads a page header of the page file.
+func pageFirstSeqId(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return readPageHeader(f)
+}
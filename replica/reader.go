@@ -0,0 +1,158 @@
+package replica
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// LogReader reads mutations from the binary log starting from the given sequence id.
+// It can follow the log while it is being written: Next returns io.EOF
+// once all written frames are read and can be called again later.
+type LogReader struct {
+	location string
+	page     *BinLogFile
+	file     *os.File
+	offset   int64
+	fromSeq  uint64
+	nextSeq  uint64
+	pageNum  int64
+	release  func()
+}
+
+// NewLogReader opens the binary log located in the directory for reading.
+// Zero sequence id starts reading from the first available mutation.
+func NewLogReader(location string, fromSeq uint64) (*LogReader, error) {
+	logFiles, err := findLogFiles(location)
+	if err != nil {
+		return nil, err
+	}
+	var page *BinLogFile
+	var pageSeq uint64
+	for _, p := range logFiles {
+		firstSeq, err := pageFirstSeqId(p.FilePath)
+		if err == errIncompleteFrame {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if page == nil && fromSeq < firstSeq && fromSeq > 0 {
+			return nil, ErrSeqNotAvailable
+		}
+		if page != nil && firstSeq > fromSeq {
+			break
+		}
+		page, pageSeq = p, firstSeq
+	}
+	if page == nil {
+		return nil, ErrSeqNotAvailable
+	}
+	r := &LogReader{location: location, fromSeq: fromSeq}
+	if err := r.openPage(page, pageSeq); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *LogReader) openPage(page *BinLogFile, firstSeq uint64) error {
+	f, err := os.Open(page.FilePath)
+	if err != nil {
+		return err
+	}
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.page = page
+	atomic.StoreInt64(&r.pageNum, int64(page.Num))
+	r.file = f
+	r.offset = pageHeaderSize
+	r.nextSeq = firstSeq
+	return nil
+}
+
+// PageNum returns the number of the page being read.
+func (r *LogReader) PageNum() int {
+	return int(atomic.LoadInt64(&r.pageNum))
+}
+
+// NextSeqId returns the sequence id of the mutation that will be read next.
+func (r *LogReader) NextSeqId() uint64 {
+	if r.nextSeq < r.fromSeq {
+		return r.fromSeq
+	}
+	return r.nextSeq
+}
+
+// Next returns the next mutation from the log.
+// Returns io.EOF if there are no more mutations written yet.
+func (r *LogReader) Next() (*Record, error) {
+	for {
+		rec, err := r.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if rec.SeqId >= r.fromSeq {
+			return rec, nil
+		}
+	}
+}
+
+func (r *LogReader) readFrame() (*Record, error) {
+	for {
+		rec, size, err := readFrame(r.file, r.offset)
+		if err == errIncompleteFrame {
+			if err = r.switchPage(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rec.SeqId != r.nextSeq {
+			return nil, ErrCorruptedLog
+		}
+		r.offset += size
+		r.nextSeq++
+		return rec, nil
+	}
+}
+
+// switchPage moves the reader to the next page if the current one is complete.
+func (r *LogReader) switchPage() error {
+	num := r.page.Num + 1
+	next := &BinLogFile{filepath.Join(r.location, pageFileName(num)), num}
+	firstSeq, err := pageFirstSeqId(next.FilePath)
+	if os.IsNotExist(err) || err == errIncompleteFrame {
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+	// Current page is complete once the next page exists,
+	// the frame may have been written in the meantime.
+	if _, _, err := readFrame(r.file, r.offset); err != errIncompleteFrame {
+		return err
+	}
+	if fi, err := r.file.Stat(); err != nil || fi.Size() != r.offset {
+		return ErrCorruptedLog
+	}
+	if firstSeq != r.nextSeq {
+		return ErrCorruptedLog
+	}
+	return r.openPage(next, firstSeq)
+}
+
+// Close closes the reader.
+func (r *LogReader) Close() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	if r.release != nil {
+		r.release()
+		r.release = nil
+	}
+}
@@ -0,0 +1,92 @@
+package replica
+
+// Replica follows the primary server over the native protocol:
+//
+//   > REPLICATE FROM <seq>
+//   < +OK
+//   < +REPL :<primary seq> $<len> <frame>   One response per mutation.
+//   < +REPLSEQ :<primary seq>               Heartbeat if there are no new mutations.
+//
+// Primary sequence id is the last sequence id of the primary binary log,
+// replica uses it to measure replication lag.
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/vburenin/firempq/enc"
+)
+
+const (
+	CmdReplicate  = "REPLICATE"
+	CmdAuth       = "AUTH"
+	PrmFrom       = "FROM"
+	RespRecord    = "+REPL"
+	RespHeartbeat = "+REPLSEQ"
+)
+
+// HeartbeatInterval is a period of heartbeats sent to the replica if there are no new mutations.
+const HeartbeatInterval = time.Second
+
+const (
+	// streamBatchSize is a max number of records written before they are flushed to the replica.
+	streamBatchSize = 256
+	// streamPollInterval is a period to check the log for new records once all of them are sent.
+	streamPollInterval = 10 * time.Millisecond
+)
+
+// Stream sends binary log records to the replica until the log can not be read,
+// the write fails or stopped returns true. Writer access is protected by the lock.
+func Stream(bl *BinaryLog, r *LogReader, w *bufio.Writer, lock sync.Locker, stopped func() bool) error {
+	lastWriteTs := time.Now()
+	for !stopped() {
+		primarySeq := bl.LastSeqId()
+		lock.Lock()
+		n, err := writeRecords(r, w, primarySeq)
+		heartbeat := n == 0 && time.Since(lastWriteTs) >= HeartbeatInterval
+		if err == nil && heartbeat {
+			w.WriteString(RespHeartbeat)
+			w.WriteByte(' ')
+			enc.WriteInt64(w, int64(primarySeq))
+			err = w.WriteByte('\n')
+		}
+		if err == nil && (n > 0 || heartbeat) {
+			err = w.Flush()
+			lastWriteTs = time.Now()
+		}
+		lock.Unlock()
+		if err != nil {
+			return err
+		}
+		if n < streamBatchSize {
+			time.Sleep(streamPollInterval)
+		}
+	}
+	return nil
+}
+
+func writeRecords(r *LogReader, w *bufio.Writer, primarySeq uint64) (int, error) {
+	for n := 0; n < streamBatchSize; n++ {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if rec.SeqId > primarySeq {
+			primarySeq = rec.SeqId
+		}
+		w.WriteString(RespRecord)
+		w.WriteByte(' ')
+		enc.WriteInt64(w, int64(primarySeq))
+		w.WriteByte(' ')
+		enc.WriteBytes(w, rec.Frame())
+		if err := w.WriteByte('\n'); err != nil {
+			return n, err
+		}
+	}
+	return streamBatchSize, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/vburenin/firempq/conf"
+	"github.com/vburenin/firempq/db"
+	"github.com/vburenin/firempq/db/backup"
+	"github.com/vburenin/firempq/log"
+	"github.com/vburenin/firempq/replica"
+)
+
+// RestoreMode is a command line mode to rebuild a data directory from the backup archive.
+const RestoreMode = "restore"
+
+// restore rebuilds the data directory from the backup archive and returns process exit code.
+func restore(args []string) int {
+	rcfg := conf.ParseRestoreParameters(args)
+	log.InitLogging()
+
+	ds, err := db.NewStorage(conf.CFG)
+	if err != nil {
+		log.Critical("Cannot initialize FireMPQ database: %s", err)
+		return 255
+	}
+	defer ds.Close()
+
+	log.Info("Restoring %s into %s", rcfg.Archive, rcfg.DatabasePath)
+	summary, err := backup.Restore(ds, rcfg.Archive)
+	if err != nil {
+		log.Critical("Restore failed: %s", err)
+		return 1
+	}
+	log.Info("Restored %d services, %d messages, %d records total",
+		summary.Services, summary.Messages, summary.Records())
+	if summary.LastSeqId > 0 {
+		// Replica started on the restored data continues replication after the archived mutations.
+		if err := replica.SeedAppliedSeq(ds, summary.LastSeqId); err != nil {
+			log.Critical("Could not store replication sequence id: %s", err)
+			return 1
+		}
+		log.Info("Replica will continue replication from sequence id %d", summary.LastSeqId+1)
+	}
+	return 0
+}
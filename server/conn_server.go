@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"net"
 	"net/http"
 	"os"
@@ -10,10 +11,13 @@ import (
 	"time"
 
 	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/auth"
 	"github.com/vburenin/firempq/conf"
 	"github.com/vburenin/firempq/db"
 	"github.com/vburenin/firempq/log"
 	"github.com/vburenin/firempq/qmgr"
+	"github.com/vburenin/firempq/queue_info"
+	"github.com/vburenin/firempq/replica"
 	"github.com/vburenin/firempq/server/snsproto"
 	"github.com/vburenin/firempq/server/sqsproto"
 	"github.com/vburenin/firempq/signals"
@@ -28,15 +32,58 @@ type QueueOpFunc func(req []string) error
 
 type ConnectionServer struct {
 	serviceManager *qmgr.ServiceManager
+	binaryLog      *replica.BinaryLog
+	replication    *Replication
+	access         *auth.Access
 	signalChan     chan os.Signal
 	waitGroup      sync.WaitGroup
 }
 
-func NewServer() apis.IServer {
-	return &ConnectionServer{
-		serviceManager: qmgr.CreateServiceManager(),
-		signalChan:     make(chan os.Signal, 1),
+func NewServer() (apis.IServer, error) {
+	cs := &ConnectionServer{
+		signalChan: make(chan os.Signal, 1),
 	}
+	if conf.CFG.UsersFile != "" {
+		access, err := auth.LoadAccess(conf.CFG.UsersFile, conf.CFG.AnonCommands)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Authentication is enabled, users are loaded from %s", conf.CFG.UsersFile)
+		cs.access = access
+	}
+	// Binary log must be ready before services are loaded.
+	if conf.CFG.BinaryLogPath != "" {
+		binaryLog, err := replica.NewBinaryLog(conf.CFG)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Binary log is written into %s starting from %d",
+			conf.CFG.BinaryLogPath, binaryLog.LastSeqId()+1)
+		if binaryLog.IsNew() {
+			if len(queue_info.GetServiceDescriptions()) == 0 {
+				if err := binaryLog.MarkFullHistory(); err != nil {
+					return nil, err
+				}
+			} else {
+				log.Warning("Binary log is enabled on existing data, it can not be used to start a new replica")
+			}
+		}
+		cs.binaryLog = binaryLog
+		db.SetMutationLog(binaryLog)
+	}
+	if conf.CFG.ReplicaOf != "" && replica.IsPromoted(db.DatabaseInstance()) {
+		return nil, errors.New("data has been promoted to primary, it can not be used by the replica")
+	}
+	cs.serviceManager = qmgr.CreateServiceManager()
+	cs.replication = &Replication{binaryLog: cs.binaryLog}
+	if conf.CFG.ReplicaOf != "" {
+		log.Info("Server is a read only replica of %s", conf.CFG.ReplicaOf)
+		follower := replica.NewFollower(conf.CFG.ReplicaOf, cs.serviceManager, db.DatabaseInstance())
+		follower.SetCredentials(conf.CFG.ReplicaUser, conf.CFG.ReplicaPassword)
+		follower.Start()
+		cs.replication.follower = follower
+	}
+	return cs, nil
 }
 
 func (cs *ConnectionServer) startAWSProtoListeners() {
@@ -118,14 +165,20 @@ func (cs *ConnectionServer) Start() {
 	}
 	go cs.waitForSignal(l)
 	cs.startAWSProtoListeners()
-	cs.waitGroup.Wait()
+	// Shutdown waits for all listeners to stop.
+	cs.Shutdown()
 }
 
 func (cs *ConnectionServer) Shutdown() {
 	cs.waitGroup.Wait()
+	cs.replication.Stop()
 	log.Info("Closing queues...")
 	cs.serviceManager.Close()
 	db.DatabaseInstance().Close()
+	if cs.binaryLog != nil {
+		db.SetMutationLog(nil)
+		cs.binaryLog.Close()
+	}
 	log.Info("Server stopped.")
 }
 
@@ -146,7 +199,7 @@ func (cs *ConnectionServer) Stop() {
 
 func (cs *ConnectionServer) handleConnection(conn net.Conn) {
 	cs.waitGroup.Add(1)
-	session_handler := NewSessionHandler(conn, cs.serviceManager)
+	session_handler := NewSessionHandler(conn, cs.serviceManager, cs.replication, cs.access)
 	session_handler.DispatchConn()
 	cs.waitGroup.Done()
 	conn.Close()
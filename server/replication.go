@@ -0,0 +1,138 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/log"
+	"github.com/vburenin/firempq/mpqerr"
+	"github.com/vburenin/firempq/mpqproto/resp"
+	"github.com/vburenin/firempq/qmgr"
+	"github.com/vburenin/firempq/replica"
+)
+
+const (
+	CMD_REPLICATE = replica.CmdReplicate
+	CMD_PROMOTE   = "PROMOTE"
+)
+
+// Replication is a replication state of the server. Server streams its binary log
+// to replicas if binary log is enabled, and follows the primary if it is a replica.
+type Replication struct {
+	lock      sync.Mutex
+	binaryLog *replica.BinaryLog
+	follower  *replica.Follower
+	streams   int64
+}
+
+// Stats returns the replication status reported by DBSTATS.
+func (r *Replication) Stats() map[string]interface{} {
+	r.lock.Lock()
+	follower := r.follower
+	r.lock.Unlock()
+
+	var stats map[string]interface{}
+	if follower != nil {
+		stats = follower.Stats()
+	} else {
+		stats = map[string]interface{}{
+			replica.STAT_ROLE:     replica.ROLE_PRIMARY,
+			replica.STAT_REPLICAS: atomic.LoadInt64(&r.streams),
+		}
+	}
+	if r.binaryLog != nil {
+		stats[replica.STAT_BINLOG_SEQ] = int64(r.binaryLog.LastSeqId())
+	}
+	return stats
+}
+
+// Promote stops following the primary and makes all services writable.
+func (r *Replication) Promote(svcs *qmgr.ServiceManager) apis.IResponse {
+	r.lock.Lock()
+	follower := r.follower
+	r.follower = nil
+	r.lock.Unlock()
+
+	if follower == nil {
+		return mpqerr.ERR_NOT_REPLICA
+	}
+	if err := follower.Promote(); err != nil {
+		log.Error("Failed to promote replica: %s", err)
+		return mpqerr.ServerError("Failed to promote replica: " + err.Error())
+	}
+	svcs.Promote()
+	log.Notice("Replica has been promoted to primary at %d", follower.AppliedSeq())
+	return resp.OK
+}
+
+// Stop stops following the primary.
+func (r *Replication) Stop() {
+	r.lock.Lock()
+	follower := r.follower
+	r.lock.Unlock()
+	if follower != nil {
+		follower.Stop()
+	}
+}
+
+// Stream sends binary log records to the replica connected to the session.
+// Session is closed once streaming is over.
+func (r *Replication) Stream(s *SessionHandler, fromSeq uint64) apis.IResponse {
+	if r.binaryLog == nil {
+		return mpqerr.ERR_BINLOG_DISABLED
+	}
+	// Replica without data needs all changes since the primary data was empty.
+	if fromSeq <= 1 && !r.binaryLog.HasFullHistory() {
+		return mpqerr.ERR_REPL_NO_FULL_HISTORY
+	}
+	if fromSeq > r.binaryLog.LastSeqId()+1 {
+		return mpqerr.ERR_REPL_SEQ_NOT_AVAILABLE
+	}
+	reader, err := r.binaryLog.NewReader(fromSeq)
+	if err == replica.ErrSeqNotAvailable {
+		return mpqerr.ERR_REPL_SEQ_NOT_AVAILABLE
+	}
+	if err != nil {
+		log.Error("Could not read binary log: %s", err)
+		return mpqerr.ServerError("Could not read binary log: " + err.Error())
+	}
+	defer reader.Close()
+
+	if err := s.WriteResponse(resp.OK); err != nil {
+		s.Stop()
+		return resp.OK
+	}
+
+	addr := s.conn.RemoteAddr().String()
+	log.Info("Replica %s is connected starting at %d", addr, fromSeq)
+	atomic.AddInt64(&r.streams, 1)
+	err = replica.Stream(r.binaryLog, reader, s.connWriter, &s.connLock, s.IsStopped)
+	atomic.AddInt64(&r.streams, -1)
+	log.Info("Replica %s is disconnected at %d: %v", addr, reader.NextSeqId(), err)
+
+	s.Stop()
+	if err != nil {
+		return mpqerr.ServerError("Replication stopped: " + err.Error())
+	}
+	return mpqerr.ERR_CONN_CLOSING
+}
+
+func (s *SessionHandler) replicateHandler(tokens []string) apis.IResponse {
+	if len(tokens) != 2 || tokens[0] != replica.PrmFrom {
+		return mpqerr.InvalidRequest("REPLICATE FROM <seq> is expected")
+	}
+	fromSeq, err := strconv.ParseUint(tokens[1], 10, 64)
+	if err != nil {
+		return mpqerr.InvalidRequest("Sequence number must be a positive integer")
+	}
+	return s.repl.Stream(s, fromSeq)
+}
+
+func (s *SessionHandler) promoteHandler(tokens []string) apis.IResponse {
+	if len(tokens) > 0 {
+		return mpqerr.ERR_CMD_WITH_NO_PARAMS
+	}
+	return s.repl.Promote(s.svcs)
+}
@@ -8,7 +8,7 @@ import (
 
 func Server(serverType string, serverAddress string) (apis.IServer, error) {
 	if serverType == SimpleServerType {
-		return NewServer(), nil
+		return NewServer()
 	}
 	return nil, errors.New("Invalid server type!")
 }
@@ -2,18 +2,26 @@ package server
 
 import (
 	"net"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 
 	"bufio"
 
 	"github.com/vburenin/firempq/apis"
+	"github.com/vburenin/firempq/auth"
+	"github.com/vburenin/firempq/conf"
 	"github.com/vburenin/firempq/db"
+	"github.com/vburenin/firempq/db/backup"
 	"github.com/vburenin/firempq/log"
 	"github.com/vburenin/firempq/mpqerr"
 	"github.com/vburenin/firempq/mpqproto"
 	"github.com/vburenin/firempq/mpqproto/resp"
+	"github.com/vburenin/firempq/pqueue"
+	"github.com/vburenin/firempq/pqueue/export"
 	"github.com/vburenin/firempq/qmgr"
+	"github.com/vburenin/firempq/replica"
 	"github.com/vburenin/firempq/signals"
 	"github.com/vburenin/firempq/utils"
 )
@@ -29,8 +37,24 @@ const (
 	CMD_LOGLEVEL   = "LOGLEVEL"
 	CMD_PANIC      = "PANIC"
 	CMD_DBSTATS    = "DBSTATS"
+	CMD_BACKUP     = "BACKUP"
+	CMD_EXPORT     = "EXPORT"
+	CMD_IMPORT     = "IMPORT"
+	CMD_COMPACT    = "COMPACT"
+	CMD_AUTH       = replica.CmdAuth
 )
 
+// PRM_SVC_TYPE is an optional CRT parameter to define a service type.
+const PRM_SVC_TYPE = "TYPE"
+
+// TAG_PREFIX starts an optional request tag token preceding the command.
+// Tagged requests are executed concurrently, their responses are tagged the same way.
+const TAG_PREFIX = "#"
+
+// QUEUE_PREFIX starts a queue name preceding the queue command, so the command
+// is executed by that queue without switching the session context.
+const QUEUE_PREFIX = "@"
+
 type FuncHandler func([]string) apis.IResponse
 
 type SessionHandler struct {
@@ -41,32 +65,58 @@ type SessionHandler struct {
 	stopChan   chan struct{}
 	tokenizer  *mpqproto.Tokenizer
 	svcs       *qmgr.ServiceManager
+	repl       *Replication
 	connWriter *bufio.Writer
+	// Limits the number of tagged requests executed concurrently.
+	inFlight      chan struct{}
+	inFlightGroup sync.WaitGroup
+	// Contexts of all queues used by the session, they are finished on disconnect.
+	ctxLock   sync.Mutex
+	queueCtxs map[string]*queueContext
+	// Access control of the session, nil if authentication is disabled.
+	access   *auth.Access
+	userLock sync.Mutex
+	user     *auth.User
+}
+
+type queueContext struct {
+	svc apis.ISvc
+	ctx apis.ServiceContext
 }
 
-func NewSessionHandler(conn net.Conn, services *qmgr.ServiceManager) *SessionHandler {
+func NewSessionHandler(conn net.Conn, services *qmgr.ServiceManager, repl *Replication,
+	access *auth.Access) *SessionHandler {
 	sh := &SessionHandler{
 		conn:       conn,
 		tokenizer:  mpqproto.NewTokenizer(),
 		ctx:        nil,
 		active:     true,
 		svcs:       services,
+		repl:       repl,
 		stopChan:   make(chan struct{}),
 		connWriter: bufio.NewWriter(conn),
+		inFlight:   make(chan struct{}, maxInFlight()),
+		queueCtxs:  make(map[string]*queueContext),
+		access:     access,
 	}
 	sh.QuitListener()
 	return sh
 }
 
+func maxInFlight() int {
+	if conf.CFG == nil || conf.CFG.MaxInFlight < 1 {
+		return 1
+	}
+	return conf.CFG.MaxInFlight
+}
+
 func (s *SessionHandler) QuitListener() {
 	go func() {
 		select {
 		case <-signals.QuitChan:
 			s.Stop()
 			s.WriteResponse(mpqerr.ERR_CONN_CLOSING)
-			if s.ctx != nil {
-				s.ctx.Finish()
-			}
+			s.finishContexts()
 			s.conn.Close()
 			return
 		case <-s.stopChan:
@@ -82,18 +132,25 @@ func (s *SessionHandler) DispatchConn() {
 	for s.active {
 		cmdTokens, err := s.tokenizer.ReadTokens(s.conn)
 		if err == nil {
-			resp := s.processCmdTokens(cmdTokens)
-			err = s.WriteResponse(resp)
+			if len(cmdTokens) > 0 && strings.HasPrefix(cmdTokens[0], TAG_PREFIX) {
+				err = s.processTagged(cmdTokens[0][len(TAG_PREFIX):], cmdTokens[1:])
+			} else {
+				if len(cmdTokens) > 0 && isSessionCmd(cmdTokens[0]) {
+					// Tagged requests in flight must complete within the current session state.
+					s.inFlightGroup.Wait()
+				}
+				resp := s.processCmdTokens(cmdTokens)
+				err = s.WriteResponse(resp)
+			}
 		}
 		if err != nil {
 			log.LogConnError(err)
 			break
 		}
 	}
+	s.inFlightGroup.Wait()
 	close(s.stopChan)
-	if s.ctx != nil {
-		s.ctx.Finish()
-	}
+	s.finishContexts()
 	s.conn.Close()
 	log.Debug("Client disconnected: %s", addr)
 }
@@ -109,7 +166,13 @@ func (s *SessionHandler) processCmdTokens(cmdTokens []string) apis.IResponse {
 	cmd := cmdTokens[0]
 	tokens := cmdTokens[1:]
 
+	if r := s.checkAccess(cmd, tokens); r != nil {
+		return r
+	}
+
 	switch cmd {
+	case CMD_AUTH:
+		return s.authHandler(tokens)
 	case CMD_QUIT:
 		return s.quitHandler(tokens)
 	case CMD_CTX:
@@ -129,8 +192,23 @@ func (s *SessionHandler) processCmdTokens(cmdTokens []string) apis.IResponse {
 	case CMD_PANIC:
 		return panicHandler(tokens)
 	case CMD_DBSTATS:
-		return dbstatHandler(tokens)
+		return s.dbstatHandler(tokens)
+	case CMD_BACKUP:
+		return backupHandler(tokens)
+	case CMD_EXPORT:
+		return s.exportHandler(tokens)
+	case CMD_IMPORT:
+		return s.importHandler(tokens)
+	case CMD_COMPACT:
+		return s.compactHandler(tokens)
+	case CMD_REPLICATE:
+		return s.replicateHandler(tokens)
+	case CMD_PROMOTE:
+		return s.promoteHandler(tokens)
 	default:
+		if strings.HasPrefix(cmd, QUEUE_PREFIX) {
+			return s.queueCmdHandler(cmd[len(QUEUE_PREFIX):], tokens)
+		}
 		if s.ctx == nil {
 			return mpqerr.InvalidRequest("Unknown command: " + cmd)
 		} else {
@@ -139,6 +217,102 @@ func (s *SessionHandler) processCmdTokens(cmdTokens []string) apis.IResponse {
 	}
 }
 
+// processTagged executes tagged request in the background once the number of requests
+// in flight is below the limit. Commands changing the session state are executed
+// after all requests in flight are completed.
+func (s *SessionHandler) processTagged(tag string, cmdTokens []string) error {
+	if !mpqproto.ValidateItemId(tag) {
+		return s.WriteResponse(mpqerr.ERR_WRONG_TAG)
+	}
+	if len(cmdTokens) > 0 && isSessionCmd(cmdTokens[0]) {
+		s.inFlightGroup.Wait()
+		return s.WriteResponse(resp.NewTaggedResponse(tag, s.processCmdTokens(cmdTokens)))
+	}
+	s.inFlight <- struct{}{}
+	s.inFlightGroup.Add(1)
+	go func() {
+		r := s.processCmdTokens(cmdTokens)
+		if err := s.WriteResponse(resp.NewTaggedResponse(tag, r)); err != nil {
+			log.LogConnError(err)
+		}
+		<-s.inFlight
+		s.inFlightGroup.Done()
+	}()
+	return nil
+}
+
+// isSessionCmd returns true if command changes the session state,
+// so it can't be executed concurrently with other commands.
+func isSessionCmd(cmd string) bool {
+	switch cmd {
+	case CMD_CTX, CMD_QUIT, CMD_REPLICATE, CMD_AUTH:
+		return true
+	}
+	return false
+}
+
+// checkAccess returns an error if the session is not allowed to execute the command.
+// Queue commands are checked by the queue context.
+func (s *SessionHandler) checkAccess(cmd string, tokens []string) apis.IResponse {
+	if s.access == nil || cmd == CMD_AUTH || cmd == CMD_QUIT {
+		return nil
+	}
+	user := s.currentUser()
+	if user == nil {
+		if s.access.AnonAllowed(cmd) {
+			return nil
+		}
+		return mpqerr.ERR_AUTH_REQUIRED
+	}
+	switch cmd {
+	case CMD_CREATE_SVC, CMD_DROP_SVC, CMD_LOGLEVEL, CMD_PANIC, CMD_DBSTATS, CMD_BACKUP,
+		CMD_EXPORT, CMD_IMPORT, CMD_REPLICATE, CMD_PROMOTE:
+		if !user.IsAdmin() {
+			return mpqerr.ERR_PERMISSION_DENIED
+		}
+	case CMD_COMPACT:
+		if len(tokens) == 1 && !user.CanAccess(tokens[0], apis.PermAdmin) ||
+			len(tokens) != 1 && !user.IsAdmin() {
+			return mpqerr.ERR_PERMISSION_DENIED
+		}
+	}
+	return nil
+}
+
+// CanAccess checks queue permissions of the session user for the queue contexts.
+func (s *SessionHandler) CanAccess(queue string, perm apis.Permission) bool {
+	if s.access == nil {
+		return true
+	}
+	user := s.currentUser()
+	return user != nil && user.CanAccess(queue, perm)
+}
+
+func (s *SessionHandler) currentUser() *auth.User {
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+	return s.user
+}
+
+// authHandler authenticates the session user. Session keeps the previous user if authentication fails.
+func (s *SessionHandler) authHandler(tokens []string) apis.IResponse {
+	if len(tokens) != 2 {
+		return mpqerr.InvalidRequest("AUTH accept user name and password only")
+	}
+	if s.access == nil {
+		return mpqerr.ERR_AUTH_DISABLED
+	}
+	user, ok := s.access.Authenticate(tokens[0], tokens[1])
+	if !ok {
+		log.Warning("Authentication of %s failed: %s", tokens[0], s.conn.RemoteAddr())
+		return mpqerr.ERR_AUTH_FAILED
+	}
+	s.userLock.Lock()
+	s.user = user
+	s.userLock.Unlock()
+	return resp.OK
+}
+
 // WriteResponse writes apis.IResponse into connection writer.
 func (s *SessionHandler) WriteResponse(resp apis.IResponse) error {
 	s.connLock.Lock()
@@ -155,9 +329,6 @@ func (s *SessionHandler) createServiceHandler(tokens []string) apis.IResponse {
 	if len(tokens) < 1 {
 		return mpqerr.InvalidRequest("Service name should be provided")
 	}
-	if len(tokens) > 1 {
-		return mpqerr.InvalidRequest("At least service name should be provided")
-	}
 
 	svcName := tokens[0]
 	if len(svcName) > 256 {
@@ -173,7 +344,17 @@ func (s *SessionHandler) createServiceHandler(tokens []string) apis.IResponse {
 		return mpqerr.ConflictRequest("Service exists already")
 	}
 
-	return s.svcs.CreateService(apis.ServiceTypePriorityQueue, svcName, tokens[1:])
+	svcType := apis.ServiceTypePriorityQueue
+	params := tokens[1:]
+	if len(params) > 0 && params[0] == PRM_SVC_TYPE {
+		var err *mpqerr.ErrorResponse
+		params, svcType, err = mpqproto.ParseServiceType(params)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.svcs.CreateService(svcType, svcName, params)
 }
 
 // Drop service.
@@ -199,20 +380,70 @@ func (s *SessionHandler) ctxHandler(tokens []string) apis.IResponse {
 		return mpqerr.InvalidRequest("Service name must be provided")
 	}
 
-	svcName := tokens[0]
-	svc, exists := s.svcs.GetService(svcName)
+	ctx, exists := s.queueContext(tokens[0])
 	if !exists {
 		return mpqerr.ERR_NO_SVC
 	}
-	s.ctx = svc.NewContext(s)
+	s.ctx = ctx
 	return resp.OK
 }
 
+// queueCmdHandler executes the command of the queue without switching the session context.
+func (s *SessionHandler) queueCmdHandler(svcName string, tokens []string) apis.IResponse {
+	if len(tokens) == 0 {
+		return mpqerr.InvalidRequest("Queue command should be provided")
+	}
+	ctx, exists := s.queueContext(svcName)
+	if !exists {
+		return mpqerr.ERR_NO_SVC
+	}
+	return ctx.Call(tokens[0], tokens[1:])
+}
+
+// queueContext returns the session context of the service creating it on the first use.
+// Context is recreated if the service has been dropped and created again.
+func (s *SessionHandler) queueContext(svcName string) (apis.ServiceContext, bool) {
+	svc, exists := s.svcs.GetService(svcName)
+	if !exists {
+		return nil, false
+	}
+	s.ctxLock.Lock()
+	qc, ok := s.queueCtxs[svcName]
+	if ok && qc.svc == svc {
+		s.ctxLock.Unlock()
+		return qc.ctx, true
+	}
+	ctx := svc.NewContext(s)
+	s.queueCtxs[svcName] = &queueContext{svc: svc, ctx: ctx}
+	s.ctxLock.Unlock()
+
+	if ok {
+		qc.ctx.Finish()
+	}
+	return ctx, true
+}
+
+// finishContexts finishes contexts of all queues used by the session.
+func (s *SessionHandler) finishContexts() {
+	s.ctxLock.Lock()
+	ctxs := s.queueCtxs
+	s.queueCtxs = make(map[string]*queueContext)
+	s.ctxLock.Unlock()
+	for _, qc := range ctxs {
+		qc.ctx.Finish()
+	}
+}
+
 // Stop the processing loop.
 func (s *SessionHandler) Stop() {
 	s.active = false
 }
 
+// IsStopped returns true if the processing loop is stopped.
+func (s *SessionHandler) IsStopped() bool {
+	return !s.active
+}
+
 // Stops the main loop on QUIT.
 func (s *SessionHandler) quitHandler(tokens []string) apis.IResponse {
 	if len(tokens) > 0 {
@@ -274,10 +505,162 @@ func panicHandler(tokens []string) apis.IResponse {
 	return resp.OK
 }
 
-func dbstatHandler(tokens []string) apis.IResponse {
-	if len(tokens) > 0 {
-		return mpqerr.ERR_CMD_WITH_NO_PARAMS
+// dbstatHandler reports storage stats. Keys of the queue are counted only if the queue
+// name is provided, since it takes iteration over all queue data.
+func (s *SessionHandler) dbstatHandler(tokens []string) apis.IResponse {
+	if len(tokens) > 1 {
+		return mpqerr.InvalidRequest("DBSTATS accept queue name only")
+	}
+	var svc apis.ISvc
+	if len(tokens) == 1 {
+		var ok bool
+		if svc, ok = s.svcs.GetService(tokens[0]); !ok {
+			return mpqerr.ERR_NO_SVC
+		}
+	}
+	ds := db.DatabaseInstance()
+	stats := ds.GetStats()
+	for k, v := range s.repl.Stats() {
+		stats[k] = v
+	}
+	for k, v := range s.svcs.ReclaimStats() {
+		stats[k] = v
+	}
+	if svc != nil {
+		ds.FlushCache()
+		svcStats, err := db.GetServiceStats(ds, svc.Info().ID, pqueue.PayloadCodec)
+		if err != nil {
+			log.Error("Could not get storage stats of %s: %s", tokens[0], err)
+			return mpqerr.ServerError("Could not get storage stats: " + err.Error())
+		}
+		for k, v := range svcStats.Dict(tokens[0]) {
+			stats[k] = v
+		}
+	}
+	return resp.NewDictResponse("+DBSTATS", stats)
+}
+
+// compactHandler compacts data of the queue or the whole database if queue is not provided.
+func (s *SessionHandler) compactHandler(tokens []string) apis.IResponse {
+	if len(tokens) > 1 {
+		return mpqerr.InvalidRequest("COMPACT accept queue name only")
+	}
+	cs, ok := db.DatabaseInstance().(apis.CompactStorage)
+	if !ok {
+		return mpqerr.ERR_COMPACT_NOT_SUPPORTED
+	}
+	start, limit := "", ""
+	name := "database"
+	if len(tokens) == 1 {
+		svc, ok := s.svcs.GetService(tokens[0])
+		if !ok {
+			return mpqerr.ERR_NO_SVC
+		}
+		start, limit = db.ServiceKeyRange(svc.Info().ID)
+		name = tokens[0]
+	}
+	log.Info("Compacting %s", name)
+	startTs := utils.Uts()
+	if err := cs.CompactRange(start, limit); err != nil {
+		log.Error("Compaction failed: %s", err)
+		return mpqerr.ServerError("Compaction failed: " + err.Error())
+	}
+	log.Info("Compaction of %s completed in %dms", name, utils.Uts()-startTs)
+	return resp.OK
+}
+
+// serverPath resolves the file name provided by the client within the configured directory.
+// Absolute paths and paths with ".." elements are rejected.
+func serverPath(dir, name string) (string, *mpqerr.ErrorResponse) {
+	if name == "" || filepath.IsAbs(name) {
+		return "", mpqerr.ERR_BAD_FILE_PATH
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(name), "/") {
+		if elem == ".." {
+			return "", mpqerr.ERR_BAD_FILE_PATH
+		}
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// backupHandler writes a consistent copy of all data into the archive file
+// in the backup directory on the server.
+func backupHandler(tokens []string) apis.IResponse {
+	if len(tokens) != 1 {
+		return mpqerr.InvalidRequest("Backup archive path should be provided")
+	}
+	if conf.CFG.BackupDir == "" {
+		return mpqerr.ERR_BACKUP_DISABLED
+	}
+	path, r := serverPath(conf.CFG.BackupDir, tokens[0])
+	if r != nil {
+		return r
+	}
+	log.Info("Writing backup into: %s", path)
+	summary, err := backup.Write(db.DatabaseInstance(), path)
+	if err != nil {
+		log.Error("Backup failed: %s", err)
+		return mpqerr.ServerError("Backup failed: " + err.Error())
+	}
+	log.Info("Backup completed: %d records written", summary.Records())
+	return resp.NewDictResponse("+BACKUP", summary.Dict())
+}
+
+// queueAndPath parses the queue name and file path parameters of export and import commands.
+// File path is resolved within the export directory.
+func (s *SessionHandler) queueAndPath(tokens []string) (*pqueue.PQueue, string, apis.IResponse) {
+	if len(tokens) != 2 {
+		return nil, "", mpqerr.InvalidRequest("Queue name and file path should be provided")
+	}
+	if conf.CFG.ExportDir == "" {
+		return nil, "", mpqerr.ERR_EXPORT_DISABLED
+	}
+	path, r := serverPath(conf.CFG.ExportDir, tokens[1])
+	if r != nil {
+		return nil, "", r
+	}
+	svc, ok := s.svcs.GetService(tokens[0])
+	if !ok {
+		return nil, "", mpqerr.ERR_NO_SVC
+	}
+	pq, ok := svc.(*pqueue.PQueue)
+	if !ok {
+		return nil, "", mpqerr.ERR_SVC_UNKNOWN_TYPE
+	}
+	return pq, path, nil
+}
+
+// exportHandler writes all queue messages into the JSON Lines file in the export directory on the server.
+func (s *SessionHandler) exportHandler(tokens []string) apis.IResponse {
+	pq, path, r := s.queueAndPath(tokens)
+	if r != nil {
+		return r
+	}
+	log.Info("Exporting %s into: %s", tokens[0], path)
+	count, err := export.Write(pq, path)
+	if err != nil {
+		log.Error("Export failed: %s", err)
+		return mpqerr.ServerError("Export failed: " + err.Error())
+	}
+	log.Info("Export completed: %d messages written", count)
+	return resp.NewIntResponse(count)
+}
+
+// importHandler pushes messages from the JSON Lines file in the export directory on the server into the queue.
+func (s *SessionHandler) importHandler(tokens []string) apis.IResponse {
+	pq, path, r := s.queueAndPath(tokens)
+	if r != nil {
+		return r
+	}
+	if pq.IsReadOnly() {
+		return mpqerr.ERR_READ_ONLY
+	}
+	log.Info("Importing %s into %s", path, tokens[0])
+	summary, err := export.Read(pq, path)
+	if err != nil {
+		log.Error("Import failed: %s", err)
+		return mpqerr.ServerError("Import failed: " + err.Error())
 	}
-	db := db.DatabaseInstance()
-	return resp.NewDictResponse("+DBSTATS", db.GetStats())
+	log.Info("Import completed: %d messages imported, %d failed", summary.Imported, summary.Failed)
+	return resp.NewDictResponse("+IMPORT", summary.Dict())
 }
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/vburenin/firempq/auth"
+	"github.com/vburenin/firempq/conf"
+	"github.com/vburenin/firempq/db"
+	"github.com/vburenin/firempq/log"
+	. "github.com/vburenin/firempq/mpqtesting"
+	"github.com/vburenin/firempq/pqueue"
+	"github.com/vburenin/firempq/qmgr"
+	"github.com/vburenin/firempq/replica"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	svcs   *qmgr.ServiceManager
+}
+
+func (c *testClient) send(cmd string) {
+	c.conn.Write([]byte(cmd + "\n"))
+}
+
+func (c *testClient) close() {
+	c.conn.Close()
+	c.svcs.Close()
+}
+
+func (c *testClient) read() string {
+	line, _ := c.reader.ReadString('\n')
+	if len(line) > 0 {
+		line = line[:len(line)-1]
+	}
+	return line
+}
+
+func passwordHash(s string) string {
+	hash, _ := bcrypt.GenerateFromPassword([]byte(s), bcrypt.MinCost)
+	return string(hash)
+}
+
+var initOnce sync.Once
+
+func newTestSession() (*testClient, *SessionHandler) {
+	initOnce.Do(func() {
+		pqueue.DefaultPQConfig()
+		log.InitLogging()
+		log.SetLevel(1)
+	})
+	conf.CFG.MaxInFlight = 4
+	db.SetDatabase(NewInMemDBService())
+
+	srv, cli := net.Pipe()
+	svcs := qmgr.NewServiceManager()
+	sh := NewSessionHandler(srv, svcs, &Replication{}, nil)
+	go sh.DispatchConn()
+	c := &testClient{conn: cli, reader: bufio.NewReader(cli), svcs: svcs}
+	c.read()
+	return c, sh
+}
+
+func TestTaggedRequests(t *testing.T) {
+	Convey("Tagged requests should be executed concurrently", t, func() {
+		c, _ := newTestSession()
+		defer c.close()
+
+		c.send("CRT q")
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("#c1 CTX q")
+		So(c.read(), ShouldEqual, "+TAG c1 +OK")
+
+		// Waiting pop doesn't block the following requests.
+		c.send("#w1 POP WAIT 1000")
+		c.send("#p1 PUSH ID m1 PL data")
+		responses := []string{c.read(), c.read()}
+		So(responses, ShouldContain, "+TAG p1 +OK")
+		So(responses[1], ShouldStartWith, "+TAG w1 +MSGS *1")
+
+		// More requests than the in flight limit, pipe is not buffered.
+		go func() {
+			for _, tag := range []string{"a", "b", "c", "d", "e", "f"} {
+				c.send("#" + tag + " PUSH PL " + tag)
+			}
+		}()
+		var pushed []string
+		for i := 0; i < 6; i++ {
+			pushed = append(pushed, c.read())
+		}
+		So(pushed, ShouldContain, "+TAG a +OK")
+		So(pushed, ShouldContain, "+TAG f +OK")
+
+		c.send("STATUS")
+		So(c.read(), ShouldContainSubstring, "TotalMessages :6")
+
+		c.send("#bad! PING")
+		So(c.read(), ShouldStartWith, "-ERR")
+		c.send("#q QUIT")
+		So(c.read(), ShouldEqual, "+TAG q +OK")
+	})
+}
+
+func TestTaggedRequestsBeforeContextSwitch(t *testing.T) {
+	Convey("Tagged requests should complete before untagged context switch", t, func() {
+		c, _ := newTestSession()
+		defer c.close()
+
+		c.send("CRT a")
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("CRT b")
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("CTX a")
+		So(c.read(), ShouldEqual, "+OK")
+
+		for i := 0; i < 10; i++ {
+			c.send("#p PUSH PL data")
+			c.send("CTX b")
+			So(c.read(), ShouldEqual, "+TAG p +OK")
+			So(c.read(), ShouldEqual, "+OK")
+			c.send("CTX a")
+			So(c.read(), ShouldEqual, "+OK")
+		}
+
+		c.send("@a STATUS")
+		So(c.read(), ShouldContainSubstring, "TotalMessages :10")
+		c.send("@b STATUS")
+		So(c.read(), ShouldContainSubstring, "TotalMessages :0")
+	})
+}
+
+func contextCount(sh *SessionHandler) int {
+	sh.ctxLock.Lock()
+	defer sh.ctxLock.Unlock()
+	return len(sh.queueCtxs)
+}
+
+func TestQueueAddressing(t *testing.T) {
+	Convey("Commands prefixed with a queue name should be executed by that queue", t, func() {
+		c, sh := newTestSession()
+		defer c.close()
+
+		c.send("CRT a")
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("CRT b")
+		So(c.read(), ShouldEqual, "+OK")
+
+		c.send("@a PUSH ID m1 PL data")
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("#t1 @b PUSH ID m2 PL data")
+		So(c.read(), ShouldEqual, "+TAG t1 +OK")
+		c.send("@b POP")
+		So(c.read(), ShouldContainSubstring, "m2")
+		c.send("@a MSGINFO m1")
+		So(c.read(), ShouldStartWith, "+MSGINFO")
+
+		c.send("@c PUSH PL data")
+		So(c.read(), ShouldStartWith, "-ERR")
+		c.send("@a")
+		So(c.read(), ShouldStartWith, "-ERR")
+		// Session context is not changed.
+		c.send("STATUS")
+		So(c.read(), ShouldStartWith, "-ERR")
+
+		c.send("CTX a")
+		So(c.read(), ShouldEqual, "+OK")
+		So(contextCount(sh), ShouldEqual, 2)
+
+		c.conn.Close()
+		for i := 0; i < 100 && contextCount(sh) > 0; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		So(contextCount(sh), ShouldEqual, 0)
+	})
+}
+
+func TestAuthentication(t *testing.T) {
+	Convey("Commands should be executed according to user permissions", t, func() {
+		c, sh := newTestSession()
+		defer c.close()
+		users, err := auth.ParseUsers([]byte(`{
+			"root": {"password": "` + passwordHash("rootpw") + `", "roles": ["admin"]},
+			"worker": {"password": "` + passwordHash("workerpw") + `", "queues": {"q": ["pop"]}},
+			"producer": {"password": "` + passwordHash("producerpw") + `", "queues": {"q": ["push"]}}
+		}`))
+		So(err, ShouldBeNil)
+		sh.access = auth.NewAccess(users, []string{CMD_PING})
+
+		c.send("PING")
+		So(c.read(), ShouldEqual, "+PONG")
+		c.send("CRT q")
+		So(c.read(), ShouldContainSubstring, "Authentication required")
+		c.send("AUTH root wrong")
+		So(c.read(), ShouldContainSubstring, "Invalid user name or password")
+
+		c.send("AUTH root rootpw")
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("CRT q")
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("@q PUSH ID m1 PL data")
+		So(c.read(), ShouldEqual, "+OK")
+
+		c.send("#a AUTH worker workerpw")
+		So(c.read(), ShouldEqual, "+TAG a +OK")
+		c.send("@q PUSH PL data")
+		So(c.read(), ShouldContainSubstring, "Permission denied")
+		c.send("@q POPLCK")
+		So(c.read(), ShouldContainSubstring, "m1")
+		c.send("CTX q")
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("PURGE")
+		So(c.read(), ShouldContainSubstring, "Permission denied")
+		c.send("STATUS")
+		So(c.read(), ShouldStartWith, "+STATUS")
+		c.send("DROP q")
+		So(c.read(), ShouldContainSubstring, "Permission denied")
+		c.send("LOGLEVEL 1")
+		So(c.read(), ShouldContainSubstring, "Permission denied")
+
+		// Producer can't read messages.
+		c.send("AUTH producer producerpw")
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("PUSH ID m2 PL data")
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("STATUS")
+		So(c.read(), ShouldStartWith, "+STATUS")
+		for _, cmd := range []string{"PEEK", "PEEKLOCKED", "MSGINFO m2", "POP"} {
+			c.send(cmd)
+			So(c.read(), ShouldContainSubstring, "Permission denied")
+		}
+	})
+}
+
+func TestReplicateFullHistory(t *testing.T) {
+	Convey("Primary should stream to a new replica only if binary log has all data", t, func() {
+		dir, _ := ioutil.TempDir("", "fmpq-binlog")
+		defer os.RemoveAll(dir)
+		bl, err := replica.NewBinaryLog(&conf.Config{BinaryLogPath: dir, BinaryLogBufferSize: 16})
+		So(err, ShouldBeNil)
+		defer bl.Close()
+
+		c, sh := newTestSession()
+		defer c.close()
+		sh.repl.binaryLog = bl
+
+		c.send("REPLICATE FROM 1")
+		So(c.read(), ShouldStartWith, "-ERR :409")
+
+		So(bl.MarkFullHistory(), ShouldBeNil)
+		c.send("REPLICATE FROM 1")
+		So(c.read(), ShouldEqual, "+OK")
+	})
+}
+
+func TestDbStats(t *testing.T) {
+	Convey("Queue keys should be counted only if queue is requested", t, func() {
+		c, _ := newTestSession()
+		defer c.close()
+		c.send("CRT q")
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("CTX q")
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("PUSH PL data")
+		So(c.read(), ShouldEqual, "+OK")
+
+		c.send("DBSTATS")
+		So(c.read(), ShouldNotContainSubstring, "Queue.q.MetaKeys")
+		c.send("DBSTATS q")
+		So(c.read(), ShouldContainSubstring, "$16 Queue.q.MetaKeys :1")
+		c.send("DBSTATS nope")
+		So(c.read(), ShouldStartWith, "-ERR")
+		c.send("DBSTATS q nope")
+		So(c.read(), ShouldStartWith, "-ERR")
+
+		c.send("SETCFG COMPRESS snappy COMPRESSMIN 10")
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("PUSH PL " + strings.Repeat("a", 200))
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("DBSTATS q")
+		stats := c.read()
+		So(stats, ShouldContainSubstring, "Queue.q.RawPayloadBytes :204")
+		So(stats, ShouldNotContainSubstring, "Queue.q.PayloadBytes :204")
+		So(stats, ShouldNotContainSubstring, "Queue.q.CompressionRatio $4 1.00")
+	})
+}
+
+func TestBackupDir(t *testing.T) {
+	Convey("Backup should be written into the backup directory only", t, func() {
+		c, _ := newTestSession()
+		defer c.close()
+
+		c.send("BACKUP fmpq.bak")
+		So(c.read(), ShouldContainSubstring, "Backup directory is not configured")
+
+		dir, _ := ioutil.TempDir("", "fmpq-backup")
+		defer os.RemoveAll(dir)
+		conf.CFG.BackupDir = dir
+		defer func() { conf.CFG.BackupDir = "" }()
+
+		c.send("BACKUP " + filepath.Join(dir, "fmpq.bak"))
+		So(c.read(), ShouldContainSubstring, "File path must be relative")
+		c.send("BACKUP ../fmpq.bak")
+		So(c.read(), ShouldContainSubstring, "File path must be relative")
+		c.send("BACKUP sub/../../fmpq.bak")
+		So(c.read(), ShouldContainSubstring, "File path must be relative")
+
+		c.send("BACKUP fmpq.bak")
+		So(c.read(), ShouldStartWith, "+BACKUP")
+		_, err := os.Stat(filepath.Join(dir, "fmpq.bak"))
+		So(err, ShouldBeNil)
+	})
+}
+
+func TestExportDir(t *testing.T) {
+	Convey("Export and import should use files in the export directory only", t, func() {
+		c, _ := newTestSession()
+		defer c.close()
+		c.send("CRT q")
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("@q PUSH ID m1 PL data")
+		So(c.read(), ShouldEqual, "+OK")
+
+		c.send("EXPORT q q.jsonl")
+		So(c.read(), ShouldContainSubstring, "Export directory is not configured")
+
+		dir, _ := ioutil.TempDir("", "fmpq-export")
+		defer os.RemoveAll(dir)
+		conf.CFG.ExportDir = dir
+		defer func() { conf.CFG.ExportDir = "" }()
+
+		c.send("EXPORT q " + filepath.Join(dir, "q.jsonl"))
+		So(c.read(), ShouldContainSubstring, "File path must be relative")
+		c.send("IMPORT q ../q.jsonl")
+		So(c.read(), ShouldContainSubstring, "File path must be relative")
+
+		c.send("EXPORT q q.jsonl")
+		So(c.read(), ShouldEqual, "+DATA :1")
+		_, err := os.Stat(filepath.Join(dir, "q.jsonl"))
+		So(err, ShouldBeNil)
+
+		c.send("CRT q2")
+		So(c.read(), ShouldEqual, "+OK")
+		c.send("IMPORT q2 q.jsonl")
+		So(c.read(), ShouldContainSubstring, "Imported :1")
+	})
+}
@@ -32,6 +32,8 @@ type QueueAttributes struct {
 	RedrivePolicy int64
 	// Queue to push died messages.
 	DeadMessageQueue string
+	// Deliver messages in order within message groups.
+	FifoQueue bool
 }
 
 type CreateQueueResponse struct {
@@ -73,6 +75,8 @@ func (r *QueueAttributes) HandleAttribute(paramName, value string) *sqserr.SQSEr
 	case AttrReceiveMessageWaitTimeSeconds:
 		r.ReceiveMessageWaitTimeSeconds, err = strconv.ParseInt(value, 10, 0)
 		r.ReceiveMessageWaitTimeSeconds *= 1000
+	case AttrFifoQueue:
+		r.FifoQueue, err = strconv.ParseBool(value)
 	default:
 		return sqserr.InvalidAttributeNameError("Unknown Attribute " + paramName + ".")
 	}
@@ -161,6 +165,7 @@ const (
 	AttrMaximumMessageSize            = "MaximumMessageSize"
 	AttrMessageRetentionPeriod        = "MessageRetentionPeriod"
 	AttrReceiveMessageWaitTimeSeconds = "ReceiveMessageWaitTimeSeconds"
+	AttrFifoQueue                     = "FifoQueue"
 )
 
 func CheckAvailableQueues(
@@ -170,9 +175,13 @@ func CheckAvailableQueues(
 
 	svc, ok := svcMgr.GetService(sqsQuery.QueueName)
 	if ok {
-		if svc.Info().Type != apis.ServiceTypePriorityQueue {
+		svcType := svc.Info().Type
+		if svcType != apis.ServiceTypePriorityQueue && svcType != apis.ServiceTypeFifoQueue {
 			return sqserr.QueueAlreadyExistsError("Queue already exists for a different type of service")
 		}
+		if attr.FifoQueue != (svcType == apis.ServiceTypeFifoQueue) {
+			return sqserr.QueueAlreadyExistsError(errQueueExists + AttrFifoQueue)
+		}
 		pq, _ := svc.(*pqueue.PQueue)
 		pqConfig := pq.Config()
 		if !ok {
@@ -212,7 +221,12 @@ func CreateQueue(svcMgr *qmgr.ServiceManager, sqsQuery *urlutils.SQSQuery) sqs_r
 		return errResp
 	}
 
-	resp := svcMgr.CreatePQueue(sqsQuery.QueueName, queueAttributes.MakePQConfig())
+	var resp apis.IResponse
+	if queueAttributes.FifoQueue {
+		resp = svcMgr.CreateFifoQueue(sqsQuery.QueueName, queueAttributes.MakePQConfig())
+	} else {
+		resp = svcMgr.CreatePQueue(sqsQuery.QueueName, queueAttributes.MakePQConfig())
+	}
 	if resp.IsError() {
 		e, _ := resp.(error)
 		return sqserr.ServerSideError(e.Error())
@@ -49,10 +49,6 @@ const (
 	// AttrPolicy                                = "Policy"
 )
 
-func makeQueueArn(name string) string {
-	return "arn:aws:sqs:us-west-2:123456789:" + name
-}
-
 func GetQueueAttributes(pq *pqueue.PQueue, sqsQuery *urlutils.SQSQuery) sqs_response.SQSResponse {
 	paramsLen := len(sqsQuery.ParamsList) - 1
 
@@ -124,7 +120,7 @@ func GetQueueAttributes(pq *pqueue.PQueue, sqsQuery *urlutils.SQSQuery) sqs_resp
 			if allAttr || attrName == AttrQueueArn {
 				resp.Attributes = append(resp.Attributes, &QAttr{
 					Name:  AttrQueueArn,
-					Value: makeQueueArn(pqDesc.Name),
+					Value: urlutils.MakeQueueArn(pqDesc.Name),
 				})
 			}
 
@@ -154,7 +150,7 @@ func GetQueueAttributes(pq *pqueue.PQueue, sqsQuery *urlutils.SQSQuery) sqs_resp
 					resp.Attributes = append(resp.Attributes, &QAttr{
 						Name: AttrRedrivePolicy,
 						Value: fmt.Sprintf(`{"deadLetterTargetArn":"%s","maxReceiveCount":%d}`,
-							makeQueueArn(pqCfg.PopLimitQueueName), pqCfg.PopCountLimit),
+							urlutils.MakeQueueArn(pqCfg.PopLimitQueueName), pqCfg.PopCountLimit),
 					})
 				}
 			}
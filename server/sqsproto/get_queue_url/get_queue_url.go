@@ -26,7 +26,8 @@ func GetQueueUrl(svcMgr *qmgr.ServiceManager, sqsQuery *urlutils.SQSQuery) sqs_r
 	if !ok {
 		return sqserr.QueueDoesNotExist()
 	}
-	if svc.Info().Type != apis.ServiceTypePriorityQueue {
+	svcType := svc.Info().Type
+	if svcType != apis.ServiceTypePriorityQueue && svcType != apis.ServiceTypeFifoQueue {
 		return sqserr.QueueDoesNotExist()
 	}
 
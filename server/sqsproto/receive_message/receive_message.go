@@ -26,6 +26,11 @@ const (
 	AttrApproximateFirstReceiveTimestamp = "ApproximateFirstReceiveTimestamp"
 	AttrApproximateReceiveCount          = "ApproximateReceiveCount"
 	AttrSentTimestamp                    = "SentTimestamp"
+	AttrMessageGroupId                   = "MessageGroupId"
+	AttrDeadLetterQueueSourceArn         = "DeadLetterQueueSourceArn"
+	AttrDeadLetterReceiveCount           = "DeadLetterReceiveCount"
+	AttrDeadLetterFirstSentTimestamp     = "DeadLetterFirstSentTimestamp"
+	AttrDeadLetterReason                 = "DeadLetterReason"
 )
 
 type SysAttribute struct {
@@ -112,6 +117,29 @@ func (self *ReceiveMessageOptions) Parse(paramName, value string) *sqserr.SQSErr
 	return nil
 }
 
+var deadLetterAttrNames = []string{
+	AttrDeadLetterQueueSourceArn,
+	AttrDeadLetterReceiveCount,
+	AttrDeadLetterFirstSentTimestamp,
+	AttrDeadLetterReason,
+}
+
+// deadLetterAttr makes a system attribute describing where a dead-lettered message came from.
+func deadLetterAttr(name string, msgMeta *pqueue.PQMsgMetaData) *SysAttribute {
+	var value string
+	switch name {
+	case AttrDeadLetterQueueSourceArn:
+		value = urlutils.MakeQueueArn(msgMeta.SrcQueue)
+	case AttrDeadLetterReceiveCount:
+		value = strconv.FormatInt(msgMeta.SrcPopCount, 10)
+	case AttrDeadLetterFirstSentTimestamp:
+		value = strconv.FormatInt(msgMeta.SrcPushTs, 10)
+	case AttrDeadLetterReason:
+		value = msgMeta.FailReason
+	}
+	return &SysAttribute{Name: name, Value: value}
+}
+
 func MakeMessageAttr(name string, sqsAttr *sqsmsg.UserAttribute) *MessageAttribute {
 	if strings.HasPrefix(sqsAttr.Type, "Binary") {
 		encodedBin := make([]byte, base64.StdEncoding.EncodedLen(len(sqsAttr.Value)))
@@ -170,6 +198,16 @@ func MakeMessageResponse(iMsg apis.IResponseItem, opts *ReceiveMessageOptions,
 		output.Attributes = append(output.Attributes, &SysAttribute{
 			Name: AttrApproximateFirstReceiveTimestamp, Value: strconv.FormatInt(utils.Uts(), 10),
 		})
+		if msgMeta.GroupId != "" {
+			output.Attributes = append(output.Attributes, &SysAttribute{
+				Name: AttrMessageGroupId, Value: msgMeta.GroupId,
+			})
+		}
+		if msgMeta.SrcQueue != "" {
+			for _, k := range deadLetterAttrNames {
+				output.Attributes = append(output.Attributes, deadLetterAttr(k, msgMeta))
+			}
+		}
 	} else {
 		for _, k := range opts.Attributes {
 			switch k {
@@ -189,6 +227,17 @@ func MakeMessageResponse(iMsg apis.IResponseItem, opts *ReceiveMessageOptions,
 				output.Attributes = append(output.Attributes, &SysAttribute{
 					Name: AttrApproximateFirstReceiveTimestamp, Value: strconv.FormatInt(utils.Uts(), 10),
 				})
+			case AttrMessageGroupId:
+				if msgMeta.GroupId != "" {
+					output.Attributes = append(output.Attributes, &SysAttribute{
+						Name: AttrMessageGroupId, Value: msgMeta.GroupId,
+					})
+				}
+			case AttrDeadLetterQueueSourceArn, AttrDeadLetterReceiveCount,
+				AttrDeadLetterFirstSentTimestamp, AttrDeadLetterReason:
+				if msgMeta.SrcQueue != "" {
+					output.Attributes = append(output.Attributes, deadLetterAttr(k, msgMeta))
+				}
 			}
 		}
 	}
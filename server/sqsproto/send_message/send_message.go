@@ -121,8 +121,9 @@ func CalcAttrMd5(attrMap map[string]*sqsmsg.UserAttribute) string {
 
 // MessageParams defines a parameters which are set to a new message.
 type MessageParams struct {
-	DelaySeconds int64
-	MessageBody  string
+	DelaySeconds   int64
+	MessageBody    string
+	MessageGroupId string
 }
 
 func (mp *MessageParams) Parse(paramName, value string) *sqserr.SQSError {
@@ -133,6 +134,8 @@ func (mp *MessageParams) Parse(paramName, value string) *sqserr.SQSError {
 		mp.DelaySeconds *= 1000
 	case "MessageBody":
 		mp.MessageBody = value
+	case "MessageGroupId":
+		mp.MessageGroupId = value
 	}
 
 	if err != nil {
@@ -214,6 +217,18 @@ func PushAMessage(pq *pqueue.PQueue, senderId string, paramList []string) sqs_re
 		}
 	}
 
+	if pq.IsFifo() {
+		if out.MessageGroupId == "" {
+			return sqserr.MissingParameterError("The request must contain the parameter MessageGroupId.")
+		}
+		if len(out.MessageGroupId) > 128 {
+			return sqserr.InvalidParameterValueError("MessageGroupId can not be longer than 128 characters")
+		}
+	} else if out.MessageGroupId != "" {
+		return sqserr.InvalidParameterValueError(
+			"The request include parameter that is not valid for this queue type: MessageGroupId")
+	}
+
 	msgId := IdGen.RandId()
 	if out.DelaySeconds < 0 {
 		out.DelaySeconds = pq.Config().DeliveryDelay
@@ -239,7 +254,12 @@ func PushAMessage(pq *pqueue.PQueue, senderId string, paramList []string) sqs_re
 	}
 	payload := string(d)
 
-	resp := pq.Push(msgId, payload, pq.Config().MsgTtl, out.DelaySeconds, 1)
+	resp := pq.PushMsg(msgId, payload, &pqueue.PushParams{
+		MsgTtl:   pq.Config().MsgTtl,
+		Delay:    out.DelaySeconds,
+		Priority: 1,
+		GroupId:  out.MessageGroupId,
+	})
 	if resp.IsError() {
 		e, _ := resp.(error)
 		return sqserr.InvalidParameterValueError(e.Error())
@@ -254,5 +274,11 @@ func PushAMessage(pq *pqueue.PQueue, senderId string, paramList []string) sqs_re
 }
 
 func SendMessage(pq *pqueue.PQueue, sqsQuery *urlutils.SQSQuery) sqs_response.SQSResponse {
-	return PushAMessage(pq, sqsQuery.SenderId, sqsQuery.ParamsList)
+	resp := PushAMessage(pq, sqsQuery.SenderId, sqsQuery.ParamsList)
+	if resp.HttpCode() == 200 {
+		if err := pq.WaitDurable(false); err != nil {
+			return sqserr.ServerSideError("Message is not durable: " + err.Error())
+		}
+	}
+	return resp
 }
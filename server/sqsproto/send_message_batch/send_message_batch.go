@@ -83,6 +83,11 @@ func SendMessageBatch(pq *pqueue.PQueue, sqsQuery *urlutils.SQSQuery) sqs_respon
 			batchResponse.ErrorEntry = append(batchResponse.ErrorEntry, resp.BatchResult(a.Id))
 		}
 	}
+	if len(batchResponse.ResultEntry) > 0 {
+		if err := pq.WaitDurable(false); err != nil {
+			return sqserr.ServerSideError("Messages are not durable: " + err.Error())
+		}
+	}
 
 	return batchResponse
 }
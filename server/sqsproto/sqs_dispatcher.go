@@ -41,6 +41,15 @@ func ParseQueueName(urlPath string) (string, error) {
 	return "", sqserr.MalformedInputError("Invalid URL Format")
 }
 
+// isReadOnlyAction returns true if action doesn't change queues, so it can be served by the replica.
+func isReadOnlyAction(action string) bool {
+	switch action {
+	case "GetQueueUrl", "ListQueues", "GetQueueAttributes", "ListDeadLetterSourceQueues":
+		return true
+	}
+	return false
+}
+
 func (rh *SQSRequestHandler) handleManageActions(sqsQuery *urlutils.SQSQuery) sqs_response.SQSResponse {
 	switch sqsQuery.Action {
 	case "CreateQueue":
@@ -94,6 +103,10 @@ func (rh *SQSRequestHandler) dispatchSQSQuery(r *http.Request) sqs_response.SQSR
 		return sqserr.ServiceDeniedError()
 	}
 
+	if rh.ServiceManager.IsReadOnly() && !isReadOnlyAction(sqsQuery.Action) {
+		return sqserr.ReadOnlyError()
+	}
+
 	if sqsQuery.QueueUrl != "" {
 		queueUrl, err := url.ParseRequestURI(sqsQuery.QueueUrl)
 		if err != nil {
@@ -95,6 +95,16 @@ func ServiceDeniedError() *SQSError {
 	}
 }
 
+func ReadOnlyError() *SQSError {
+	return &SQSError{
+		Code:         "ServiceUnavailable",
+		HttpRespCode: 503,
+		Message:      "Server is a read only replica",
+		Type:         "Server",
+		RequestId:    "reqid",
+	}
+}
+
 func InvalidQueueNameError() *SQSError {
 	return &SQSError{
 		Code:         "InvalidParameterValue",
@@ -21,6 +21,11 @@ type SQSQuery struct {
 	SenderId        string
 }
 
+// MakeQueueArn returns a fake AWS ARN of the queue.
+func MakeQueueArn(name string) string {
+	return "arn:aws:sqs:us-west-2:123456789:" + name
+}
+
 var maxFormSize = int64(30 * 1024 * 1024)
 var ErrTooLargePost = errors.New("http: POST too large")
 